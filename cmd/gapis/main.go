@@ -18,6 +18,7 @@ import (
 	"context"
 	"flag"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -37,6 +38,7 @@ import (
 	"github.com/google/gapid/core/os/file"
 	"github.com/google/gapid/core/text"
 	"github.com/google/gapid/gapir/client"
+	"github.com/google/gapid/gapis/api/vulkan"
 	"github.com/google/gapid/gapis/database"
 	"github.com/google/gapid/gapis/replay"
 	"github.com/google/gapid/gapis/server"
@@ -62,6 +64,7 @@ var (
 	adbPath          = flag.String("adb", "", "Path to the adb executable; leave empty to search the environment")
 	enableLocalFiles = flag.Bool("enable-local-files", false, "Allow clients to access local .gfxtrace files by path")
 	remoteSSHConfig  = flag.String("ssh-config", "", "_Path to an ssh config file for remote devices")
+	vkPrimerConfig   = flag.String("vulkan-image-primer-config", "", "_Path to a JSON file of the options for priming the Vulkan images when rebuilding the state")
 )
 
 func main() {
@@ -104,6 +107,18 @@ func run(ctx context.Context) error {
 	ctx = trace.PutManager(ctx, trace.New(ctx))
 	ctx = database.Put(ctx, database.NewInMemory(ctx))
 
+	if *vkPrimerConfig != "" {
+		data, err := ioutil.ReadFile(*vkPrimerConfig)
+		if err != nil {
+			return err
+		}
+		opts, err := vulkan.ParseImagePrimerOptions(data)
+		if err != nil {
+			return log.Errf(ctx, err, "Failed to parse the Vulkan image primer config: %v", *vkPrimerConfig)
+		}
+		ctx = vulkan.PutImagePrimerOptions(ctx, opts)
+	}
+
 	// Grpc is very verbose, turn that down
 	grpclog.SetLogger(log.From(ctx).SetFilter(log.SeverityFilter(log.Error)))
 
@@ -25,6 +25,12 @@ func NewASTC(name string, blockWidth, blockHeight uint32, srgb bool) *Format {
 	return &Format{Name: name, Format: &Format_Astc{&FmtASTC{BlockWidth: blockWidth, BlockHeight: blockHeight, Srgb: srgb}}}
 }
 
+// NewASTCHDR returns an ASTC format whose blocks are decoded with the HDR
+// profile.
+func NewASTCHDR(name string, blockWidth, blockHeight uint32) *Format {
+	return &Format{Name: name, Format: &Format_Astc{&FmtASTC{BlockWidth: blockWidth, BlockHeight: blockHeight, Hdr: true}}}
+}
+
 func (f *FmtASTC) key() interface{} {
 	return f.String()
 }
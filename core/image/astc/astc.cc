@@ -44,13 +44,17 @@ extern "C" void init_astc() {
     build_quantization_mode_table();
 }
 
-extern "C" void decompress_astc(
+// decompress_blocks decodes the blocks of the given image with the given
+// decode mode, and calls write with the decoded RGBA values of each texel.
+template <typename F>
+static void decompress_blocks(
         uint8_t* in,
-        uint8_t* out,
         uint32_t width,
         uint32_t height,
         uint32_t block_width,
-        uint32_t block_height) {
+        uint32_t block_height,
+        astc_decode_mode decode_mode,
+        F write) {
 
     uint32_t blocks_x = (width + block_width - 1) / block_width;
     uint32_t blocks_y = (height + block_height - 1) / block_height;
@@ -61,7 +65,7 @@ extern "C" void decompress_astc(
             physical_compressed_block pcb = *(physical_compressed_block*) in;
             symbolic_compressed_block scb;
             physical_to_symbolic(block_width, block_height, 1, pcb, &scb);
-            decompress_symbolic_block(DECODE_LDR, block_width, block_height, 1, 0, 0, 0, &scb, &pb);
+            decompress_symbolic_block(decode_mode, block_width, block_height, 1, 0, 0, 0, &scb, &pb);
             in += 16;
 
             const float* data = pb.orig_data;
@@ -70,15 +74,47 @@ extern "C" void decompress_astc(
                 for (uint32_t dx = 0; dx < block_width; dx++) {
                     uint32_t x = bx*block_width + dx;
                     if (x < width && y < height) {
-                        uint8_t* pxl = &out[(width*y+x)*4];
-                        pxl[0] = float2byte(data[0]);
-                        pxl[1] = float2byte(data[1]);
-                        pxl[2] = float2byte(data[2]);
-                        pxl[3] = float2byte(data[3]);
+                        write(width*y+x, data);
                     }
                     data += 4;
                 }
             }
         }
     }
-}
\ No newline at end of file
+}
+
+extern "C" void decompress_astc(
+        uint8_t* in,
+        uint8_t* out,
+        uint32_t width,
+        uint32_t height,
+        uint32_t block_width,
+        uint32_t block_height,
+        int srgb) {
+    astc_decode_mode decode_mode = srgb ? DECODE_LDR_SRGB : DECODE_LDR;
+    decompress_blocks(in, width, height, block_width, block_height, decode_mode,
+        [out](uint32_t i, const float* data) {
+            uint8_t* pxl = &out[i*4];
+            pxl[0] = float2byte(data[0]);
+            pxl[1] = float2byte(data[1]);
+            pxl[2] = float2byte(data[2]);
+            pxl[3] = float2byte(data[3]);
+        });
+}
+
+extern "C" void decompress_astc_hdr(
+        uint8_t* in,
+        float* out,
+        uint32_t width,
+        uint32_t height,
+        uint32_t block_width,
+        uint32_t block_height) {
+    decompress_blocks(in, width, height, block_width, block_height, DECODE_HDR,
+        [out](uint32_t i, const float* data) {
+            float* pxl = &out[i*4];
+            pxl[0] = data[0];
+            pxl[1] = data[1];
+            pxl[2] = data[2];
+            pxl[3] = data[3];
+        });
+}
@@ -56,6 +56,20 @@ var (
 	SRGB8_ALPHA8_10x10 = NewSRGB8_ALPHA8_10x10("ASTC_SRGB8_ALPHA8_10x10")
 	SRGB8_ALPHA8_12x10 = NewSRGB8_ALPHA8_12x10("ASTC_SRGB8_ALPHA8_12x10")
 	SRGB8_ALPHA8_12x12 = NewSRGB8_ALPHA8_12x12("ASTC_SRGB8_ALPHA8_12x12")
+	RGBA_HDR_4x4       = NewRGBA_HDR_4x4("ASTC_RGBA_HDR_4x4")
+	RGBA_HDR_5x4       = NewRGBA_HDR_5x4("ASTC_RGBA_HDR_5x4")
+	RGBA_HDR_5x5       = NewRGBA_HDR_5x5("ASTC_RGBA_HDR_5x5")
+	RGBA_HDR_6x5       = NewRGBA_HDR_6x5("ASTC_RGBA_HDR_6x5")
+	RGBA_HDR_6x6       = NewRGBA_HDR_6x6("ASTC_RGBA_HDR_6x6")
+	RGBA_HDR_8x5       = NewRGBA_HDR_8x5("ASTC_RGBA_HDR_8x5")
+	RGBA_HDR_8x6       = NewRGBA_HDR_8x6("ASTC_RGBA_HDR_8x6")
+	RGBA_HDR_8x8       = NewRGBA_HDR_8x8("ASTC_RGBA_HDR_8x8")
+	RGBA_HDR_10x5      = NewRGBA_HDR_10x5("ASTC_RGBA_HDR_10x5")
+	RGBA_HDR_10x6      = NewRGBA_HDR_10x6("ASTC_RGBA_HDR_10x6")
+	RGBA_HDR_10x8      = NewRGBA_HDR_10x8("ASTC_RGBA_HDR_10x8")
+	RGBA_HDR_10x10     = NewRGBA_HDR_10x10("ASTC_RGBA_HDR_10x10")
+	RGBA_HDR_12x10     = NewRGBA_HDR_12x10("ASTC_RGBA_HDR_12x10")
+	RGBA_HDR_12x12     = NewRGBA_HDR_12x12("ASTC_RGBA_HDR_12x12")
 )
 
 func NewRGBA_4x4(name string) *image.Format           { return image.NewASTC(name, 4, 4, false) }
@@ -86,6 +100,20 @@ func NewSRGB8_ALPHA8_10x8(name string) *image.Format  { return image.NewASTC(nam
 func NewSRGB8_ALPHA8_10x10(name string) *image.Format { return image.NewASTC(name, 10, 10, true) }
 func NewSRGB8_ALPHA8_12x10(name string) *image.Format { return image.NewASTC(name, 12, 10, true) }
 func NewSRGB8_ALPHA8_12x12(name string) *image.Format { return image.NewASTC(name, 12, 12, true) }
+func NewRGBA_HDR_4x4(name string) *image.Format       { return image.NewASTCHDR(name, 4, 4) }
+func NewRGBA_HDR_5x4(name string) *image.Format       { return image.NewASTCHDR(name, 5, 4) }
+func NewRGBA_HDR_5x5(name string) *image.Format       { return image.NewASTCHDR(name, 5, 5) }
+func NewRGBA_HDR_6x5(name string) *image.Format       { return image.NewASTCHDR(name, 6, 5) }
+func NewRGBA_HDR_6x6(name string) *image.Format       { return image.NewASTCHDR(name, 6, 6) }
+func NewRGBA_HDR_8x5(name string) *image.Format       { return image.NewASTCHDR(name, 8, 5) }
+func NewRGBA_HDR_8x6(name string) *image.Format       { return image.NewASTCHDR(name, 8, 6) }
+func NewRGBA_HDR_8x8(name string) *image.Format       { return image.NewASTCHDR(name, 8, 8) }
+func NewRGBA_HDR_10x5(name string) *image.Format      { return image.NewASTCHDR(name, 10, 5) }
+func NewRGBA_HDR_10x6(name string) *image.Format      { return image.NewASTCHDR(name, 10, 6) }
+func NewRGBA_HDR_10x8(name string) *image.Format      { return image.NewASTCHDR(name, 10, 8) }
+func NewRGBA_HDR_10x10(name string) *image.Format     { return image.NewASTCHDR(name, 10, 10) }
+func NewRGBA_HDR_12x10(name string) *image.Format     { return image.NewASTCHDR(name, 12, 10) }
+func NewRGBA_HDR_12x12(name string) *image.Format     { return image.NewASTCHDR(name, 12, 12) }
 
 func init() {
 	C.init_astc()
@@ -122,24 +150,57 @@ func init() {
 		{SRGB8_ALPHA8_10x10, image.SRGBA_U8_NORM},
 		{SRGB8_ALPHA8_12x10, image.SRGBA_U8_NORM},
 		{SRGB8_ALPHA8_12x12, image.SRGBA_U8_NORM},
+		{RGBA_HDR_4x4, image.RGBA_F32},
+		{RGBA_HDR_5x4, image.RGBA_F32},
+		{RGBA_HDR_5x5, image.RGBA_F32},
+		{RGBA_HDR_6x5, image.RGBA_F32},
+		{RGBA_HDR_6x6, image.RGBA_F32},
+		{RGBA_HDR_8x5, image.RGBA_F32},
+		{RGBA_HDR_8x6, image.RGBA_F32},
+		{RGBA_HDR_8x8, image.RGBA_F32},
+		{RGBA_HDR_10x5, image.RGBA_F32},
+		{RGBA_HDR_10x6, image.RGBA_F32},
+		{RGBA_HDR_10x8, image.RGBA_F32},
+		{RGBA_HDR_10x10, image.RGBA_F32},
+		{RGBA_HDR_12x10, image.RGBA_F32},
+		{RGBA_HDR_12x12, image.RGBA_F32},
 	} {
 		f := f
 		image.RegisterConverter(f.src, f.dst, func(src []byte, w, h, d int) ([]byte, error) {
-			dst := make([]byte, w*h*d*4)
+			fmt := f.src.GetAstc()
+			// HDR blocks decode to 32-bit float RGBA, LDR ones to 8-bit RGBA.
+			texelSize := 4
+			if fmt.Hdr {
+				texelSize = 16
+			}
+			dst := make([]byte, w*h*d*texelSize)
 			sliceSize := f.src.Size(w, h, 1)
 			for z := 0; z < d; z++ {
-				dst, src := dst[z*w*h*4:], src[z*sliceSize:]
+				dst, src := dst[z*w*h*texelSize:], src[z*sliceSize:]
 				in := (unsafe.Pointer)(&src[0])
 				out := (unsafe.Pointer)(&dst[0])
-				blockW := f.src.GetAstc().BlockWidth
-				blockH := f.src.GetAstc().BlockHeight
+				if fmt.Hdr {
+					C.decompress_astc_hdr(
+						(*C.uint8_t)(in),
+						(*C.float)(out),
+						(C.uint32_t)(w),
+						(C.uint32_t)(h),
+						(C.uint32_t)(fmt.BlockWidth),
+						(C.uint32_t)(fmt.BlockHeight))
+					continue
+				}
+				srgb := 0
+				if fmt.Srgb {
+					srgb = 1
+				}
 				C.decompress_astc(
 					(*C.uint8_t)(in),
 					(*C.uint8_t)(out),
 					(C.uint32_t)(w),
 					(C.uint32_t)(h),
-					(C.uint32_t)(blockW),
-					(C.uint32_t)(blockH))
+					(C.uint32_t)(fmt.BlockWidth),
+					(C.uint32_t)(fmt.BlockHeight),
+					(C.int)(srgb))
 			}
 			return dst, nil
 		})
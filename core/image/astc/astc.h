@@ -20,8 +20,18 @@ extern "C" {
 
 void init_astc();
 
+// decompress_astc decodes the given ASTC image with the LDR profile to 8-bit
+// RGBA. If srgb is not 0, the image is decoded with the sRGB variant of the
+// profile, which expands the color endpoints as sRGB values, and the decoded
+// values are sRGB encoded.
 void decompress_astc(uint8_t* in, uint8_t* out, uint32_t width, uint32_t height,
-                     uint32_t block_width, uint32_t block_height);
+                     uint32_t block_width, uint32_t block_height, int srgb);
+
+// decompress_astc_hdr decodes the given ASTC image with the HDR profile to
+// 32-bit float RGBA.
+void decompress_astc_hdr(uint8_t* in, float* out, uint32_t width,
+                         uint32_t height, uint32_t block_width,
+                         uint32_t block_height);
 
 #ifdef __cplusplus
 }  // extern "C"
@@ -0,0 +1,111 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package astc_test
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/image"
+	"github.com/google/gapid/core/image/astc"
+	"github.com/google/gapid/core/log"
+)
+
+// Void-extent blocks of a constant color, bit 9 of the header tells whether
+// the color is in UNORM16 (LDR) or FP16 (HDR).
+var (
+	ldrOrange = []byte{
+		0xFC, 0xFD, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0xFF, 0xFF, 0x00, 0x80, 0x00, 0x00, 0xFF, 0xFF, // (1.0, 0.5, 0.0, 1.0)
+	}
+	ldrBlue = []byte{
+		0xFC, 0xFD, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x00, 0x80, // (0.0, 0.0, 1.0, 0.5)
+	}
+	hdrBright = []byte{
+		0xFC, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0x00, 0x40, 0x00, 0x38, 0x00, 0x00, 0x00, 0x3C, // (2.0, 0.5, 0.0, 1.0)
+	}
+)
+
+// repeat returns the given blocks, each repeated the given number of times.
+func repeat(count int, blocks ...[]byte) []byte {
+	out := []byte{}
+	for _, b := range blocks {
+		for i := 0; i < count; i++ {
+			out = append(out, b...)
+		}
+	}
+	return out
+}
+
+func TestDecompressLDR(t *testing.T) {
+	ctx := log.Testing(t)
+	// A 5x5x2 image needs 2x2 blocks of 4x4 texels for each slice, and only
+	// the texels within the image are written.
+	src := repeat(4, ldrOrange, ldrBlue)
+	data, err := image.Convert(src, 5, 5, 2, astc.RGBA_4x4, image.RGBA_U8_NORM)
+	if !assert.For(ctx, "err").ThatError(err).Succeeded() {
+		return
+	}
+	if !assert.For(ctx, "size").That(len(data)).Equals(5 * 5 * 2 * 4) {
+		return
+	}
+	for z, expected := range [][]byte{{0xFF, 0x80, 0x00, 0xFF}, {0x00, 0x00, 0xFF, 0x80}} {
+		for i := 0; i < 5*5; i++ {
+			offset := (z*5*5 + i) * 4
+			assert.For(ctx, "slice %v texel %v", z, i).ThatSlice(data[offset : offset+4]).Equals(expected)
+		}
+	}
+}
+
+func TestDecompressHDR(t *testing.T) {
+	ctx := log.Testing(t)
+	data, err := image.Convert(hdrBright, 4, 4, 1, astc.RGBA_HDR_4x4, image.RGBA_F32)
+	if !assert.For(ctx, "err").ThatError(err).Succeeded() {
+		return
+	}
+	if !assert.For(ctx, "size").That(len(data)).Equals(4 * 4 * 16) {
+		return
+	}
+	// The HDR profile keeps the values out of [0, 1].
+	expected := []float32{2.0, 0.5, 0.0, 1.0}
+	for i := 0; i < 4*4; i++ {
+		for c, e := range expected {
+			offset := (i*4 + c) * 4
+			v := math.Float32frombits(binary.LittleEndian.Uint32(data[offset:]))
+			assert.For(ctx, "texel %v channel %v", i, c).That(v).Equals(e)
+		}
+	}
+}
+
+func TestDecompressSRGB(t *testing.T) {
+	ctx := log.Testing(t)
+	data, err := image.Convert(ldrOrange, 4, 4, 1, astc.SRGB8_ALPHA8_4x4, image.SRGBA_U8_NORM)
+	if !assert.For(ctx, "err").ThatError(err).Succeeded() {
+		return
+	}
+	if !assert.For(ctx, "size").That(len(data)).Equals(4 * 4 * 4) {
+		return
+	}
+	// The decoded values stay sRGB encoded, the half intensity green is not
+	// converted to linear.
+	expected := []byte{0xFF, 0x80, 0x00, 0xFF}
+	for i := 0; i < 4*4; i++ {
+		assert.For(ctx, "texel %v", i).ThatSlice(data[i*4 : i*4+4]).Equals(expected)
+	}
+}
@@ -72,7 +72,7 @@ func Convert(data []byte, width, height, depth int, srcFmt, dstFmt *Format) ([]b
 
 	// No direct conversion found. Try going via a common intermediate formats.
 	for _, via := range []*Format{
-		RGBA_U8_NORM, SRGBA_U8_NORM,
+		RGBA_U8_NORM, SRGBA_U8_NORM, RGBA_F32,
 	} {
 		if data, _ := convertDirect(data, width, height, depth, srcFmt, via); data != nil {
 			if data, _ := convertDirect(data, width, height, depth, via, dstFmt); data != nil {
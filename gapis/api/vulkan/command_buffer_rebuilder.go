@@ -148,9 +148,31 @@ func rebuildVkCmdBeginRenderPass(
 
 	clearValuesData := s.AllocDataOrPanic(ctx, clearValues)
 
+	// The image views of imageless framebuffers are given in the pNext chain.
+	pNext := NewVoidᶜᵖ(memory.Nullptr)
+	var attachmentsData, attachmentBeginData api.AllocResult
+	if d.Attachments().Len() > 0 {
+		attachments := make([]VkImageView, d.Attachments().Len())
+		for i := range attachments {
+			attachments[i] = d.Attachments().Get(uint32(i))
+			if !GetState(s).ImageViews().Contains(attachments[i]) {
+				clearValuesData.Free()
+				return nil, nil, fmt.Errorf("Cannot find ImageView %v", attachments[i])
+			}
+		}
+		attachmentsData = s.AllocDataOrPanic(ctx, attachments)
+		attachmentBeginData = s.AllocDataOrPanic(ctx, NewVkRenderPassAttachmentBeginInfoKHR(a,
+			VkStructureType_VK_STRUCTURE_TYPE_RENDER_PASS_ATTACHMENT_BEGIN_INFO_KHR, // sType
+			0,                        // pNext
+			uint32(len(attachments)), // attachmentCount
+			NewVkImageViewᶜᵖ(attachmentsData.Ptr()), // pAttachments
+		))
+		pNext = NewVoidᶜᵖ(attachmentBeginData.Ptr())
+	}
+
 	begin := NewVkRenderPassBeginInfo(a,
 		VkStructureType_VK_STRUCTURE_TYPE_RENDER_PASS_BEGIN_INFO, // sType
-		0,                        // pNext
+		pNext,                    // pNext
 		d.RenderPass(),           // renderPass
 		d.Framebuffer(),          // framebuffer
 		d.RenderArea(),           // renderArea
@@ -159,13 +181,22 @@ func rebuildVkCmdBeginRenderPass(
 	)
 	beginData := s.AllocDataOrPanic(ctx, begin)
 
+	cmd := cb.VkCmdBeginRenderPass(
+		commandBuffer,
+		beginData.Ptr(),
+		d.Contents()).AddRead(beginData.Data()).AddRead(clearValuesData.Data())
+	if d.Attachments().Len() > 0 {
+		cmd.AddRead(attachmentBeginData.Data()).AddRead(attachmentsData.Data())
+	}
+
 	return func() {
-			clearValuesData.Free()
-			beginData.Free()
-		}, cb.VkCmdBeginRenderPass(
-			commandBuffer,
-			beginData.Ptr(),
-			d.Contents()).AddRead(beginData.Data()).AddRead(clearValuesData.Data()), nil
+		clearValuesData.Free()
+		beginData.Free()
+		if d.Attachments().Len() > 0 {
+			attachmentBeginData.Free()
+			attachmentsData.Free()
+		}
+	}, cmd, nil
 }
 
 func rebuildVkCmdEndRenderPass(
@@ -392,6 +423,55 @@ func rebuildVkCmdPipelineBarrier(
 		).AddRead(memoryBarrierData.Data()).AddRead(bufferMemoryBarrierData.Data()).AddRead(imageMemoryBarrierData.Data()), nil
 }
 
+func rebuildVkCmdPipelineBarrier2KHR(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdPipelineBarrier2KHRArgsʳ) (func(), api.Cmd, error) {
+
+	memoryBarrierData, memoryBarrierCount := unpackMap(ctx, s, d.MemoryBarriers())
+	bufferMemoryBarrierData, bufferMemoryBarrierCount := unpackMap(ctx, s, d.BufferMemoryBarriers())
+	imageMemoryBarrierData, imageMemoryBarrierCount := unpackMap(ctx, s, d.ImageMemoryBarriers())
+
+	for i, c := 0, d.BufferMemoryBarriers().Len(); i < c; i++ {
+		buf := d.BufferMemoryBarriers().Get(uint32(i)).Buffer()
+		if !GetState(s).Buffers().Contains(buf) {
+			return nil, nil, fmt.Errorf("Cannot find Buffer %v", buf)
+		}
+	}
+
+	for i, c := 0, d.ImageMemoryBarriers().Len(); i < c; i++ {
+		img := d.ImageMemoryBarriers().Get(uint32(i)).Image()
+		if !GetState(s).Images().Contains(img) {
+			return nil, nil, fmt.Errorf("Cannot find Image %v", img)
+		}
+	}
+
+	dependencyInfo := NewVkDependencyInfoKHR(s.Arena,
+		VkStructureType_VK_STRUCTURE_TYPE_DEPENDENCY_INFO_KHR, // sType
+		0,                   // pNext
+		d.DependencyFlags(), // dependencyFlags
+		memoryBarrierCount,  // memoryBarrierCount
+		NewVkMemoryBarrier2KHRᶜᵖ(memoryBarrierData.Ptr()),             // pMemoryBarriers
+		bufferMemoryBarrierCount,                                      // bufferMemoryBarrierCount
+		NewVkBufferMemoryBarrier2KHRᶜᵖ(bufferMemoryBarrierData.Ptr()), // pBufferMemoryBarriers
+		imageMemoryBarrierCount,                                       // imageMemoryBarrierCount
+		NewVkImageMemoryBarrier2KHRᶜᵖ(imageMemoryBarrierData.Ptr()),   // pImageMemoryBarriers
+	)
+	dependencyInfoData := s.AllocDataOrPanic(ctx, dependencyInfo)
+
+	return func() {
+			memoryBarrierData.Free()
+			bufferMemoryBarrierData.Free()
+			imageMemoryBarrierData.Free()
+			dependencyInfoData.Free()
+		}, cb.VkCmdPipelineBarrier2KHR(commandBuffer,
+			dependencyInfoData.Ptr(),
+		).AddRead(memoryBarrierData.Data()).AddRead(bufferMemoryBarrierData.Data()).AddRead(imageMemoryBarrierData.Data()).AddRead(dependencyInfoData.Data()), nil
+}
+
 func rebuildVkCmdBeginQuery(
 	ctx context.Context,
 	cb CommandBuilder,
@@ -662,6 +742,42 @@ func rebuildVkCmdDispatch(
 	), nil
 }
 
+func rebuildVkCmdDispatchBase(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdDispatchBaseArgsʳ) (func(), api.Cmd, error) {
+
+	return func() {}, cb.VkCmdDispatchBase(commandBuffer,
+		d.BaseGroupX(),
+		d.BaseGroupY(),
+		d.BaseGroupZ(),
+		d.GroupCountX(),
+		d.GroupCountY(),
+		d.GroupCountZ(),
+	), nil
+}
+
+func rebuildVkCmdDispatchBaseKHR(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdDispatchBaseKHRArgsʳ) (func(), api.Cmd, error) {
+
+	return func() {}, cb.VkCmdDispatchBaseKHR(commandBuffer,
+		d.BaseGroupX(),
+		d.BaseGroupY(),
+		d.BaseGroupZ(),
+		d.GroupCountX(),
+		d.GroupCountY(),
+		d.GroupCountZ(),
+	), nil
+}
+
 func rebuildVkCmdDispatchIndirect(
 	ctx context.Context,
 	cb CommandBuilder,
@@ -998,6 +1114,80 @@ func rebuildVkCmdSetStencilReference(
 		), nil
 }
 
+func rebuildVkCmdSetCullModeEXT(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdSetCullModeEXTArgsʳ) (func(), api.Cmd, error) {
+
+	return func() {
+		}, cb.VkCmdSetCullModeEXT(commandBuffer,
+			d.CullMode(),
+		), nil
+}
+
+func rebuildVkCmdSetDepthTestEnableEXT(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdSetDepthTestEnableEXTArgsʳ) (func(), api.Cmd, error) {
+
+	return func() {
+		}, cb.VkCmdSetDepthTestEnableEXT(commandBuffer,
+			d.DepthTestEnable(),
+		), nil
+}
+
+func rebuildVkCmdSetDepthWriteEnableEXT(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdSetDepthWriteEnableEXTArgsʳ) (func(), api.Cmd, error) {
+
+	return func() {
+		}, cb.VkCmdSetDepthWriteEnableEXT(commandBuffer,
+			d.DepthWriteEnable(),
+		), nil
+}
+
+func rebuildVkCmdSetDepthCompareOpEXT(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdSetDepthCompareOpEXTArgsʳ) (func(), api.Cmd, error) {
+
+	return func() {
+		}, cb.VkCmdSetDepthCompareOpEXT(commandBuffer,
+			d.DepthCompareOp(),
+		), nil
+}
+
+func rebuildVkCmdSetStencilOpEXT(
+	ctx context.Context,
+	cb CommandBuilder,
+	commandBuffer VkCommandBuffer,
+	r *api.GlobalState,
+	s *api.GlobalState,
+	d VkCmdSetStencilOpEXTArgsʳ) (func(), api.Cmd, error) {
+
+	return func() {
+		}, cb.VkCmdSetStencilOpEXT(commandBuffer,
+			d.FaceMask(),
+			d.FailOp(),
+			d.PassOp(),
+			d.DepthFailOp(),
+			d.CompareOp(),
+		), nil
+}
+
 func rebuildVkCmdSetStencilWriteMask(
 	ctx context.Context,
 	cb CommandBuilder,
@@ -1166,6 +1356,8 @@ func GetCommandArgs(ctx context.Context,
 		return cmds.VkCmdBindIndexBuffer().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdPipelineBarrier:
 		return cmds.VkCmdPipelineBarrier().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdPipelineBarrier2KHR:
+		return cmds.VkCmdPipelineBarrier2KHR().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdWaitEvents:
 		return cmds.VkCmdWaitEvents().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdBeginQuery:
@@ -1192,6 +1384,10 @@ func GetCommandArgs(ctx context.Context,
 		return cmds.VkCmdDispatch().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdDispatchIndirect:
 		return cmds.VkCmdDispatchIndirect().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdDispatchBase:
+		return cmds.VkCmdDispatchBase().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdDispatchBaseKHR:
+		return cmds.VkCmdDispatchBaseKHR().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdDraw:
 		return cmds.VkCmdDraw().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdDrawIndexed:
@@ -1230,6 +1426,16 @@ func GetCommandArgs(ctx context.Context,
 		return cmds.VkCmdSetStencilCompareMask().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdSetStencilReference:
 		return cmds.VkCmdSetStencilReference().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdSetCullModeEXT:
+		return cmds.VkCmdSetCullModeEXT().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdSetDepthTestEnableEXT:
+		return cmds.VkCmdSetDepthTestEnableEXT().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdSetDepthWriteEnableEXT:
+		return cmds.VkCmdSetDepthWriteEnableEXT().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdSetDepthCompareOpEXT:
+		return cmds.VkCmdSetDepthCompareOpEXT().Get(cr.MapIndex())
+	case CommandType_cmd_vkCmdSetStencilOpEXT:
+		return cmds.VkCmdSetStencilOpEXT().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdSetStencilWriteMask:
 		return cmds.VkCmdSetStencilWriteMask().Get(cr.MapIndex())
 	case CommandType_cmd_vkCmdSetViewport:
@@ -1271,6 +1477,8 @@ func GetCommandFunction(cr *CommandReference) interface{} {
 		return subDovkCmdBindIndexBuffer
 	case CommandType_cmd_vkCmdPipelineBarrier:
 		return subDovkCmdPipelineBarrier
+	case CommandType_cmd_vkCmdPipelineBarrier2KHR:
+		return subDovkCmdPipelineBarrier2KHR
 	case CommandType_cmd_vkCmdWaitEvents:
 		return subDovkCmdWaitEvents
 	case CommandType_cmd_vkCmdBeginQuery:
@@ -1297,6 +1505,10 @@ func GetCommandFunction(cr *CommandReference) interface{} {
 		return subDovkCmdDispatch
 	case CommandType_cmd_vkCmdDispatchIndirect:
 		return subDovkCmdDispatchIndirect
+	case CommandType_cmd_vkCmdDispatchBase:
+		return subDovkCmdDispatchBase
+	case CommandType_cmd_vkCmdDispatchBaseKHR:
+		return subDovkCmdDispatchBaseKHR
 	case CommandType_cmd_vkCmdDraw:
 		return subDovkCmdDraw
 	case CommandType_cmd_vkCmdDrawIndexed:
@@ -1335,6 +1547,16 @@ func GetCommandFunction(cr *CommandReference) interface{} {
 		return subDovkCmdSetStencilCompareMask
 	case CommandType_cmd_vkCmdSetStencilReference:
 		return subDovkCmdSetStencilReference
+	case CommandType_cmd_vkCmdSetCullModeEXT:
+		return subDovkCmdSetCullModeEXT
+	case CommandType_cmd_vkCmdSetDepthTestEnableEXT:
+		return subDovkCmdSetDepthTestEnableEXT
+	case CommandType_cmd_vkCmdSetDepthWriteEnableEXT:
+		return subDovkCmdSetDepthWriteEnableEXT
+	case CommandType_cmd_vkCmdSetDepthCompareOpEXT:
+		return subDovkCmdSetDepthCompareOpEXT
+	case CommandType_cmd_vkCmdSetStencilOpEXT:
+		return subDovkCmdSetStencilOpEXT
 	case CommandType_cmd_vkCmdSetStencilWriteMask:
 		return subDovkCmdSetStencilWriteMask
 	case CommandType_cmd_vkCmdSetViewport:
@@ -1383,6 +1605,8 @@ func AddCommand(ctx context.Context,
 		return rebuildVkCmdBindIndexBuffer(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdPipelineBarrierArgsʳ:
 		return rebuildVkCmdPipelineBarrier(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdPipelineBarrier2KHRArgsʳ:
+		return rebuildVkCmdPipelineBarrier2KHR(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdWaitEventsArgsʳ:
 		return rebuildVkCmdWaitEvents(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdBeginQueryArgsʳ:
@@ -1409,6 +1633,10 @@ func AddCommand(ctx context.Context,
 		return rebuildVkCmdDispatch(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdDispatchIndirectArgsʳ:
 		return rebuildVkCmdDispatchIndirect(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdDispatchBaseArgsʳ:
+		return rebuildVkCmdDispatchBase(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdDispatchBaseKHRArgsʳ:
+		return rebuildVkCmdDispatchBaseKHR(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdDrawArgsʳ:
 		return rebuildVkCmdDraw(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdDrawIndexedArgsʳ:
@@ -1447,6 +1675,16 @@ func AddCommand(ctx context.Context,
 		return rebuildVkCmdSetStencilCompareMask(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdSetStencilReferenceArgsʳ:
 		return rebuildVkCmdSetStencilReference(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdSetCullModeEXTArgsʳ:
+		return rebuildVkCmdSetCullModeEXT(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdSetDepthTestEnableEXTArgsʳ:
+		return rebuildVkCmdSetDepthTestEnableEXT(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdSetDepthWriteEnableEXTArgsʳ:
+		return rebuildVkCmdSetDepthWriteEnableEXT(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdSetDepthCompareOpEXTArgsʳ:
+		return rebuildVkCmdSetDepthCompareOpEXT(ctx, cb, commandBuffer, r, s, t)
+	case VkCmdSetStencilOpEXTArgsʳ:
+		return rebuildVkCmdSetStencilOpEXT(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdSetStencilWriteMaskArgsʳ:
 		return rebuildVkCmdSetStencilWriteMask(ctx, cb, commandBuffer, r, s, t)
 	case VkCmdSetViewportArgsʳ:
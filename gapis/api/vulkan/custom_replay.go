@@ -853,6 +853,8 @@ func (a *ReplayAllocateImageMemory) Mutate(ctx context.Context, id api.CmdID, s
 		NilVulkanDebugMarkerInfoʳ,         // DebugInfo
 		NilMemoryDedicatedAllocationInfoʳ, // DedicatedAllocationNV
 		NilMemoryDedicatedAllocationInfoʳ, // DedicatedAllocationKHR
+		NilMemoryAllocateFlagsInfoʳ,       // AllocateFlags
+		NilExportMemoryInfoʳ,              // ExportMemory
 	)
 
 	c.DeviceMemories().Add(memory, memoryObject)
@@ -15,14 +15,17 @@
 package vulkan
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/google/gapid/core/image"
 	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/memory/arena"
+	"github.com/google/gapid/core/os/device"
 	"github.com/google/gapid/core/stream"
 	"github.com/google/gapid/gapis/api"
 	"github.com/google/gapid/gapis/memory"
@@ -33,13 +36,216 @@ type imagePrimer struct {
 	sb *stateBuilder
 	rh *ipRenderHandler
 	sh *ipImageStoreHandler
+	// srcData is the caller supplied data to be used instead of the data of
+	// the images in the old state, nil if the old state data should be used.
+	srcData map[ipSubresource][]uint8
+	// imageData are the caller supplied data of the images, which are primed
+	// with primeFromBytes instead of the data in the old state, see
+	// primeImageData.
+	imageData map[VkImage]map[ipSubresource][]uint8
+	// layoutOnlyUsages are the image usages with which the data of the image
+	// will not be primed, but only the layouts of the image will be restored.
+	layoutOnlyUsages VkImageUsageFlags
+	// skipPriming, if not nil, is called with each image and its info before
+	// building the primeable image data. The data of the images for which it
+	// returns true will not be primed, but only the layouts will be restored,
+	// e.g. to exclude huge images irrelevant to the debugging.
+	skipPriming func(img VkImage, info ImageInfo) bool
+	// subset, if not nil, are the only images whose data will be primed, the
+	// other images are skipped for priming, see primeSubset.
+	subset map[VkImage]bool
+	// narrowStagingFormats makes the color staging images use the 32-bit uint
+	// format with the fewest channels that can hold the source data, instead
+	// of always using stagingColorImageBufferFormat.
+	narrowStagingFormats bool
+	// stagingColorFormat and stagingDepthStencilFormat, if not UNDEFINED,
+	// override stagingColorImageBufferFormat and
+	// stagingDepthStencilImageBufferFormat respectively, e.g. to isolate
+	// driver issues with a specific staging format. Overrides which can not
+	// hold the source data or are not supported on the device are ignored,
+	// see stagingFormatOverride.
+	stagingColorFormat        VkFormat
+	stagingDepthStencilFormat VkFormat
+	// generateMipLevels makes the images whose base mip level is the only one
+	// with data be primed by priming only the base level and generating the
+	// other levels with blits, instead of priming every level.
+	generateMipLevels bool
+	// sourceSubresource, if not nil, is called with each image and each of its
+	// subresources to be primed, and returns the subresource of the same image
+	// whose data is used to prime it, e.g. to fill all the mip levels with the
+	// data of level 0 for investigating mip chain issues. The source
+	// subresource must be of the same aspect and extent, see
+	// ipCheckSourceSubresource.
+	sourceSubresource func(img VkImage, dst ipSubresource) ipSubresource
+	// plans are the priming plans of the images for which primeable image
+	// data has been built, see primingPlans.
+	plans map[VkImage]ipPrimingPlan
+	// replayPlans are the priming plans to be followed instead of deciding
+	// how to prime the images from the properties of the device. It is up to
+	// the caller to make sure the plans are valid for the images.
+	replayPlans map[VkImage]ipPrimingPlan
+	// signalSemaphore, if not 0, is the timeline semaphore signaled with
+	// signalValue once all the images are primed, or if signalEachImage is
+	// set, with signalValue + i once the i-th image is primed, e.g. so that
+	// the progress of the priming can be tracked, see signalPrimed.
+	signalSemaphore VkSemaphore
+	signalValue     uint64
+	signalEachImage bool
+	// signaledValues is the number of values signaled to signalSemaphore.
+	signaledValues uint64
+	// forcedStrategies are the strategies the images are primed with
+	// regardless of their usages and the properties of the device, overriding
+	// the strategies of the replayed plans, e.g. to check that the strategies
+	// prime the same data, see checkPrimingStrategies. It is up to the caller
+	// to make sure the strategies are applicable to the images.
+	forcedStrategies map[VkImage]ipPrimingStrategy
+	// distributeQueues makes each image be primed on the least loaded of the
+	// compatible queues of its device, instead of mostly on the same queue, so
+	// that independent images can be primed concurrently on multi-queue
+	// devices.
+	distributeQueues bool
+	// strategyQueues makes each image be primed on a queue of the family best
+	// suited for its priming strategy, e.g. a dedicated transfer family for
+	// buffer copies or an async compute family for image store, instead of
+	// preferring the last bound queues of the image. The ownership of the
+	// images primed on other families is handed off to their last bound queues
+	// afterwards, see strategyQueueForPriming.
+	strategyQueues bool
+	// queueLoads are the numbers of images assigned to each queue for priming
+	// when distributeQueues is set.
+	queueLoads map[VkQueue]int
+	// stagingMemoryProperties are the acceptable memory property flags for the
+	// memory of staging images, in the order of preference.
+	stagingMemoryProperties []VkMemoryPropertyFlags
+	// heapUsages are the estimated sizes of the memory allocated from each
+	// memory heap by this image primer, which are not freed yet.
+	heapUsages map[ipMemoryHeap]VkDeviceSize
+	// stagingMemoryBudget, if not 0, is the maximum size of the memory of the
+	// staging images allocated by this image primer at the same time. The
+	// staging images are downgraded to narrower formats to fit in the budget,
+	// and if they still do not fit, only the layouts of the image are
+	// restored, see ipErrStagingBudgetExceeded.
+	stagingMemoryBudget VkDeviceSize
+	// trackCompletion makes the images whose priming completed without error
+	// be recorded in primedImages, so they can be saved in a checkpoint, see
+	// ipPrimingCheckpoint.
+	trackCompletion bool
+	// primedImages are the images fully primed by this image primer when
+	// trackCompletion is set.
+	primedImages map[VkImage]bool
+	// resumedImages are the images primed before the checkpoint being resumed
+	// from. Their data is not primed again, but their layouts are restored.
+	resumedImages map[VkImage]bool
+	// auditCoverage makes the bound subresources of each image for which no
+	// copy, render or store job is recorded be reported after building its
+	// primeable image data, see auditPrimingCoverage.
+	auditCoverage bool
+	// dedupContent makes the images with the same format, extent and data as
+	// an image already primed on the same device be primed by copying from
+	// it, instead of running the full priming strategy again, e.g. for
+	// repeated texture atlases. Hashing the data of every image is costly, so
+	// it is opt-in, see ipContentKey.
+	dedupContent bool
+	// contentKeys are the content keys of the images being primed when
+	// dedupContent is set, which are moved to primedContents once the images
+	// are fully primed.
+	contentKeys map[VkImage]ipContentKey
+	// primedContents are the fully primed images to copy from for each
+	// content key when dedupContent is set.
+	primedContents map[ipContentKey]VkImage
+	// batchSize, if not 0, makes the priming work of the images be queued and
+	// done in chunks of at most batchSize images, instead of priming each
+	// image as soon as its primeable image data is built, see queuePriming.
+	batchSize int
+	// cancelPriming, if not nil, is called before priming each queued image
+	// when batchSize is set. Once it returns true, only the layouts of the
+	// remaining queued images are restored, see flushPrimingWorks.
+	cancelPriming func() bool
+	// cancelled is set once cancelPriming has returned true.
+	cancelled bool
+	// primingWorks are the queued priming works not done yet.
+	primingWorks []ipPrimingWork
+	// prefetchSourceData makes the buffer image copy sessions read the data of
+	// all the subresources of an image unpacked on the host concurrently
+	// before collecting the copies, instead of reading the data of each copy
+	// synchronously, see ipBufferImageCopySession.prefetch.
+	prefetchSourceData bool
+	// prefetchWorkers is the max number of source data reads run concurrently
+	// when prefetchSourceData is set, see ipReadConcurrently.
+	prefetchWorkers int
+	// combineAspects makes the buffer image copy sessions walk all the
+	// aspects of each subresource together, see
+	// collectCopiesFromCombinedAspects.
+	combineAspects bool
+	// sourceReads counts the source data reads of all the buffer image copy
+	// sessions.
+	sourceReads ipSourceReads
+	// allocationFailures is the number of the memory allocations of the
+	// rebuilt state which failed in a prior replay, it reduces the
+	// overallocation of the memory of the staging images, see
+	// ipStagingOverallocation.
+	allocationFailures int
+	// primedLayout, if not UNDEFINED, is the layout the primed subresources
+	// are left in, instead of their layouts in the old state, e.g.
+	// TRANSFER_DST_OPTIMAL or GENERAL, so the images can be further modified
+	// with transfers without being transitioned again. The layouts of the
+	// images whose data is not primed are still restored, see
+	// ipLayoutInfoForPrimed.
+	primedLayout VkImageLayout
+	// dstLayouts, if not nil, are the layouts the subresource ranges of the
+	// images are left in once primed, instead of their layouts in the old
+	// state, see dstLayoutsOf.
+	dstLayouts map[VkImage]*ipLayoutInfoFromRanges
+	// stagingBlockSize, if not 0, makes the memory of the staging images be
+	// suballocated from memory blocks of this size, instead of allocating
+	// memory for each staging image, so priming many images does not exhaust
+	// the maxMemoryAllocationCount limit of the device. The staging images
+	// which do not fit in a block still get their own allocations, see
+	// suballocateStagingMemory.
+	stagingBlockSize VkDeviceSize
+	// stagingBlocks are the staging memory blocks to suballocate from for each
+	// memory type, and stagingBlockOf are all the blocks not freed yet, by
+	// their memory.
+	stagingBlocks  map[ipStagingBlockKey]*ipStagingMemoryBlock
+	stagingBlockOf map[VkDeviceMemory]*ipStagingMemoryBlock
+	// maxStagingImagesPerAspect is the max number of staging images created
+	// for an aspect of an image. The images in formats wider than the staging
+	// format would need more staging images, they fail to be primed by
+	// rendering or image store instead, see ipStagingImageCount.
+	maxStagingImagesPerAspect uint32
+}
+
+// ipMemoryHeap identifies a memory heap of the physical device of a device.
+type ipMemoryHeap struct {
+	dev   VkDevice
+	index uint32
+}
+
+// ipSubresource identifies a single aspect, array layer and mip level of an
+// image.
+type ipSubresource struct {
+	aspect VkImageAspectFlagBits
+	layer  uint32
+	level  uint32
 }
 
 func newImagePrimer(sb *stateBuilder) *imagePrimer {
 	p := &imagePrimer{
-		sb: sb,
-		rh: newImagePrimerRenderHandler(sb),
-		sh: newImagePrimerStoreHandler(sb),
+		sb:                        sb,
+		rh:                        newImagePrimerRenderHandler(sb),
+		sh:                        newImagePrimerStoreHandler(sb),
+		layoutOnlyUsages:          defaultLayoutOnlyUsages,
+		plans:                     map[VkImage]ipPrimingPlan{},
+		queueLoads:                map[VkQueue]int{},
+		stagingMemoryProperties:   defaultStagingMemoryProperties,
+		maxStagingImagesPerAspect: defaultMaxStagingImagesPerAspect,
+		prefetchWorkers:           defaultPrefetchWorkers,
+		heapUsages:                map[ipMemoryHeap]VkDeviceSize{},
+		primedImages:              map[VkImage]bool{},
+		contentKeys:               map[VkImage]ipContentKey{},
+		primedContents:            map[ipContentKey]VkImage{},
+		stagingBlocks:             map[ipStagingBlockKey]*ipStagingMemoryBlock{},
+		stagingBlockOf:            map[VkDeviceMemory]*ipStagingMemoryBlock{},
 	}
 	return p
 }
@@ -47,13 +253,188 @@ func newImagePrimer(sb *stateBuilder) *imagePrimer {
 const (
 	stagingColorImageBufferFormat        = VkFormat_VK_FORMAT_R32G32B32A32_UINT
 	stagingDepthStencilImageBufferFormat = VkFormat_VK_FORMAT_R32_UINT
+	// The contents of images with these usages are usually procedurally
+	// determined, and none of the priming strategies work for them.
+	defaultLayoutOnlyUsages = VkImageUsageFlags(
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_SHADING_RATE_IMAGE_BIT_NV |
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_FRAGMENT_DENSITY_MAP_BIT_EXT)
+	// Memory types whose heaps would be filled beyond this percentage of their
+	// sizes by a new allocation are skipped when creating staging images.
+	ipHeapUsageLimitPercent = 90
+	// The widest formats, e.g. R64G64B64A64_SFLOAT, need 2 staging images of
+	// stagingColorImageBufferFormat.
+	defaultMaxStagingImagesPerAspect = 4
+	// The reads of the source data may resolve resources from a remote or
+	// compressed store, so they are run concurrently, but with a bounded
+	// number of workers to not exhaust the memory and connections.
+	defaultPrefetchWorkers = 8
 )
 
+// defaultStagingMemoryProperties prefers DEVICE_LOCAL memory for staging
+// images, and falls back to any type of memory.
+var defaultStagingMemoryProperties = []VkMemoryPropertyFlags{
+	VkMemoryPropertyFlags(VkMemoryPropertyFlagBits_VK_MEMORY_PROPERTY_DEVICE_LOCAL_BIT),
+	VkMemoryPropertyFlags(0),
+}
+
 func (p *imagePrimer) free() {
+	for _, work := range p.primingWorks {
+		work.primeable.free()
+	}
+	p.primingWorks = nil
+	if p.distributeQueues {
+		// The priming work may be pending on any of the queues, wait for all
+		// of them to complete before destroying the shared resources.
+		p.sb.flushAllScratchResources()
+	}
 	p.rh.free()
 	p.sh.free()
 }
 
+// primeFromBytes primes the given image with the given data, instead of the
+// data of the image in the old state, and transitions the primed image to the
+// given layouts. The data of each subresource must be tightly packed in the
+// format of the image, and its size must match the size of the subresource.
+// Note that when the image is primed by rendering, the subresources not
+// included in the given data will have undefined content.
+func (p *imagePrimer) primeFromBytes(img VkImage, data map[ipSubresource][]uint8, dstLayout ipLayoutInfo) error {
+	oldStateImgObj := GetState(p.sb.oldState).Images().Get(img)
+	if oldStateImgObj.IsNil() {
+		return log.Errf(p.sb.ctx, fmt.Errorf("Nil Image in old state"), "[Priming image: %v from bytes]", img)
+	}
+	newStateImgObj := GetState(p.sb.newState).Images().Get(img)
+	if newStateImgObj.IsNil() {
+		return log.Errf(p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming image: %v from bytes]", img)
+	}
+	if err := ipValidateImageInfo(oldStateImgObj.Info()); err != nil {
+		return log.Errf(p.sb.ctx, err, "[Priming image: %v from bytes]", img)
+	}
+	if len(data) == 0 {
+		return log.Errf(p.sb.ctx, nil, "no data to prime image: %v", img)
+	}
+
+	rngs, err := ipSubresourceDataRanges(p.sb, oldStateImgObj, data)
+	if err != nil {
+		return log.Errf(p.sb.ctx, err, "[Priming image: %v from bytes]", img)
+	}
+
+	p.srcData = data
+	defer func() { p.srcData = nil }()
+	primeable, err := p.newPrimeableImageData(img, rngs, true)
+	if err != nil {
+		return log.Errf(p.sb.ctx, err, "[Building primeable image data for image: %v from bytes]", img)
+	}
+	defer primeable.free()
+	if err := p.checkDstLayouts(newStateImgObj, dstLayout); err != nil {
+		return log.Errf(p.sb.ctx, err, "[Priming image: %v from bytes]", img)
+	}
+	if _, ok := primeable.(*ipPrimeableByPreinitialization); ok {
+		return log.Errf(p.sb.ctx, nil, "priming image: %v from bytes by preinitialization is not supported", img)
+	}
+	if err := primeable.prime(p.layoutsInNewState(img), dstLayout); err != nil {
+		return log.Errf(p.sb.ctx, err, "[Priming image: %v from bytes]", img)
+	}
+	return nil
+}
+
+// primeImageData primes the caller supplied data of the given image, if there
+// is any, with primeFromBytes and transitions the primed subresources to their
+// destination layouts, see dstLayoutsOf. Returns the ones of the given subresource ranges
+// whose data still needs to be primed from the old state. If the supplied data
+// can not be primed, it is reported and all the given ranges are returned, so
+// the image is primed with its captured data instead.
+func (p *imagePrimer) primeImageData(img ImageObjectʳ, rngs []VkImageSubresourceRange) []VkImageSubresourceRange {
+	data, ok := p.imageData[img.VulkanHandle()]
+	if !ok {
+		return rngs
+	}
+	if err := p.primeFromBytes(img.VulkanHandle(), data, p.dstLayoutsOf(img.VulkanHandle())); err != nil {
+		log.E(p.sb.ctx, "[Priming the supplied data of image: %v] %v, its captured data is primed instead", img.VulkanHandle(), err)
+		return rngs
+	}
+	rest := make([]VkImageSubresourceRange, 0, len(rngs))
+	for _, rng := range rngs {
+		walkImageSubresourceRange(p.sb, img, rng, func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			if _, ok := data[ipSubresource{aspect: aspect, layer: layer, level: level}]; ok {
+				return
+			}
+			rest = append(rest, NewVkImageSubresourceRange(p.sb.ta,
+				VkImageAspectFlags(aspect), // aspectMask
+				level,                      // baseMipLevel
+				1,                          // levelCount
+				layer,                      // baseArrayLayer
+				1,                          // layerCount
+			))
+		})
+	}
+	return rest
+}
+
+// ipSubresourceDataRanges returns the subresource ranges, one for each
+// subresource, of the given caller supplied data of the given image, sorted by
+// aspect, layer and level. Returns an error if any of the subresources does not
+// exist in the image, or if the size of its data does not match the size of
+// the subresource.
+func ipSubresourceDataRanges(sb *stateBuilder, img ImageObjectʳ, data map[ipSubresource][]uint8) ([]VkImageSubresourceRange, error) {
+	subresources := make([]ipSubresource, 0, len(data))
+	for sr := range data {
+		subresources = append(subresources, sr)
+	}
+	sort.Slice(subresources, func(i, j int) bool {
+		a, b := subresources[i], subresources[j]
+		if a.aspect != b.aspect {
+			return a.aspect < b.aspect
+		}
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		return a.level < b.level
+	})
+	rngs := make([]VkImageSubresourceRange, 0, len(subresources))
+	for _, sr := range subresources {
+		if !img.Aspects().Contains(sr.aspect) ||
+			sr.layer >= img.Info().ArrayLayers() ||
+			sr.level >= img.Info().MipLevels() {
+			return nil, fmt.Errorf("subresource: %+v does not exist in image: %v", sr, img.VulkanHandle())
+		}
+		expected := sb.levelSize(img.Info().Extent(), img.Info().Fmt(), sr.level, sr.aspect).levelSize
+		if uint64(len(data[sr])) != expected {
+			return nil, fmt.Errorf("size of data for subresource: %+v of image: %v does not match expectation, actual: %v, expected: %v", sr, img.VulkanHandle(), len(data[sr]), expected)
+		}
+		rngs = append(rngs, NewVkImageSubresourceRange(sb.ta,
+			VkImageAspectFlags(sr.aspect), // aspectMask
+			sr.level,                      // baseMipLevel
+			1,                             // levelCount
+			sr.layer,                      // baseArrayLayer
+			1,                             // layerCount
+		))
+	}
+	return rngs, nil
+}
+
+// primeSubset makes only the data of the given images be primed, e.g. the
+// images read or written by the command being debugged, which are computed by
+// the caller with dependency analysis. The other images are still created,
+// but only their layouts are restored, so jumping to the command does not pay
+// for priming the whole image set of the capture. Calling it again replaces
+// the subset.
+func (p *imagePrimer) primeSubset(images []VkImage) {
+	p.subset = make(map[VkImage]bool, len(images))
+	for _, img := range images {
+		p.subset[img] = true
+	}
+}
+
+// skipped returns true if the data of the given image with the given info
+// should not be primed, because it is not in the subset or skipPriming
+// returns true for it.
+func (p *imagePrimer) skipped(img VkImage, info ImageInfo) bool {
+	if p.subset != nil && !p.subset[img] {
+		return true
+	}
+	return p.skipPriming != nil && p.skipPriming(img, info)
+}
+
 // internal functions of image primer
 
 // createImageAndBindMemory creates an image with the give image info and device
@@ -61,8 +442,16 @@ func (p *imagePrimer) free() {
 // allocates memory for the created image based on the given memory type index,
 // binds the memory with the new image, returns the created image object and the
 // new device memory object in the new state of the state builder of the current
-// image primer, and an error if any error occur.
-func (p *imagePrimer) createImageAndBindMemory(dev VkDevice, info ImageInfo, memTypeIndex int) (ImageObjectʳ, DeviceMemoryObjectʳ, error) {
+// image primer, and an error if any error occur. If the size of the new image
+// cannot be inferred, the given fallback size, which is expected to be derived
+// from the memory requirements recorded in the trace, is used instead. A zero
+// fallback size means no fallback is available. The memory is allocated with
+// the allocate flags of the given source memory, if it has any, see
+// ipMemoryAllocateFlagsPNext.
+func (p *imagePrimer) createImageAndBindMemory(dev VkDevice, info ImageInfo, memTypeIndex int, fallbackSize VkDeviceSize, srcMem DeviceMemoryObjectʳ) (ImageObjectʳ, DeviceMemoryObjectʳ, error) {
+	if err := p.checkCapturedImageFormatSupported(dev, info); err != nil {
+		return ImageObjectʳ{}, DeviceMemoryObjectʳ{}, log.Errf(p.sb.ctx, err, "[Validating image create info against the captured format properties]")
+	}
 	imgHandle := VkImage(newUnusedID(true, func(x uint64) bool {
 		return GetState(p.sb.newState).Images().Contains(VkImage(x))
 	}))
@@ -71,30 +460,272 @@ func (p *imagePrimer) createImageAndBindMemory(dev VkDevice, info ImageInfo, mem
 	// Query the memory requirements so validation layers are happy
 	vkGetImageMemoryRequirements(p.sb, dev, imgHandle, MakeVkMemoryRequirements(p.sb.ta))
 
-	imgSize, err := subInferImageSize(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.newState, GetState(p.sb.newState), 0, nil, nil, img)
+	inferredSize, inferErr := subInferImageSize(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.newState, GetState(p.sb.newState), 0, nil, nil, img)
+	imgSize, err := ipImageSizeOrFallback(p.sb.ctx, imgHandle, inferredSize, inferErr, fallbackSize)
 	if err != nil {
-		return ImageObjectʳ{}, DeviceMemoryObjectʳ{}, log.Errf(p.sb.ctx, err, "[Getting image size]")
+		return ImageObjectʳ{}, DeviceMemoryObjectʳ{}, err
 	}
-	memHandle := VkDeviceMemory(newUnusedID(true, func(x uint64) bool {
-		return GetState(p.sb.newState).DeviceMemories().Contains(VkDeviceMemory(x))
-	}))
 	// Since we cannot guess how much the driver will actually request of us,
-	// overallocating by a factor of 2 should be enough.
-	// TODO: Insert opcodes to determine the allocation size dynamically on the
-	// replay side.
-	allocSize := VkDeviceSize(imgSize * 2)
+	// overallocating by a factor of 2 should be enough, unless the
+	// allocations failed in a prior replay, in which case the factor is
+	// reduced towards no overallocation.
+	allocSize := ipOverallocatedSize(imgSize, ipStagingOverallocation(p.allocationFailures))
 	if allocSize < VkDeviceSize(256*1024) {
 		allocSize = VkDeviceSize(256 * 1024)
 	}
-	vkAllocateMemory(p.sb, dev, allocSize, uint32(memTypeIndex), memHandle)
-	mem := GetState(p.sb.newState).DeviceMemories().Get(memHandle)
 
-	vkBindImageMemory(p.sb, dev, imgHandle, memHandle, 0)
+	if !isDisjointImageInfo(info) && p.stagingBlockSize != 0 {
+		if mem, ok := p.suballocateStagingMemory(dev, imgHandle, allocSize, memTypeIndex, srcMem); ok {
+			return img, mem, nil
+		}
+	}
+	memHandle := VkDeviceMemory(newUnusedID(true, func(x uint64) bool {
+		return GetState(p.sb.newState).DeviceMemories().Contains(VkDeviceMemory(x))
+	}))
+	if !isDisjointImageInfo(info) {
+		vkAllocateMemory(p.sb, dev, allocSize, uint32(memTypeIndex), memHandle, ipMemoryAllocateFlagsPNext(p.sb, srcMem, NewVoidᶜᵖ(memory.Nullptr)))
+		mem := GetState(p.sb.newState).DeviceMemories().Get(memHandle)
+		p.trackHeapUsage(mem, true)
+		vkBindImageMemory(p.sb, dev, imgHandle, memHandle, 0)
+		return img, mem, nil
+	}
+
+	// Disjoint multi-planar image, each plane is bound separately to its own
+	// range of the memory, sized by the format and extent of the plane and
+	// overallocated the same way as the whole image. If the plane sizes are
+	// not known, the size of the whole image is used as the size of each
+	// plane, so the planes still won't overlap.
+	planes := p.sb.imageAspectFlagBits(img, img.ImageAspect())
+	planeSizes, ok := ipPlaneSizes(info.Extent(), info.Fmt(), info.MipLevels(), info.ArrayLayers(), planes)
+	if !ok {
+		log.W(p.sb.ctx, "Size of the planes of image: %v in format: %v not known, fallback to the size of the whole image for each plane", imgHandle, info.Fmt())
+		planeSizes = make([]VkDeviceSize, len(planes))
+		for i := range planeSizes {
+			planeSizes[i] = imgSize
+		}
+	}
+	planeOffsets, totalSize := ipPlaneOffsets(planeSizes, ipStagingOverallocation(p.allocationFailures))
+	vkAllocateMemory(p.sb, dev, totalSize, uint32(memTypeIndex), memHandle, ipMemoryAllocateFlagsPNext(p.sb, srcMem, NewVoidᶜᵖ(memory.Nullptr)))
+	mem := GetState(p.sb.newState).DeviceMemories().Get(memHandle)
+	p.trackHeapUsage(mem, true)
+	for i, plane := range planes {
+		vkBindImagePlaneMemory(p.sb, dev, imgHandle, memHandle, planeOffsets[i], plane)
+	}
 	return img, mem, nil
 }
 
+// ipImageSizeOrFallback returns the given inferred size of the given image, or
+// the given fallback size if the inference failed with the given error. The
+// inference does not model every image configuration, so the known memory
+// requirement is used instead, the overallocation of the memory still applies
+// so the replay side requirement should be covered. Returns an error if the
+// inference failed and the fallback size is 0, i.e. no fallback is available.
+func ipImageSizeOrFallback(ctx context.Context, img VkImage, inferredSize VkDeviceSize, inferErr error, fallbackSize VkDeviceSize) (VkDeviceSize, error) {
+	if inferErr == nil {
+		return inferredSize, nil
+	}
+	if fallbackSize == 0 {
+		return 0, log.Errf(ctx, inferErr, "[Getting image size]")
+	}
+	log.W(ctx, "[Getting image size for image: %v] %v, fallback to size: %v", img, inferErr, fallbackSize)
+	return fallbackSize, nil
+}
+
+const (
+	// ipMaxStagingOverallocation is the factor by which the memory of the
+	// staging images is overallocated over the inferred image size when no
+	// allocation failed in a prior replay.
+	ipMaxStagingOverallocation = 2.0
+	// ipStagingOverallocationStep is the amount the overallocation factor is
+	// reduced by for each allocation failure of a prior replay.
+	ipStagingOverallocationStep = 0.25
+	// ipPlaneAllocationAlignment is the alignment of the memory ranges the
+	// planes of disjoint multi-planar staging images are bound to.
+	ipPlaneAllocationAlignment = 256 * 1024
+)
+
+// ipStagingOverallocation returns the factor by which the memory of the
+// staging images is overallocated, given the number of the memory allocations
+// of the rebuilt state which failed in a prior replay. Each failure reduces the
+// factor by ipStagingOverallocationStep, down to 1.0, i.e. no overallocation.
+func ipStagingOverallocation(allocationFailures int) float64 {
+	return math.Max(1.0, ipMaxStagingOverallocation-ipStagingOverallocationStep*float64(allocationFailures))
+}
+
+// ipOverallocatedSize returns the given size overallocated by the given factor.
+func ipOverallocatedSize(size VkDeviceSize, factor float64) VkDeviceSize {
+	return VkDeviceSize(math.Ceil(float64(size) * factor))
+}
+
+// ipPlaneSizes returns the sizes of the given planes of an image with the
+// given extent, multi-planar format, mip levels and array layers, i.e. the
+// sizes of all the levels and layers of each plane. Returns false if the
+// format is not a multi-planar one or has no such plane.
+func ipPlaneSizes(extent VkExtent3D, format VkFormat, mipLevels, arrayLayers uint32, planes []VkImageAspectFlagBits) ([]VkDeviceSize, bool) {
+	sizes := make([]VkDeviceSize, 0, len(planes))
+	for _, plane := range planes {
+		size := VkDeviceSize(0)
+		for level := uint32(0); level < mipLevels; level++ {
+			levelSize, ok := ipPlaneLevelSize(extent, format, level, plane)
+			if !ok {
+				return nil, false
+			}
+			size += VkDeviceSize(levelSize.alignedLevelSize) * VkDeviceSize(arrayLayers)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, true
+}
+
+// ipPlaneOffsets returns the offsets of the memory ranges of the planes with
+// the given sizes, each overallocated by the given factor and aligned to
+// ipPlaneAllocationAlignment, and the total size of the ranges.
+func ipPlaneOffsets(sizes []VkDeviceSize, overallocation float64) ([]VkDeviceSize, VkDeviceSize) {
+	offsets := make([]VkDeviceSize, 0, len(sizes))
+	total := VkDeviceSize(0)
+	for _, size := range sizes {
+		offsets = append(offsets, total)
+		total += VkDeviceSize(nextMultipleOf(uint64(ipOverallocatedSize(size, overallocation)), ipPlaneAllocationAlignment))
+	}
+	return offsets, total
+}
+
+// stagingMemoryTypeIndex returns the index of the memory type to allocate the
+// memory of the given size for a staging image from. The memory type must be
+// one of the given memory type bits, and have one of the acceptable memory
+// property flags in stagingMemoryProperties, which are tried in order. The
+// memory types whose heaps are near capacity, estimated from the memory
+// allocated by this image primer, are skipped, unless all the acceptable
+// memory types are near capacity. Returns -1 if no memory type is acceptable.
+func (p *imagePrimer) stagingMemoryTypeIndex(dev VkDevice, memTypeBits uint32, props VkPhysicalDeviceMemoryProperties, size VkDeviceSize) int {
+	for _, flags := range p.stagingMemoryProperties {
+		for i := 0; i < int(props.MemoryTypeCount()); i++ {
+			if (memTypeBits & (1 << uint(i))) == 0 {
+				continue
+			}
+			t := props.MemoryTypes().Get(i)
+			if flags != (t.PropertyFlags() & flags) {
+				continue
+			}
+			heap := ipMemoryHeap{dev: dev, index: t.HeapIndex()}
+			if !ipHeapHasRoom(p.heapUsages[heap], size, props.MemoryHeaps().Get(int(t.HeapIndex())).Size()) {
+				continue
+			}
+			return i
+		}
+	}
+	// All the acceptable memory types are near capacity, the allocation may
+	// still succeed as the usages are only estimated.
+	for _, flags := range p.stagingMemoryProperties {
+		if i := memoryTypeIndexFor(memTypeBits, props, flags); i >= 0 {
+			log.W(p.sb.ctx, "All the acceptable memory heaps are near capacity, allocating staging image memory of size: %v from memory type: %v", size, i)
+			return i
+		}
+	}
+	return -1
+}
+
+// ipErrStagingBudgetExceeded is returned when the staging images for priming
+// an image do not fit in the staging memory budget of the image primer.
+var ipErrStagingBudgetExceeded = fmt.Errorf("staging memory budget exceeded")
+
+// ipWithinBudget returns true if allocating memory of the given size, in
+// addition to the given used size, does not exceed the given budget. A zero
+// budget means there is no budget.
+func ipWithinBudget(used, size, budget VkDeviceSize) bool {
+	return budget == 0 || uint64(used)+uint64(size) <= uint64(budget)
+}
+
+// stagingMemoryInUse returns the estimated size of the memory allocated by
+// this image primer, which is not freed yet.
+func (p *imagePrimer) stagingMemoryInUse() VkDeviceSize {
+	used := VkDeviceSize(0)
+	for _, size := range p.heapUsages {
+		used += size
+	}
+	return used
+}
+
+// ipHeapHasRoom returns true if allocating memory of the given size from a heap
+// of the given heap size, in which the given used size is already allocated,
+// does not exceed ipHeapUsageLimitPercent of the heap. A zero heap size means
+// the size of the heap is unknown, and the heap is assumed to have room.
+func ipHeapHasRoom(used, size, heapSize VkDeviceSize) bool {
+	if heapSize == 0 {
+		return true
+	}
+	return uint64(used)+uint64(size) <= uint64(heapSize)/100*ipHeapUsageLimitPercent
+}
+
+// trackHeapUsage adds the size of the given memory allocated by this image
+// primer to the usage of its heap if allocated is true, otherwise removes it.
+func (p *imagePrimer) trackHeapUsage(mem DeviceMemoryObjectʳ, allocated bool) {
+	dev := p.sb.s.Devices().Get(mem.Device())
+	if dev.IsNil() {
+		return
+	}
+	props := p.sb.s.PhysicalDevices().Get(dev.PhysicalDevice()).MemoryProperties()
+	heap := ipMemoryHeap{dev: mem.Device(), index: props.MemoryTypes().Get(int(mem.MemoryTypeIndex())).HeapIndex()}
+	if allocated {
+		p.heapUsages[heap] += mem.AllocationSize()
+	} else if p.heapUsages[heap] > mem.AllocationSize() {
+		p.heapUsages[heap] -= mem.AllocationSize()
+	} else {
+		delete(p.heapUsages, heap)
+	}
+}
+
+// freeMemory frees the given memory allocated by this image primer. If the
+// memory is a staging memory block, only the suballocation of one staging
+// image is released, see releaseStagingMemory.
+func (p *imagePrimer) freeMemory(mem DeviceMemoryObjectʳ) {
+	if p.releaseStagingMemory(mem) {
+		return
+	}
+	p.trackHeapUsage(mem, false)
+	p.sb.write(p.sb.cb.VkFreeMemory(mem.Device(), mem.VulkanHandle(), memory.Nullptr))
+}
+
+// checkCapturedImageFormatSupported checks the format, tiling and usages of
+// the given image info against the format properties of the physical device of
+// the given device recorded in the trace, returns an error if the combination
+// is known to be unsupported. The check is done on the host with the capture
+// side properties, as the result of a replay side query is not available when
+// building the commands. The captured properties are enough for it: at replay,
+// replayEnumeratePhysicalDevices maps each physical device of the trace to the
+// replay device with the same vendor and device IDs, whose format properties
+// are the captured ones. Only when no such device exists is another device
+// used, with a warning that the replay may not work correctly, and an image
+// passing this check may then still fail to be created.
+func (p *imagePrimer) checkCapturedImageFormatSupported(dev VkDevice, info ImageInfo) error {
+	devObj := p.sb.s.Devices().Get(dev)
+	if devObj.IsNil() {
+		return fmt.Errorf("Nil Device: %v", dev)
+	}
+	formatProps := p.sb.s.PhysicalDevices().Get(devObj.PhysicalDevice()).FormatProperties()
+	if !formatProps.Contains(info.Fmt()) {
+		// Format support information not available, assume it is supported.
+		return nil
+	}
+	var supported VkFormatFeatureFlags
+	switch info.Tiling() {
+	case VkImageTiling_VK_IMAGE_TILING_OPTIMAL:
+		supported = formatProps.Get(info.Fmt()).OptimalTilingFeatures()
+	case VkImageTiling_VK_IMAGE_TILING_LINEAR:
+		supported = formatProps.Get(info.Fmt()).LinearTilingFeatures()
+	default:
+		return nil
+	}
+	required := ipFormatFeaturesForUsages(info.Usage())
+	if supported&required != required {
+		return fmt.Errorf("format: %v with tiling: %v does not support usage: %v, supported features: %v", info.Fmt(), info.Tiling(), info.Usage(), supported)
+	}
+	return nil
+}
+
 // createSameStagingImage creates an image with the same image info (except
-// initial layout) as the given image along with the given initial layout, and
+// initial layout and tiling) as the given image along with the given initial
+// layout and the tiling returned by stagingImageTiling, and
 // create backing memory for the new image and bind the image with the created
 // memory (sparse binding not supported). Returns the created image object in
 // the new state of the stateBuilder in the image primer, a function to destroy
@@ -105,28 +736,550 @@ func (p *imagePrimer) createSameStagingImage(img ImageObjectʳ, initialLayout Vk
 	// TODO: Handle multi-planar images
 	memInfo, _ := subGetImagePlaneMemoryInfo(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, img, VkImageAspectFlagBits(0))
 	memTypeBits := memInfo.MemoryRequirements().MemoryTypeBits()
-	memIndex := memoryTypeIndexFor(memTypeBits, phyDevMemProps, VkMemoryPropertyFlags(VkMemoryPropertyFlagBits_VK_MEMORY_PROPERTY_DEVICE_LOCAL_BIT))
-	if memIndex < 0 {
-		// fallback to use whatever type of memory available
-		memIndex = memoryTypeIndexFor(memTypeBits, phyDevMemProps, VkMemoryPropertyFlags(0))
-	}
+	memIndex := p.stagingMemoryTypeIndex(dev.VulkanHandle(), memTypeBits, phyDevMemProps, memInfo.MemoryRequirements().Size()*2)
 	if memIndex < 0 {
 		return ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, fmt.Errorf("can't find an appropriate memory type index"), "[Creatig staging image same as image: %v]", img.VulkanHandle())
 	}
 
-	createInfo := img.Info()
+	createInfo := img.Info().Clone(p.sb.newState.Arena, api.CloneContext{})
 	createInfo.SetInitialLayout(initialLayout)
+	createInfo.SetTiling(p.stagingImageTiling(dev, createInfo.Fmt(), createInfo.Usage()))
+	ipSetExclusiveSharing(createInfo, p.sb.newState.Arena)
 
-	stagingImg, stagingImgMem, err := p.createImageAndBindMemory(img.Device(), createInfo, memIndex)
+	stagingImg, stagingImgMem, err := p.createImageAndBindMemory(img.Device(), createInfo, memIndex, memInfo.MemoryRequirements().Size(), memInfo.BoundMemory())
 	if err != nil {
 		return ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, err, "[Creating staging image same as image: %v]", img.VulkanHandle())
 	}
 	return stagingImg, func() {
 		p.sb.write(p.sb.cb.VkDestroyImage(stagingImg.Device(), stagingImg.VulkanHandle(), memory.Nullptr))
-		p.sb.write(p.sb.cb.VkFreeMemory(stagingImgMem.Device(), stagingImgMem.VulkanHandle(), memory.Nullptr))
+		p.freeMemory(stagingImgMem)
 	}, nil
 }
 
+// stagingImageTiling returns the tiling to be used by staging images of the
+// given format and usages on the given device. Staging images are transient,
+// so OPTIMAL tiling is always preferred, unless the format properties of the
+// physical device show that only LINEAR tiling supports the usages.
+func (p *imagePrimer) stagingImageTiling(dev DeviceObjectʳ, format VkFormat, usages VkImageUsageFlags) VkImageTiling {
+	formatProps := p.sb.s.PhysicalDevices().Get(dev.PhysicalDevice()).FormatProperties()
+	if !formatProps.Contains(format) {
+		// Format support information not available, assume OPTIMAL is ok.
+		return VkImageTiling_VK_IMAGE_TILING_OPTIMAL
+	}
+	required := ipFormatFeaturesForUsages(usages)
+	props := formatProps.Get(format)
+	if props.OptimalTilingFeatures()&required != required &&
+		props.LinearTilingFeatures()&required == required {
+		return VkImageTiling_VK_IMAGE_TILING_LINEAR
+	}
+	return VkImageTiling_VK_IMAGE_TILING_OPTIMAL
+}
+
+// ipSetExclusiveSharing sets the sharing mode of the given image info to
+// EXCLUSIVE and clears its queue family indices. Staging images are only used
+// on the priming queue, whose family may not be in the queue family indices of
+// the source image, so they should not inherit the sharing mode of the source.
+func ipSetExclusiveSharing(info ImageInfo, a arena.Arena) {
+	info.SetSharingMode(VkSharingMode_VK_SHARING_MODE_EXCLUSIVE)
+	info.SetQueueFamilyIndices(NewU32ːu32ᵐ(a))
+}
+
+// ipDstLayout returns the layout to leave an image subresource in after
+// priming, given the layout it should be in, which is returned unless it is
+// UNDEFINED or PREINITIALIZED. Images can not be transitioned to those two
+// layouts, nor can render pass attachments end in them, so the given fallback
+// layout is returned instead. Every other layout, including PRESENT_SRC_KHR of
+// the swapchain images, is valid as the new layout of image memory barriers
+// and the final layout of render pass attachments.
+func ipDstLayout(layout, fallback VkImageLayout) VkImageLayout {
+	switch layout {
+	case VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED,
+		VkImageLayout_VK_IMAGE_LAYOUT_PREINITIALIZED:
+		return fallback
+	}
+	return layout
+}
+
+// ipSynchronization2Layout returns true if the given layout is one of the
+// unified layouts of VK_KHR_synchronization2, which are only valid on devices
+// with its synchronization2 feature enabled.
+func ipSynchronization2Layout(layout VkImageLayout) bool {
+	switch layout {
+	case VkImageLayout_VK_IMAGE_LAYOUT_READ_ONLY_OPTIMAL_KHR,
+		VkImageLayout_VK_IMAGE_LAYOUT_ATTACHMENT_OPTIMAL_KHR:
+		return true
+	}
+	return false
+}
+
+// checkDstLayouts returns an error if any subresource of the given image is
+// to be left in a synchronization2 layout by the given destination layouts,
+// while synchronization2 is not enabled on the device of the image. Otherwise
+// the barriers transitioning the image are written with
+// vkCmdPipelineBarrier2KHR, see writeImageBarriers.
+func (p *imagePrimer) checkDstLayouts(img ImageObjectʳ, dstLayout ipLayoutInfo) error {
+	if p.sb.synchronization2(img.Device()) {
+		return nil
+	}
+	var err error
+	walkImageSubresourceRange(p.sb, img, p.sb.imageWholeSubresourceRange(img),
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			if layout := dstLayout.layoutOf(aspect, layer, level); err == nil && ipSynchronization2Layout(layout) {
+				err = fmt.Errorf("layout: %v of aspect: %v, layer: %v, level: %v requires the synchronization2 feature of VK_KHR_synchronization2, which is not enabled on device: %v",
+					layout, aspect, layer, level, img.Device())
+			}
+		})
+	return err
+}
+
+// ipAttachmentLayout returns the optimal attachment layout for rendering to
+// the given aspect.
+func ipAttachmentLayout(aspect VkImageAspectFlagBits) VkImageLayout {
+	if aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+		return VkImageLayout_VK_IMAGE_LAYOUT_COLOR_ATTACHMENT_OPTIMAL
+	}
+	return VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL
+}
+
+// ipQueueFamilyCompatible returns true if an image with the given info can be
+// accessed on queues of the given family without ownership transfers being
+// invalid, which is the case for images with EXCLUSIVE sharing mode, and for
+// images with CONCURRENT sharing mode whose queue family indices include the
+// family.
+func ipQueueFamilyCompatible(info ImageInfo, family uint32) bool {
+	if info.SharingMode() != VkSharingMode_VK_SHARING_MODE_CONCURRENT {
+		return true
+	}
+	for _, i := range queueFamilyIndicesToU32Slice(info.QueueFamilyIndices()) {
+		if i == family {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFormatFeaturesForUsages returns the format features required for an image
+// to be created with the given usages.
+func ipFormatFeaturesForUsages(usages VkImageUsageFlags) VkFormatFeatureFlags {
+	features := VkFormatFeatureFlags(0)
+	for usage, feature := range map[VkImageUsageFlagBits]VkFormatFeatureFlagBits{
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT:                  VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_SAMPLED_IMAGE_BIT,
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT:                  VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_STORAGE_IMAGE_BIT,
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT:         VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_COLOR_ATTACHMENT_BIT,
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT: VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_DEPTH_STENCIL_ATTACHMENT_BIT,
+	} {
+		if usages&VkImageUsageFlags(usage) != 0 {
+			features |= VkFormatFeatureFlags(feature)
+		}
+	}
+	return features
+}
+
+// primingUsage returns the usage to recreate the given image with. If the
+// captured usage of the image permits none of the priming strategies, e.g. the
+// image is SAMPLED only with OPTIMAL tiling, TRANSFER_DST or STORAGE usage is
+// added, given the format of the image supports it with the image's tiling.
+// Note that this makes the recreated image differ from the captured one in
+// usage, and the memory requirements of the recreated image are assumed to be
+// unchanged. Returns the captured usage if no usage needs to or can be added.
+func (p *imagePrimer) primingUsage(img ImageObjectʳ) VkImageUsageFlags {
+	usage := img.Info().Usage()
+	primeableUsages := VkImageUsageFlags(
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT|
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT|
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT|
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT) | p.layoutOnlyUsages
+	if p.viewableUsage(img, usage)&primeableUsages != 0 {
+		return usage
+	}
+	if img.Info().Tiling() == VkImageTiling_VK_IMAGE_TILING_LINEAR &&
+		img.Info().InitialLayout() == VkImageLayout_VK_IMAGE_LAYOUT_PREINITIALIZED {
+		// Can be primed by preinitialization.
+		return usage
+	}
+	supported, ok := p.formatFeatures(img)
+	if !ok {
+		return usage
+	}
+
+	transferFeatures := VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_TRANSFER_SRC_BIT |
+			VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_TRANSFER_DST_BIT)
+	// Without VK_KHR_maintenance1, the transfer format features are not
+	// reported and transfer usages are supported by all formats.
+	if supported&transferFeatures == 0 ||
+		supported&VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_TRANSFER_DST_BIT) != 0 {
+		return usage | VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
+	}
+	if supported&VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_STORAGE_IMAGE_BIT) != 0 {
+		return usage | VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	}
+	return usage
+}
+
+// formatFeatures returns the features supported by the format of the given
+// image with the image's tiling. Returns false if the features are unknown.
+func (p *imagePrimer) formatFeatures(img ImageObjectʳ) (VkFormatFeatureFlags, bool) {
+	return p.formatFeaturesOf(img, img.Info().Fmt())
+}
+
+// formatFeaturesOf returns the features supported by the given format with the
+// tiling of the given image, on the device of the image. Returns false if the
+// features are unknown.
+func (p *imagePrimer) formatFeaturesOf(img ImageObjectʳ, format VkFormat) (VkFormatFeatureFlags, bool) {
+	dev := p.sb.s.Devices().Get(img.Device())
+	if dev.IsNil() {
+		return 0, false
+	}
+	formatProps := p.sb.s.PhysicalDevices().Get(dev.PhysicalDevice()).FormatProperties()
+	if !formatProps.Contains(format) {
+		return 0, false
+	}
+	switch img.Info().Tiling() {
+	case VkImageTiling_VK_IMAGE_TILING_OPTIMAL:
+		return formatProps.Get(format).OptimalTilingFeatures(), true
+	case VkImageTiling_VK_IMAGE_TILING_LINEAR:
+		return formatProps.Get(format).LinearTilingFeatures(), true
+	}
+	return 0, false
+}
+
+// blockTexelViewFormat returns the uncompressed format of the storage views
+// through which the given compressed image can be primed, one texel per
+// compressed block, see ipBlockTexelViewFormat. Returns false if the image is
+// not compressed, or not created with
+// VK_IMAGE_CREATE_BLOCK_TEXEL_VIEW_COMPATIBLE_BIT, or the uncompressed format
+// does not support storage with the image's tiling, or the mip levels of the
+// image can not be staged in an image measured in blocks, see
+// ipBlockTexelLevelsMatch. Such images need their data decompressed on the host
+// instead.
+func (p *imagePrimer) blockTexelViewFormat(img ImageObjectʳ) (VkFormat, bool) {
+	info := img.Info()
+	if info.Flags()&VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_BLOCK_TEXEL_VIEW_COMPATIBLE_BIT) == 0 {
+		return VkFormat_VK_FORMAT_UNDEFINED, false
+	}
+	elementAndTexelInfo, err := subGetElementAndTexelBlockSize(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, info.Fmt())
+	if err != nil {
+		return VkFormat_VK_FORMAT_UNDEFINED, false
+	}
+	blockWidth := elementAndTexelInfo.TexelBlockSize().Width()
+	blockHeight := elementAndTexelInfo.TexelBlockSize().Height()
+	if blockWidth == 1 && blockHeight == 1 {
+		return VkFormat_VK_FORMAT_UNDEFINED, false
+	}
+	format, ok := ipBlockTexelViewFormat(elementAndTexelInfo.ElementSize())
+	if !ok || !ipBlockTexelLevelsMatch(info.Extent().Width(), info.Extent().Height(), blockWidth, blockHeight, info.MipLevels()) {
+		return VkFormat_VK_FORMAT_UNDEFINED, false
+	}
+	features, ok := p.formatFeaturesOf(img, format)
+	if !ok || features&VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_STORAGE_IMAGE_BIT) == 0 {
+		return VkFormat_VK_FORMAT_UNDEFINED, false
+	}
+	return format, true
+}
+
+// ipViewUsageFeatures maps the image usages which require image views to the
+// format features of which at least one must be supported by the view format.
+var ipViewUsageFeatures = map[VkImageUsageFlagBits]VkFormatFeatureFlags{
+	VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT: VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_SAMPLED_IMAGE_BIT),
+	VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT: VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_STORAGE_IMAGE_BIT),
+	VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT: VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_COLOR_ATTACHMENT_BIT),
+	VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT: VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_DEPTH_STENCIL_ATTACHMENT_BIT),
+	VkImageUsageFlagBits_VK_IMAGE_USAGE_INPUT_ATTACHMENT_BIT: VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_COLOR_ATTACHMENT_BIT |
+			VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_DEPTH_STENCIL_ATTACHMENT_BIT),
+}
+
+// ipViewableUsage returns the given usage of an image created with the given
+// info, without the usages that views in the image's own format cannot have,
+// given the features supported by the image's format. An image created with
+// VK_IMAGE_CREATE_EXTENDED_USAGE_BIT may have usages that are not supported by
+// its format, but only by some of the formats its views can be created with.
+// As the priming strategies create views in the image's own format, such
+// usages cannot be used for priming. The usage of images created without
+// EXTENDED_USAGE is returned unchanged, as it must be supported by the format.
+func ipViewableUsage(info ImageInfo, usage VkImageUsageFlags, features VkFormatFeatureFlags) VkImageUsageFlags {
+	if info.Flags()&VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_EXTENDED_USAGE_BIT) == 0 {
+		return usage
+	}
+	for bit, required := range ipViewUsageFeatures {
+		if features&required == 0 {
+			usage &^= VkImageUsageFlags(bit)
+		}
+	}
+	return usage
+}
+
+// viewableUsage returns the given usage of the given image without the usages
+// that the views in the image's own format cannot have, see ipViewableUsage.
+// Returns the usage unchanged if the features of the image's format are
+// unknown.
+func (p *imagePrimer) viewableUsage(img ImageObjectʳ, usage VkImageUsageFlags) VkImageUsageFlags {
+	features, ok := p.formatFeatures(img)
+	if !ok {
+		return usage
+	}
+	viewable := ipViewableUsage(img.Info(), usage, features)
+	// Compressed images can be stored to through their uncompressed block
+	// texel views.
+	if _, ok := p.blockTexelViewFormat(img); ok {
+		viewable |= usage & VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	}
+	return viewable
+}
+
+// levelHasData returns true if the given subresource of the image in the old
+// state has any data to prime, i.e. data is supplied by the caller for it, or
+// any of its bytes have been written.
+func (p *imagePrimer) levelHasData(img ImageObjectʳ, aspect VkImageAspectFlagBits, layer, level uint32) bool {
+	if p.srcData != nil {
+		_, ok := p.srcData[ipSubresource{aspect: aspect, layer: layer, level: level}]
+		return ok
+	}
+	if _, ok := img.Aspects().Lookup(aspect); !ok {
+		return false
+	}
+	if _, ok := img.Aspects().Get(aspect).Layers().Lookup(layer); !ok {
+		return false
+	}
+	if _, ok := img.Aspects().Get(aspect).Layers().Get(layer).Levels().Lookup(level); !ok {
+		return false
+	}
+	data := img.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level).Data()
+	pool, err := p.sb.oldState.Memory.Get(data.Pool())
+	if err != nil {
+		return false
+	}
+	return len(pool.Slice(memory.Range{Base: data.Base(), Size: data.Size()}).ValidRanges()) != 0
+}
+
+// mipGenerationRange returns the subresource range of the base mip level of
+// the given image, if the image can be primed by priming only its base level
+// and generating the rest of the levels requested by the given ranges with
+// blits: the image must be a single sampled, non-sparse color image with
+// multiple mip levels, with transfer usages and a format supporting blits, and
+// only the base level of the image has data. Returns false if any of these does
+// not hold, in which case all the levels should be primed.
+func (p *imagePrimer) mipGenerationRange(img ImageObjectʳ, usage VkImageUsageFlags, rngs []VkImageSubresourceRange) (VkImageSubresourceRange, bool) {
+	info := img.Info()
+	if info.MipLevels() <= 1 ||
+		info.Samples() != VkSampleCountFlagBits_VK_SAMPLE_COUNT_1_BIT ||
+		img.ImageAspect() != VkImageAspectFlags(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT) ||
+		isSparseResidency(img) {
+		return VkImageSubresourceRange{}, false
+	}
+	transferUsages := VkImageUsageFlags(
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_SRC_BIT |
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
+	if usage&transferUsages != transferUsages {
+		return VkImageSubresourceRange{}, false
+	}
+	blitFeatures := VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_BLIT_SRC_BIT |
+			VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_BLIT_DST_BIT)
+	if supported, ok := p.formatFeatures(img); !ok || supported&blitFeatures != blitFeatures {
+		return VkImageSubresourceRange{}, false
+	}
+	hasBase, hasUpper := true, false
+	requestsUpper := false
+	for _, rng := range rngs {
+		walkImageSubresourceRange(p.sb, img, rng,
+			func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+				if level != 0 {
+					requestsUpper = true
+				}
+			})
+	}
+	for layer := uint32(0); layer < info.ArrayLayers(); layer++ {
+		hasBase = hasBase && p.levelHasData(img, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT, layer, 0)
+		for level := uint32(1); level < info.MipLevels(); level++ {
+			hasUpper = hasUpper || p.levelHasData(img, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT, layer, level)
+		}
+	}
+	if !requestsUpper || !hasBase || hasUpper {
+		return VkImageSubresourceRange{}, false
+	}
+	return NewVkImageSubresourceRange(p.sb.ta,
+		VkImageAspectFlags(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT), // aspectMask
+		0,                  // baseMipLevel
+		1,                  // levelCount
+		0,                  // baseArrayLayer
+		info.ArrayLayers(), // layerCount
+	), true
+}
+
+// ipStagingColorFormat returns the format of the staging images for the color
+// aspect of an image in the given format. The data is unpacked to 32 bits per
+// channel for staging, so with narrow set, the 32-bit uint format with the
+// fewest channels that can hold all the channels of the source format is
+// returned. Otherwise, or if the channels of the source format are unknown,
+// stagingColorImageBufferFormat is returned. The priming shaders and render
+// passes are built for the format of the staging images in use.
+func ipStagingColorFormat(srcFmt VkFormat, narrow bool) VkFormat {
+	if !narrow {
+		return stagingColorImageBufferFormat
+	}
+	f, err := getImageFormatFromVulkanFormat(srcFmt)
+	if err != nil || f.GetUncompressed() == nil {
+		return stagingColorImageBufferFormat
+	}
+	switch len(f.GetUncompressed().GetFormat().GetComponents()) {
+	case 1:
+		return VkFormat_VK_FORMAT_R32_UINT
+	case 2:
+		return VkFormat_VK_FORMAT_R32G32_UINT
+	}
+	return stagingColorImageBufferFormat
+}
+
+// ipBlockTexelViewFormat returns the uncompressed format whose texels are of the
+// given size of the compressed blocks of a format, which the views of an image
+// created with VK_IMAGE_CREATE_BLOCK_TEXEL_VIEW_COMPATIBLE_BIT can be created
+// with to access one compressed block per texel. Returns false if there is no
+// such 32 bit per channel uint format.
+func ipBlockTexelViewFormat(blockSize uint32) (VkFormat, bool) {
+	switch blockSize {
+	case 8:
+		return VkFormat_VK_FORMAT_R32G32_UINT, true
+	case 16:
+		return VkFormat_VK_FORMAT_R32G32B32A32_UINT, true
+	}
+	return VkFormat_VK_FORMAT_UNDEFINED, false
+}
+
+// ipBlockTexelLevelsMatch returns true if each of the given number of mip
+// levels of a compressed image with the given extent and texel block size,
+// measured in blocks, has the same extent as the same level of an image whose
+// base level has the extent of the compressed image in blocks. The data of such
+// compressed images can be staged in an uncompressed image with one texel per
+// block.
+func ipBlockTexelLevelsMatch(width, height, blockWidth, blockHeight, mipLevels uint32) bool {
+	blocks := func(texels, blockSize uint32) uint32 { return (texels + blockSize - 1) / blockSize }
+	mip := func(size, level uint32) uint32 {
+		if size>>level == 0 {
+			return 1
+		}
+		return size >> level
+	}
+	for level := uint32(0); level < mipLevels; level++ {
+		if blocks(mip(width, level), blockWidth) != mip(blocks(width, blockWidth), level) ||
+			blocks(mip(height, level), blockHeight) != mip(blocks(height, blockHeight), level) {
+			return false
+		}
+	}
+	return true
+}
+
+// ipStagingFormatChannels are the formats which the staging images can be
+// created in, mapped to their channel counts. The data is unpacked to 32-bit
+// uint channels for staging.
+var ipStagingFormatChannels = map[VkFormat]int{
+	VkFormat_VK_FORMAT_R32_UINT:          1,
+	VkFormat_VK_FORMAT_R32G32_UINT:       2,
+	VkFormat_VK_FORMAT_R32G32B32A32_UINT: 4,
+}
+
+// ipCheckStagingFormat returns an error if the given staging format can not
+// hold the data of a source aspect with the given number of channels and
+// element size, where defaultElementSize is the element size of the default
+// staging format of the aspect. Source elements larger than the default
+// staging elements are split across several staging images, so only the
+// default size is required for them.
+func ipCheckStagingFormat(format VkFormat, srcChannels int, srcElementSize, defaultElementSize uint32) error {
+	channels, ok := ipStagingFormatChannels[format]
+	if !ok {
+		return fmt.Errorf("staging format: %v is not a 32-bit per channel uint format", format)
+	}
+	if channels < srcChannels {
+		return fmt.Errorf("staging format: %v has %v channels, less than the %v source channels", format, channels, srcChannels)
+	}
+	if size := uint32(channels) * 4; size < srcElementSize && size < defaultElementSize {
+		return fmt.Errorf("staging format: %v with %v byte elements can not hold the %v byte source elements", format, size, srcElementSize)
+	}
+	return nil
+}
+
+// stagingFormatOverride returns the given override of the given default
+// staging format for the given aspect of the given image, whose elements are
+// of the given size, or the default format if the override is not set, can not
+// hold the source data, see ipCheckStagingFormat, or does not support the
+// given usages on the device of the image.
+func (p *imagePrimer) stagingFormatOverride(img ImageObjectʳ, aspect VkImageAspectFlagBits, override, defaultFormat VkFormat, srcElementSize uint32, usages VkImageUsageFlags) VkFormat {
+	if override == VkFormat_VK_FORMAT_UNDEFINED || override == defaultFormat {
+		return defaultFormat
+	}
+	srcChannels := 1
+	if aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+		if f, err := getImageFormatFromVulkanFormat(img.Info().Fmt()); err == nil && f.GetUncompressed() != nil {
+			srcChannels = len(f.GetUncompressed().GetFormat().GetComponents())
+		}
+	}
+	err := ipCheckStagingFormat(override, srcChannels, srcElementSize, uint32(ipStagingFormatChannels[defaultFormat])*4)
+	if err == nil && !p.stagingFormatSupported(p.sb.s.Devices().Get(img.Device()), override, usages) {
+		err = fmt.Errorf("staging format: %v does not support the usages: %v on device: %v", override, usages, img.Device())
+	}
+	if err != nil {
+		log.W(p.sb.ctx, "[Overriding the staging format of image: %v, aspect: %v] %v, using staging format: %v", img.VulkanHandle(), aspect, err, defaultFormat)
+		return defaultFormat
+	}
+	return override
+}
+
+// stagingFormatSupported returns true if the given format supports the given
+// usages with either tiling on the given device, or if the format properties
+// are unknown.
+func (p *imagePrimer) stagingFormatSupported(dev DeviceObjectʳ, format VkFormat, usages VkImageUsageFlags) bool {
+	if dev.IsNil() {
+		return true
+	}
+	formatProps := p.sb.s.PhysicalDevices().Get(dev.PhysicalDevice()).FormatProperties()
+	if !formatProps.Contains(format) {
+		return true
+	}
+	required := ipFormatFeaturesForUsages(usages)
+	props := formatProps.Get(format)
+	return props.OptimalTilingFeatures()&required == required ||
+		props.LinearTilingFeatures()&required == required
+}
+
+// ip32BitChannelFormats are the color formats with 32 bits per channel, mapped
+// to their channel counts. The data of these formats unpacked for priming is
+// bitwise the same as the source data, given the same number of channels.
+var ip32BitChannelFormats = map[VkFormat]int{
+	VkFormat_VK_FORMAT_R32_UINT:            1,
+	VkFormat_VK_FORMAT_R32_SINT:            1,
+	VkFormat_VK_FORMAT_R32_SFLOAT:          1,
+	VkFormat_VK_FORMAT_R32G32_UINT:         2,
+	VkFormat_VK_FORMAT_R32G32_SINT:         2,
+	VkFormat_VK_FORMAT_R32G32_SFLOAT:       2,
+	VkFormat_VK_FORMAT_R32G32B32A32_UINT:   4,
+	VkFormat_VK_FORMAT_R32G32B32A32_SINT:   4,
+	VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT: 4,
+}
+
+// ipNeedsUnpacking returns true if the data of the given aspect in srcFmt
+// needs to be unpacked to be copied to an image in dstFmt. Returns false if
+// the two formats are the same, or the data of the source format is already
+// laid out as dstFmt, e.g. RGBA32_SFLOAT data to be copied to an RGBA32_UINT
+// staging image, in which case the data can be copied directly.
+func ipNeedsUnpacking(srcFmt, dstFmt VkFormat, aspect VkImageAspectFlagBits) bool {
+	if srcFmt == dstFmt {
+		return false
+	}
+	if aspect != VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+		return true
+	}
+	srcChannels, ok := ip32BitChannelFormats[srcFmt]
+	if !ok {
+		return true
+	}
+	return srcChannels != ip32BitChannelFormats[dstFmt]
+}
+
 // create32BitUintColorStagingImagesForAspect creates stagining images with format
 // RGBA32_UINT for the given image's specific, allocated backing memory for the
 // new created images and bind memory for them, returns the created image
@@ -141,7 +1294,12 @@ func (p *imagePrimer) create32BitUintColorStagingImagesForAspect(img ImageObject
 	if err != nil {
 		return []ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, err, "[Getting element size and texel block info]")
 	}
-	if srcElementAndTexelInfo.TexelBlockSize().Width() != 1 || srcElementAndTexelInfo.TexelBlockSize().Height() != 1 {
+	blockWidth := srcElementAndTexelInfo.TexelBlockSize().Width()
+	blockHeight := srcElementAndTexelInfo.TexelBlockSize().Height()
+	// Compressed images can only be staged as their raw blocks for their block
+	// texel views.
+	blockTexelFormat, blockTexel := p.blockTexelViewFormat(img)
+	if (blockWidth != 1 || blockHeight != 1) && !blockTexel {
 		// compressed formats are not supported
 		return []ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, err, "allocating staging images for compressed format images is not supported")
 	}
@@ -155,48 +1313,116 @@ func (p *imagePrimer) create32BitUintColorStagingImagesForAspect(img ImageObject
 		srcElementSize = 1
 	}
 
-	stagingImgFormat := VkFormat_VK_FORMAT_UNDEFINED
+	// TODO: Handle multi-planar images
+	memInfo, _ := subGetImagePlaneMemoryInfo(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, img, VkImageAspectFlagBits(0))
+	wideColorFormat := stagingColorImageBufferFormat
+	depthStencilFormat := stagingDepthStencilImageBufferFormat
 	switch aspect {
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
-		stagingImgFormat = stagingColorImageBufferFormat
+		wideColorFormat = p.stagingFormatOverride(img, aspect, p.stagingColorFormat, stagingColorImageBufferFormat, srcElementSize, usages)
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT,
 		VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
-		stagingImgFormat = stagingDepthStencilImageBufferFormat
+		depthStencilFormat = p.stagingFormatOverride(img, aspect, p.stagingDepthStencilFormat, stagingDepthStencilImageBufferFormat, srcElementSize, usages)
+	}
+	stagingFormatFor := func(narrow bool) (VkFormat, uint32) {
+		if blockTexel {
+			// One staging texel per compressed block.
+			return blockTexelFormat, srcElementSize
+		}
+		stagingImgFormat := VkFormat_VK_FORMAT_UNDEFINED
+		switch aspect {
+		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
+			stagingImgFormat = ipStagingColorFormat(img.Info().Fmt(), narrow)
+			if stagingImgFormat == stagingColorImageBufferFormat {
+				stagingImgFormat = wideColorFormat
+			}
+		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT,
+			VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
+			stagingImgFormat = depthStencilFormat
+		}
+		if stagingImgFormat == VkFormat_VK_FORMAT_UNDEFINED {
+			return stagingImgFormat, 0
+		}
+		stagingElementInfo, _ := subGetElementAndTexelBlockSize(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, stagingImgFormat)
+		stagingElementSize := stagingElementInfo.ElementSize()
+		if stagingElementSize < srcElementSize && stagingImgFormat != wideColorFormat &&
+			aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+			// The narrower staging format can't hold a whole source element.
+			stagingImgFormat = wideColorFormat
+			stagingElementInfo, _ = subGetElementAndTexelBlockSize(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, stagingImgFormat)
+			stagingElementSize = stagingElementInfo.ElementSize()
+		}
+		return stagingImgFormat, stagingElementSize
 	}
+	// stagingSize returns the estimated size of all the staging images with
+	// the given element size, which is also the fallback size of each of them.
+	stagingSize := func(stagingElementSize uint32) (total, each VkDeviceSize) {
+		// The staging images may have larger elements than the source image,
+		// scale the source memory requirement accordingly.
+		each = (memInfo.MemoryRequirements().Size()*VkDeviceSize(stagingElementSize) + VkDeviceSize(srcElementSize) - 1) / VkDeviceSize(srcElementSize)
+		return each * VkDeviceSize(ipStagingImageCount(srcElementSize, stagingElementSize)), each
+	}
+
+	stagingImgFormat, stagingElementSize := stagingFormatFor(p.narrowStagingFormats)
 	if stagingImgFormat == VkFormat_VK_FORMAT_UNDEFINED {
 		return []ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, nil, "unsupported aspect: %v", aspect)
 	}
-	stagingElementInfo, _ := subGetElementAndTexelBlockSize(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, stagingImgFormat)
-	stagingElementSize := stagingElementInfo.ElementSize()
+	total, fallbackSize := stagingSize(stagingElementSize)
+	if !ipWithinBudget(p.stagingMemoryInUse(), total, p.stagingMemoryBudget) {
+		// Downgrade to the narrower staging format to fit in the budget.
+		if narrowFormat, narrowElementSize := stagingFormatFor(true); narrowFormat != stagingImgFormat {
+			log.W(p.sb.ctx, "Staging images of image: %v, aspect: %v exceed the staging memory budget, using staging format: %v", img.VulkanHandle(), aspect, narrowFormat)
+			stagingImgFormat, stagingElementSize = narrowFormat, narrowElementSize
+			total, fallbackSize = stagingSize(stagingElementSize)
+		}
+	}
+	if !ipWithinBudget(p.stagingMemoryInUse(), total, p.stagingMemoryBudget) {
+		return []ImageObjectʳ{}, func() {}, ipErrStagingBudgetExceeded
+	}
+	count := ipStagingImageCount(srcElementSize, stagingElementSize)
+	if count > p.maxStagingImagesPerAspect {
+		return []ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, nil,
+			"image: %v, aspect: %v with element size: %v needs %v staging images in format: %v, more than the max number of staging images per aspect: %v",
+			img.VulkanHandle(), aspect, srcElementSize, count, stagingImgFormat, p.maxStagingImagesPerAspect)
+	}
+	log.D(p.sb.ctx, "Creating %v staging images in format: %v for image: %v, aspect: %v, max: %v", count, stagingImgFormat, img.VulkanHandle(), aspect, p.maxStagingImagesPerAspect)
 
 	stagingInfo := img.Info().Clone(p.sb.newState.Arena, api.CloneContext{})
 	stagingInfo.SetDedicatedAllocationNV(NilDedicatedAllocationBufferImageCreateInfoNVʳ)
+	// The view formats of the source image are not compatible with the
+	// staging format.
+	stagingInfo.SetViewFormatList(NilImageFormatListInfoʳ)
+	// The staging images are bound to normal memory.
+	stagingInfo.SetExternalMemory(NilExternalMemoryImageInfoʳ)
 	stagingInfo.SetFmt(stagingImgFormat)
 	stagingInfo.SetUsage(usages)
+	if blockTexel {
+		blocks := func(texels, blockSize uint32) uint32 { return (texels + blockSize - 1) / blockSize }
+		stagingInfo.SetExtent(NewVkExtent3D(p.sb.ta,
+			blocks(img.Info().Extent().Width(), blockWidth),
+			blocks(img.Info().Extent().Height(), blockHeight),
+			img.Info().Extent().Depth(),
+		))
+		stagingInfo.SetFlags(stagingInfo.Flags() &^ VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_BLOCK_TEXEL_VIEW_COMPATIBLE_BIT))
+	}
 
 	dev := p.sb.s.Devices().Get(img.Device())
+	stagingInfo.SetTiling(p.stagingImageTiling(dev, stagingImgFormat, usages))
+	ipSetExclusiveSharing(stagingInfo, p.sb.newState.Arena)
 	phyDevMemProps := p.sb.s.PhysicalDevices().Get(dev.PhysicalDevice()).MemoryProperties()
-	// TODO: Handle multi-planar images
-	memInfo, _ := subGetImagePlaneMemoryInfo(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, img, VkImageAspectFlagBits(0))
 	memTypeBits := memInfo.MemoryRequirements().MemoryTypeBits()
-	memIndex := memoryTypeIndexFor(memTypeBits, phyDevMemProps, VkMemoryPropertyFlags(VkMemoryPropertyFlagBits_VK_MEMORY_PROPERTY_DEVICE_LOCAL_BIT))
-	if memIndex < 0 {
-		// fallback to use whatever type of memory available
-		memIndex = memoryTypeIndexFor(memTypeBits, phyDevMemProps, VkMemoryPropertyFlags(0))
-	}
+	memIndex := p.stagingMemoryTypeIndex(dev.VulkanHandle(), memTypeBits, phyDevMemProps, fallbackSize*2)
 	if memIndex < 0 {
 		return []ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, nil, "can't find an appropriate memory type index")
 	}
 
-	covered := uint32(0)
-	for covered < srcElementSize {
-		stagingImg, mem, err := p.createImageAndBindMemory(dev.VulkanHandle(), stagingInfo, memIndex)
+	for i := uint32(0); i < count; i++ {
+		stagingImg, mem, err := p.createImageAndBindMemory(dev.VulkanHandle(), stagingInfo, memIndex, fallbackSize, memInfo.BoundMemory())
 		if err != nil {
 			return []ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, err, "[Creating 32 bit wide staging images for image: %v, aspect: %v, usages: %v]", img.VulkanHandle(), aspect, usages)
 		}
 		stagingImgs = append(stagingImgs, stagingImg)
 		stagingMems = append(stagingMems, mem)
-		covered += stagingElementSize
 	}
 
 	free := func() {
@@ -204,14 +1430,64 @@ func (p *imagePrimer) create32BitUintColorStagingImagesForAspect(img ImageObject
 			p.sb.write(p.sb.cb.VkDestroyImage(img.Device(), img.VulkanHandle(), memory.Nullptr))
 		}
 		for _, mem := range stagingMems {
-			p.sb.write(p.sb.cb.VkFreeMemory(mem.Device(), mem.VulkanHandle(), memory.Nullptr))
+			p.freeMemory(mem)
 		}
 	}
+	if err := ipCheckStagingCoverage(srcElementSize, stagingElementSize, uint32(len(stagingImgs))); err != nil {
+		free()
+		return []ImageObjectʳ{}, func() {}, log.Errf(p.sb.ctx, err, "[Checking the staging images in format: %v for image: %v in format: %v, aspect: %v]", stagingImgFormat, img.VulkanHandle(), img.Info().Fmt(), aspect)
+	}
 	return stagingImgs, free, nil
 }
 
+// ipCheckStagingCoverage returns an error if the given number of staging
+// images with the given element size do not represent a source element of the
+// given size: their combined element size must cover the source element, and
+// without the last staging image it must not, so every staging image holds
+// part of the source element. The combined size exceeds the source element
+// size only for the source elements which are not a multiple of the staging
+// element size, e.g. R64G64B64_SFLOAT in R32G32B32A32_UINT.
+func ipCheckStagingCoverage(srcElementSize, stagingElementSize, count uint32) error {
+	covered := uint64(stagingElementSize) * uint64(count)
+	switch {
+	case srcElementSize == 0 || stagingElementSize == 0:
+		return fmt.Errorf("invalid element size, source: %v, staging: %v", srcElementSize, stagingElementSize)
+	case covered < uint64(srcElementSize):
+		return fmt.Errorf("%v staging images with element size: %v cover %v bytes, less than the source element size: %v", count, stagingElementSize, covered, srcElementSize)
+	case covered-uint64(stagingElementSize) >= uint64(srcElementSize):
+		return fmt.Errorf("%v staging images with element size: %v cover %v bytes, more staging images than needed for the source element size: %v", count, stagingElementSize, covered, srcElementSize)
+	}
+	return nil
+}
+
+// ipStagingImageCount returns the number of staging images with the given
+// element size needed to hold the elements of the given source element size.
+func ipStagingImageCount(srcElementSize, stagingElementSize uint32) uint32 {
+	if stagingElementSize == 0 {
+		return 0
+	}
+	return (srcElementSize + stagingElementSize - 1) / stagingElementSize
+}
+
+// ipImageViewType returns the type of the views of a single subresource of an
+// image of the given type.
+func ipImageViewType(imgType VkImageType) VkImageViewType {
+	switch imgType {
+	case VkImageType_VK_IMAGE_TYPE_1D:
+		return VkImageViewType_VK_IMAGE_VIEW_TYPE_1D
+	case VkImageType_VK_IMAGE_TYPE_2D:
+		return VkImageViewType_VK_IMAGE_VIEW_TYPE_2D
+	case VkImageType_VK_IMAGE_TYPE_3D:
+		return VkImageViewType_VK_IMAGE_VIEW_TYPE_3D
+	}
+	return VkImageViewType_VK_IMAGE_VIEW_TYPE_2D
+}
+
+// createImageViewForImageSubresource creates an image view in the given format
+// for the given subresource of the given image. If usage is not 0, the usage of
+// the view is restricted to it, see ipImageViewUsagePNext.
 func (p *imagePrimer) createImageViewForImageSubresource(
-	img ImageObjectʳ, aspect VkImageAspectFlagBits, layer, level uint32, imgViewType VkImageViewType) (ImageViewObjectʳ, func(), error) {
+	img ImageObjectʳ, format VkFormat, aspect VkImageAspectFlagBits, layer, level uint32, imgViewType VkImageViewType, usage VkImageUsageFlags) (ImageViewObjectʳ, func(), error) {
 
 	if img.IsNil() {
 		return ImageViewObjectʳ{}, func() {}, log.Errf(p.sb.ctx, fmt.Errorf("Nil Image object"), "[Creating image view]")
@@ -220,22 +1496,18 @@ func (p *imagePrimer) createImageViewForImageSubresource(
 	imgView := VkImageView(newUnusedID(true, func(x uint64) bool {
 		return GetState(p.sb.newState).ImageViews().Contains(VkImageView(x))
 	}))
+	pNext := ipImageViewUsagePNext(p.sb, img, usage)
 	p.sb.write(p.sb.cb.VkCreateImageView(
 		img.Device(),
 		NewVkImageViewCreateInfoᶜᵖ(p.sb.MustAllocReadData(
 			NewVkImageViewCreateInfo(p.sb.ta,
 				VkStructureType_VK_STRUCTURE_TYPE_IMAGE_VIEW_CREATE_INFO, // sType
-				0,                  // pNext
-				0,                  // flags
-				img.VulkanHandle(), // image
-				imgViewType,        // viewType
-				img.Info().Fmt(),   // format
-				NewVkComponentMapping(p.sb.ta, // components
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // r
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // g
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // b
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // a
-				),
+				pNext,                               // pNext
+				0,                                   // flags
+				img.VulkanHandle(),                  // image
+				imgViewType,                         // viewType
+				format,                              // format
+				ipIdentityComponentMapping(p.sb.ta), // components
 				NewVkImageSubresourceRange(p.sb.ta, // subresourceRange
 					VkImageAspectFlags(aspect), // aspectMask
 					level,                      // baseMipLevel
@@ -254,6 +1526,63 @@ func (p *imagePrimer) createImageViewForImageSubresource(
 	return GetState(p.sb.newState).ImageViews().Get(imgView), free, nil
 }
 
+// ipImageViewUsagePNext returns the pNext chain for creating an image view of
+// the given image with its usage restricted to the given usage. Drivers may
+// validate that the format of a view supports all the usages of the image,
+// which may not hold for e.g. a storage view of an image with broad usage.
+// Returns a null pointer if the usage does not restrict the image's usage, or
+// VK_KHR_maintenance2 is not enabled on the image's device.
+func ipImageViewUsagePNext(sb *stateBuilder, img ImageObjectʳ, usage VkImageUsageFlags) Voidᶜᵖ {
+	restricted := ipImageViewUsage(sb, img, usage)
+	if restricted == img.Info().Usage() {
+		return NewVoidᶜᵖ(memory.Nullptr)
+	}
+	return NewVoidᶜᵖ(sb.MustAllocReadData(
+		NewVkImageViewUsageCreateInfoKHR(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_IMAGE_VIEW_USAGE_CREATE_INFO_KHR, // sType
+			0,          // pNext
+			restricted, // usage
+		),
+	).Ptr())
+}
+
+// ipImageViewUsage returns the usage of the image views of the given image
+// created with the pNext chain of ipImageViewUsagePNext for the given usage,
+// which is the usage of the image if it is not restricted.
+func ipImageViewUsage(sb *stateBuilder, img ImageObjectʳ, usage VkImageUsageFlags) VkImageUsageFlags {
+	restricted := usage & img.Info().Usage()
+	if restricted == 0 || restricted == img.Info().Usage() {
+		return img.Info().Usage()
+	}
+	dev := GetState(sb.newState).Devices().Get(img.Device())
+	if dev.IsNil() {
+		return img.Info().Usage()
+	}
+	for _, ext := range dev.EnabledExtensions().All() {
+		if ext == "VK_KHR_maintenance2" {
+			return restricted
+		}
+	}
+	return img.Info().Usage()
+}
+
+// ipIdentityComponentMapping returns the component mapping of all the image
+// views created by the image primer. The image data is primed in the order the
+// channels are stored in the image's format, regardless of the swizzles of the
+// views through which the captured application samples the image: the staging
+// data is unpacked by channel, see unpackData, and the views for rendering and
+// storing the primed data never swizzle the channels. So the primed image holds
+// the same raw data as the captured one, and the captured views apply their own
+// swizzles on top of it as in the capture.
+func ipIdentityComponentMapping(a arena.Arena) VkComponentMapping {
+	return NewVkComponentMapping(a,
+		VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // r
+		VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // g
+		VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // b
+		VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // a
+	)
+}
+
 type ipLayoutInfo interface {
 	layoutOf(aspect VkImageAspectFlagBits, layer, level uint32) VkImageLayout
 }
@@ -266,40 +1595,246 @@ func (i *ipLayoutInfoFromImage) layoutOf(aspect VkImageAspectFlagBits, layer, le
 	if _, ok := i.img.Aspects().Lookup(aspect); !ok {
 		return VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
 	}
-	if _, ok := i.img.Aspects().Get(aspect).Layers().Lookup(layer); !ok {
-		return VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
+	if _, ok := i.img.Aspects().Get(aspect).Layers().Lookup(layer); !ok {
+		return VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
+	}
+	if _, ok := i.img.Aspects().Get(aspect).Layers().Get(layer).Levels().Lookup(level); !ok {
+		return VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
+	}
+	return i.img.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level).Layout()
+}
+
+func sameLayoutsOfImage(img ImageObjectʳ) ipLayoutInfo {
+	return &ipLayoutInfoFromImage{img: img}
+}
+
+// layoutsInNewState returns the layout info of the given image in the new
+// state, i.e. the current layouts of the rebuilt image, to be passed to prime()
+// as the source layouts. Layouts of subresources not in the new state, or of
+// an image not in the new state, are UNDEFINED.
+func (p *imagePrimer) layoutsInNewState(img VkImage) ipLayoutInfo {
+	newStateImgObj := GetState(p.sb.newState).Images().Get(img)
+	if newStateImgObj.IsNil() {
+		return useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED)
+	}
+	return sameLayoutsOfImage(newStateImgObj)
+}
+
+// layoutsInOldState returns the layout info of the given image in the old
+// state, i.e. the captured layouts the rebuilt image should end up in, to be
+// passed to prime() as the destination layouts. Layouts of subresources not
+// in the old state, or of an image not in the old state, are UNDEFINED.
+func (p *imagePrimer) layoutsInOldState(img VkImage) ipLayoutInfo {
+	oldStateImgObj := GetState(p.sb.oldState).Images().Get(img)
+	if oldStateImgObj.IsNil() {
+		return useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED)
+	}
+	return sameLayoutsOfImage(oldStateImgObj)
+}
+
+// dstLayoutsOf returns the layout info of the given image to be passed to
+// prime() as the destination layouts when the state is rebuilt: the layouts
+// in the old state, overridden by the ranges in dstLayouts of the image.
+func (p *imagePrimer) dstLayoutsOf(img VkImage) ipLayoutInfo {
+	if overrides, ok := p.dstLayouts[img]; ok {
+		return &ipLayoutInfoWithOverrides{overrides: overrides, base: p.layoutsInOldState(img)}
+	}
+	return p.layoutsInOldState(img)
+}
+
+// ipLayoutInfoWithOverrides is a layout info whose layouts are the ones of the
+// base layout info, except for the subresources in the ranges of the
+// overrides, whose layouts are the ones of the ranges. The subresources whose
+// layouts in the base are UNDEFINED are not primed, so they are not
+// overridden.
+type ipLayoutInfoWithOverrides struct {
+	overrides *ipLayoutInfoFromRanges
+	base      ipLayoutInfo
+}
+
+func (i *ipLayoutInfoWithOverrides) layoutOf(aspect VkImageAspectFlagBits, layer, level uint32) VkImageLayout {
+	layout := i.base.layoutOf(aspect, layer, level)
+	if layout == VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED {
+		return layout
+	}
+	if override := i.overrides.layoutOf(aspect, layer, level); override != VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED {
+		return override
+	}
+	return layout
+}
+
+type ipLayoutInfoFromLayout struct {
+	layout VkImageLayout
+}
+
+func (i *ipLayoutInfoFromLayout) layoutOf(aspect VkImageAspectFlagBits, layer, level uint32) VkImageLayout {
+	return i.layout
+}
+
+func useSpecifiedLayout(layout VkImageLayout) ipLayoutInfo {
+	return &ipLayoutInfoFromLayout{layout: layout}
+}
+
+// ipLayoutRange is a range of layers and levels of an aspect, and the layout
+// of the subresources in it. The ends are exclusive.
+type ipLayoutRange struct {
+	layerBegin, layerEnd uint32
+	levelBegin, levelEnd uint32
+	layout               VkImageLayout
+}
+
+// ipLayoutInfoFromRanges is a layout info backed by a list of subresource
+// ranges for each aspect, for specifying different layouts for different
+// subresources without an entry for each subresource. Ranges set later
+// override the ranges set before them, and the layout of a subresource not in
+// any range is the default layout.
+type ipLayoutInfoFromRanges struct {
+	defaultLayout VkImageLayout
+	ranges        map[VkImageAspectFlagBits][]ipLayoutRange
+}
+
+func (i *ipLayoutInfoFromRanges) layoutOf(aspect VkImageAspectFlagBits, layer, level uint32) VkImageLayout {
+	ranges := i.ranges[aspect]
+	for j := len(ranges) - 1; j >= 0; j-- {
+		r := ranges[j]
+		if layer >= r.layerBegin && layer < r.layerEnd && level >= r.levelBegin && level < r.levelEnd {
+			return r.layout
+		}
+	}
+	return i.defaultLayout
+}
+
+// setLayout sets the layout of the subresources in the given range, for each
+// aspect in the range's aspect mask, and returns the layout info so calls can
+// be chained. A layer or level count that runs past the maximum value, e.g.
+// VK_REMAINING_ARRAY_LAYERS or VK_REMAINING_MIP_LEVELS, covers all the layers
+// or levels from the base one. Empty ranges are ignored.
+func (i *ipLayoutInfoFromRanges) setLayout(rng VkImageSubresourceRange, layout VkImageLayout) *ipLayoutInfoFromRanges {
+	r := ipLayoutRange{
+		layerBegin: rng.BaseArrayLayer(),
+		layerEnd:   ipRangeEnd(rng.BaseArrayLayer(), rng.LayerCount()),
+		levelBegin: rng.BaseMipLevel(),
+		levelEnd:   ipRangeEnd(rng.BaseMipLevel(), rng.LevelCount()),
+		layout:     layout,
+	}
+	if r.layerBegin == r.layerEnd || r.levelBegin == r.levelEnd {
+		return i
+	}
+	mask := uint32(rng.AspectMask())
+	for bit := uint32(1); bit != 0 && bit <= mask; bit <<= 1 {
+		if mask&bit == 0 {
+			continue
+		}
+		aspect := VkImageAspectFlagBits(bit)
+		i.ranges[aspect] = append(i.ranges[aspect], r)
+	}
+	return i
+}
+
+// ipCoalescedLayoutRanges returns the ranges covering the given numbers of
+// layers and levels, with the layouts given by layoutOf. If all the
+// subresources have the same layout, a single range covers all of them, so
+// they can be transitioned with one barrier. Otherwise, there is one range for
+// each subresource, ordered by layer, then level.
+func ipCoalescedLayoutRanges(layers, levels uint32, layoutOf func(layer, level uint32) VkImageLayout) []ipLayoutRange {
+	if layers == 0 || levels == 0 {
+		return []ipLayoutRange{}
+	}
+	ranges := make([]ipLayoutRange, 0, layers*levels)
+	uniform := true
+	for layer := uint32(0); layer < layers; layer++ {
+		for level := uint32(0); level < levels; level++ {
+			layout := layoutOf(layer, level)
+			if len(ranges) > 0 && layout != ranges[0].layout {
+				uniform = false
+			}
+			ranges = append(ranges, ipLayoutRange{
+				layerBegin: layer,
+				layerEnd:   layer + 1,
+				levelBegin: level,
+				levelEnd:   level + 1,
+				layout:     layout,
+			})
+		}
+	}
+	if uniform {
+		return []ipLayoutRange{{
+			layerEnd: layers,
+			levelEnd: levels,
+			layout:   ranges[0].layout,
+		}}
 	}
-	if _, ok := i.img.Aspects().Get(aspect).Layers().Get(layer).Levels().Lookup(level); !ok {
-		return VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
+	return ranges
+}
+
+// ipRangeEnd returns the exclusive end of a range with the given base and
+// count, clamped to the maximum uint32 value.
+func ipRangeEnd(base, count uint32) uint32 {
+	if count > ^uint32(0)-base {
+		return ^uint32(0)
 	}
-	return i.img.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level).Layout()
+	return base + count
 }
 
-func sameLayoutsOfImage(img ImageObjectʳ) ipLayoutInfo {
-	return &ipLayoutInfoFromImage{img: img}
+// useLayoutsOfRanges returns a layout info whose layouts are set by ranges with
+// setLayout, and are the given default layout outside of the ranges.
+func useLayoutsOfRanges(defaultLayout VkImageLayout) *ipLayoutInfoFromRanges {
+	return &ipLayoutInfoFromRanges{
+		defaultLayout: defaultLayout,
+		ranges:        map[VkImageAspectFlagBits][]ipLayoutRange{},
+	}
 }
 
-type ipLayoutInfoFromLayout struct {
+// ipLayoutInfoForPrimed is a layout info whose layouts are the given layout,
+// except for the subresources whose layouts in the wrapped layout info are
+// UNDEFINED, which are not primed.
+type ipLayoutInfoForPrimed struct {
 	layout VkImageLayout
+	dst    ipLayoutInfo
 }
 
-func (i *ipLayoutInfoFromLayout) layoutOf(aspect VkImageAspectFlagBits, layer, level uint32) VkImageLayout {
+func (i *ipLayoutInfoForPrimed) layoutOf(aspect VkImageAspectFlagBits, layer, level uint32) VkImageLayout {
+	if i.dst.layoutOf(aspect, layer, level) == VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED {
+		return VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
+	}
 	return i.layout
 }
 
-func useSpecifiedLayout(layout VkImageLayout) ipLayoutInfo {
-	return &ipLayoutInfoFromLayout{layout: layout}
+// leaveInLayout returns a layout info that leaves the subresources primed with
+// the given destination layouts in the given layout instead.
+func leaveInLayout(layout VkImageLayout, dstLayout ipLayoutInfo) ipLayoutInfo {
+	return &ipLayoutInfoForPrimed{layout: layout, dst: dstLayout}
 }
 
 // In-shader image store handler
 type ipImageStoreHandler struct {
-	sb              *stateBuilder
+	sb *stateBuilder
+	// The descriptor set layouts, descriptor pools, pipeline layouts,
+	// pipelines and shader modules are cached for the lifetime of the handler.
+	// They are not scratch resources, so flushing the scratch resources does
+	// not invalidate them, and they are only destroyed in free. Descriptor sets
+	// are not cached, see store.
 	descSetLayouts  map[VkDevice]VkDescriptorSetLayout
 	descPools       map[VkDevice]VkDescriptorPool
-	descSets        map[VkDevice]VkDescriptorSet
 	pipelineLayouts map[VkDevice]VkPipelineLayout
 	pipelines       map[ipImageStoreShaderInfo]ComputePipelineObjectʳ
 	shaders         map[ipImageStoreShaderInfo]ShaderModuleObjectʳ
+	// blitDescSetLayouts and blitPipelineLayouts are the layouts of the blit
+	// jobs, whose input image is a combined image sampler, see
+	// ipImageBlitDescriptorTypes. samplers are the samplers of their input
+	// images. They are cached the same way as the layouts of the store jobs.
+	blitDescSetLayouts  map[VkDevice]VkDescriptorSetLayout
+	blitPipelineLayouts map[VkDevice]VkPipelineLayout
+	samplers            map[VkDevice]VkSampler
+	// spirvCacheDir, if not empty, is the directory the generated SPIR-V of
+	// the shaders is loaded from and saved to, see ipLoadOrGenerateSpirv.
+	spirvCacheDir string
+	// dumpShadersDir, if not empty, is the directory the SPIR-V binary of each
+	// created shader module is written to, see dumpShader.
+	dumpShadersDir string
+	// pendingDescSets are the numbers of descriptor sets allocated for the
+	// store jobs which have not been executed yet.
+	pendingDescSets ipPendingDescSets
 }
 
 type ipImageStoreJob struct {
@@ -308,6 +1843,13 @@ type ipImageStoreJob struct {
 	output     ImageViewObjectʳ
 	offset     VkOffset3D
 	extent     VkExtent3D
+	// sampledInput is true if the input image view is sampled instead of
+	// being loaded as a storage image, so the data can be converted between
+	// any pair of formats, see ipComputeBlitShaderSpirv. The input must be in
+	// SHADER_READ_ONLY_OPTIMAL layout.
+	sampledInput bool
+	// logCtx is the context of the logs of the job.
+	logCtx ipLogContext
 }
 
 type ipImageStoreShaderInfo struct {
@@ -317,6 +1859,89 @@ type ipImageStoreShaderInfo struct {
 	outputFormat VkFormat
 	outputAspect VkImageAspectFlagBits
 	imgType      VkImageType
+	// sampledInput is true if the input image is a combined image sampler,
+	// see ipImageStoreJob.
+	sampledInput bool
+	// entryPoint is the name of the entry point of the shader, see
+	// ipShaderEntryPoint.
+	entryPoint string
+	// specConstants are the values of the specialization constants of the
+	// pipeline. They do not change the shader module.
+	specConstants ipSpecConstants
+	// dispatchBase is true if the pipeline is dispatched with non-zero base
+	// work group offsets, see ipDispatchBase. It does not change the shader
+	// module.
+	dispatchBase bool
+}
+
+// ipMaxSpecConstants is the maximum number of specialization constants of an
+// image primer pipeline.
+const ipMaxSpecConstants = 4
+
+// ipSpecConstants are the 32-bit values of the specialization constants of an
+// image primer pipeline, the constant ID of each value is its index. The
+// values are kept in an array so the shader infos can index pipelines.
+type ipSpecConstants struct {
+	count  int
+	values [ipMaxSpecConstants]uint32
+}
+
+// newIPSpecConstants returns the specialization constants of the given values.
+func newIPSpecConstants(values ...uint32) (ipSpecConstants, error) {
+	c := ipSpecConstants{count: len(values)}
+	if len(values) > ipMaxSpecConstants {
+		return ipSpecConstants{}, fmt.Errorf("%v specialization constants given, at most %v are supported", len(values), ipMaxSpecConstants)
+	}
+	copy(c.values[:], values)
+	return c, nil
+}
+
+// data returns the data block of the specialization constants in the given
+// byte order.
+func (c ipSpecConstants) data(endian device.Endian) []uint8 {
+	return ipUint32sData(endian, c.values[:c.count])
+}
+
+// mapEntries returns the map entries of the specialization constants in the
+// data block returned by data.
+func (c ipSpecConstants) mapEntries(a arena.Arena) []VkSpecializationMapEntry {
+	entries := make([]VkSpecializationMapEntry, 0, c.count)
+	for i := 0; i < c.count; i++ {
+		entries = append(entries, NewVkSpecializationMapEntry(a,
+			uint32(i),   // constantID
+			uint32(i*4), // offset
+			4,           // size
+		))
+	}
+	return entries
+}
+
+// specializationInfo allocates the specialization info of the constants, or
+// returns a null pointer if there are no constants.
+func (c ipSpecConstants) specializationInfo(sb *stateBuilder) VkSpecializationInfoᶜᵖ {
+	if c.count == 0 {
+		return NewVkSpecializationInfoᶜᵖ(memory.Nullptr)
+	}
+	data := c.data(ipEndian(sb))
+	return NewVkSpecializationInfoᶜᵖ(sb.MustAllocReadData(NewVkSpecializationInfo(sb.ta,
+		uint32(c.count), // mapEntryCount
+		NewVkSpecializationMapEntryᶜᵖ(sb.MustAllocReadData(c.mapEntries(sb.ta)).Ptr()), // pMapEntries
+		memory.Size(len(data)),                      // dataSize
+		NewVoidᶜᵖ(sb.MustAllocReadData(data).Ptr()), // pData
+	)).Ptr())
+}
+
+// ipDefaultShaderEntryPoint is the entry point name of the shaders generated
+// by the image primer.
+const ipDefaultShaderEntryPoint = "main"
+
+// ipShaderEntryPoint returns the given entry point name of a shader, or the
+// default one if the given name is empty.
+func ipShaderEntryPoint(name string) string {
+	if name == "" {
+		return ipDefaultShaderEntryPoint
+	}
+	return name
 }
 
 const (
@@ -326,8 +1951,207 @@ const (
 	specMaxComputeGroupCountX        = 65536
 	specMaxComputeGroupCountY        = 65536
 	specMaxComputeGroupCountZ        = 65536
+	// ipImageStorePushConstantStages are the stages the store metadata is
+	// pushed to. The push constant range of the store pipeline layouts must
+	// declare the same stages as the push constant commands.
+	ipImageStorePushConstantStages = VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_COMPUTE_BIT)
+)
+
+// The specialization constant IDs of the image store shaders, see
+// ipImageStoreSpecConstants.
+const (
+	ipImageStoreSpecWorkGroupSizeX = iota
+	ipImageStoreSpecWorkGroupSizeY
+	ipImageStoreSpecWorkGroupSizeZ
+	ipImageStoreSpecChannelCount
 )
 
+// ipImageStoreWorkGroupSize returns the local work group size of the image
+// store pipelines for images of the given type. The sizes do not exceed the
+// spec required minimums of maxComputeWorkGroupSize and
+// maxComputeWorkGroupInvocations, so all devices support them.
+func ipImageStoreWorkGroupSize(imgType VkImageType) [3]uint32 {
+	switch imgType {
+	case VkImageType_VK_IMAGE_TYPE_2D:
+		return [3]uint32{8, 8, 1}
+	case VkImageType_VK_IMAGE_TYPE_3D:
+		return [3]uint32{4, 4, 4}
+	}
+	return [3]uint32{64, 1, 1}
+}
+
+// ipImageStoreChannelCount returns the number of channels of the given format
+// written by the image store shaders, the other channels are written with
+// the default values (0, 0, 0, 1). Returns 4 if the channels of the format are
+// unknown.
+func ipImageStoreChannelCount(format VkFormat) uint32 {
+	f, err := getImageFormatFromVulkanFormat(format)
+	if err != nil || f.GetUncompressed() == nil {
+		return 4
+	}
+	if n := len(f.GetUncompressed().GetFormat().GetComponents()); n > 0 && n < 4 {
+		return uint32(n)
+	}
+	return 4
+}
+
+// ipImageStoreSpecConstants returns the specialization constants of the image
+// store pipeline storing to the given output format and image type: the local
+// work group size and the channel count of the output. A single shader module
+// is shared by the pipelines with different constants, see
+// getOrCreateShaderModule.
+func ipImageStoreSpecConstants(outputFormat VkFormat, imgType VkImageType) (ipSpecConstants, error) {
+	values := make([]uint32, ipImageStoreSpecChannelCount+1)
+	size := ipImageStoreWorkGroupSize(imgType)
+	values[ipImageStoreSpecWorkGroupSizeX] = size[0]
+	values[ipImageStoreSpecWorkGroupSizeY] = size[1]
+	values[ipImageStoreSpecWorkGroupSizeZ] = size[2]
+	values[ipImageStoreSpecChannelCount] = ipImageStoreChannelCount(outputFormat)
+	return newIPSpecConstants(values...)
+}
+
+// ipImageStoreDescriptorTypes are the descriptor types of the bindings of the
+// store descriptor set layout. Both the output and the input images are
+// accessed with imageLoad/imageStore in the store shaders, so both are storage
+// images.
+var ipImageStoreDescriptorTypes = map[uint32]VkDescriptorType{
+	ipImageStoreOutputImageBinding:   VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE,
+	ipImageStoreInputImageBinding:    VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE,
+	ipImageStoreUniformBufferBinding: VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_BUFFER,
+}
+
+// ipImageBlitDescriptorTypes are the descriptor types of the bindings of the
+// blit descriptor set layout. The output image is accessed with imageStore,
+// and the input image is read with texelFetch in the blit shaders.
+var ipImageBlitDescriptorTypes = map[uint32]VkDescriptorType{
+	ipImageStoreOutputImageBinding:   VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE,
+	ipImageStoreInputImageBinding:    VkDescriptorType_VK_DESCRIPTOR_TYPE_COMBINED_IMAGE_SAMPLER,
+	ipImageStoreUniformBufferBinding: VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_BUFFER,
+}
+
+// ipImageStoreDescriptorTypesOf returns the descriptor types of the bindings
+// of the store jobs, or of the blit jobs if sampledInput is true.
+func ipImageStoreDescriptorTypesOf(sampledInput bool) map[uint32]VkDescriptorType {
+	if sampledInput {
+		return ipImageBlitDescriptorTypes
+	}
+	return ipImageStoreDescriptorTypes
+}
+
+// ipImageStoreInputLayout returns the layout of the input image of the store
+// jobs, or of the blit jobs if sampledInput is true.
+func ipImageStoreInputLayout(sampledInput bool) VkImageLayout {
+	if sampledInput {
+		return VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL
+	}
+	return VkImageLayout_VK_IMAGE_LAYOUT_GENERAL
+}
+
+// ipCheckSampledInput returns an error if the given job samples its input
+// image view, but the image of the view lacks SAMPLED usage, so the view can
+// not be bound as a combined image sampler.
+func ipCheckSampledInput(job ipImageStoreJob) error {
+	if !job.sampledInput {
+		return nil
+	}
+	img := job.input.Image()
+	if img.IsNil() {
+		return fmt.Errorf("Nil image of the sampled input image view: %v", job.input.VulkanHandle())
+	}
+	if img.Info().Usage()&VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT) == 0 {
+		return fmt.Errorf("Image: %v of the sampled input image view: %v lacks SAMPLED usage", img.VulkanHandle(), job.input.VulkanHandle())
+	}
+	return nil
+}
+
+// ipDispatchTile is a region of the extent of an image store job to be
+// dispatched in one dispatch command.
+type ipDispatchTile struct {
+	base  [3]uint32
+	count [3]uint32
+}
+
+// ipDispatchTiles splits the given extent into tiles, whose size in each
+// dimension does not exceed the given max group count of the dimension. The
+// tiles are ordered by z, then y, then x of their base.
+func ipDispatchTiles(extent, maxCounts [3]uint32) []ipDispatchTile {
+	tiles := []ipDispatchTile{}
+	for z := uint32(0); z < extent[2]; z += maxCounts[2] {
+		for y := uint32(0); y < extent[1]; y += maxCounts[1] {
+			for x := uint32(0); x < extent[0]; x += maxCounts[0] {
+				base := [3]uint32{x, y, z}
+				tile := ipDispatchTile{base: base}
+				for i := range base {
+					tile.count[i] = extent[i] - base[i]
+					if tile.count[i] > maxCounts[i] {
+						tile.count[i] = maxCounts[i]
+					}
+				}
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+	return tiles
+}
+
+// ipWorkGroupCounts returns the numbers of work groups of the given size to
+// cover the given extent.
+func ipWorkGroupCounts(extent, groupSize [3]uint32) [3]uint32 {
+	counts := [3]uint32{}
+	for i := range counts {
+		counts[i] = (extent[i] + groupSize[i] - 1) / groupSize[i]
+	}
+	return counts
+}
+
+// ipDispatchTileCmd returns the command to dispatch the given tile with the
+// given dispatch base command. Without a dispatch base command, the tile is
+// dispatched from the zero base, and its base offsets are expected to be
+// passed through the push constants, see ipPushedTileBase.
+func ipDispatchTileCmd(cb CommandBuilder, commandBuffer VkCommandBuffer, dispatchBase ipDispatchBaseCommand, tile ipDispatchTile) api.Cmd {
+	switch dispatchBase {
+	case ipDispatchBaseCore:
+		return cb.VkCmdDispatchBase(commandBuffer,
+			tile.base[0], tile.base[1], tile.base[2],
+			tile.count[0], tile.count[1], tile.count[2])
+	case ipDispatchBaseKHR:
+		return cb.VkCmdDispatchBaseKHR(commandBuffer,
+			tile.base[0], tile.base[1], tile.base[2],
+			tile.count[0], tile.count[1], tile.count[2])
+	default:
+		return cb.VkCmdDispatch(commandBuffer, tile.count[0], tile.count[1], tile.count[2])
+	}
+}
+
+// ipPushedTileBase returns the base work group offsets of the given tile to be
+// passed through the push constants. They are zero if the tile is dispatched with a
+// dispatch base command, as the base work group offsets are then already
+// included in the global invocation IDs.
+func ipPushedTileBase(dispatchBase ipDispatchBaseCommand, tile ipDispatchTile) [3]uint32 {
+	if dispatchBase != ipDispatchBaseUnsupported {
+		return [3]uint32{}
+	}
+	return tile.base
+}
+
+// maxComputeGroupCounts returns the max compute work group counts of a single
+// dispatch command of the given device, or the spec required minimums if the
+// device limits are not known.
+func (h *ipImageStoreHandler) maxComputeGroupCounts(dev VkDevice) [3]uint32 {
+	counts := [3]uint32{specMaxComputeGroupCountX, specMaxComputeGroupCountY, specMaxComputeGroupCountZ}
+	devObj := h.sb.s.Devices().Get(dev)
+	if devObj.IsNil() || !h.sb.s.PhysicalDevices().Contains(devObj.PhysicalDevice()) {
+		return counts
+	}
+	limits := h.sb.s.PhysicalDevices().Get(devObj.PhysicalDevice()).PhysicalDeviceProperties().Limits()
+	for i := range counts {
+		if c := limits.MaxComputeWorkGroupCount().Get(i); c != 0 {
+			counts[i] = c
+		}
+	}
+	return counts
+}
+
 // Interfaces of image store handler to interact with image primer
 
 func newImagePrimerStoreHandler(sb *stateBuilder) *ipImageStoreHandler {
@@ -335,17 +2159,60 @@ func newImagePrimerStoreHandler(sb *stateBuilder) *ipImageStoreHandler {
 		sb:              sb,
 		descSetLayouts:  map[VkDevice]VkDescriptorSetLayout{},
 		descPools:       map[VkDevice]VkDescriptorPool{},
-		descSets:        map[VkDevice]VkDescriptorSet{},
 		pipelineLayouts: map[VkDevice]VkPipelineLayout{},
 		pipelines:       map[ipImageStoreShaderInfo]ComputePipelineObjectʳ{},
 		shaders:         map[ipImageStoreShaderInfo]ShaderModuleObjectʳ{},
+		pendingDescSets: ipPendingDescSets{},
+
+		blitDescSetLayouts:  map[VkDevice]VkDescriptorSetLayout{},
+		blitPipelineLayouts: map[VkDevice]VkPipelineLayout{},
+		samplers:            map[VkDevice]VkSampler{},
+	}
+}
+
+// ipImageStoreMaxDescSets is the maximum number of descriptor sets allocated
+// for store jobs that are not executed yet, on each device.
+const ipImageStoreMaxDescSets = maxPendingScratchTasks
+
+// ipPendingDescSets are the numbers of descriptor sets allocated on each
+// device for the store jobs which have not been executed yet.
+type ipPendingDescSets map[VkDevice]int
+
+// reserve counts a new descriptor set to be allocated on the given device, and
+// returns true if the pending jobs must be executed first to free their
+// descriptor sets, as the descriptor pool has room for at most
+// ipImageStoreMaxDescSets of them.
+func (p ipPendingDescSets) reserve(dev VkDevice) bool {
+	full := p[dev] >= ipImageStoreMaxDescSets
+	p[dev]++
+	return full
+}
+
+// release counts a descriptor set allocated on the given device as freed, once
+// its store job is executed.
+func (p ipPendingDescSets) release(dev VkDevice) {
+	if p[dev] > 0 {
+		p[dev]--
 	}
 }
 
+// store records the commands to store the job's input data to its output image
+// in a scratch task on the given queue. The task is committed, but the queue
+// family scratch resources are not flushed, so the caller can record multiple
+// store jobs and flush once.
 func (h *ipImageStoreHandler) store(job ipImageStoreJob, queue VkQueue) error {
+	ctx := job.logCtx.bind(h.sb.ctx)
 	var err error
 
+	if err := ipCheckSampledInput(job); err != nil {
+		return log.Errf(ctx, err, "[Checking the input image view]")
+	}
 	dev := job.output.Device()
+	descTypes := ipImageStoreDescriptorTypesOf(job.sampledInput)
+	descSetLayouts, pipelineLayouts := h.descSetLayouts, h.pipelineLayouts
+	if job.sampledInput {
+		descSetLayouts, pipelineLayouts = h.blitDescSetLayouts, h.blitPipelineLayouts
+	}
 
 	if _, ok := h.descPools[dev]; !ok {
 		descPool := VkDescriptorPool(newUnusedID(true, func(x uint64) bool {
@@ -355,141 +2222,179 @@ func (h *ipImageStoreHandler) store(job ipImageStoreJob, queue VkQueue) error {
 			// for output image and input image
 			NewVkDescriptorPoolSize(h.sb.ta,
 				VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE, // Type
-				2, // descriptorCount
+				2*ipImageStoreMaxDescSets,                         // descriptorCount
+			),
+			// for input image of blit jobs
+			NewVkDescriptorPoolSize(h.sb.ta,
+				VkDescriptorType_VK_DESCRIPTOR_TYPE_COMBINED_IMAGE_SAMPLER, // Type
+				ipImageStoreMaxDescSets, // descriptorCount
 			),
 			// for image dimension info
 			NewVkDescriptorPoolSize(h.sb.ta,
 				VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_BUFFER, // Type
-				1, // descriptorCount
+				ipImageStoreMaxDescSets,                            // descriptorCount
 			),
 		}
 		vkCreateDescriptorPool(h.sb, dev, VkDescriptorPoolCreateFlags(
 			VkDescriptorPoolCreateFlagBits_VK_DESCRIPTOR_POOL_CREATE_FREE_DESCRIPTOR_SET_BIT),
-			1, descPoolSizes, descPool)
+			ipImageStoreMaxDescSets, descPoolSizes, descPool)
 		h.descPools[dev] = descPool
 	}
 	descPool := h.descPools[dev]
 
 	// create descriptor set layout
-	if _, ok := h.descSetLayouts[dev]; !ok {
+	if _, ok := descSetLayouts[dev]; !ok {
 		descSetLayoutHandle := VkDescriptorSetLayout(newUnusedID(true, func(x uint64) bool {
 			return GetState(h.sb.newState).DescriptorSetLayouts().Contains(VkDescriptorSetLayout(x))
 		}))
 		bindings := []VkDescriptorSetLayoutBinding{
 			NewVkDescriptorSetLayoutBinding(h.sb.ta,
-				ipImageStoreOutputImageBinding,                    // binding
-				VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE, // descriptorType
+				ipImageStoreOutputImageBinding,            // binding
+				descTypes[ipImageStoreOutputImageBinding], // descriptorType
 				1, // descriptorCount
 				VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_COMPUTE_BIT), // stageFlags
 				0, // pImmutableSamplers
 			),
 			NewVkDescriptorSetLayoutBinding(h.sb.ta,
-				ipImageStoreInputImageBinding,                            // binding
-				VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_TEXEL_BUFFER, // descriptorType
-				1, // descriptorCount
+				ipImageStoreInputImageBinding,            // binding
+				descTypes[ipImageStoreInputImageBinding], // descriptorType
+				1,                                        // descriptorCount
 				VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_COMPUTE_BIT), // stageFlags
 				0, // pImmutableSamplers
 			),
 			NewVkDescriptorSetLayoutBinding(h.sb.ta,
-				ipImageStoreUniformBufferBinding,                   // binding
-				VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_BUFFER, // descriptorType
+				ipImageStoreUniformBufferBinding,            // binding
+				descTypes[ipImageStoreUniformBufferBinding], // descriptorType
 				1, // descriptorCount
 				VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_COMPUTE_BIT), // stageFlags
 				0, // pImmutableSamplers
 			),
 		}
 		vkCreateDescriptorSetLayout(h.sb, dev, bindings, descSetLayoutHandle)
-		h.descSetLayouts[dev] = descSetLayoutHandle
+		descSetLayouts[dev] = descSetLayoutHandle
 	}
 
-	// allocate descriptor set
-	if _, ok := h.descSets[dev]; !ok {
-		descSet := VkDescriptorSet(newUnusedID(true, func(x uint64) bool {
-			return GetState(h.sb.newState).DescriptorSets().Contains(VkDescriptorSet(x))
-		}))
-		vkAllocateDescriptorSet(h.sb, dev, descPool, h.descSetLayouts[dev], descSet)
-		h.descSets[dev] = descSet
-	}
-	descSet := h.descSets[dev]
-
 	// Create compute pipeline
-	metaData := make([]uint32, 0, 6)
-	metaData = append(metaData,
-		uint32(job.offset.X()),
-		uint32(job.offset.Y()),
-		uint32(job.offset.Z()),
-		uint32(job.inputIndex),
-	)
-	var db bytes.Buffer
-	binary.Write(&db, binary.LittleEndian, metaData)
-	if _, ok := h.pipelineLayouts[dev]; !ok {
+	imgType := job.input.Image().Info().ImageType()
+	groupSize := ipImageStoreWorkGroupSize(imgType)
+	dispatchBase := ipDispatchBase(h.sb, dev)
+	// The metadata holds the offset of the first invocation of the tile, the
+	// index of the input image, and the end of the store extent, as the
+	// invocations of the last work groups may be out of the extent.
+	metaData := func(tile ipDispatchTile) []byte {
+		base := ipPushedTileBase(dispatchBase, tile)
+		data := []uint32{
+			uint32(job.offset.X()) + base[0]*groupSize[0],
+			uint32(job.offset.Y()) + base[1]*groupSize[1],
+			uint32(job.offset.Z()) + base[2]*groupSize[2],
+			uint32(job.inputIndex),
+			uint32(job.offset.X()) + job.extent.Width(),
+			uint32(job.offset.Y()) + job.extent.Height(),
+			uint32(job.offset.Z()) + job.extent.Depth(),
+		}
+		return ipUint32sData(ipEndian(h.sb), data)
+	}
+	metaDataSize := uint32(len(metaData(ipDispatchTile{})))
+	if _, ok := pipelineLayouts[dev]; !ok {
 		pipelineLayoutHandle := VkPipelineLayout(newUnusedID(true, func(x uint64) bool {
 			return GetState(h.sb.newState).PipelineLayouts().Contains(VkPipelineLayout(x))
 		}))
-		vkCreatePipelineLayout(h.sb, dev, []VkDescriptorSetLayout{h.descSetLayouts[dev]},
+		vkCreatePipelineLayout(h.sb, dev, []VkDescriptorSetLayout{descSetLayouts[dev]},
 			[]VkPushConstantRange{
 				NewVkPushConstantRange(h.sb.ta,
-					VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_FRAGMENT_BIT), // stageFlags
-					0,                       // offset
-					uint32(len(db.Bytes())), // size
+					ipImageStorePushConstantStages, // stageFlags
+					0,                              // offset
+					metaDataSize,                   // size
 				)}, pipelineLayoutHandle)
-		h.pipelineLayouts[dev] = pipelineLayoutHandle
+		pipelineLayouts[dev] = pipelineLayoutHandle
 	}
-	pipelineLayoutHandle := h.pipelineLayouts[dev]
+	pipelineLayoutHandle := pipelineLayouts[dev]
 
 	if job.input.Image().Info().ImageType() != job.output.Image().Info().ImageType() {
-		return log.Errf(h.sb.ctx, fmt.Errorf("input image type: %v != output image type: %v",
+		return log.Errf(ctx, fmt.Errorf("input image type: %v != output image type: %v",
 			job.input.Image().Info().ImageType(), job.output.Image().Info().ImageType()),
 			"[Checking compute pipeline shader info]")
 	}
+	specConstants, err := ipImageStoreSpecConstants(job.output.Fmt(), imgType)
+	if err != nil {
+		return log.Errf(ctx, err, "[Getting compute pipeline specialization constants]")
+	}
 	compShaderInfo := ipImageStoreShaderInfo{
-		dev:          dev,
-		inputFormat:  job.input.Fmt(),
-		inputAspect:  VkImageAspectFlagBits(job.input.SubresourceRange().AspectMask()),
-		outputFormat: job.output.Fmt(),
-		outputAspect: VkImageAspectFlagBits(job.output.SubresourceRange().AspectMask()),
-		imgType:      job.input.Image().Info().ImageType(),
+		dev:           dev,
+		inputFormat:   job.input.Fmt(),
+		inputAspect:   VkImageAspectFlagBits(job.input.SubresourceRange().AspectMask()),
+		outputFormat:  job.output.Fmt(),
+		outputAspect:  VkImageAspectFlagBits(job.output.SubresourceRange().AspectMask()),
+		imgType:       imgType,
+		sampledInput:  job.sampledInput,
+		specConstants: specConstants,
+		dispatchBase:  dispatchBase != ipDispatchBaseUnsupported,
 	}
 	pipeline, err := h.getOrCreateComputePipeline(compShaderInfo)
 	if err != nil {
-		return log.Errf(h.sb.ctx, err, "[Getting compute pipeline]")
+		return log.Errf(ctx, err, "[Getting compute pipeline]")
 	}
 
-	// Check store extent dimension.
-	// All the compute shader has local size:  local_size_x/y/z = 1, and we make
-	// each invocation to process one pixel. This means the dispatch group count
-	// in each dimension should equal to the store extent.
-	if specMaxComputeGroupCountX < job.extent.Width() {
-		return log.Errf(h.sb.ctx, fmt.Errorf("Extent.Width: %v too large", job.extent.Width()), "[Checking imageStore extent dimension]")
+	// Each invocation of the compute shaders processes one pixel, the local
+	// work group size is given by the specialization constants, see
+	// ipImageStoreWorkGroupSize. This means the dispatch group count in each
+	// dimension should be the store extent divided by the work group size,
+	// rounded up. Group counts exceeding the device's work group count limits
+	// are split into tiles, each is dispatched separately. The base offsets of
+	// the tiles are given to vkCmdDispatchBase if the device supports it,
+	// otherwise they are passed through the push constants, see
+	// ipDispatchTileCmd.
+	tiles := ipDispatchTiles(
+		ipWorkGroupCounts([3]uint32{job.extent.Width(), job.extent.Height(), job.extent.Depth()}, groupSize),
+		h.maxComputeGroupCounts(dev))
+
+	// allocate descriptor set. Each job uses its own descriptor set, as the
+	// descriptor set must not be updated before the commands of the previous
+	// jobs using it are executed, and a cached descriptor set could still refer
+	// to the image views of a previous job freed after it was executed. The
+	// descriptor sets are freed once the job is executed, and if too many of
+	// them are pending, all the scratch resources are flushed to reclaim them.
+	if h.pendingDescSets.reserve(dev) {
+		h.sb.flushAllScratchResources()
 	}
-	if specMaxComputeGroupCountY < job.extent.Height() {
-		return log.Errf(h.sb.ctx, fmt.Errorf("Extent.Height: %v too large", job.extent.Height()), "[Checking imageStore extent dimension]")
-	}
-	if specMaxComputeGroupCountZ < job.extent.Depth() {
-		return log.Errf(h.sb.ctx, fmt.Errorf("Extent.z: %v too large", job.extent.Depth()), "[Checking imageStore extent dimension]")
+	descSet := VkDescriptorSet(newUnusedID(true, func(x uint64) bool {
+		return GetState(h.sb.newState).DescriptorSets().Contains(VkDescriptorSet(x))
+	}))
+	vkAllocateDescriptorSet(h.sb, dev, descPool, descSetLayouts[dev], descSet)
+	sampler := VkSampler(0)
+	if job.sampledInput {
+		sampler = h.getOrCreateSampler(dev)
 	}
 
 	tsk := h.sb.newScratchTaskOnQueue(queue)
+	tsk.deferUntilExecuted(func() {
+		h.sb.write(h.sb.cb.VkFreeDescriptorSets(
+			dev, descPool, 1, NewVkDescriptorSetᶜᵖ(
+				h.sb.MustAllocReadData(descSet).Ptr()), VkResult_VK_SUCCESS))
+		h.pendingDescSets.release(dev)
+	})
 
 	// update descriptor sets
 	tsk.doOnCommitted(func() {
-		writeDescriptorSet(h.sb, dev, descSet, ipImageStoreOutputImageBinding, 0,
-			VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE, []VkDescriptorImageInfo{
-				NewVkDescriptorImageInfo(h.sb.ta,
-					0,                                     // Sampler
-					job.output.VulkanHandle(),             // ImageView
-					VkImageLayout_VK_IMAGE_LAYOUT_GENERAL, // ImageLayout
-				),
-			}, []VkDescriptorBufferInfo{}, []VkBufferView{},
-		)
-		writeDescriptorSet(h.sb, dev, descSet, ipImageStoreInputImageBinding, 0,
-			VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE, []VkDescriptorImageInfo{
-				NewVkDescriptorImageInfo(h.sb.ta,
-					0,                                     // Sampler
-					job.input.VulkanHandle(),              // ImageView
-					VkImageLayout_VK_IMAGE_LAYOUT_GENERAL, // ImageLayout
-				),
-			}, []VkDescriptorBufferInfo{}, []VkBufferView{},
+		writeDescriptorSets(h.sb, dev,
+			newDescriptorSetWrite(h.sb, descSet, ipImageStoreOutputImageBinding, 0,
+				descTypes[ipImageStoreOutputImageBinding], []VkDescriptorImageInfo{
+					NewVkDescriptorImageInfo(h.sb.ta,
+						0,                                     // Sampler
+						job.output.VulkanHandle(),             // ImageView
+						VkImageLayout_VK_IMAGE_LAYOUT_GENERAL, // ImageLayout
+					),
+				}, []VkDescriptorBufferInfo{}, []VkBufferView{},
+			),
+			newDescriptorSetWrite(h.sb, descSet, ipImageStoreInputImageBinding, 0,
+				descTypes[ipImageStoreInputImageBinding], []VkDescriptorImageInfo{
+					NewVkDescriptorImageInfo(h.sb.ta,
+						sampler,                  // Sampler
+						job.input.VulkanHandle(), // ImageView
+						ipImageStoreInputLayout(job.sampledInput), // ImageLayout
+					),
+				}, []VkDescriptorBufferInfo{}, []VkBufferView{},
+			),
 		)
 	})
 
@@ -507,29 +2412,36 @@ func (h *ipImageStoreHandler) store(job ipImageStoreJob, queue VkQueue) error {
 			0, 1, h.sb.MustAllocReadData(descSet).Ptr(),
 			0, NewU32ᶜᵖ(memory.Nullptr),
 		))
-		h.sb.write(h.sb.cb.VkCmdPushConstants(
-			commandBuffer,
-			pipelineLayoutHandle,
-			VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_COMPUTE_BIT),
-			0,
-			uint32(len(db.Bytes())),
-			NewCharᶜᵖ(h.sb.MustAllocReadData(db.Bytes()).Ptr()),
-		))
-		groupCountX := job.extent.Width()
-		groupCountY := job.extent.Height()
-		groupCountZ := job.extent.Depth()
-		h.sb.write(h.sb.cb.VkCmdDispatch(commandBuffer, groupCountX, groupCountY, groupCountZ))
+		for _, tile := range tiles {
+			data := metaData(tile)
+			h.sb.write(h.sb.cb.VkCmdPushConstants(
+				commandBuffer,
+				pipelineLayoutHandle,
+				ipImageStorePushConstantStages,
+				0,
+				uint32(len(data)),
+				NewCharᶜᵖ(h.sb.MustAllocReadData(data).Ptr()),
+			))
+			h.sb.write(ipDispatchTileCmd(h.sb.cb, commandBuffer, dispatchBase, tile))
+		}
 	})
 
 	// commit the task
 	if err := tsk.commit(); err != nil {
-		log.E(h.sb.ctx, "[Committing scratch task for priming storage image: %v by imageStore, image view subresource: %v ] %v", job.output.Image().VulkanHandle(), job.output.SubresourceRange(), err)
+		log.E(ctx, "[Committing scratch task for priming storage image: %v by imageStore, image view subresource: %v ] %v", job.output.Image().VulkanHandle(), job.output.SubresourceRange(), err)
 	}
-	h.sb.flushQueueFamilyScratchResources(tsk.queue)
 	return nil
 }
 
 func (h *ipImageStoreHandler) free() {
+	// The pending store jobs must be executed before their descriptor sets,
+	// pipelines, etc. are destroyed.
+	for _, n := range h.pendingDescSets {
+		if n > 0 {
+			h.sb.flushAllScratchResources()
+			break
+		}
+	}
 	for dev, p := range h.pipelines {
 		h.sb.write(h.sb.cb.VkDestroyPipeline(p.Device(), p.VulkanHandle(), memory.Nullptr))
 		delete(h.pipelines, dev)
@@ -542,6 +2454,10 @@ func (h *ipImageStoreHandler) free() {
 		h.sb.write(h.sb.cb.VkDestroyPipelineLayout(dev, l, memory.Nullptr))
 		delete(h.pipelineLayouts, dev)
 	}
+	for dev, l := range h.blitPipelineLayouts {
+		h.sb.write(h.sb.cb.VkDestroyPipelineLayout(dev, l, memory.Nullptr))
+		delete(h.blitPipelineLayouts, dev)
+	}
 	for dev, p := range h.descPools {
 		h.sb.write(h.sb.cb.VkDestroyDescriptorPool(dev, p, memory.Nullptr))
 		delete(h.descPools, dev)
@@ -550,6 +2466,14 @@ func (h *ipImageStoreHandler) free() {
 		h.sb.write(h.sb.cb.VkDestroyDescriptorSetLayout(dev, l, memory.Nullptr))
 		delete(h.descSetLayouts, dev)
 	}
+	for dev, l := range h.blitDescSetLayouts {
+		h.sb.write(h.sb.cb.VkDestroyDescriptorSetLayout(dev, l, memory.Nullptr))
+		delete(h.blitDescSetLayouts, dev)
+	}
+	for dev, smp := range h.samplers {
+		h.sb.write(h.sb.cb.VkDestroySampler(dev, smp, memory.Nullptr))
+		delete(h.samplers, dev)
+	}
 }
 
 // Internal functions of image store handler
@@ -566,7 +2490,11 @@ func (h *ipImageStoreHandler) getOrCreateComputePipeline(info ipImageStoreShader
 		return NilComputePipelineObjectʳ, log.Errf(h.sb.ctx, err, "[Getting compute shader module]")
 	}
 
-	if _, ok := h.pipelineLayouts[info.dev]; !ok {
+	pipelineLayouts := h.pipelineLayouts
+	if info.sampledInput {
+		pipelineLayouts = h.blitPipelineLayouts
+	}
+	if _, ok := pipelineLayouts[info.dev]; !ok {
 		return NilComputePipelineObjectʳ, log.Errf(h.sb.ctx, nil, "pipeline layout not found")
 	}
 
@@ -574,22 +2502,27 @@ func (h *ipImageStoreHandler) getOrCreateComputePipeline(info ipImageStoreShader
 		return GetState(h.sb.newState).ComputePipelines().Contains(VkPipeline(x))
 	}))
 
+	entryPoint := ipShaderEntryPoint(info.entryPoint)
+	flags := VkPipelineCreateFlags(0)
+	if info.dispatchBase {
+		flags |= VkPipelineCreateFlags(VkPipelineCreateFlagBits_VK_PIPELINE_CREATE_DISPATCH_BASE)
+	}
 	createInfo := NewVkComputePipelineCreateInfo(h.sb.ta,
 		VkStructureType_VK_STRUCTURE_TYPE_COMPUTE_PIPELINE_CREATE_INFO, // sType
-		0, // pNext
-		0, // flags
+		0,     // pNext
+		flags, // flags
 		NewVkPipelineShaderStageCreateInfo(h.sb.ta, // stage
 			VkStructureType_VK_STRUCTURE_TYPE_PIPELINE_SHADER_STAGE_CREATE_INFO, // sType
 			0, // pNext
 			0, // flags
-			VkShaderStageFlagBits_VK_SHADER_STAGE_COMPUTE_BIT, // stage
-			compShader.VulkanHandle(),                         // module
-			NewCharᶜᵖ(h.sb.MustAllocReadData("main").Ptr()),   // pName
-			NewVkSpecializationInfoᶜᵖ(memory.Nullptr),         // pSpecializationInfo
+			VkShaderStageFlagBits_VK_SHADER_STAGE_COMPUTE_BIT,   // stage
+			compShader.VulkanHandle(),                           // module
+			NewCharᶜᵖ(h.sb.MustAllocReadData(entryPoint).Ptr()), // pName
+			info.specConstants.specializationInfo(h.sb),         // pSpecializationInfo
 		),
-		h.pipelineLayouts[info.dev], // layout
-		0,                           // basePipelineHandle
-		0,                           // basePipelineIndex
+		pipelineLayouts[info.dev], // layout
+		0,                         // basePipelineHandle
+		0,                         // basePipelineIndex
 	)
 	h.sb.write(h.sb.cb.VkCreateComputePipelines(
 		info.dev, VkPipelineCache(0), uint32(1),
@@ -602,30 +2535,81 @@ func (h *ipImageStoreHandler) getOrCreateComputePipeline(info ipImageStoreShader
 }
 
 func (h *ipImageStoreHandler) getOrCreateShaderModule(info ipImageStoreShaderInfo) (ShaderModuleObjectʳ, error) {
+	// Pipelines that only differ in specialization constants or create flags
+	// share the same shader module.
+	info.specConstants = ipSpecConstants{}
+	info.dispatchBase = false
 	if m, ok := h.shaders[info]; ok {
 		return m, nil
 	}
 	handle := VkShaderModule(newUnusedID(true, func(x uint64) bool {
 		return GetState(h.sb.newState).ShaderModules().Contains(VkShaderModule(x))
 	}))
-	code, err := ipComputeShaderSpirv(info.outputFormat, info.outputAspect, info.inputFormat, info.inputAspect, info.imgType)
+	code, err := h.shaderSpirv(info)
 	if err != nil {
 		return NilShaderModuleObjectʳ, log.Errf(h.sb.ctx, err, "[Generating SPIR-V for: %v]", info)
 	}
 	if len(code) == 0 {
 		return NilShaderModuleObjectʳ, log.Errf(h.sb.ctx, nil, "no SPIR-V code generated")
 	}
+	if err := ipValidateShaderSpirv(code); err != nil {
+		return NilShaderModuleObjectʳ, log.Errf(h.sb.ctx, err, "[Validating generated SPIR-V for: %v]", info)
+	}
+	if h.dumpShadersDir != "" {
+		h.dumpShader(info)
+	}
 	vkCreateShaderModule(h.sb, info.dev, code, handle)
 	h.shaders[info] = GetState(h.sb.newState).ShaderModules().Get(handle)
 	return h.shaders[info], nil
 }
 
+// getOrCreateSampler returns the sampler of the input images of the blit jobs
+// on the given device. The blit shaders only read the input with texelFetch,
+// which ignores the filters and address modes, so one nearest sampler is
+// shared by all the blit jobs.
+func (h *ipImageStoreHandler) getOrCreateSampler(dev VkDevice) VkSampler {
+	if smp, ok := h.samplers[dev]; ok {
+		return smp
+	}
+	handle := VkSampler(newUnusedID(true, func(x uint64) bool {
+		return GetState(h.sb.newState).Samplers().Contains(VkSampler(x))
+	}))
+	vkCreateSampler(h.sb, dev, VkFilter_VK_FILTER_NEAREST, handle)
+	h.samplers[dev] = handle
+	return handle
+}
+
 // Input attachment -> image render handler
 
 type ipRenderJob struct {
 	inputAttachmentImages []ipRenderImage
 	renderTarget          ipRenderImage
 	inputFormat           VkFormat
+	// inputAttachmentLayout is the layout in which the input attachment images
+	// are read during rendering. SHADER_READ_ONLY_OPTIMAL is used if not set.
+	inputAttachmentLayout VkImageLayout
+	// additionalRenderTargets are the color render targets rendered in the
+	// same draw as renderTarget. The render targets, renderTarget being the
+	// first one, are reconstructed from the input attachment images of the
+	// same indices, and must have the same format, samples and extent.
+	additionalRenderTargets []ipRenderImage
+	// logCtx is the context of the logs of the job.
+	logCtx ipLogContext
+}
+
+// renderTargets returns all the render targets of the job, starting with
+// renderTarget.
+func (job *ipRenderJob) renderTargets() []ipRenderImage {
+	return append([]ipRenderImage{job.renderTarget}, job.additionalRenderTargets...)
+}
+
+// inputLayout returns the layout in which the input attachment images of the
+// job are read.
+func (job *ipRenderJob) inputLayout() VkImageLayout {
+	if job.inputAttachmentLayout == VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED {
+		return VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL
+	}
+	return job.inputAttachmentLayout
 }
 
 type ipRenderImage struct {
@@ -639,6 +2623,13 @@ type ipRenderImage struct {
 
 const (
 	ipRenderInputAttachmentBinding = 0
+	// ipRenderCullMode and ipRenderFrontFace are the rasterization states of
+	// the render pipelines. The triangles covering the viewport are counter-
+	// clockwise with a viewport of positive height, but no face is culled, so
+	// that a flipped viewport does not silently drop the draw and leave the
+	// image unprimed, see ipRenderQuadPositions.
+	ipRenderCullMode  = VkCullModeFlagBits_VK_CULL_MODE_NONE
+	ipRenderFrontFace = VkFrontFace_VK_FRONT_FACE_COUNTER_CLOCKWISE
 )
 
 type ipRenderDescriptorSetInfo struct {
@@ -655,19 +2646,53 @@ type ipRenderPassInfo struct {
 	targetAspect                VkImageAspectFlagBits
 	targetFormat                VkFormat
 	targetSamples               VkSampleCountFlagBits
+	// numTargets is the number of render targets, which can be more than one
+	// only for color aspect.
+	numTargets int
 }
 
 type ipRenderShaderInfo struct {
-	dev      VkDevice
-	isVertex bool
-	format   VkFormat
-	aspect   VkImageAspectFlagBits
+	dev        VkDevice
+	isVertex   bool
+	format     VkFormat
+	aspect     VkImageAspectFlagBits
+	numTargets int
+	// stencilExport is true if the stencil shader exports the stencil value,
+	// see ipRenderStencilShaderSpirv.
+	stencilExport bool
+	// entryPoint is the name of the entry point of the shader, see
+	// ipShaderEntryPoint.
+	entryPoint string
 }
 
 type ipGfxPipelineInfo struct {
 	fragShaderInfo ipRenderShaderInfo
 	pipelineLayout VkPipelineLayout
 	renderPassInfo ipRenderPassInfo
+	depthState     ipRenderDepthState
+	// dynamicDepthStencil is true if the cull mode, the depth test state and
+	// the stencil ops are set when drawing, with VK_EXT_extended_dynamic_state.
+	// depthState is not used then, so that the pipelines differing only in
+	// these states are collapsed into one.
+	dynamicDepthStencil bool
+}
+
+// ipRenderDepthState is the depth test state of a graphics pipeline for
+// priming by rendering.
+type ipRenderDepthState struct {
+	testEnable  bool
+	writeEnable bool
+	compareOp   VkCompareOp
+}
+
+// ipDefaultRenderDepthState returns the depth test state for rendering to the
+// given aspect. The depth aspect is written with any depth value, and the
+// other aspects do not use depth test.
+func ipDefaultRenderDepthState(aspect VkImageAspectFlagBits) ipRenderDepthState {
+	if aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT {
+		return ipRenderDepthState{testEnable: true, writeEnable: true, compareOp: VkCompareOp_VK_COMPARE_OP_ALWAYS}
+	}
+	return ipRenderDepthState{compareOp: VkCompareOp_VK_COMPARE_OP_ALWAYS}
 }
 
 type ipRenderHandler struct {
@@ -679,12 +2704,25 @@ type ipRenderHandler struct {
 	pipelineLayouts map[ipRenderDescriptorSetInfo]PipelineLayoutObjectʳ
 	// pipelines indexed by the pipeline info.
 	pipelines map[ipGfxPipelineInfo]GraphicsPipelineObjectʳ
+	// imageless framebuffers indexed by the framebuffer info, shared by the
+	// render jobs with compatible render passes, see ipImagelessFramebuffer.
+	framebuffers map[ipImagelessFramebufferInfo]FramebufferObjectʳ
 	// shader modules indexed by the shader info.
 	shaders map[ipRenderShaderInfo]ShaderModuleObjectʳ
+	// spirvCacheDir, if not empty, is the directory the generated SPIR-V of
+	// the shaders is loaded from and saved to, see ipLoadOrGenerateSpirv.
+	spirvCacheDir string
+	// dumpShadersDir, if not empty, is the directory the SPIR-V binary of each
+	// created shader module is written to, see dumpShader.
+	dumpShadersDir string
 	// the fill info for the scratch buffers for vertex buffer and index buffer,
 	// the raw content of the those two buffers are supposed to be contants.
 	vertexBufferFillInfo *bufferSubRangeFillInfo
 	indexBufferFillInfo  *bufferSubRangeFillInfo
+	// depthState, if not nil, is used instead of the default depth test state
+	// for rendering depth aspect, e.g. to investigate depth reconstruction
+	// issues with another compare op.
+	depthState *ipRenderDepthState
 }
 
 // Interfaces of render handler to interact with image primer
@@ -696,10 +2734,14 @@ func newImagePrimerRenderHandler(sb *stateBuilder) *ipRenderHandler {
 		pipelineLayouts:      map[ipRenderDescriptorSetInfo]PipelineLayoutObjectʳ{},
 		pipelines:            map[ipGfxPipelineInfo]GraphicsPipelineObjectʳ{},
 		shaders:              map[ipRenderShaderInfo]ShaderModuleObjectʳ{},
+		framebuffers:         map[ipImagelessFramebufferInfo]FramebufferObjectʳ{},
 	}
 }
 
 func (h *ipRenderHandler) free() {
+	for _, obj := range h.framebuffers {
+		h.sb.write(h.sb.cb.VkDestroyFramebuffer(obj.Device(), obj.VulkanHandle(), memory.Nullptr))
+	}
 	for _, obj := range h.pipelines {
 		h.sb.write(h.sb.cb.VkDestroyPipeline(obj.Device(), obj.VulkanHandle(), memory.Nullptr))
 	}
@@ -725,34 +2767,192 @@ func ipImageBarrierAspectFlags(aspect VkImageAspectFlagBits, fmt VkFormat) VkIma
 	return VkImageAspectFlags(aspect)
 }
 
+// ipSeparateDepthStencilLayouts returns true if
+// VK_KHR_separate_depth_stencil_layouts is enabled on the given device, along
+// with its separateDepthStencilLayouts feature, so the depth and stencil
+// aspects of images can be in different layouts and transitioned separately.
+// Enabling the extension alone does not allow the separate layouts.
+func ipSeparateDepthStencilLayouts(sb *stateBuilder, dev VkDevice) bool {
+	devObj := GetState(sb.newState).Devices().Get(dev)
+	if devObj.IsNil() {
+		return false
+	}
+	features := devObj.SeparateDepthStencilLayoutsFeatures()
+	if features.IsNil() || features.SeparateDepthStencilLayouts() == VkBool32(0) {
+		return false
+	}
+	for _, ext := range devObj.EnabledExtensions().All() {
+		if ext == "VK_KHR_separate_depth_stencil_layouts" {
+			return true
+		}
+	}
+	return false
+}
+
+// ipShaderStencilExport returns true if VK_EXT_shader_stencil_export is
+// enabled on the given device, so the stencil data can be rendered in a single
+// pass.
+func ipShaderStencilExport(sb *stateBuilder, dev VkDevice) bool {
+	devObj := GetState(sb.newState).Devices().Get(dev)
+	if devObj.IsNil() {
+		return false
+	}
+	for _, ext := range devObj.EnabledExtensions().All() {
+		if ext == "VK_EXT_shader_stencil_export" {
+			return true
+		}
+	}
+	return false
+}
+
+// ipImagelessFramebuffer returns true if VK_KHR_imageless_framebuffer is
+// enabled on the given device, along with its imagelessFramebuffer feature,
+// so the render jobs can share framebuffers and give the image views when the
+// render passes begin.
+func ipImagelessFramebuffer(sb *stateBuilder, dev VkDevice) bool {
+	devObj := GetState(sb.newState).Devices().Get(dev)
+	if devObj.IsNil() {
+		return false
+	}
+	features := devObj.ImagelessFramebufferFeatures()
+	if features.IsNil() || features.ImagelessFramebuffer() == VkBool32(0) {
+		return false
+	}
+	for _, ext := range devObj.EnabledExtensions().All() {
+		if ext == "VK_KHR_imageless_framebuffer" {
+			return true
+		}
+	}
+	return false
+}
+
+// ipExtendedDynamicState returns true if VK_EXT_extended_dynamic_state is
+// enabled on the given device, along with its extendedDynamicState feature,
+// so the render pipelines can set the depth and stencil states dynamically.
+func ipExtendedDynamicState(sb *stateBuilder, dev VkDevice) bool {
+	devObj := GetState(sb.newState).Devices().Get(dev)
+	if devObj.IsNil() {
+		return false
+	}
+	features := devObj.ExtendedDynamicStateFeatures()
+	if features.IsNil() || features.ExtendedDynamicState() == VkBool32(0) {
+		return false
+	}
+	for _, ext := range devObj.EnabledExtensions().All() {
+		if ext == "VK_EXT_extended_dynamic_state" {
+			return true
+		}
+	}
+	return false
+}
+
+// ipDispatchBaseCommand is the command used to dispatch compute work groups
+// with non-zero base work group offsets.
+type ipDispatchBaseCommand int
+
+const (
+	// ipDispatchBaseUnsupported means the device supports no dispatch base
+	// command.
+	ipDispatchBaseUnsupported ipDispatchBaseCommand = iota
+	// ipDispatchBaseCore means vkCmdDispatchBase of Vulkan 1.1.
+	ipDispatchBaseCore
+	// ipDispatchBaseKHR means vkCmdDispatchBaseKHR of VK_KHR_device_group.
+	ipDispatchBaseKHR
+)
+
+// ipVulkanVersion11 is the Vulkan 1.1 API version number.
+const ipVulkanVersion11 = uint32(1<<22 | 1<<12)
+
+// ipDispatchBase returns the dispatch base command supported by the given
+// device. vkCmdDispatchBase is used if both the instance of the device is
+// created for Vulkan 1.1 or later and the physical device supports Vulkan 1.1
+// or later, otherwise vkCmdDispatchBaseKHR is used if VK_KHR_device_group is
+// enabled on the device.
+func ipDispatchBase(sb *stateBuilder, dev VkDevice) ipDispatchBaseCommand {
+	s := GetState(sb.newState)
+	devObj := s.Devices().Get(dev)
+	if devObj.IsNil() {
+		return ipDispatchBaseUnsupported
+	}
+	if phyDevObj := s.PhysicalDevices().Get(devObj.PhysicalDevice()); !phyDevObj.IsNil() {
+		inst := s.Instances().Get(phyDevObj.Instance())
+		if !inst.IsNil() && inst.ApiVersion() >= ipVulkanVersion11 &&
+			phyDevObj.PhysicalDeviceProperties().ApiVersion() >= ipVulkanVersion11 {
+			return ipDispatchBaseCore
+		}
+	}
+	for _, ext := range devObj.EnabledExtensions().All() {
+		if ext == "VK_KHR_device_group" {
+			return ipDispatchBaseKHR
+		}
+	}
+	return ipDispatchBaseUnsupported
+}
+
+// ipImageAspectBarrierFlags returns the aspect mask of the image memory
+// barriers to transition the layout of the given aspect of the given image.
+// The depth and stencil aspects of combined depth/stencil images are
+// transitioned separately if the device of the image supports separate
+// depth/stencil layouts, so each aspect can be in its own layout, otherwise
+// they are transitioned together, see ipImageBarrierAspectFlags.
+func ipImageAspectBarrierFlags(sb *stateBuilder, img ImageObjectʳ, aspect VkImageAspectFlagBits) VkImageAspectFlags {
+	if ipSeparateDepthStencilLayouts(sb, img.Device()) {
+		return VkImageAspectFlags(aspect)
+	}
+	return ipImageBarrierAspectFlags(aspect, img.Info().Fmt())
+}
+
 func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
+	ctx := job.logCtx.bind(h.sb.ctx)
 	switch job.renderTarget.aspect {
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
 		VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT,
 		VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
 	default:
-		return log.Errf(h.sb.ctx, nil, "unsupported aspect: %v", job.renderTarget.aspect)
+		return log.Errf(ctx, nil, "unsupported aspect: %v", job.renderTarget.aspect)
+	}
+	outputBarrierAspect := ipImageAspectBarrierFlags(h.sb, job.renderTarget.image, job.renderTarget.aspect)
+	targets := job.renderTargets()
+	if len(targets) > 1 {
+		if job.renderTarget.aspect != VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+			return log.Errf(ctx, nil, "multiple render targets are not supported for aspect: %v", job.renderTarget.aspect)
+		}
+		if len(job.inputAttachmentImages) != len(targets) {
+			return log.Errf(ctx, nil, "%v input attachment images for %v render targets", len(job.inputAttachmentImages), len(targets))
+		}
+		for _, target := range job.additionalRenderTargets {
+			if target.aspect != job.renderTarget.aspect ||
+				target.image.Info().Fmt() != job.renderTarget.image.Info().Fmt() ||
+				target.image.Info().Samples() != job.renderTarget.image.Info().Samples() {
+				return log.Errf(ctx, nil, "render target image: %v does not match render target image: %v",
+					target.image.VulkanHandle(), job.renderTarget.image.VulkanHandle())
+			}
+		}
 	}
-	outputBarrierAspect := ipImageBarrierAspectFlags(job.renderTarget.aspect, job.renderTarget.image.Info().Fmt())
 
 	var outputPreRenderLayout VkImageLayout
+	var outputViewUsage VkImageUsageFlags
 	switch job.renderTarget.aspect {
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
 		outputPreRenderLayout = VkImageLayout_VK_IMAGE_LAYOUT_COLOR_ATTACHMENT_OPTIMAL
+		outputViewUsage = VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT)
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT,
 		VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
 		outputPreRenderLayout = VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL
+		outputViewUsage = VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT)
 	default:
-		return log.Errf(h.sb.ctx, nil, "unsupported aspect: %v", job.renderTarget.aspect)
+		return log.Errf(ctx, nil, "unsupported aspect: %v", job.renderTarget.aspect)
 	}
 
 	dev := job.renderTarget.image.Device()
+	stencilExport := job.renderTarget.aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT &&
+		ipShaderStencilExport(h.sb, dev)
 
 	descSetInfo := ipRenderDescriptorSetInfo{
 		dev:                 dev,
 		numInputAttachments: len(job.inputAttachmentImages),
 	}
-	if job.renderTarget.aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT {
+	if job.renderTarget.aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT && !stencilExport {
 		// If the render target aspect is stencil, an uniform buffer is required
 		// to store the stencil bit index value.
 		descSetInfo.pushConstant = true
@@ -763,7 +2963,7 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 			h.sb.write(h.sb.cb.VkDestroyDescriptorPool(dev, descPool.VulkanHandle(), memory.Nullptr))
 		})
 	} else {
-		return log.Errf(h.sb.ctx, nil, "failed to create descriptor pool for %v input attachments", len(job.inputAttachmentImages))
+		return log.Errf(ctx, nil, "failed to create descriptor pool for %v input attachments", len(job.inputAttachmentImages))
 	}
 	descSetLayout := h.getOrCreateDescriptorSetLayout(descSetInfo)
 	descSet := h.allocDescriptorSet(dev, descPool.VulkanHandle(), descSetLayout.VulkanHandle())
@@ -774,45 +2974,51 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 					h.sb.MustAllocReadData(descSet.VulkanHandle()).Ptr()), VkResult_VK_SUCCESS))
 		})
 	} else {
-		return log.Errf(h.sb.ctx, nil, "failed to allocate descriptorset with %v input attachments", len(job.inputAttachmentImages))
+		return log.Errf(ctx, nil, "failed to allocate descriptorset with %v input attachments", len(job.inputAttachmentImages))
 	}
 
 	inputViews := []ImageViewObjectʳ{}
 	for _, input := range job.inputAttachmentImages {
 		// TODO: support rendering to 3D images if maintenance1 is enabled.
 		if input.image.Info().ImageType() == VkImageType_VK_IMAGE_TYPE_3D {
-			return log.Errf(h.sb.ctx, nil, "rendering to 3D images are not supported yet")
+			return log.Errf(ctx, nil, "rendering to 3D images are not supported yet")
 		}
-		view := h.createImageView(dev, input.image, input.aspect, input.layer, input.level)
+		view := h.createImageView(dev, input.image, input.aspect, input.layer, input.level,
+			VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_INPUT_ATTACHMENT_BIT))
 		inputViews = append(inputViews, view)
 		if !view.IsNil() {
 			tsk.deferUntilExecuted(func() {
 				h.sb.write(h.sb.cb.VkDestroyImageView(dev, view.VulkanHandle(), memory.Nullptr))
 			})
 		} else {
-			return log.Errf(h.sb.ctx, nil, "failed to create image view for input attachment image: %v", input.image.VulkanHandle())
+			return log.Errf(ctx, nil, "failed to create image view for input attachment image: %v", input.image.VulkanHandle())
 		}
 	}
-	// TODO: support rendering to 3D images if maintenance1 is enabled.
-	if job.renderTarget.image.Info().ImageType() == VkImageType_VK_IMAGE_TYPE_3D {
-		return log.Errf(h.sb.ctx, nil, "rendering to 3D images are not supported yet")
-	}
-	outputView := h.createImageView(dev, job.renderTarget.image, job.renderTarget.aspect, job.renderTarget.layer, job.renderTarget.level)
-	if !outputView.IsNil() {
-		tsk.deferUntilExecuted(func() {
-			h.sb.write(h.sb.cb.VkDestroyImageView(dev, outputView.VulkanHandle(), memory.Nullptr))
-		})
-	} else {
-		return log.Errf(h.sb.ctx, nil, "failed to create image view for rendering target image: %v",
-			job.renderTarget.image.VulkanHandle())
+	outputViews := []ImageViewObjectʳ{}
+	for _, target := range targets {
+		// TODO: support rendering to 3D images if maintenance1 is enabled.
+		if target.image.Info().ImageType() == VkImageType_VK_IMAGE_TYPE_3D {
+			return log.Errf(ctx, nil, "rendering to 3D images are not supported yet")
+		}
+		outputView := h.createImageView(dev, target.image, target.aspect, target.layer, target.level, outputViewUsage)
+		outputViews = append(outputViews, outputView)
+		if !outputView.IsNil() {
+			tsk.deferUntilExecuted(func() {
+				h.sb.write(h.sb.cb.VkDestroyImageView(dev, outputView.VulkanHandle(), memory.Nullptr))
+			})
+		} else {
+			return log.Errf(ctx, nil, "failed to create image view for rendering target image: %v",
+				target.image.VulkanHandle())
+		}
 	}
 
+	inputLayout := job.inputLayout()
 	imgInfoList := []VkDescriptorImageInfo{}
 	for _, view := range inputViews {
 		imgInfoList = append(imgInfoList, NewVkDescriptorImageInfo(h.sb.ta,
 			0,                   // Sampler
 			view.VulkanHandle(), // ImageView
-			VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL, // ImageLayout
+			inputLayout,         // ImageLayout
 		))
 	}
 
@@ -828,53 +3034,106 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 		targetAspect:                job.renderTarget.aspect,
 		targetFormat:                job.renderTarget.image.Info().Fmt(),
 		targetSamples:               job.renderTarget.image.Info().Samples(),
+		numTargets:                  len(targets),
 	}
-	renderPass := h.createRenderPass(renderPassInfo, job.renderTarget.finalLayout)
+	finalLayouts := []VkImageLayout{}
+	for _, target := range targets {
+		finalLayouts = append(finalLayouts, target.finalLayout)
+	}
+	renderPass := h.createRenderPass(renderPassInfo, inputLayout, finalLayouts)
 	if !renderPass.IsNil() {
 		tsk.deferUntilExecuted(func() {
 			h.sb.write(h.sb.cb.VkDestroyRenderPass(dev, renderPass.VulkanHandle(), memory.Nullptr))
 		})
 	} else {
-		return log.Errf(h.sb.ctx, nil, "failed to create renderpass for rendering")
+		return log.Errf(ctx, nil, "failed to create renderpass for rendering")
 	}
 
 	allViews := []VkImageView{}
 	for _, view := range inputViews {
 		allViews = append(allViews, view.VulkanHandle())
 	}
-	allViews = append(allViews, outputView.VulkanHandle())
+	for _, view := range outputViews {
+		allViews = append(allViews, view.VulkanHandle())
+	}
 
 	targetLevelSize := h.sb.levelSize(job.renderTarget.image.Info().Extent(),
 		job.renderTarget.image.Info().Fmt(), job.renderTarget.level, job.renderTarget.aspect)
+	for _, target := range job.additionalRenderTargets {
+		levelSize := h.sb.levelSize(target.image.Info().Extent(),
+			target.image.Info().Fmt(), target.level, target.aspect)
+		if levelSize.width != targetLevelSize.width || levelSize.height != targetLevelSize.height {
+			return log.Errf(ctx, nil, "render target image: %v level: %v does not match the extent of the other render targets",
+				target.image.VulkanHandle(), target.level)
+		}
+	}
 
-	framebuffer := h.createFramebuffer(dev, renderPass.VulkanHandle(), allViews,
-		uint32(targetLevelSize.width), uint32(targetLevelSize.height))
-	if !framebuffer.IsNil() {
-		tsk.deferUntilExecuted(func() {
-			h.sb.write(h.sb.cb.VkDestroyFramebuffer(dev, framebuffer.VulkanHandle(), memory.Nullptr))
-		})
+	var framebuffer FramebufferObjectʳ
+	// drawAttachments are the image views given when the render passes begin,
+	// if the framebuffer is imageless.
+	var drawAttachments []VkImageView
+	if ipImagelessFramebuffer(h.sb, dev) {
+		attachmentInfos := []ipFramebufferAttachmentInfo{}
+		for _, input := range job.inputAttachmentImages {
+			attachmentInfos = append(attachmentInfos, ipNewFramebufferAttachmentInfo(h.sb, input.image, input.aspect, input.level,
+				VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_INPUT_ATTACHMENT_BIT)))
+		}
+		for _, target := range targets {
+			attachmentInfos = append(attachmentInfos, ipNewFramebufferAttachmentInfo(h.sb, target.image, target.aspect, target.level, outputViewUsage))
+		}
+		framebuffer = h.getOrCreateImagelessFramebuffer(ipImagelessFramebufferInfo{
+			renderPassInfo: renderPassInfo,
+			width:          uint32(targetLevelSize.width),
+			height:         uint32(targetLevelSize.height),
+			attachments:    fmt.Sprint(attachmentInfos),
+		}, renderPass.VulkanHandle(), attachmentInfos)
+		drawAttachments = allViews
 	} else {
-		return log.Errf(h.sb.ctx, nil, "failed to create framebuffer for rendering")
+		framebuffer = h.createFramebuffer(dev, renderPass.VulkanHandle(), allViews,
+			uint32(targetLevelSize.width), uint32(targetLevelSize.height))
+		if !framebuffer.IsNil() {
+			tsk.deferUntilExecuted(func() {
+				h.sb.write(h.sb.cb.VkDestroyFramebuffer(dev, framebuffer.VulkanHandle(), memory.Nullptr))
+			})
+		}
+	}
+	if framebuffer.IsNil() {
+		return log.Errf(ctx, nil, "failed to create framebuffer for rendering")
 	}
 
 	pipelineLayout := h.getOrCreatePipelineLayout(descSetInfo)
 	if pipelineLayout.IsNil() {
-		return log.Errf(h.sb.ctx, nil, "failed to get pipeline layout for the rendering")
+		return log.Errf(ctx, nil, "failed to get pipeline layout for the rendering")
 	}
 
 	pipelineInfo := ipGfxPipelineInfo{
 		fragShaderInfo: ipRenderShaderInfo{
-			dev:      dev,
-			isVertex: false,
-			format:   job.inputFormat,
-			aspect:   job.renderTarget.aspect,
+			dev:           dev,
+			isVertex:      false,
+			format:        job.inputFormat,
+			aspect:        job.renderTarget.aspect,
+			numTargets:    len(targets),
+			stencilExport: stencilExport,
 		},
 		pipelineLayout: pipelineLayout.VulkanHandle(),
 		renderPassInfo: renderPassInfo,
+		depthState:     ipDefaultRenderDepthState(job.renderTarget.aspect),
+	}
+	if h.depthState != nil && job.renderTarget.aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT {
+		pipelineInfo.depthState = *h.depthState
+	}
+	// drawDepthState is the depth test state set when drawing, if the depth
+	// and stencil states of the pipeline are dynamic.
+	var drawDepthState *ipRenderDepthState
+	if ipExtendedDynamicState(h.sb, dev) {
+		depthState := pipelineInfo.depthState
+		drawDepthState = &depthState
+		pipelineInfo.depthState = ipRenderDepthState{}
+		pipelineInfo.dynamicDepthStencil = true
 	}
 	pipeline, err := h.getOrCreateGraphicsPipeline(pipelineInfo, renderPass.VulkanHandle())
 	if err != nil {
-		return log.Errf(h.sb.ctx, err, "[Getting graphics pipeline]")
+		return log.Errf(ctx, err, "[Getting graphics pipeline]")
 	}
 
 	inputSrcBarriers := []VkImageMemoryBarrier{}
@@ -887,8 +3146,8 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 				0, // pNext
 				VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // srcAccessMask
 				VkAccessFlags(VkAccessFlagBits_VK_ACCESS_INPUT_ATTACHMENT_READ_BIT),                                        // dstAccessMask
-				input.initialLayout, // oldLayout
-				VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL, // newLayout
+				input.initialLayout,        // oldLayout
+				inputLayout,                // newLayout
 				queueFamilyIgnore,          // srcQueueFamilyIndex
 				queueFamilyIgnore,          // dstQueueFamilyIndex
 				input.image.VulkanHandle(), // image
@@ -900,14 +3159,14 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 					input.image.Info().ArrayLayers(), // layerCount
 				),
 			))
-		if input.finalLayout != VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL {
+		if input.finalLayout != inputLayout {
 			dstBarriers = append(dstBarriers,
 				NewVkImageMemoryBarrier(h.sb.ta,
 					VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
 					0, // pNext
 					VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // srcAccessMask
 					VkAccessFlags(VkAccessFlagBits_VK_ACCESS_INPUT_ATTACHMENT_READ_BIT),                                        // dstAccessMask
-					VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL,                                                     // oldLayout
+					inputLayout,                // oldLayout
 					input.finalLayout,          // newLayout
 					queueFamilyIgnore,          // srcQueueFamilyIndex
 					queueFamilyIgnore,          // dstQueueFamilyIndex
@@ -922,40 +3181,36 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 				))
 		}
 	}
-	outputBarrier := NewVkImageMemoryBarrier(h.sb.ta,
-		VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
-		0, // pNext
-		0, // srcAccessMask
-		VkAccessFlags(VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // dstAccessMask
-		GetState(h.sb.newState).Images().Get(job.renderTarget.image.VulkanHandle()).Aspects().Get(
-			job.renderTarget.aspect).Layers().Get(
-			job.renderTarget.layer).Levels().Get(
-			job.renderTarget.level).Layout(), // oldLayout
-		outputPreRenderLayout,                 // newLayout
-		queueFamilyIgnore,                     // srcQueueFamilyIndex
-		queueFamilyIgnore,                     // dstQueueFamilyIndex
-		job.renderTarget.image.VulkanHandle(), // image
-		NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
-			outputBarrierAspect,    // aspectMask
-			job.renderTarget.level, // baseMipLevel
-			1,                      // levelCount
-			job.renderTarget.layer, // baseArrayLayer
-			1,                      // layerCount
-		))
+	outputBarriers := []VkImageMemoryBarrier{}
+	for _, target := range targets {
+		outputBarriers = append(outputBarriers, NewVkImageMemoryBarrier(h.sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
+			0, // pNext
+			0, // srcAccessMask
+			VkAccessFlags(VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // dstAccessMask
+			GetState(h.sb.newState).Images().Get(target.image.VulkanHandle()).Aspects().Get(
+				target.aspect).Layers().Get(
+				target.layer).Levels().Get(
+				target.level).Layout(), // oldLayout
+			outputPreRenderLayout,       // newLayout
+			queueFamilyIgnore,           // srcQueueFamilyIndex
+			queueFamilyIgnore,           // dstQueueFamilyIndex
+			target.image.VulkanHandle(), // image
+			NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
+				ipImageAspectBarrierFlags(h.sb, target.image, target.aspect), // aspectMask
+				target.level, // baseMipLevel
+				1,            // levelCount
+				target.layer, // baseArrayLayer
+				1,            // layerCount
+			)))
+	}
+	srcBarriers := append(inputSrcBarriers, outputBarriers...)
 
 	tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-		h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
-			commandBuffer,
+		h.sb.writeImageBarriers(commandBuffer,
 			VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
 			VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-			VkDependencyFlags(0),
-			uint32(0),
-			memory.Nullptr,
-			uint32(0),
-			memory.Nullptr,
-			uint32(len(append(inputSrcBarriers, outputBarrier))),
-			h.sb.MustAllocReadData(append(inputSrcBarriers, outputBarrier)).Ptr(),
-		))
+			srcBarriers)
 	})
 
 	switch job.renderTarget.aspect {
@@ -965,6 +3220,8 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 			tsk:              tsk,
 			renderPass:       renderPass,
 			framebuffer:      framebuffer,
+			attachments:      drawAttachments,
+			depthState:       drawDepthState,
 			descSet:          descSet,
 			pipelineLayout:   pipelineLayout,
 			pipeline:         pipeline,
@@ -979,71 +3236,83 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 
 	// render stencil aspect
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
-		// render the i'th bit of all pixels.
-		for i := uint32(0); i < uint32(8); i++ {
-			tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-				h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
-					commandBuffer,
-					VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-					VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-					VkDependencyFlags(0),
-					uint32(0),
-					memory.Nullptr,
-					uint32(0),
-					memory.Nullptr,
-					uint32(1),
-					h.sb.MustAllocReadData([]VkImageMemoryBarrier{
-						NewVkImageMemoryBarrier(h.sb.ta,
-							VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
-							0, // pNext
-							VkAccessFlags(VkAccessFlagBits_VK_ACCESS_DEPTH_STENCIL_ATTACHMENT_WRITE_BIT), // srcAccessMask
-							VkAccessFlags(VkAccessFlagBits_VK_ACCESS_DEPTH_STENCIL_ATTACHMENT_WRITE_BIT), // dstAccessMask
-							VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL,               // oldLayout
-							VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL,               // newLayout
-							queueFamilyIgnore,                     // srcQueueFamilyIndex
-							queueFamilyIgnore,                     // dstQueueFamilyIndex
-							job.renderTarget.image.VulkanHandle(), // image
-							NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
-								outputBarrierAspect, // aspectMask
-								0,                   // baseMipLevel
-								job.renderTarget.image.Info().MipLevels(), // levelCount
-								0, // baseArrayLayer
-								job.renderTarget.image.Info().ArrayLayers(), // layerCount
-							),
-						)}).Ptr(),
-				))
-
-				// Create compute pipeline
-				stencilIndex := []uint32{i}
-				var sib bytes.Buffer
-				binary.Write(&sib, binary.LittleEndian, stencilIndex)
-				h.sb.write(h.sb.cb.VkCmdPushConstants(
-					commandBuffer,
-					pipelineLayout.VulkanHandle(),
-					VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_FRAGMENT_BIT),
-					0,
-					4,
-					NewCharᶜᵖ(h.sb.MustAllocReadData(sib.Bytes()).Ptr()),
-				))
-			})
-			drawInfo := ipRenderDrawInfo{
+		if stencilExport {
+			// render all the bits of all pixels in one pass.
+			h.beginRenderPassAndDraw(ipRenderDrawInfo{
 				tsk:              tsk,
 				renderPass:       renderPass,
 				framebuffer:      framebuffer,
+				attachments:      drawAttachments,
+				depthState:       drawDepthState,
 				descSet:          descSet,
 				pipelineLayout:   pipelineLayout,
 				pipeline:         pipeline,
 				aspect:           VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT,
 				width:            uint32(targetLevelSize.width),
 				height:           uint32(targetLevelSize.height),
-				stencilWriteMask: 0x1 << i,
-				stencilReference: 0x1 << i,
-				clearStencil:     false,
-			}
-			if i == uint32(0) {
-				drawInfo.clearStencil = true
+				stencilWriteMask: 0xFF,
+				stencilReference: 0,
+				clearStencil:     true,
+			})
+		} else {
+			// render the i'th bit of all pixels.
+			for i := uint32(0); i < uint32(8); i++ {
+				tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+					h.sb.writeImageBarriers(commandBuffer,
+						VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+						VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+						[]VkImageMemoryBarrier{
+							NewVkImageMemoryBarrier(h.sb.ta,
+								VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
+								0, // pNext
+								VkAccessFlags(VkAccessFlagBits_VK_ACCESS_DEPTH_STENCIL_ATTACHMENT_WRITE_BIT), // srcAccessMask
+								VkAccessFlags(VkAccessFlagBits_VK_ACCESS_DEPTH_STENCIL_ATTACHMENT_WRITE_BIT), // dstAccessMask
+								VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL,               // oldLayout
+								VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL,               // newLayout
+								queueFamilyIgnore,                     // srcQueueFamilyIndex
+								queueFamilyIgnore,                     // dstQueueFamilyIndex
+								job.renderTarget.image.VulkanHandle(), // image
+								NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
+									outputBarrierAspect, // aspectMask
+									0,                   // baseMipLevel
+									job.renderTarget.image.Info().MipLevels(), // levelCount
+									0, // baseArrayLayer
+									job.renderTarget.image.Info().ArrayLayers(), // layerCount
+								),
+							)})
+
+					// Create compute pipeline
+					stencilIndex := ipUint32sData(ipEndian(h.sb), []uint32{i})
+					h.sb.write(h.sb.cb.VkCmdPushConstants(
+						commandBuffer,
+						pipelineLayout.VulkanHandle(),
+						VkShaderStageFlags(VkShaderStageFlagBits_VK_SHADER_STAGE_FRAGMENT_BIT),
+						0,
+						4,
+						NewCharᶜᵖ(h.sb.MustAllocReadData(stencilIndex).Ptr()),
+					))
+				})
+				drawInfo := ipRenderDrawInfo{
+					tsk:              tsk,
+					renderPass:       renderPass,
+					framebuffer:      framebuffer,
+					attachments:      drawAttachments,
+					depthState:       drawDepthState,
+					descSet:          descSet,
+					pipelineLayout:   pipelineLayout,
+					pipeline:         pipeline,
+					aspect:           VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT,
+					width:            uint32(targetLevelSize.width),
+					height:           uint32(targetLevelSize.height),
+					stencilWriteMask: 0x1 << i,
+					stencilReference: 0x1 << i,
+					clearStencil:     false,
+				}
+				if i == uint32(0) {
+					drawInfo.clearStencil = true
+				}
+				h.beginRenderPassAndDraw(drawInfo)
 			}
-			h.beginRenderPassAndDraw(drawInfo)
 		}
 		dstBarriers = append(dstBarriers, NewVkImageMemoryBarrier(h.sb.ta,
 			VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
@@ -1064,22 +3333,14 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 			),
 		))
 	default:
-		return log.Errf(h.sb.ctx, nil, "invalid aspect: %v to render", job.renderTarget.aspect)
+		return log.Errf(ctx, nil, "invalid aspect: %v to render", job.renderTarget.aspect)
 	}
 	if len(dstBarriers) > 0 {
 		tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-			h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
-				commandBuffer,
+			h.sb.writeImageBarriers(commandBuffer,
 				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
 				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-				VkDependencyFlags(0),
-				0,
-				memory.Nullptr,
-				0,
-				memory.Nullptr,
-				uint32(len(dstBarriers)),
-				h.sb.MustAllocReadData(dstBarriers).Ptr(),
-			))
+				dstBarriers)
 		})
 	}
 
@@ -1089,9 +3350,15 @@ func (h *ipRenderHandler) render(job *ipRenderJob, tsk *scratchTask) error {
 // Internal functions for render handler
 
 type ipRenderDrawInfo struct {
-	tsk              *scratchTask
-	renderPass       RenderPassObjectʳ
-	framebuffer      FramebufferObjectʳ
+	tsk         *scratchTask
+	renderPass  RenderPassObjectʳ
+	framebuffer FramebufferObjectʳ
+	// attachments are the image views of the imageless framebuffer, nil if
+	// the framebuffer is not imageless.
+	attachments []VkImageView
+	// depthState is the depth test state set when drawing, nil if the depth
+	// and stencil states of the pipeline are not dynamic.
+	depthState       *ipRenderDepthState
 	descSet          DescriptorSetObjectʳ
 	pipelineLayout   PipelineLayoutObjectʳ
 	pipeline         GraphicsPipelineObjectʳ
@@ -1105,14 +3372,24 @@ type ipRenderDrawInfo struct {
 
 func (h *ipRenderHandler) beginRenderPassAndDraw(info ipRenderDrawInfo) {
 	info.tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+		pNext := NewVoidᶜᵖ(memory.Nullptr)
+		if info.attachments != nil {
+			pNext = NewVoidᶜᵖ(h.sb.MustAllocReadData(
+				NewVkRenderPassAttachmentBeginInfoKHR(h.sb.ta,
+					VkStructureType_VK_STRUCTURE_TYPE_RENDER_PASS_ATTACHMENT_BEGIN_INFO_KHR, // sType
+					0,                             // pNext
+					uint32(len(info.attachments)), // attachmentCount
+					NewVkImageViewᶜᵖ(h.sb.MustAllocReadData(info.attachments).Ptr()), // pAttachments
+				)).Ptr())
+		}
 		h.sb.write(h.sb.cb.VkCmdBeginRenderPass(
 			commandBuffer,
 			h.sb.MustAllocReadData(
 				NewVkRenderPassBeginInfo(h.sb.ta,
 					VkStructureType_VK_STRUCTURE_TYPE_RENDER_PASS_BEGIN_INFO, // sType
-					NewVoidᶜᵖ(memory.Nullptr),                                // pNext
-					info.renderPass.VulkanHandle(),                           // renderPass
-					info.framebuffer.VulkanHandle(),                          // framebuffer
+					pNext,                           // pNext
+					info.renderPass.VulkanHandle(),  // renderPass
+					info.framebuffer.VulkanHandle(), // framebuffer
 					NewVkRect2D(h.sb.ta, // renderArea
 						MakeVkOffset2D(h.sb.ta),
 						NewVkExtent2D(h.sb.ta, info.width, info.height),
@@ -1155,6 +3432,9 @@ func (h *ipRenderHandler) beginRenderPassAndDraw(info ipRenderDrawInfo) {
 			VkPipelineBindPoint_VK_PIPELINE_BIND_POINT_GRAPHICS,
 			info.pipeline.VulkanHandle(),
 		))
+		if info.depthState != nil {
+			h.setDynamicDepthStencilState(commandBuffer, *info.depthState)
+		}
 		h.sb.write(h.sb.cb.VkCmdSetViewport(
 			commandBuffer,
 			uint32(0),
@@ -1198,7 +3478,7 @@ func (h *ipRenderHandler) beginRenderPassAndDraw(info ipRenderDrawInfo) {
 		))
 		h.sb.write(h.sb.cb.VkCmdDraw(
 			commandBuffer,
-			6, 1, 0, 0,
+			uint32(len(ipRenderQuadPositions)), 1, 0, 0,
 		))
 		h.sb.write(h.sb.cb.VkCmdEndRenderPass(commandBuffer))
 	})
@@ -1230,27 +3510,111 @@ func (h *ipRenderHandler) createFramebuffer(dev VkDevice, renderPass VkRenderPas
 	return GetState(h.sb.newState).Framebuffers().Get(handle)
 }
 
-func (h *ipRenderHandler) createImageView(dev VkDevice, img ImageObjectʳ, aspect VkImageAspectFlagBits, layer, level uint32) ImageViewObjectʳ {
+// ipFramebufferAttachmentInfo is the info of an attachment of an imageless
+// framebuffer, which the image view given for the attachment must match.
+type ipFramebufferAttachmentInfo struct {
+	flags  VkImageCreateFlags
+	usage  VkImageUsageFlags
+	width  uint32
+	height uint32
+	format VkFormat
+}
+
+// ipNewFramebufferAttachmentInfo returns the info of the framebuffer
+// attachment for the view of the given aspect and level of the given image,
+// created by createImageView with the given usage.
+func ipNewFramebufferAttachmentInfo(sb *stateBuilder, img ImageObjectʳ, aspect VkImageAspectFlagBits, level uint32, usage VkImageUsageFlags) ipFramebufferAttachmentInfo {
+	levelSize := sb.levelSize(img.Info().Extent(), img.Info().Fmt(), level, aspect)
+	return ipFramebufferAttachmentInfo{
+		flags:  img.Info().Flags(),
+		usage:  ipImageViewUsage(sb, img, usage),
+		width:  uint32(levelSize.width),
+		height: uint32(levelSize.height),
+		format: img.Info().Fmt(),
+	}
+}
+
+// ipImagelessFramebufferInfo identifies the imageless framebuffers which can
+// be shared by the render jobs. attachments is the string of the infos of the
+// attachments, so the info can index maps.
+type ipImagelessFramebufferInfo struct {
+	renderPassInfo ipRenderPassInfo
+	width          uint32
+	height         uint32
+	attachments    string
+}
+
+// getOrCreateImagelessFramebuffer returns the imageless framebuffer with the
+// given info and attachment infos, creating it with the given render pass if
+// it does not exist yet. The framebuffer can be used with all the render
+// passes compatible with the given one, and is destroyed when the handler is
+// freed.
+func (h *ipRenderHandler) getOrCreateImagelessFramebuffer(info ipImagelessFramebufferInfo, renderPass VkRenderPass, attachmentInfos []ipFramebufferAttachmentInfo) FramebufferObjectʳ {
+	if fb, ok := h.framebuffers[info]; ok {
+		return fb
+	}
+	handle := VkFramebuffer(newUnusedID(true, func(x uint64) bool {
+		return GetState(h.sb.newState).Framebuffers().Contains(VkFramebuffer(x))
+	}))
+	imageInfos := []VkFramebufferAttachmentImageInfoKHR{}
+	for _, a := range attachmentInfos {
+		imageInfos = append(imageInfos, NewVkFramebufferAttachmentImageInfoKHR(h.sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_FRAMEBUFFER_ATTACHMENT_IMAGE_INFO_KHR, // sType
+			0,        // pNext
+			a.flags,  // flags
+			a.usage,  // usage
+			a.width,  // width
+			a.height, // height
+			1,        // layerCount
+			1,        // viewFormatCount
+			NewVkFormatᶜᵖ(h.sb.MustAllocReadData(a.format).Ptr()), // pViewFormats
+		))
+	}
+	attachments := NewVkFramebufferAttachmentsCreateInfoKHR(h.sb.ta,
+		VkStructureType_VK_STRUCTURE_TYPE_FRAMEBUFFER_ATTACHMENTS_CREATE_INFO_KHR, // sType
+		0,                       // pNext
+		uint32(len(imageInfos)), // attachmentImageInfoCount
+		NewVkFramebufferAttachmentImageInfoKHRᶜᵖ(h.sb.MustAllocReadData(imageInfos).Ptr()), // pAttachmentImageInfos
+	)
+	createInfo := NewVkFramebufferCreateInfo(h.sb.ta,
+		VkStructureType_VK_STRUCTURE_TYPE_FRAMEBUFFER_CREATE_INFO,                                     // sType
+		NewVoidᶜᵖ(h.sb.MustAllocReadData(attachments).Ptr()),                                          // pNext
+		VkFramebufferCreateFlags(VkFramebufferCreateFlagBits_VK_FRAMEBUFFER_CREATE_IMAGELESS_BIT_KHR), // flags
+		renderPass,              // renderPass
+		uint32(len(imageInfos)), // attachmentCount
+		0,                       // pAttachments
+		info.width,              // width
+		info.height,             // height
+		1,                       // layers
+	)
+	h.sb.write(h.sb.cb.VkCreateFramebuffer(
+		info.renderPassInfo.dev,
+		NewVkFramebufferCreateInfoᶜᵖ(h.sb.MustAllocReadData(createInfo).Ptr()),
+		memory.Nullptr,
+		h.sb.MustAllocWriteData(handle).Ptr(),
+		VkResult_VK_SUCCESS,
+	))
+	h.framebuffers[info] = GetState(h.sb.newState).Framebuffers().Get(handle)
+	return h.framebuffers[info]
+}
+
+func (h *ipRenderHandler) createImageView(dev VkDevice, img ImageObjectʳ, aspect VkImageAspectFlagBits, layer, level uint32, usage VkImageUsageFlags) ImageViewObjectʳ {
 
 	handle := VkImageView(newUnusedID(true, func(x uint64) bool {
 		return GetState(h.sb.newState).ImageViews().Contains(VkImageView(x))
 	}))
+	pNext := ipImageViewUsagePNext(h.sb, img, usage)
 	h.sb.write(h.sb.cb.VkCreateImageView(
 		dev,
 		NewVkImageViewCreateInfoᶜᵖ(h.sb.MustAllocReadData(
 			NewVkImageViewCreateInfo(h.sb.ta,
 				VkStructureType_VK_STRUCTURE_TYPE_IMAGE_VIEW_CREATE_INFO, // sType
-				0,                                     // pNext
+				pNext,                                 // pNext
 				0,                                     // flags
 				img.VulkanHandle(),                    // image
 				VkImageViewType_VK_IMAGE_VIEW_TYPE_2D, // viewType
 				img.Info().Fmt(),                      // format
-				NewVkComponentMapping(h.sb.ta, // components
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // r
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // g
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // b
-					VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY, // a
-				),
+				ipIdentityComponentMapping(h.sb.ta),   // components
 				NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
 					VkImageAspectFlags(aspect), // aspectMask
 					level,                      // baseMipLevel
@@ -1294,45 +3658,68 @@ func (h *ipRenderHandler) createDescriptorPool(descSetInfo ipRenderDescriptorSet
 	return GetState(h.sb.newState).DescriptorPools().Get(handle)
 }
 
-func (h *ipRenderHandler) createRenderPass(info ipRenderPassInfo, finalLayout VkImageLayout) RenderPassObjectʳ {
+// ipRenderTargetLoadOp returns the load op of the color or depth data of the
+// render target when rendering to the given aspect. The color and depth
+// aspects are fully overwritten, so their previous data is not loaded. When
+// rendering the stencil aspect of a depth-stencil image, the depth data
+// rendered before must be loaded, or the stencil passes would leave it
+// undefined, see ipRenderAspectOrder.
+func ipRenderTargetLoadOp(aspect VkImageAspectFlagBits) VkAttachmentLoadOp {
+	if aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT {
+		return VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_LOAD
+	}
+	return VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_DONT_CARE
+}
+
+// createRenderPass creates a render pass with the input attachments followed by
+// the render targets, each render target transitioned to the final layout of
+// the same index at the end of the render pass.
+func (h *ipRenderHandler) createRenderPass(info ipRenderPassInfo, inputLayout VkImageLayout, finalLayouts []VkImageLayout) RenderPassObjectʳ {
 	inputAttachmentRefs := make([]VkAttachmentReference, info.numInputAttachments)
 	inputAttachmentDescs := make([]VkAttachmentDescription, info.numInputAttachments)
 	for i := 0; i < info.numInputAttachments; i++ {
 		inputAttachmentRefs[i] = NewVkAttachmentReference(h.sb.ta,
-			uint32(i), // Attachment
-			VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL, // Layout
+			uint32(i),   // Attachment
+			inputLayout, // Layout
 		)
 		inputAttachmentDescs[i] = NewVkAttachmentDescription(h.sb.ta,
 			0,                                // flags
 			info.inputAttachmentImageFormat,  // format
 			info.inputAttachmentImageSamples, // samples
-			VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_LOAD,          // loadOp
-			VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_DONT_CARE,   // storeOp
-			VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_DONT_CARE,     // stencilLoadOp
-			VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_DONT_CARE,   // stencilStoreOp
-			VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL, // initialLayout
-			VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL, // finalLayout
+			VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_LOAD,        // loadOp
+			VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_DONT_CARE, // storeOp
+			VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_DONT_CARE,   // stencilLoadOp
+			VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_DONT_CARE, // stencilStoreOp
+			inputLayout, // initialLayout
+			inputLayout, // finalLayout
+		)
+	}
+	if len(finalLayouts) != info.numTargets || info.numTargets == 0 {
+		return NilRenderPassObjectʳ
+	}
+	outputAttachmentRefs := make([]VkAttachmentReference, info.numTargets)
+	outputAttachmentDescs := make([]VkAttachmentDescription, info.numTargets)
+	for i := 0; i < info.numTargets; i++ {
+		outputAttachmentRefs[i] = NewVkAttachmentReference(h.sb.ta,
+			uint32(info.numInputAttachments+i), // Attachment
+			// The layout will be set later according to the image aspect bits.
+			VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED, // Layout
+		)
+		outputAttachmentDescs[i] = NewVkAttachmentDescription(h.sb.ta,
+			0,                                       // flags
+			info.targetFormat,                       // format
+			info.targetSamples,                      // samples
+			ipRenderTargetLoadOp(info.targetAspect), // loadOp
+			VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_STORE, // storeOp
+			// Keep the stencil aspect data. When rendering color or depth aspect,
+			// stencil test will be disabled so stencil data won't be modified.
+			VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_LOAD,    // stencilLoadOp
+			VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_STORE, // stencilStoreOp
+			// The layout will be set later according to the image aspect bit.
+			VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED, // initialLayout
+			finalLayouts[i],                         // finalLayout
 		)
 	}
-	outputAttachmentRef := NewVkAttachmentReference(h.sb.ta,
-		uint32(info.numInputAttachments), // Attachment
-		// The layout will be set later according to the image aspect bits.
-		VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED, // Layout
-	)
-	outputAttachmentDesc := NewVkAttachmentDescription(h.sb.ta,
-		0,                  // flags
-		info.targetFormat,  // format
-		info.targetSamples, // samples
-		VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_DONT_CARE, // loadOp
-		VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_STORE,   // storeOp
-		// Keep the stencil aspect data. When rendering color or depth aspect,
-		// stencil test will be disabled so stencil data won't be modified.
-		VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_LOAD,    // stencilLoadOp
-		VkAttachmentStoreOp_VK_ATTACHMENT_STORE_OP_STORE, // stencilStoreOp
-		// The layout will be set later according to the image aspect bit.
-		VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED, // initialLayout
-		finalLayout,                             // finalLayout
-	)
 	subpassDesc := NewVkSubpassDescription(h.sb.ta,
 		0, // flags
 		VkPipelineBindPoint_VK_PIPELINE_BIND_POINT_GRAPHICS,                           // pipelineBindPoint
@@ -1349,32 +3736,40 @@ func (h *ipRenderHandler) createRenderPass(info ipRenderPassInfo, finalLayout Vk
 	)
 	switch info.targetAspect {
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
-		outputAttachmentRef.SetLayout(VkImageLayout_VK_IMAGE_LAYOUT_COLOR_ATTACHMENT_OPTIMAL)
-		outputAttachmentDesc.SetInitialLayout(VkImageLayout_VK_IMAGE_LAYOUT_COLOR_ATTACHMENT_OPTIMAL)
-		subpassDesc.SetColorAttachmentCount(1)
-		subpassDesc.SetPColorAttachments(NewVkAttachmentReferenceᶜᵖ(h.sb.MustAllocReadData(outputAttachmentRef).Ptr()))
+		for i := range outputAttachmentRefs {
+			outputAttachmentRefs[i].SetLayout(VkImageLayout_VK_IMAGE_LAYOUT_COLOR_ATTACHMENT_OPTIMAL)
+			outputAttachmentDescs[i].SetInitialLayout(VkImageLayout_VK_IMAGE_LAYOUT_COLOR_ATTACHMENT_OPTIMAL)
+		}
+		subpassDesc.SetColorAttachmentCount(uint32(info.numTargets))
+		subpassDesc.SetPColorAttachments(NewVkAttachmentReferenceᶜᵖ(h.sb.MustAllocReadData(outputAttachmentRefs).Ptr()))
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT:
-		outputAttachmentRef.SetLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
-		outputAttachmentDesc.SetInitialLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
-		subpassDesc.SetPDepthStencilAttachment(NewVkAttachmentReferenceᶜᵖ(h.sb.MustAllocReadData(outputAttachmentRef).Ptr()))
+		if info.numTargets != 1 {
+			return NilRenderPassObjectʳ
+		}
+		outputAttachmentRefs[0].SetLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
+		outputAttachmentDescs[0].SetInitialLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
+		subpassDesc.SetPDepthStencilAttachment(NewVkAttachmentReferenceᶜᵖ(h.sb.MustAllocReadData(outputAttachmentRefs[0]).Ptr()))
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
-		outputAttachmentRef.SetLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
-		outputAttachmentDesc.SetInitialLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
+		if info.numTargets != 1 {
+			return NilRenderPassObjectʳ
+		}
+		outputAttachmentRefs[0].SetLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
+		outputAttachmentDescs[0].SetInitialLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
 		// Rendering stencil data requires running the renderpass multiple times,
 		// so do not change the image layout at the end of the renderpass
-		outputAttachmentDesc.SetFinalLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
-		subpassDesc.SetPDepthStencilAttachment(NewVkAttachmentReferenceᶜᵖ(h.sb.MustAllocReadData(outputAttachmentRef).Ptr()))
+		outputAttachmentDescs[0].SetFinalLayout(VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
+		subpassDesc.SetPDepthStencilAttachment(NewVkAttachmentReferenceᶜᵖ(h.sb.MustAllocReadData(outputAttachmentRefs[0]).Ptr()))
 	default:
 		return NilRenderPassObjectʳ
 	}
 
 	createInfo := NewVkRenderPassCreateInfo(h.sb.ta,
 		VkStructureType_VK_STRUCTURE_TYPE_RENDER_PASS_CREATE_INFO, // sType
-		0,                                  // pNext
-		0,                                  // flags
-		uint32(info.numInputAttachments+1), // attachmentCount
+		0, // pNext
+		0, // flags
+		uint32(info.numInputAttachments+info.numTargets), // attachmentCount
 		NewVkAttachmentDescriptionᶜᵖ(h.sb.MustAllocReadData( // pAttachments
-			append(inputAttachmentDescs, outputAttachmentDesc),
+			append(inputAttachmentDescs, outputAttachmentDescs...),
 		).Ptr()),
 		1, // subpassCount
 		NewVkSubpassDescriptionᶜᵖ(h.sb.MustAllocReadData(subpassDesc).Ptr()), // pSubpasses
@@ -1404,33 +3799,97 @@ func (h *ipRenderHandler) getOrCreateShaderModule(info ipRenderShaderInfo) (Shad
 	handle := VkShaderModule(newUnusedID(true, func(x uint64) bool {
 		return GetState(h.sb.newState).ShaderModules().Contains(VkShaderModule(x))
 	}))
-	var err error
-	code := []uint32{}
-	if info.isVertex {
-		code, err = ipRenderVertexShaderSpirv()
-	} else {
-		switch info.aspect {
-		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
-			code, err = ipRenderColorShaderSpirv(info.format)
-		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT:
-			code, err = ipRenderDepthShaderSpirv(info.format)
-		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
-			code, err = ipRenderStencilShaderSpirv()
-		default:
-			err = fmt.Errorf("Unsupported aspect bit: %v", info.aspect)
-		}
-	}
+	code, err := h.shaderSpirv(info)
 	if err != nil {
 		return NilShaderModuleObjectʳ, log.Errf(h.sb.ctx, err, "[Generating shader SPIR-V for: %v]", info)
 	}
 	if len(code) == 0 {
 		return NilShaderModuleObjectʳ, log.Errf(h.sb.ctx, nil, "no SPIR-V code generated")
 	}
+	if err := ipValidateShaderSpirv(code); err != nil {
+		return NilShaderModuleObjectʳ, log.Errf(h.sb.ctx, err, "[Validating generated SPIR-V for: %v]", info)
+	}
+	if h.dumpShadersDir != "" {
+		h.dumpShader(info)
+	}
 	vkCreateShaderModule(h.sb, info.dev, code, handle)
 	h.shaders[info] = GetState(h.sb.newState).ShaderModules().Get(handle)
 	return h.shaders[info], nil
 }
 
+// ipColorBlendAttachments returns the given blend attachment state repeated
+// for each of the given number of color attachments. It returns nil for the
+// pipelines without color attachments, e.g. for rendering the depth and
+// stencil aspects, whose color blend state must have null pAttachments.
+func ipColorBlendAttachments(numColorAttachments uint32, attachment VkPipelineColorBlendAttachmentState) []VkPipelineColorBlendAttachmentState {
+	if numColorAttachments == 0 {
+		return nil
+	}
+	attachments := make([]VkPipelineColorBlendAttachmentState, numColorAttachments)
+	for i := range attachments {
+		attachments[i] = attachment
+	}
+	return attachments
+}
+
+// setDynamicDepthStencilState writes the commands setting the cull mode, the
+// given depth test state and the stencil ops to the given command buffer, for
+// the graphics pipelines of which these states are dynamic. The values are the
+// same as the static states of the other pipelines.
+func (h *ipRenderHandler) setDynamicDepthStencilState(commandBuffer VkCommandBuffer, depthState ipRenderDepthState) {
+	depthTestEnable := VkBool32(0)
+	if depthState.testEnable {
+		depthTestEnable = VkBool32(1)
+	}
+	depthWriteEnable := VkBool32(0)
+	if depthState.writeEnable {
+		depthWriteEnable = VkBool32(1)
+	}
+	h.sb.write(h.sb.cb.VkCmdSetCullModeEXT(commandBuffer, VkCullModeFlags(ipRenderCullMode)))
+	h.sb.write(h.sb.cb.VkCmdSetDepthTestEnableEXT(commandBuffer, depthTestEnable))
+	h.sb.write(h.sb.cb.VkCmdSetDepthWriteEnableEXT(commandBuffer, depthWriteEnable))
+	h.sb.write(h.sb.cb.VkCmdSetDepthCompareOpEXT(commandBuffer, depthState.compareOp))
+	h.sb.write(h.sb.cb.VkCmdSetStencilOpEXT(commandBuffer,
+		VkStencilFaceFlags(VkStencilFaceFlagBits_VK_STENCIL_FACE_FRONT_BIT),
+		VkStencilOp_VK_STENCIL_OP_KEEP,    // failOp
+		VkStencilOp_VK_STENCIL_OP_REPLACE, // passOp
+		VkStencilOp_VK_STENCIL_OP_REPLACE, // depthFailOp
+		VkCompareOp_VK_COMPARE_OP_ALWAYS,  // compareOp
+	))
+	h.sb.write(h.sb.cb.VkCmdSetStencilOpEXT(commandBuffer,
+		VkStencilFaceFlags(VkStencilFaceFlagBits_VK_STENCIL_FACE_BACK_BIT),
+		VkStencilOp_VK_STENCIL_OP_KEEP,  // failOp
+		VkStencilOp_VK_STENCIL_OP_KEEP,  // passOp
+		VkStencilOp_VK_STENCIL_OP_KEEP,  // depthFailOp
+		VkCompareOp_VK_COMPARE_OP_NEVER, // compareOp
+	))
+}
+
+// ipRenderDynamicStates returns the dynamic states of the graphics pipeline
+// with the given info.
+func ipRenderDynamicStates(info ipGfxPipelineInfo) []VkDynamicState {
+	dynamicStates := []VkDynamicState{
+		VkDynamicState_VK_DYNAMIC_STATE_VIEWPORT,
+		VkDynamicState_VK_DYNAMIC_STATE_SCISSOR,
+	}
+	if info.renderPassInfo.targetAspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT {
+		dynamicStates = append(dynamicStates,
+			VkDynamicState_VK_DYNAMIC_STATE_STENCIL_WRITE_MASK,
+			VkDynamicState_VK_DYNAMIC_STATE_STENCIL_REFERENCE,
+		)
+	}
+	if info.dynamicDepthStencil {
+		dynamicStates = append(dynamicStates,
+			VkDynamicState_VK_DYNAMIC_STATE_CULL_MODE_EXT,
+			VkDynamicState_VK_DYNAMIC_STATE_DEPTH_TEST_ENABLE_EXT,
+			VkDynamicState_VK_DYNAMIC_STATE_DEPTH_WRITE_ENABLE_EXT,
+			VkDynamicState_VK_DYNAMIC_STATE_DEPTH_COMPARE_OP_EXT,
+			VkDynamicState_VK_DYNAMIC_STATE_STENCIL_OP_EXT,
+		)
+	}
+	return dynamicStates
+}
+
 func (h *ipRenderHandler) getOrCreateGraphicsPipeline(info ipGfxPipelineInfo, renderPass VkRenderPass) (GraphicsPipelineObjectʳ, error) {
 
 	if p, ok := h.pipelines[info]; ok {
@@ -1448,35 +3907,49 @@ func (h *ipRenderHandler) getOrCreateGraphicsPipeline(info ipGfxPipelineInfo, re
 	}
 
 	depthTestEnable := VkBool32(0)
-	depthWriteEnable := VkBool32(0)
-	numColorAttachments := uint32(1)
-	if info.renderPassInfo.targetAspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT {
+	if info.depthState.testEnable {
 		depthTestEnable = VkBool32(1)
+	}
+	depthWriteEnable := VkBool32(0)
+	if info.depthState.writeEnable {
 		depthWriteEnable = VkBool32(1)
+	}
+	numColorAttachments := uint32(info.renderPassInfo.numTargets)
+	if info.renderPassInfo.targetAspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT {
 		numColorAttachments = uint32(0)
 	}
 	stencilTestEnable := VkBool32(0)
-	dynamicStates := []VkDynamicState{
-		VkDynamicState_VK_DYNAMIC_STATE_VIEWPORT,
-		VkDynamicState_VK_DYNAMIC_STATE_SCISSOR,
-	}
 	if info.renderPassInfo.targetAspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT {
 		stencilTestEnable = VkBool32(1)
-		dynamicStates = append(dynamicStates,
-			VkDynamicState_VK_DYNAMIC_STATE_STENCIL_WRITE_MASK,
-			VkDynamicState_VK_DYNAMIC_STATE_STENCIL_REFERENCE,
-		)
 		numColorAttachments = uint32(0)
 	}
+	dynamicStates := ipRenderDynamicStates(info)
+
+	// One blend attachment state for each color attachment, none for the
+	// depth and stencil aspects, see ipColorBlendAttachments.
+	blendAttachment := NewVkPipelineColorBlendAttachmentState(h.sb.ta,
+		0,                                  // blendEnable
+		VkBlendFactor_VK_BLEND_FACTOR_ZERO, // srcColorBlendFactor
+		VkBlendFactor_VK_BLEND_FACTOR_ONE,  // dstColorBlendFactor
+		VkBlendOp_VK_BLEND_OP_ADD,          // colorBlendOp
+		VkBlendFactor_VK_BLEND_FACTOR_ZERO, // srcAlphaBlendFactor
+		VkBlendFactor_VK_BLEND_FACTOR_ONE,  // dstAlphaBlendFactor
+		VkBlendOp_VK_BLEND_OP_ADD,          // alphaBlendOp
+		0xf,                                // colorWriteMask
+	)
+	pBlendAttachments := NewVkPipelineColorBlendAttachmentStateᶜᵖ(memory.Nullptr)
+	if blendAttachments := ipColorBlendAttachments(numColorAttachments, blendAttachment); len(blendAttachments) > 0 {
+		pBlendAttachments = NewVkPipelineColorBlendAttachmentStateᶜᵖ(h.sb.MustAllocReadData(blendAttachments).Ptr())
+	}
 
 	depethStencilState := NewVkPipelineDepthStencilStateCreateInfo(h.sb.ta,
 		VkStructureType_VK_STRUCTURE_TYPE_PIPELINE_DEPTH_STENCIL_STATE_CREATE_INFO, // sType
-		0,                                // pNext
-		0,                                // flags
-		depthTestEnable,                  // depthTestEnable
-		depthWriteEnable,                 // depthWriteEnable
-		VkCompareOp_VK_COMPARE_OP_ALWAYS, // depthCompareOp
-		0,                                // depthBoundsTestEnable
+		0,                         // pNext
+		0,                         // flags
+		depthTestEnable,           // depthTestEnable
+		depthWriteEnable,          // depthWriteEnable
+		info.depthState.compareOp, // depthCompareOp
+		0,                         // depthBoundsTestEnable
 		stencilTestEnable,
 		NewVkStencilOpState(h.sb.ta, // front
 			VkStencilOp_VK_STENCIL_OP_KEEP,    // failOp
@@ -1501,6 +3974,8 @@ func (h *ipRenderHandler) getOrCreateGraphicsPipeline(info ipGfxPipelineInfo, re
 		0.0, // maxDepthBounds
 	)
 
+	vertEntryPoint := ipShaderEntryPoint(vertInfo.entryPoint)
+	fragEntryPoint := ipShaderEntryPoint(info.fragShaderInfo.entryPoint)
 	createInfo := NewVkGraphicsPipelineCreateInfo(h.sb.ta,
 		VkStructureType_VK_STRUCTURE_TYPE_GRAPHICS_PIPELINE_CREATE_INFO, // sType
 		0, // pNext
@@ -1512,19 +3987,19 @@ func (h *ipRenderHandler) getOrCreateGraphicsPipeline(info ipGfxPipelineInfo, re
 					VkStructureType_VK_STRUCTURE_TYPE_PIPELINE_SHADER_STAGE_CREATE_INFO, // sType
 					0, // pNext
 					0, // flags
-					VkShaderStageFlagBits_VK_SHADER_STAGE_VERTEX_BIT, // stage
-					vertShader.VulkanHandle(),                        // module
-					NewCharᶜᵖ(h.sb.MustAllocReadData("main").Ptr()),  // pName
-					NewVkSpecializationInfoᶜᵖ(memory.Nullptr),        // pSpecializationInfo
+					VkShaderStageFlagBits_VK_SHADER_STAGE_VERTEX_BIT,        // stage
+					vertShader.VulkanHandle(),                               // module
+					NewCharᶜᵖ(h.sb.MustAllocReadData(vertEntryPoint).Ptr()), // pName
+					NewVkSpecializationInfoᶜᵖ(memory.Nullptr),               // pSpecializationInfo
 				),
 				NewVkPipelineShaderStageCreateInfo(h.sb.ta,
 					VkStructureType_VK_STRUCTURE_TYPE_PIPELINE_SHADER_STAGE_CREATE_INFO, // sType
 					0, // pNext
 					0, // flags
-					VkShaderStageFlagBits_VK_SHADER_STAGE_FRAGMENT_BIT, // stage
-					fragShader.VulkanHandle(),                          // module
-					NewCharᶜᵖ(h.sb.MustAllocReadData("main").Ptr()),    // pName
-					NewVkSpecializationInfoᶜᵖ(memory.Nullptr),          // pSpecializationInfo
+					VkShaderStageFlagBits_VK_SHADER_STAGE_FRAGMENT_BIT,      // stage
+					fragShader.VulkanHandle(),                               // module
+					NewCharᶜᵖ(h.sb.MustAllocReadData(fragEntryPoint).Ptr()), // pName
+					NewVkSpecializationInfoᶜᵖ(memory.Nullptr),               // pSpecializationInfo
 				),
 			}).Ptr()),
 		NewVkPipelineVertexInputStateCreateInfoᶜᵖ(h.sb.MustAllocReadData( // pVertexInputState
@@ -1566,13 +4041,13 @@ func (h *ipRenderHandler) getOrCreateGraphicsPipeline(info ipGfxPipelineInfo, re
 				0,                                  // depthClampEnable
 				0,                                  // rasterizerDiscardEnable
 				VkPolygonMode_VK_POLYGON_MODE_FILL, // polygonMode
-				VkCullModeFlags(VkCullModeFlagBits_VK_CULL_MODE_BACK_BIT), // cullMode
-				VkFrontFace_VK_FRONT_FACE_COUNTER_CLOCKWISE,               // frontFace
-				0, // depthBiasEnable
-				0, // depthBiasConstantFactor
-				0, // depthBiasClamp
-				0, // depthBiasSlopeFactor
-				1, // lineWidth
+				VkCullModeFlags(ipRenderCullMode),  // cullMode
+				ipRenderFrontFace,                  // frontFace
+				0,                                  // depthBiasEnable
+				0,                                  // depthBiasConstantFactor
+				0,                                  // depthBiasClamp
+				0,                                  // depthBiasSlopeFactor
+				1,                                  // lineWidth
 			)).Ptr()),
 		NewVkPipelineMultisampleStateCreateInfoᶜᵖ(h.sb.MustAllocReadData( // pMultisampleState
 			NewVkPipelineMultisampleStateCreateInfo(h.sb.ta,
@@ -1595,19 +4070,8 @@ func (h *ipRenderHandler) getOrCreateGraphicsPipeline(info ipGfxPipelineInfo, re
 				0,                           // logicOpEnable
 				VkLogicOp_VK_LOGIC_OP_CLEAR, // logicOp
 				numColorAttachments,         // attachmentCount
-				// there is at most one color attachment
-				NewVkPipelineColorBlendAttachmentStateᶜᵖ(h.sb.MustAllocReadData( // pAttachments
-					NewVkPipelineColorBlendAttachmentState(h.sb.ta,
-						0,                                  // blendEnable
-						VkBlendFactor_VK_BLEND_FACTOR_ZERO, // srcColorBlendFactor
-						VkBlendFactor_VK_BLEND_FACTOR_ONE,  // dstColorBlendFactor
-						VkBlendOp_VK_BLEND_OP_ADD,          // colorBlendOp
-						VkBlendFactor_VK_BLEND_FACTOR_ZERO, // srcAlphaBlendFactor
-						VkBlendFactor_VK_BLEND_FACTOR_ONE,  // dstAlphaBlendFactor
-						VkBlendOp_VK_BLEND_OP_ADD,          // alphaBlendOp
-						0xf,                                // colorWriteMask
-					)).Ptr()),
-				NilF32ː4ᵃ, // blendConstants
+				pBlendAttachments,           // pAttachments
+				NilF32ː4ᵃ,                   // blendConstants
 			)).Ptr()),
 		NewVkPipelineDynamicStateCreateInfoᶜᵖ(h.sb.MustAllocReadData( // pDynamicState
 			NewVkPipelineDynamicStateCreateInfo(h.sb.ta,
@@ -1715,7 +4179,18 @@ func newImagePrimerBufferImageCopyJob(srcImg ImageObjectʳ) *ipBufImgCopyJob {
 	}
 }
 
+// addDst adds the given dst images whose dstAspect will be written with the
+// data of the srcAspect of the src image. Returns an error if the srcAspect is
+// not an aspect of the src image, the dstAspect is not an aspect of any of the
+// dst images, or the srcAspect is already mapped to another dstAspect.
 func (s *ipBufImgCopyJob) addDst(ctx context.Context, srcAspect, dstAspect VkImageAspectFlagBits, dstImgs ...ImageObjectʳ) error {
+	dstAspects := make([]VkImageAspectFlags, 0, len(dstImgs))
+	for _, dstImg := range dstImgs {
+		dstAspects = append(dstAspects, dstImg.ImageAspect())
+	}
+	if err := ipCheckCopyAspects(s.srcImg.ImageAspect(), srcAspect, dstAspect, dstAspects...); err != nil {
+		return log.Errf(ctx, err, "[Adding dst images for src image: %v]", s.srcImg.VulkanHandle())
+	}
 	if s.srcAspectsToDsts[srcAspect] == nil {
 		s.srcAspectsToDsts[srcAspect] = &ipBufImgCopyDst{
 			dstImgs:   []ImageObjectʳ{},
@@ -1729,12 +4204,52 @@ func (s *ipBufImgCopyJob) addDst(ctx context.Context, srcAspect, dstAspect VkIma
 	return nil
 }
 
+// ipCheckCopyAspects returns an error if the given srcAspect is not in the
+// given aspects of the src image, or the given dstAspect is not in the given
+// aspects of each of the dst images.
+func ipCheckCopyAspects(srcAspects VkImageAspectFlags, srcAspect, dstAspect VkImageAspectFlagBits, dstAspects ...VkImageAspectFlags) error {
+	if srcAspects&VkImageAspectFlags(srcAspect) == 0 {
+		return fmt.Errorf("srcAspect: %v is not an aspect of the src image, whose aspects are: %v", srcAspect, srcAspects)
+	}
+	for i, aspects := range dstAspects {
+		if aspects&VkImageAspectFlags(dstAspect) == 0 {
+			return fmt.Errorf("dstAspect: %v is not an aspect of dst image %v, whose aspects are: %v", dstAspect, i, aspects)
+		}
+	}
+	return nil
+}
+
+// ipCopyContent is the buffer content of a VkBufferImageCopy, which consists of
+// the data of each of the array layers to copy, placed next to each other.
+type ipCopyContent []bufferSubRangeFillInfo
+
+// size returns the total size of the content.
+func (c ipCopyContent) size() uint64 {
+	size := uint64(0)
+	for _, r := range c {
+		size += r.size()
+	}
+	return size
+}
+
+// placedAt returns the fill info of each layer of the content, with the
+// content placed in a buffer starting at the given offset.
+func (c ipCopyContent) placedAt(offsetInBuf uint64) []bufferSubRangeFillInfo {
+	placed := make([]bufferSubRangeFillInfo, 0, len(c))
+	for _, r := range c {
+		r.setOffsetInBuffer(offsetInBuf)
+		placed = append(placed, r)
+		offsetInBuf += r.size()
+	}
+	return placed
+}
+
 type ipBufferImageCopySession struct {
 	// Copies for each dst image, in the same order of content, all copies have offsets start at 0.
 	copies map[ImageObjectʳ][]VkBufferImageCopy
-	// The buffer content of each VkBufferImageCopy for each dst image, all sub-range fill info
-	// starts their range at 0.
-	content map[ImageObjectʳ][]bufferSubRangeFillInfo
+	// The buffer content of each VkBufferImageCopy for each dst image, the content
+	// of each copy starts its range at 0.
+	content map[ImageObjectʳ][]ipCopyContent
 	// The index of each dst images, in case the source data image format is
 	// wider than staging image format, so that multple destination images are
 	// used.
@@ -1742,59 +4257,373 @@ type ipBufferImageCopySession struct {
 	totalSize uint64
 	// The source and destination image for this copy session.
 	job *ipBufImgCopyJob
-	sb  *stateBuilder
+	// The caller supplied data to be used instead of the data of the source
+	// image, nil if the data of the source image should be used.
+	srcData map[ipSubresource][]uint8
+	// The function that returns the subresource of the source image whose
+	// data is used for each subresource, nil if each subresource is primed
+	// with its own data, see imagePrimer.sourceSubresource.
+	srcSubresource func(dst ipSubresource) ipSubresource
+	// The errors of the subresources failed to produce copies.
+	errs []error
+	// prefetchData makes the data of the source subresources that are
+	// unpacked on the host be read once and concurrently before collecting
+	// the copies, see prefetch.
+	prefetchData bool
+	// prefetchWorkers is the max number of concurrent reads of prefetch.
+	prefetchWorkers int
+	// prefetched are the data of the whole source subresources read by
+	// prefetch.
+	prefetched map[ipSubresource][]uint8
+	// combineAspects makes the copies of the subresource ranges be collected
+	// by collectCopiesFromCombinedAspects.
+	combineAspects bool
+	// walked are the data of the source subresources of the subresource
+	// being walked by collectCopiesFromCombinedAspects.
+	walked map[ipSubresource]*ipWalkedData
+	// reads counts the source data reads of this session.
+	reads *ipSourceReads
+	// logCtx is the context of the logs of the session.
+	logCtx ipLogContext
+	sb     *stateBuilder
 }
 
 // interfaces to interact with image primer
 
-func newImagePrimerBufferImageCopySession(sb *stateBuilder, job *ipBufImgCopyJob) *ipBufferImageCopySession {
+func newImagePrimerBufferImageCopySession(sb *stateBuilder, job *ipBufImgCopyJob, srcData map[ipSubresource][]uint8) *ipBufferImageCopySession {
 	h := &ipBufferImageCopySession{
 		copies:  map[ImageObjectʳ][]VkBufferImageCopy{},
-		content: map[ImageObjectʳ][]bufferSubRangeFillInfo{},
+		content: map[ImageObjectʳ][]ipCopyContent{},
 		indices: map[ImageObjectʳ]int{},
 		job:     job,
+		srcData: srcData,
+		reads:   &ipSourceReads{},
+		logCtx:  ipImageLogContext(job.srcImg.VulkanHandle(), ""),
 		sb:      sb,
 	}
 	for _, dst := range job.srcAspectsToDsts {
 		for _, img := range dst.dstImgs {
 			h.copies[img] = []VkBufferImageCopy{}
-			h.content[img] = []bufferSubRangeFillInfo{}
+			h.content[img] = []ipCopyContent{}
 		}
 	}
 	return h
 }
 
+// newBufferImageCopySession returns a new buffer -> image copy session for the
+// given job of the given priming strategy, with the caller supplied data and
+// source subresources of this image primer.
+func (p *imagePrimer) newBufferImageCopySession(job *ipBufImgCopyJob, strategy ipPrimingStrategy) *ipBufferImageCopySession {
+	h := newImagePrimerBufferImageCopySession(p.sb, job, p.srcData)
+	h.logCtx.strategy = strategy
+	h.prefetchData = p.prefetchSourceData
+	h.prefetchWorkers = p.prefetchWorkers
+	h.combineAspects = p.combineAspects
+	h.reads = &p.sourceReads
+	if p.sourceSubresource != nil {
+		img := job.srcImg.VulkanHandle()
+		h.srcSubresource = func(dst ipSubresource) ipSubresource { return p.sourceSubresource(img, dst) }
+	}
+	return h
+}
+
+// sourceOf returns the subresource of the source image whose data is used for
+// the given subresource.
+func (h *ipBufferImageCopySession) sourceOf(dst ipSubresource) ipSubresource {
+	if h.srcSubresource == nil {
+		return dst
+	}
+	return h.srcSubresource(dst)
+}
+
+// collectCopiesFromSubresourceRanges collects the copies of the subresources
+// of the source image in the given ranges to the dst images. If prefetchData
+// is set, the source data of all the subresources in the ranges is prefetched
+// first. If combineAspects is set, the aspects of each subresource are walked
+// together.
+func (h *ipBufferImageCopySession) collectCopiesFromSubresourceRanges(srcRngs []VkImageSubresourceRange) {
+	if h.prefetchData {
+		h.prefetch(srcRngs)
+	}
+	for _, rng := range srcRngs {
+		if h.combineAspects {
+			h.collectCopiesFromCombinedAspects(rng)
+			continue
+		}
+		h.collectCopiesFromSubresourceRange(rng)
+	}
+}
+
+// unpacksOnHost returns true if the data of the given aspect of the source
+// image is read and unpacked on the host for any of its dst images, instead
+// of being copied from the resource directly.
+func (h *ipBufferImageCopySession) unpacksOnHost(aspect VkImageAspectFlagBits) bool {
+	srcFmt := h.job.srcImg.Info().Fmt()
+	if aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT &&
+		(srcFmt == VkFormat_VK_FORMAT_D24_UNORM_S8_UINT || srcFmt == VkFormat_VK_FORMAT_X8_D24_UNORM_PACK32) {
+		return true
+	}
+	blockTexelFmt := VkFormat_VK_FORMAT_UNDEFINED
+	if info, err := subGetElementAndTexelBlockSize(h.sb.ctx, nil, api.CmdNoID, nil, h.sb.oldState, GetState(h.sb.oldState), 0, nil, nil, srcFmt); err == nil &&
+		(info.TexelBlockSize().Width() != 1 || info.TexelBlockSize().Height() != 1) {
+		if f, ok := ipBlockTexelViewFormat(info.ElementSize()); ok {
+			blockTexelFmt = f
+		}
+	}
+	for _, dstImg := range h.job.srcAspectsToDsts[aspect].dstImgs {
+		dstFmt := dstImg.Info().Fmt()
+		if dstFmt != blockTexelFmt && ipNeedsUnpacking(srcFmt, dstFmt, aspect) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefetch reads the data of the source subresources in the given ranges
+// whose data is unpacked on the host, so the data of each subresource is read
+// once for all its copies and dst images, and the reads, which may resolve
+// resources from a remote or compressed store, do not block each other.
+// Nothing is prefetched for caller supplied data.
+func (h *ipBufferImageCopySession) prefetch(srcRngs []VkImageSubresourceRange) {
+	if h.srcData != nil {
+		return
+	}
+	srcs := []ipSubresource{}
+	seen := map[ipSubresource]bool{}
+	unpacks := map[VkImageAspectFlagBits]bool{}
+	for _, rng := range srcRngs {
+		walkImageSubresourceRange(h.sb, h.job.srcImg, rng,
+			func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+				if _, ok := h.job.srcAspectsToDsts[aspect]; !ok {
+					return
+				}
+				if _, ok := unpacks[aspect]; !ok {
+					unpacks[aspect] = h.unpacksOnHost(aspect)
+				}
+				src := h.sourceOf(ipSubresource{aspect: aspect, layer: layer, level: level})
+				if unpacks[aspect] && !seen[src] && h.prefetched[src] == nil {
+					seen[src] = true
+					srcs = append(srcs, src)
+				}
+			})
+	}
+	h.prefetchSubresources(srcs)
+}
+
+// prefetchSparseBindings reads the data of the source subresources with sparse
+// image memory bindings whose data is unpacked on the host, see prefetch.
+func (h *ipBufferImageCopySession) prefetchSparseBindings() {
+	if h.srcData != nil {
+		return
+	}
+	srcs := []ipSubresource{}
+	seen := map[ipSubresource]bool{}
+	unpacks := map[VkImageAspectFlagBits]bool{}
+	walkSparseImageMemoryBindings(h.sb, h.job.srcImg,
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused SparseBoundImageBlockInfoʳ) {
+			if _, ok := h.job.srcAspectsToDsts[aspect]; !ok {
+				return
+			}
+			if _, ok := unpacks[aspect]; !ok {
+				unpacks[aspect] = h.unpacksOnHost(aspect)
+			}
+			src := h.sourceOf(ipSubresource{aspect: aspect, layer: layer, level: level})
+			if unpacks[aspect] && !seen[src] && h.prefetched[src] == nil {
+				seen[src] = true
+				srcs = append(srcs, src)
+			}
+		})
+	h.prefetchSubresources(srcs)
+}
+
+// prefetchSubresources reads the data of the given source subresources with
+// at most prefetchWorkers reads running concurrently, before the copies are
+// collected, so collecting the copies consumes the already read data instead
+// of blocking on each read. The old state is not modified during priming, and
+// the context and old state to read from are captured before the reads start,
+// so the data is read from the state being rebuilt. The subresources failed
+// to be read are read again when collecting their copies.
+func (h *ipBufferImageCopySession) prefetchSubresources(srcs []ipSubresource) {
+	if len(srcs) == 0 {
+		return
+	}
+	ctx, oldState := h.sb.ctx, h.sb.oldState
+	srcImg := h.job.srcImg
+	data := make([][]uint8, len(srcs))
+	errs := make([]error, len(srcs))
+	ipReadConcurrently(len(srcs), h.prefetchWorkers, func(i int) {
+		src := srcs[i]
+		data[i], errs[i] = srcImg.
+			Aspects().Get(src.aspect).
+			Layers().Get(src.layer).
+			Levels().Get(src.level).
+			Data().Read(ctx, nil, oldState, nil)
+	})
+	if h.prefetched == nil {
+		h.prefetched = map[ipSubresource][]uint8{}
+	}
+	for i, src := range srcs {
+		if errs[i] != nil {
+			log.W(ctx, "Failed to prefetch the data of subresource: %+v of image: %v: %v", src, srcImg.VulkanHandle(), errs[i])
+			continue
+		}
+		h.prefetched[src] = data[i]
+		h.reads.reads++
+	}
+}
+
+// ipReadConcurrently calls read with each index in [0, count), with at most
+// the given number of calls running concurrently, and returns once all of
+// them return. A non-positive number of workers runs all the calls
+// concurrently.
+func ipReadConcurrently(count, workers int, read func(i int)) {
+	if workers <= 0 || workers > count {
+		workers = count
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				read(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+// collectCopiesFromSubresourceRange collects the copies of the whole
+// subresources of the source image in the given range to the dst images, see
+// collectCopiesFromRegions.
 func (h *ipBufferImageCopySession) collectCopiesFromSubresourceRange(srcRng VkImageSubresourceRange) {
+	regions := []ipSubresourceRegion{}
 	walkImageSubresourceRange(h.sb, h.job.srcImg, srcRng,
 		func(aspect VkImageAspectFlagBits, layer, level uint32, levelSize byteSizeAndExtent) {
-			extent := NewVkExtent3D(h.sb.ta,
-				uint32(levelSize.width),
-				uint32(levelSize.height),
-				uint32(levelSize.depth),
-			)
-			for dstIndex, dstImg := range h.job.srcAspectsToDsts[aspect].dstImgs {
-				// dstIndex is reserved for handling wide channel image format
-				// like R64G64B64A64
-				// TODO: handle wide format
-				bufFillInfo, bufImgCopy, err := h.getCopyAndData(
-					dstImg, h.job.srcAspectsToDsts[aspect].dstAspect,
-					h.job.srcImg, aspect, layer, level, MakeVkOffset3D(h.sb.ta),
-					extent)
-				if err != nil {
-					log.E(h.sb.ctx, "[Getting VkBufferImageCopy and raw data for priming data at image: %v, aspect: %v, layer: %v, level: %v] %v", h.job.srcImg.VulkanHandle(), aspect, layer, level, err)
+			regions = append(regions, ipSubresourceRegion{
+				ipSubresource: ipSubresource{aspect: aspect, layer: layer, level: level},
+				extent:        [3]uint32{uint32(levelSize.width), uint32(levelSize.height), uint32(levelSize.depth)},
+			})
+		})
+	h.collectCopiesFromRegions(regions)
+}
+
+// ipSourceReads counts the reads of the data slices of the source
+// subresources, captured or supplied by the caller, to collect the copies of
+// buffer image copy sessions. The data read once by prefetch is counted once.
+type ipSourceReads struct {
+	reads int
+	// saved is the number of reads saved by reusing the data read by
+	// collectCopiesFromCombinedAspects for the copies to more than one dst
+	// image, which walking the aspects one after another reads again.
+	saved int
+}
+
+// ipWalkedData is the data of a source subresource read by
+// collectCopiesFromCombinedAspects, and whether it is used by any copy yet.
+type ipWalkedData struct {
+	data []uint8
+	used bool
+}
+
+// collectCopiesFromCombinedAspects collects the copies of the whole
+// subresources of the source image in the given range to the dst images like
+// collectCopiesFromSubresourceRange, but walks all the aspects of each
+// subresource together, see walkImageSubresourceRangeAspects. The source data
+// of each aspect of a subresource, e.g. the depth and the stencil data, is
+// read once for the copies to all its dst images, and is dropped once the
+// copies of the subresource are collected. The copies of consecutive layers to
+// a dst image of more than one aspect are not coalesced, see appendCopy.
+func (h *ipBufferImageCopySession) collectCopiesFromCombinedAspects(srcRng VkImageSubresourceRange) {
+	defer func() { h.walked = nil }()
+	walkImageSubresourceRangeAspects(h.sb, h.job.srcImg, srcRng,
+		func(aspects []VkImageAspectFlagBits, layer, level uint32, levelSizes []byteSizeAndExtent) {
+			h.walked = map[ipSubresource]*ipWalkedData{}
+			regions := []ipSubresourceRegion{}
+			for i, aspect := range aspects {
+				if _, ok := h.job.srcAspectsToDsts[aspect]; !ok {
 					continue
 				}
-				h.copies[dstImg] = append(h.copies[dstImg], bufImgCopy)
-				h.content[dstImg] = append(h.content[dstImg], bufFillInfo)
-				h.indices[dstImg] = dstIndex
-				h.totalSize += bufFillInfo.size()
+				sub := ipSubresource{aspect: aspect, layer: layer, level: level}
+				if src := h.sourceOf(sub); h.walked[src] == nil && h.prefetched[src] == nil {
+					// The subresources failed to be read fail with errors
+					// when collecting their copies. The prefetched data is
+					// read once already.
+					if data, err := h.subresourceData(h.srcData, src); err == nil {
+						h.walked[src] = &ipWalkedData{data: data}
+					}
+				}
+				regions = append(regions, ipSubresourceRegion{
+					ipSubresource: sub,
+					extent:        [3]uint32{uint32(levelSizes[i].width), uint32(levelSizes[i].height), uint32(levelSizes[i].depth)},
+				})
 			}
+			h.collectCopiesFromRegions(regions)
 		})
 }
 
+// appendCopy appends the given copy of a whole subresource and its buffer
+// content to the copies of the given destination image. If the copy is to the
+// array layer next to the ones of the last copy, in the same mip level and
+// aspect, and the data of the layers are contiguous in the buffer, the copy is
+// coalesced into the last copy as one more layer instead.
+func (h *ipBufferImageCopySession) appendCopy(dstImg ImageObjectʳ, bufImgCopy VkBufferImageCopy, content bufferSubRangeFillInfo) {
+	copies := h.copies[dstImg]
+	if n := len(copies); n > 0 {
+		last := h.content[dstImg][n-1]
+		layerSize := uint64(h.sb.levelSize(bufImgCopy.ImageExtent(), dstImg.Info().Fmt(), 0,
+			VkImageAspectFlagBits(bufImgCopy.ImageSubresource().AspectMask())).levelSize)
+		if last.size()+content.size() <= scratchBufferSize &&
+			ipCanCoalesceCopies(copies[n-1], bufImgCopy, last[len(last)-1].size(), layerSize) {
+			subresource := copies[n-1].ImageSubresource()
+			subresource.SetLayerCount(subresource.LayerCount() + 1)
+			copies[n-1].SetImageSubresource(subresource)
+			h.content[dstImg][n-1] = append(last, content)
+			return
+		}
+	}
+	h.copies[dstImg] = append(copies, bufImgCopy)
+	h.content[dstImg] = append(h.content[dstImg], ipCopyContent{content})
+}
+
+// ipCanCoalesceCopies returns true if the given next copy can be carried out
+// as one more array layer of the given previous copy. Both copies must be
+// tightly packed, covering the same region of the same mip level and aspect,
+// and the next copy must be to the layer next to the last layer of the
+// previous copy. The data of the last layer of the previous copy must be of
+// the given layer size, so the data of the next layer can follow it directly.
+func ipCanCoalesceCopies(prev, next VkBufferImageCopy, prevLastLayerDataSize, layerSize uint64) bool {
+	p, n := prev.ImageSubresource(), next.ImageSubresource()
+	return prevLastLayerDataSize == layerSize &&
+		prev.BufferRowLength() == 0 && prev.BufferImageHeight() == 0 &&
+		next.BufferRowLength() == 0 && next.BufferImageHeight() == 0 &&
+		p.AspectMask() == n.AspectMask() &&
+		p.MipLevel() == n.MipLevel() &&
+		p.BaseArrayLayer()+p.LayerCount() == n.BaseArrayLayer() &&
+		n.LayerCount() == 1 &&
+		prev.ImageOffset().X() == next.ImageOffset().X() &&
+		prev.ImageOffset().Y() == next.ImageOffset().Y() &&
+		prev.ImageOffset().Z() == next.ImageOffset().Z() &&
+		prev.ImageExtent().Width() == next.ImageExtent().Width() &&
+		prev.ImageExtent().Height() == next.ImageExtent().Height() &&
+		prev.ImageExtent().Depth() == next.ImageExtent().Depth()
+}
+
 func (h *ipBufferImageCopySession) collectCopiesFromSparseImageBindings() {
+	if h.prefetchData {
+		h.prefetchSparseBindings()
+	}
 	walkSparseImageMemoryBindings(h.sb, h.job.srcImg,
 		func(aspect VkImageAspectFlagBits, layer, level uint32, blockData SparseBoundImageBlockInfoʳ) {
+			if _, ok := h.job.srcAspectsToDsts[aspect]; !ok {
+				// The aspect is not requested to be copied.
+				return
+			}
 			for dstIndex, dstImg := range h.job.srcAspectsToDsts[aspect].dstImgs {
 				// dstIndex is reserved for handling wide channel image format
 				// TODO: handle wide format
@@ -1804,185 +4633,185 @@ func (h *ipBufferImageCopySession) collectCopiesFromSparseImageBindings() {
 					h.job.srcImg, aspect, layer, level, blockData.Offset(),
 					blockData.Extent())
 				if err != nil {
-					log.E(h.sb.ctx, "[Getting VkBufferImageCopy and raw data from sparse image binding at image: %v, aspect: %v, layer: %v, level: %v, offset: %v, extent: %v] %v", h.job.srcImg.VulkanHandle(), aspect, layer, level, blockData.Offset(), blockData.Extent(), err)
+					h.errs = append(h.errs, log.Errf(h.logCtx.at(aspect, layer, level).bind(h.sb.ctx), err, "[Getting VkBufferImageCopy and raw data from sparse image binding at offset: %v, extent: %v]", blockData.Offset(), blockData.Extent()))
 					continue
 				}
 				h.copies[dstImg] = append(h.copies[dstImg], bufImgCopy)
-				h.content[dstImg] = append(h.content[dstImg], bufFillInfo)
+				h.content[dstImg] = append(h.content[dstImg], ipCopyContent{bufFillInfo})
 				h.indices[dstImg] = dstIndex
 				h.totalSize += bufFillInfo.size()
 			}
 		})
 }
 
+// errors returns the errors of the subresources which failed to produce
+// buffer -> image copies when collecting copies.
+func (h *ipBufferImageCopySession) errors() []error {
+	return h.errs
+}
+
+// collectErr returns an error which summarizes the errors met when collecting
+// copies, or nil if there was no error.
+func (h *ipBufferImageCopySession) collectErr() error {
+	if len(h.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v subresource(s) failed to produce buf->img copies, first error: %v", len(h.errs), h.errs[0])
+}
+
+// rolloutBufCopies rolls out the collected copies. If any subresource failed to
+// produce copies when collecting, the copies of the rest subresources are
+// still rolled out, and an error is returned.
 func (h *ipBufferImageCopySession) rolloutBufCopies(queue VkQueue, initLayouts, finalLayouts ipLayoutInfo) error {
+	ctx := h.logCtx.bind(h.sb.ctx)
 
 	if h.totalSize == 0 || len(h.copies) == 0 || len(h.content) == 0 {
-		return log.Errf(h.sb.ctx, nil, "no content for buf->img copy")
+		return log.Errf(ctx, h.collectErr(), "no content for buf->img copy")
 	}
 
 	if len(h.copies) != len(h.content) {
-		return log.Errf(h.sb.ctx, nil, "mismatch number of VkBufferImageCopy: %v and buffer content pieces: %v", len(h.copies), len(h.content))
-	}
-
-	for _, dst := range h.job.srcAspectsToDsts {
-		for _, dstImg := range dst.dstImgs {
-			preCopyDstImgBarriers := []VkImageMemoryBarrier{}
-			for layer := uint32(0); layer < dstImg.Info().ArrayLayers(); layer++ {
-				for level := uint32(0); level < dstImg.Info().MipLevels(); level++ {
-					barrier := NewVkImageMemoryBarrier(h.sb.ta,
-						VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
-						0, // pNext
-						VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // srcAccessMask
-						VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // dstAccessMask
-						initLayouts.layoutOf(dst.dstAspect, layer, level),                                                          // oldLayout
-						VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,                                                         // newLayout
-						queueFamilyIgnore,     // srcQueueFamilyIndex
-						queueFamilyIgnore,     // dstQueueFamilyIndex
-						dstImg.VulkanHandle(), // image
-						NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
-							ipImageBarrierAspectFlags(dst.dstAspect, dstImg.Info().Fmt()), // aspectMask
-							level, // baseMipLevel
-							1,     // levelCount
-							layer, // baseArrayLayer
-							1,     // layerCount
-						),
-					)
-					preCopyDstImgBarriers = append(preCopyDstImgBarriers, barrier)
-				}
-			}
+		return log.Errf(ctx, nil, "mismatch number of VkBufferImageCopy: %v and buffer content pieces: %v", len(h.copies), len(h.content))
+	}
 
-			postCopyDstImgBarriers := []VkImageMemoryBarrier{}
-			for layer := uint32(0); layer < dstImg.Info().ArrayLayers(); layer++ {
-				for level := uint32(0); level < dstImg.Info().MipLevels(); level++ {
-					barrier := NewVkImageMemoryBarrier(h.sb.ta,
-						VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
-						0, // pNext
-						VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // srcAccessMask
-						VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // dstAccessMask
-						VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,                                                         // oldLayout
-						finalLayouts.layoutOf(dst.dstAspect, layer, level),                                                         // newLayout
-						queueFamilyIgnore,     // srcQueueFamilyIndex
-						queueFamilyIgnore,     // dstQueueFamilyIndex
-						dstImg.VulkanHandle(), // image
-						NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
-							ipImageBarrierAspectFlags(dst.dstAspect, dstImg.Info().Fmt()), // aspectMask
-							level, // baseMipLevel
-							1,     // levelCount
-							layer, // baseArrayLayer
-							1,     // layerCount
-						),
-					)
-					postCopyDstImgBarriers = append(postCopyDstImgBarriers, barrier)
-				}
+	for _, dstImg := range h.dstImages() {
+		preCopyDstImgBarriers := []VkImageMemoryBarrier{}
+		postCopyDstImgBarriers := []VkImageMemoryBarrier{}
+		// Combined depth/stencil images must have both aspects transitioned
+		// together unless separate depth/stencil layouts are supported, so
+		// only one barrier is needed for all the aspects sharing the same
+		// barrier aspect mask.
+		barrierAspects := map[VkImageAspectFlags]struct{}{}
+		for _, dstAspect := range h.dstAspects(dstImg) {
+			aspectMask := ipImageAspectBarrierFlags(h.sb, dstImg, dstAspect)
+			if _, ok := barrierAspects[aspectMask]; ok {
+				continue
 			}
-
-			preCopyDstLayoutTransitionTsk := h.sb.newScratchTaskOnQueue(queue)
-			preCopyDstLayoutTransitionTsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-				h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
-					commandBuffer,
-					VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-					VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-					VkDependencyFlags(0),
-					uint32(0),
-					memory.Nullptr,
-					uint32(0),
-					memory.Nullptr,
-					uint32(len(preCopyDstImgBarriers)),
-					h.sb.MustAllocReadData(preCopyDstImgBarriers).Ptr(),
-				))
-			})
-			if err := preCopyDstLayoutTransitionTsk.commit(); err != nil {
-				return log.Errf(h.sb.ctx, err, "[Committing pre-copy destination image layout transition commands]")
+			barrierAspects[aspectMask] = struct{}{}
+			// The copies of all the levels and layers are already batched
+			// into as few VkCmdCopyBufferToImage commands as the scratch
+			// buffer size allows, so only the layout transitions around them
+			// are coalesced: a single barrier covers the whole image if all
+			// its subresources share the same layouts.
+			layers, levels := dstImg.Info().ArrayLayers(), dstImg.Info().MipLevels()
+			newBarrier := func(r ipLayoutRange, oldLayout, newLayout VkImageLayout) VkImageMemoryBarrier {
+				return NewVkImageMemoryBarrier(h.sb.ta,
+					VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
+					0, // pNext
+					VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // srcAccessMask
+					VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // dstAccessMask
+					oldLayout,             // oldLayout
+					newLayout,             // newLayout
+					queueFamilyIgnore,     // srcQueueFamilyIndex
+					queueFamilyIgnore,     // dstQueueFamilyIndex
+					dstImg.VulkanHandle(), // image
+					NewVkImageSubresourceRange(h.sb.ta, // subresourceRange
+						aspectMask,              // aspectMask
+						r.levelBegin,            // baseMipLevel
+						r.levelEnd-r.levelBegin, // levelCount
+						r.layerBegin,            // baseArrayLayer
+						r.layerEnd-r.layerBegin, // layerCount
+					),
+				)
 			}
+			for _, r := range ipCoalescedLayoutRanges(layers, levels, func(layer, level uint32) VkImageLayout {
+				return initLayouts.layoutOf(dstAspect, layer, level)
+			}) {
+				preCopyDstImgBarriers = append(preCopyDstImgBarriers,
+					newBarrier(r, r.layout, VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL))
+			}
+			for _, r := range ipCoalescedLayoutRanges(layers, levels, func(layer, level uint32) VkImageLayout {
+				return ipDstLayout(finalLayouts.layoutOf(dstAspect, layer, level), VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL)
+			}) {
+				postCopyDstImgBarriers = append(postCopyDstImgBarriers,
+					newBarrier(r, VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL, r.layout))
+			}
+		}
 
-			notProcessedCopies := h.copies[dstImg]
-			notProcessedContent := h.content[dstImg]
-			for len(notProcessedCopies) != 0 && len(notProcessedContent) != 0 {
-				copies := []VkBufferImageCopy{}
-				bufContent := []bufferSubRangeFillInfo{}
-				bufOffset := uint64(0)
-				tsk := h.sb.newScratchTaskOnQueue(queue)
-				addIthCopyAndContent := func(i int) {
-					copy := notProcessedCopies[i]
-					copy.SetBufferOffset(VkDeviceSize(bufOffset))
-					copies = append(copies, copy)
-					content := notProcessedContent[i]
-					content.setOffsetInBuffer(bufOffset)
-					bufContent = append(bufContent, content)
-					bufOffset += content.size()
-				}
-
-				addIthCopyAndContent(0)
-				for i := 1; i < len(notProcessedCopies); i++ {
-					if nextMultipleOf(bufOffset+notProcessedContent[i].size(), 256) > scratchBufferSize {
-						break
-					}
-					addIthCopyAndContent(i)
-				}
-
-				notProcessedCopies = notProcessedCopies[len(copies):]
-				notProcessedContent = notProcessedContent[len(copies):]
-				// scratch buffer will be destroyed once the scratch task finishes.
-				scratchBuffer := tsk.newBuffer(bufContent, VkBufferUsageFlagBits_VK_BUFFER_USAGE_TRANSFER_SRC_BIT)
-
-				tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-					h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
-						commandBuffer,
-						VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-						VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-						VkDependencyFlags(0),
-						uint32(0),
-						memory.Nullptr,
-						uint32(1),
-						h.sb.MustAllocReadData(
-							NewVkBufferMemoryBarrier(h.sb.ta,
-								VkStructureType_VK_STRUCTURE_TYPE_BUFFER_MEMORY_BARRIER, // sType
-								0, // pNext
-								VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // srcAccessMask
-								VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // dstAccessMask
-								queueFamilyIgnore,       // srcQueueFamilyIndex
-								queueFamilyIgnore,       // dstQueueFamilyIndex
-								scratchBuffer,           // buffer
-								0,                       // offset
-								VkDeviceSize(bufOffset), // size
-							)).Ptr(),
-						uint32(0),
-						memory.Nullptr,
-					))
-				})
-
-				tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-					h.sb.write(h.sb.cb.VkCmdCopyBufferToImage(
-						commandBuffer,
-						scratchBuffer,
-						dstImg.VulkanHandle(),
-						VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,
-						uint32(len(copies)),
-						h.sb.MustAllocReadData(copies).Ptr(),
-					))
-				})
+		preCopyDstLayoutTransitionTsk := h.sb.newScratchTaskOnQueue(queue)
+		preCopyDstLayoutTransitionTsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+			h.sb.writeImageBarriers(commandBuffer,
+				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+				preCopyDstImgBarriers)
+		})
+		if err := preCopyDstLayoutTransitionTsk.commit(); err != nil {
+			return log.Errf(ctx, err, "[Committing pre-copy destination image layout transition commands]")
+		}
 
-				tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-					h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
-						commandBuffer,
-						VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-						VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-						VkDependencyFlags(0),
-						uint32(0),
-						memory.Nullptr,
-						uint32(0),
-						memory.Nullptr,
-						uint32(0),
-						memory.Nullptr,
-					))
-				})
-				if err := tsk.commit(); err != nil {
-					return log.Errf(h.sb.ctx, err, "[Committing scratch buffer filling and image copy commands, scratch buffer size: %v]", bufOffset)
+		// Copies of different aspects of the same image are interleaved and
+		// carried out by the same VkCmdCopyBufferToImage command. Each copy in
+		// the shared scratch buffer starts at an offset aligned to the
+		// requirement of its own aspect.
+		notProcessedCopies, notProcessedContent := h.interleavedCopiesAndContent(dstImg)
+		for len(notProcessedCopies) != 0 && len(notProcessedContent) != 0 {
+			copies := []VkBufferImageCopy{}
+			bufContent := []bufferSubRangeFillInfo{}
+			bufOffset := uint64(0)
+			tsk := h.sb.newScratchTaskOnQueue(queue)
+			addIthCopyAndContent := func(i int) {
+				copy := notProcessedCopies[i]
+				bufOffset = nextMultipleOf(bufOffset, h.bufferOffsetAlignment(dstImg,
+					VkImageAspectFlagBits(copy.ImageSubresource().AspectMask())))
+				copy.SetBufferOffset(VkDeviceSize(bufOffset))
+				copies = append(copies, copy)
+				content := notProcessedContent[i]
+				bufContent = append(bufContent, content.placedAt(bufOffset)...)
+				bufOffset += content.size()
+			}
+
+			addIthCopyAndContent(0)
+			for i := 1; i < len(notProcessedCopies); i++ {
+				nextOffset := nextMultipleOf(bufOffset, h.bufferOffsetAlignment(dstImg,
+					VkImageAspectFlagBits(notProcessedCopies[i].ImageSubresource().AspectMask())))
+				if nextOffset+notProcessedContent[i].size() > scratchBufferSize {
+					break
 				}
+				addIthCopyAndContent(i)
 			}
-			postCopyDstLayoutTransitionTsk := h.sb.newScratchTaskOnQueue(queue)
-			postCopyDstLayoutTransitionTsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+
+			notProcessedCopies = notProcessedCopies[len(copies):]
+			notProcessedContent = notProcessedContent[len(copies):]
+			// scratch buffer will be destroyed once the scratch task finishes.
+			scratchBuffer := tsk.newBuffer(bufContent, VkBufferUsageFlagBits_VK_BUFFER_USAGE_TRANSFER_SRC_BIT)
+
+			tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+				h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
+					commandBuffer,
+					VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+					VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+					VkDependencyFlags(0),
+					uint32(0),
+					memory.Nullptr,
+					uint32(1),
+					h.sb.MustAllocReadData(
+						NewVkBufferMemoryBarrier(h.sb.ta,
+							VkStructureType_VK_STRUCTURE_TYPE_BUFFER_MEMORY_BARRIER, // sType
+							0, // pNext
+							VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // srcAccessMask
+							VkAccessFlags((VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT-1)|VkAccessFlagBits_VK_ACCESS_MEMORY_WRITE_BIT), // dstAccessMask
+							queueFamilyIgnore,       // srcQueueFamilyIndex
+							queueFamilyIgnore,       // dstQueueFamilyIndex
+							scratchBuffer,           // buffer
+							0,                       // offset
+							VkDeviceSize(bufOffset), // size
+						)).Ptr(),
+					uint32(0),
+					memory.Nullptr,
+				))
+			})
+
+			tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+				h.sb.write(h.sb.cb.VkCmdCopyBufferToImage(
+					commandBuffer,
+					scratchBuffer,
+					dstImg.VulkanHandle(),
+					VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,
+					uint32(len(copies)),
+					h.sb.MustAllocReadData(copies).Ptr(),
+				))
+			})
+
+			tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
 				h.sb.write(h.sb.cb.VkCmdPipelineBarrier(
 					commandBuffer,
 					VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
@@ -1992,20 +4821,154 @@ func (h *ipBufferImageCopySession) rolloutBufCopies(queue VkQueue, initLayouts,
 					memory.Nullptr,
 					uint32(0),
 					memory.Nullptr,
-					uint32(len(postCopyDstImgBarriers)),
-					h.sb.MustAllocReadData(postCopyDstImgBarriers).Ptr(),
+					uint32(0),
+					memory.Nullptr,
 				))
 			})
-			if err := postCopyDstLayoutTransitionTsk.commit(); err != nil {
-				return log.Errf(h.sb.ctx, err, "[Committing post-copy destination image layout transition commands]")
+			if err := tsk.commit(); err != nil {
+				return log.Errf(ctx, err, "[Committing scratch buffer filling and image copy commands, scratch buffer size: %v]", bufOffset)
 			}
 		}
+		postCopyDstLayoutTransitionTsk := h.sb.newScratchTaskOnQueue(queue)
+		postCopyDstLayoutTransitionTsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+			h.sb.writeImageBarriers(commandBuffer,
+				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
+				postCopyDstImgBarriers)
+		})
+		if err := postCopyDstLayoutTransitionTsk.commit(); err != nil {
+			return log.Errf(ctx, err, "[Committing post-copy destination image layout transition commands]")
+		}
+	}
+	if err := h.collectErr(); err != nil {
+		return log.Errf(ctx, err, "[Collecting buf->img copies]")
 	}
 	return nil
 }
 
 // internal functions of ipBufferCopSessionr
 
+// dstImages returns all the destination images of this copy session, with
+// the images for the source aspects with lower bit values coming first.
+func (h *ipBufferImageCopySession) dstImages() []ImageObjectʳ {
+	imgs := []ImageObjectʳ{}
+	seen := map[ImageObjectʳ]struct{}{}
+	for _, srcAspect := range h.srcAspects() {
+		for _, img := range h.job.srcAspectsToDsts[srcAspect].dstImgs {
+			if _, ok := seen[img]; ok {
+				continue
+			}
+			seen[img] = struct{}{}
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs
+}
+
+// dstAspects returns all the aspects of the given image to be written by this
+// copy session.
+func (h *ipBufferImageCopySession) dstAspects(dstImg ImageObjectʳ) []VkImageAspectFlagBits {
+	aspects := []VkImageAspectFlagBits{}
+	for _, srcAspect := range h.srcAspects() {
+		dst := h.job.srcAspectsToDsts[srcAspect]
+		for _, img := range dst.dstImgs {
+			if img == dstImg {
+				aspects = append(aspects, dst.dstAspect)
+				break
+			}
+		}
+	}
+	return aspects
+}
+
+// srcAspects returns the source aspects of the copy job in ascending order.
+func (h *ipBufferImageCopySession) srcAspects() []VkImageAspectFlagBits {
+	aspects := make([]VkImageAspectFlagBits, 0, len(h.job.srcAspectsToDsts))
+	for aspect := range h.job.srcAspectsToDsts {
+		aspects = append(aspects, aspect)
+	}
+	sort.Slice(aspects, func(i, j int) bool { return aspects[i] < aspects[j] })
+	return aspects
+}
+
+// bufferOffsetAlignment returns the alignment of the buffer offset for copies
+// to the given aspect of the given destination image. The offset must be a
+// multiple of the element size of the image format, and a multiple of 4 for
+// both depth/stencil aspects and the buffer copy command itself. It is also
+// rounded up to the optimalBufferCopyOffsetAlignment of the physical device.
+// Note that the optimalBufferCopyRowPitchAlignment does not apply here, as
+// the buffer content is always tightly packed, i.e. the bufferRowLength of
+// the copies is always 0.
+func (h *ipBufferImageCopySession) bufferOffsetAlignment(dstImg ImageObjectʳ, aspect VkImageAspectFlagBits) uint64 {
+	required := uint64(4)
+	if aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+		elementAndTexelInfo, err := subGetElementAndTexelBlockSize(h.sb.ctx, nil, api.CmdNoID, nil, h.sb.newState, GetState(h.sb.newState), 0, nil, nil, dstImg.Info().Fmt())
+		if err != nil || elementAndTexelInfo.ElementSize() == 0 {
+			required = 16
+		} else {
+			elementSize := uint64(elementAndTexelInfo.ElementSize())
+			required = elementSize
+			for required%4 != 0 {
+				required += elementSize
+			}
+		}
+	}
+	alignment := required
+	if optimal := h.optimalBufferCopyOffsetAlignment(dstImg); optimal > 1 {
+		for alignment%optimal != 0 {
+			alignment += required
+		}
+	}
+	return alignment
+}
+
+// optimalBufferCopyOffsetAlignment returns the optimalBufferCopyOffsetAlignment
+// of the physical device of the given image. If the physical device
+// properties are not available, 256, which is the upper bound of the limit,
+// is returned.
+func (h *ipBufferImageCopySession) optimalBufferCopyOffsetAlignment(img ImageObjectʳ) uint64 {
+	dev := h.sb.s.Devices().Get(img.Device())
+	if dev.IsNil() || !h.sb.s.PhysicalDevices().Contains(dev.PhysicalDevice()) {
+		return 256
+	}
+	alignment := uint64(h.sb.s.PhysicalDevices().Get(dev.PhysicalDevice()).PhysicalDeviceProperties().Limits().OptimalBufferCopyOffsetAlignment())
+	if alignment == 0 {
+		return 256
+	}
+	return alignment
+}
+
+// interleavedCopiesAndContent returns the copies and the corresponding buffer
+// content for the given destination image, sorted by array layer, mip level
+// and then aspect, so that the copies of different aspects to the same
+// subresource are next to each other.
+func (h *ipBufferImageCopySession) interleavedCopiesAndContent(dstImg ImageObjectʳ) ([]VkBufferImageCopy, []ipCopyContent) {
+	copies := h.copies[dstImg]
+	content := h.content[dstImg]
+	indices := make([]int, len(copies))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		a := copies[indices[i]].ImageSubresource()
+		b := copies[indices[j]].ImageSubresource()
+		if a.BaseArrayLayer() != b.BaseArrayLayer() {
+			return a.BaseArrayLayer() < b.BaseArrayLayer()
+		}
+		if a.MipLevel() != b.MipLevel() {
+			return a.MipLevel() < b.MipLevel()
+		}
+		return a.AspectMask() < b.AspectMask()
+	})
+	sortedCopies := make([]VkBufferImageCopy, 0, len(copies))
+	sortedContent := make([]ipCopyContent, 0, len(content))
+	for _, i := range indices {
+		sortedCopies = append(sortedCopies, copies[i])
+		sortedContent = append(sortedContent, content[i])
+	}
+	return sortedCopies, sortedContent
+}
+
 // getCopyAndData returns the buffer content and the VkBufferImageCopy struct
 // to be used to conduct the data copy from the specific subresource of the src
 // image to the corresponding subresource of the dst image. The returned content
@@ -2014,6 +4977,42 @@ func (h *ipBufferImageCopySession) rolloutBufCopies(queue VkQueue, initLayouts,
 // bufferSubRangeFillInfo's range begin at 0.
 func (h *ipBufferImageCopySession) getCopyAndData(dstImg ImageObjectʳ, dstAspect VkImageAspectFlagBits, srcImg ImageObjectʳ, srcAspect VkImageAspectFlagBits, layer, level uint32, opaqueBlockOffset VkOffset3D, opaqueBlockExtent VkExtent3D) (bufferSubRangeFillInfo, VkBufferImageCopy, error) {
 	var err error
+	// Sparse blocks at the edges of a level may extend past the level, only
+	// the region within the level is copied.
+	levelExtent := h.sb.levelSize(srcImg.Info().Extent(), srcImg.Info().Fmt(), level, srcAspect)
+	opaqueBlockExtent = ipClampBlockExtent(h.sb.ta, opaqueBlockOffset, opaqueBlockExtent,
+		uint32(levelExtent.width), uint32(levelExtent.height), uint32(levelExtent.depth))
+	if opaqueBlockExtent.Width() == 0 || opaqueBlockExtent.Height() == 0 || opaqueBlockExtent.Depth() == 0 {
+		return bufferSubRangeFillInfo{}, MakeVkBufferImageCopy(h.sb.ta), log.Errf(h.sb.ctx, nil, "region at offset: %v is out of the level: %v of image: %v", opaqueBlockOffset, level, srcImg.VulkanHandle())
+	}
+	dst := ipSubresource{aspect: srcAspect, layer: layer, level: level}
+	src := h.sourceOf(dst)
+	if src != dst {
+		srcLevelExtent := h.sb.levelSize(srcImg.Info().Extent(), srcImg.Info().Fmt(), src.level, srcAspect)
+		if err := ipCheckSourceSubresource(dst, src, levelExtent, srcLevelExtent, srcImg.Info().ArrayLayers(), srcImg.Info().MipLevels()); err != nil {
+			return bufferSubRangeFillInfo{}, MakeVkBufferImageCopy(h.sb.ta), log.Errf(h.sb.ctx, err, "[Remapping the source of subresource: %+v of image: %v]", dst, srcImg.VulkanHandle())
+		}
+	}
+	// The raw compressed blocks are copied to the staging images for block
+	// texel views, whose offsets and extents are measured in blocks.
+	dstOffset, dstExtent, blockTexel := opaqueBlockOffset, opaqueBlockExtent, false
+	if srcInfo, err := subGetElementAndTexelBlockSize(h.sb.ctx, nil, api.CmdNoID, nil, h.sb.oldState, GetState(h.sb.oldState), 0, nil, nil, srcImg.Info().Fmt()); err == nil {
+		f, ok := ipBlockTexelViewFormat(srcInfo.ElementSize())
+		blockWidth, blockHeight := srcInfo.TexelBlockSize().Width(), srcInfo.TexelBlockSize().Height()
+		if ok && (blockWidth != 1 || blockHeight != 1) && dstImg.Info().Fmt() == f {
+			blockTexel = true
+			dstOffset = NewVkOffset3D(h.sb.ta,
+				opaqueBlockOffset.X()/int32(blockWidth),
+				opaqueBlockOffset.Y()/int32(blockHeight),
+				opaqueBlockOffset.Z(),
+			)
+			dstExtent = NewVkExtent3D(h.sb.ta,
+				(opaqueBlockExtent.Width()+blockWidth-1)/blockWidth,
+				(opaqueBlockExtent.Height()+blockHeight-1)/blockHeight,
+				opaqueBlockExtent.Depth(),
+			)
+		}
+	}
 	bufImgCopy := NewVkBufferImageCopy(h.sb.ta,
 		VkDeviceSize(0), // bufferOffset
 		0,               // bufferRowLength
@@ -2024,8 +5023,8 @@ func (h *ipBufferImageCopySession) getCopyAndData(dstImg ImageObjectʳ, dstAspec
 			layer,                         // baseArrayLayer
 			1,                             // layerCount
 		),
-		opaqueBlockOffset, // imageOffset
-		opaqueBlockExtent, // imageExtent
+		dstOffset, // imageOffset
+		dstExtent, // imageExtent
 	)
 	srcImgDataOffset := uint64(h.sb.levelSize(NewVkExtent3D(h.sb.ta,
 		uint32(opaqueBlockOffset.X()),
@@ -2036,14 +5035,58 @@ func (h *ipBufferImageCopySession) getCopyAndData(dstImg ImageObjectʳ, dstAspec
 		opaqueBlockExtent,
 		srcImg.Info().Fmt(),
 		0, srcAspect).levelSize)
-	dataSlice := srcImg.
-		Aspects().Get(srcAspect).
-		Layers().Get(layer).
-		Levels().Get(level).
-		Data().Slice(srcImgDataOffset, srcImgDataOffset+srcImgDataSizeInBytes)
+	// The captured data of the subresource is not read when the caller
+	// supplies the data, the subresource may not have captured data at all.
+	var dataSlice U8ˢ
+	var srcBytes []uint8
+	walked := h.walked[src]
+	if walked != nil && uint64(len(walked.data)) < srcImgDataOffset+srcImgDataSizeInBytes {
+		walked = nil
+	}
+	if walked != nil {
+		srcBytes = walked.data[srcImgDataOffset : srcImgDataOffset+srcImgDataSizeInBytes]
+	} else if h.srcData != nil {
+		d, ok := h.srcData[src]
+		if !ok || uint64(len(d)) < srcImgDataOffset+srcImgDataSizeInBytes {
+			return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, nil, "no data supplied for image: %v, aspect: %v, layer: %v, level: %v, offset: %v, extent: %v", srcImg.VulkanHandle(), srcAspect, src.layer, src.level, opaqueBlockOffset, opaqueBlockExtent)
+		}
+		srcBytes = d[srcImgDataOffset : srcImgDataOffset+srcImgDataSizeInBytes]
+	} else {
+		dataSlice = srcImg.
+			Aspects().Get(srcAspect).
+			Layers().Get(src.layer).
+			Levels().Get(src.level).
+			Data().Slice(srcImgDataOffset, srcImgDataOffset+srcImgDataSizeInBytes)
+	}
+	readData := func() []uint8 {
+		if srcBytes != nil {
+			switch {
+			case walked == nil:
+				h.reads.reads++
+			case walked.used:
+				h.reads.saved++
+			}
+			if walked != nil {
+				walked.used = true
+			}
+			// Copy the caller supplied or walked data, so it won't be
+			// modified.
+			data := make([]uint8, len(srcBytes))
+			copy(data, srcBytes)
+			return data
+		}
+		if d, ok := h.prefetched[src]; ok && uint64(len(d)) >= srcImgDataOffset+srcImgDataSizeInBytes {
+			// Copy the prefetched data, so it won't be modified.
+			data := make([]uint8, srcImgDataSizeInBytes)
+			copy(data, d[srcImgDataOffset:])
+			return data
+		}
+		h.reads.reads++
+		return dataSlice.MustRead(h.sb.ctx, nil, h.sb.oldState, nil)
+	}
 
 	errorIfUnexpectedLength := func(dataLen uint64) error {
-		dstLevelSize := h.sb.levelSize(opaqueBlockExtent, dstImg.Info().Fmt(), 0, dstAspect)
+		dstLevelSize := h.sb.levelSize(dstExtent, dstImg.Info().Fmt(), 0, dstAspect)
 		if dataLen != dstLevelSize.alignedLevelSizeInBuf {
 			return log.Errf(h.sb.ctx, nil, "size of unpackedData data does not match expectation, actual: %v, expected: %v, srcFmt: %v, dstFmt: %v", dataLen, dstLevelSize.alignedLevelSizeInBuf, srcImg.Info().Fmt(), dstImg.Info().Fmt())
 		}
@@ -2052,32 +5095,65 @@ func (h *ipBufferImageCopySession) getCopyAndData(dstImg ImageObjectʳ, dstAspec
 
 	unpackedData := []uint8{}
 
-	if dstImg.Info().Fmt() != srcImg.Info().Fmt() {
+	if !blockTexel && ipNeedsUnpacking(srcImg.Info().Fmt(), dstImg.Info().Fmt(), srcAspect) {
 		// dstImg format is different with the srcImage format, the dst image
 		// should be a staging image.
 		srcVkFmt := srcImg.Info().Fmt()
-		data := dataSlice.MustRead(h.sb.ctx, nil, h.sb.oldState, nil)
-		if srcVkFmt == VkFormat_VK_FORMAT_E5B9G9R9_UFLOAT_PACK32 {
-			data, srcVkFmt, err = ebgrDataToRGB32SFloat(data, opaqueBlockExtent)
+		data := readData()
+		bigEndian := ipEndian(h.sb) == device.BigEndian
+		if bigEndian {
+			data, err = ipSwapDataBytes(data, srcVkFmt, srcAspect)
+			if err != nil {
+				return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Converting data in %v to little endian]", srcVkFmt)
+			}
+		}
+		if isPackedFloatFormat(srcVkFmt) {
+			data, srcVkFmt, err = packedFloatDataToRGB32SFloat(data, srcVkFmt, opaqueBlockExtent)
+			if err != nil {
+				return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Converting data in %v to VK_FORMAT_R32G32B32_SFLOAT]", srcImg.Info().Fmt())
+			}
+		}
+		if _, ok := astcDecodedFormat(srcVkFmt); ok {
+			data, srcVkFmt, err = astcDataToUncompressed(data, srcVkFmt, opaqueBlockExtent)
 			if err != nil {
-				return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Converting data in VK_FORMAT_E5B9G9R9_UFLOAT_PACK32 to VK_FORMAT_R32G32B32_SFLOAT]")
+				return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Decoding data in %v]", srcImg.Info().Fmt())
 			}
 		}
-		unpackedData, _, err = unpackDataForPriming(h.sb.ctx, data, srcVkFmt, srcAspect)
+		unpackedData, err = unpackDataForPriming(h.sb.ctx, data, srcVkFmt, dstImg.Info().Fmt(), srcAspect)
 		if err != nil {
 			return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Unpacking data from format: %v aspect: %v]", srcVkFmt, srcAspect)
 		}
+		if bigEndian {
+			// The staging images are color images.
+			unpackedData, err = ipSwapDataBytes(unpackedData, dstImg.Info().Fmt(), VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT)
+			if err != nil {
+				return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Converting data in %v to big endian]", dstImg.Info().Fmt())
+			}
+		}
 
 	} else if srcAspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT {
 		// srcImg format is the same to the dstImage format, the data is ready to
 		// be used directly, except when the src image is a dpeth 24 UNORM one.
 		if (srcImg.Info().Fmt() == VkFormat_VK_FORMAT_D24_UNORM_S8_UINT) ||
 			(srcImg.Info().Fmt() == VkFormat_VK_FORMAT_X8_D24_UNORM_PACK32) {
-			data := dataSlice.MustRead(h.sb.ctx, nil, h.sb.oldState, nil)
-			unpackedData, _, err = unpackDataForPriming(h.sb.ctx, data, srcImg.Info().Fmt(), srcAspect)
+			data := readData()
+			bigEndian := ipEndian(h.sb) == device.BigEndian
+			if bigEndian {
+				data, err = ipSwapDataBytes(data, srcImg.Info().Fmt(), srcAspect)
+				if err != nil {
+					return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Converting data in %v to little endian]", srcImg.Info().Fmt())
+				}
+			}
+			unpackedData, err = unpackDataForPriming(h.sb.ctx, data, srcImg.Info().Fmt(), stagingDepthStencilImageBufferFormat, srcAspect)
 			if err != nil {
 				return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Unpacking data from format: %v aspect: %v]", srcImg.Info().Fmt(), srcAspect)
 			}
+			if bigEndian {
+				unpackedData, err = ipSwapDataBytes(unpackedData, stagingDepthStencilImageBufferFormat, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT)
+				if err != nil {
+					return bufferSubRangeFillInfo{}, bufImgCopy, log.Errf(h.sb.ctx, err, "[Converting data in %v to big endian]", stagingDepthStencilImageBufferFormat)
+				}
+			}
 		}
 	}
 
@@ -2086,26 +5162,87 @@ func (h *ipBufferImageCopySession) getCopyAndData(dstImg ImageObjectʳ, dstAspec
 		if err := errorIfUnexpectedLength(uint64(len(unpackedData))); err != nil {
 			return bufferSubRangeFillInfo{}, bufImgCopy, err
 		}
-	} else if dataSlice.Size()%8 != 0 {
-		unpackedData = dataSlice.MustRead(h.sb.ctx, nil, h.sb.oldState, nil)
+	} else if srcImgDataSizeInBytes%8 != 0 {
+		unpackedData = readData()
 		extendToMultipleOf8(&unpackedData)
 		if err := errorIfUnexpectedLength(uint64(len(unpackedData))); err != nil {
 			return bufferSubRangeFillInfo{}, bufImgCopy, err
 		}
 	} else {
-		if err := errorIfUnexpectedLength(dataSlice.Size()); err != nil {
+		if err := errorIfUnexpectedLength(srcImgDataSizeInBytes); err != nil {
 			return bufferSubRangeFillInfo{}, bufImgCopy, err
 		}
+		if srcBytes != nil {
+			unpackedData = readData()
+		}
 	}
 
 	if len(unpackedData) != 0 {
 		return newBufferSubRangeFillInfoFromNewData(unpackedData, 0), bufImgCopy, nil
 	}
+	// The slice is read when the buffer is filled.
+	h.reads.reads++
 	return newBufferSubRangeFillInfoFromSlice(h.sb, dataSlice, 0), bufImgCopy, nil
 }
 
 // free functions
 
+// ipCheckDescriptorType returns an error if the given binding does not exist in
+// the given descriptor types of the bindings of a descriptor set layout, or if
+// its descriptor type is not the given one.
+func ipCheckDescriptorType(types map[uint32]VkDescriptorType, binding uint32, descType VkDescriptorType) error {
+	t, ok := types[binding]
+	if !ok {
+		return fmt.Errorf("binding: %v is not in the descriptor set layout", binding)
+	}
+	if t != descType {
+		return fmt.Errorf("descriptor type: %v does not match the type: %v of binding: %v in the descriptor set layout", descType, t, binding)
+	}
+	return nil
+}
+
+// ipCheckSourceSubresource returns an error if the given destination
+// subresource, whose level has the given extent, can not be primed with the
+// data of the given source subresource, whose level has the given extent, of
+// an image with the given numbers of array layers and mip levels. The data is
+// copied without scaling, so the two subresources must be of the same aspect
+// and extent.
+func ipCheckSourceSubresource(dst, src ipSubresource, dstExtent, srcExtent byteSizeAndExtent, arrayLayers, mipLevels uint32) error {
+	switch {
+	case src.aspect != dst.aspect:
+		return fmt.Errorf("source aspect: %v is not the destination aspect: %v", src.aspect, dst.aspect)
+	case src.layer >= arrayLayers || src.level >= mipLevels:
+		return fmt.Errorf("source subresource: %+v does not exist", src)
+	case srcExtent.width != dstExtent.width || srcExtent.height != dstExtent.height || srcExtent.depth != dstExtent.depth:
+		return fmt.Errorf("extent of source level: %v (%vx%vx%v) does not match the extent of destination level: %v (%vx%vx%v)",
+			src.level, srcExtent.width, srcExtent.height, srcExtent.depth,
+			dst.level, dstExtent.width, dstExtent.height, dstExtent.depth)
+	}
+	return nil
+}
+
+// ipClampBlockExtent returns the extent of the region at the given offset with
+// the given extent, clamped to the given extent of the level, so that a sparse
+// block at the edge of a level whose extent is not a multiple of the block
+// size only covers the texels of the level. The returned extent is empty if
+// the offset is out of the level.
+func ipClampBlockExtent(a arena.Arena, offset VkOffset3D, extent VkExtent3D, levelWidth, levelHeight, levelDepth uint32) VkExtent3D {
+	clamp := func(offset int32, size, levelSize uint32) uint32 {
+		if offset < 0 || uint32(offset) >= levelSize {
+			return 0
+		}
+		if remaining := levelSize - uint32(offset); size > remaining {
+			return remaining
+		}
+		return size
+	}
+	return NewVkExtent3D(a,
+		clamp(offset.X(), extent.Width(), levelWidth),
+		clamp(offset.Y(), extent.Height(), levelHeight),
+		clamp(offset.Z(), extent.Depth(), levelDepth),
+	)
+}
+
 func extendToMultipleOf8(dataPtr *[]uint8) {
 	l := uint64(len(*dataPtr))
 	nl := nextMultipleOf(l, 8)
@@ -2113,46 +5250,44 @@ func extendToMultipleOf8(dataPtr *[]uint8) {
 	*dataPtr = append(*dataPtr, zeros...)
 }
 
-func unpackDataForPriming(ctx context.Context, data []uint8, srcFmt VkFormat, aspect VkImageAspectFlagBits) ([]uint8, VkFormat, error) {
+// unpackDataForPriming unpacks the data of the given aspect in srcFmt to the
+// given staging format dstFmt.
+func unpackDataForPriming(ctx context.Context, data []uint8, srcFmt, dstFmt VkFormat, aspect VkImageAspectFlagBits) ([]uint8, error) {
 	ctx = log.Enter(ctx, "unpackDataForPriming")
 	var sf *image.Format
 	var err error
-	var dstFmt VkFormat
 	switch aspect {
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
 		sf, err = getImageFormatFromVulkanFormat(srcFmt)
 		if err != nil {
-			return []uint8{}, dstFmt, log.Errf(ctx, err, "[Getting image.Format for VkFormat: %v, aspect: %v]", srcFmt, aspect)
+			return []uint8{}, log.Errf(ctx, err, "[Getting image.Format for VkFormat: %v, aspect: %v]", srcFmt, aspect)
 		}
-		dstFmt = stagingColorImageBufferFormat
 
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT:
 		sf, err = getDepthImageFormatFromVulkanFormat(srcFmt)
 		if err != nil {
-			return []uint8{}, dstFmt, log.Errf(ctx, err, "[Getting image.Format for VkFormat: %v, aspect: %v]", srcFmt, aspect)
+			return []uint8{}, log.Errf(ctx, err, "[Getting image.Format for VkFormat: %v, aspect: %v]", srcFmt, aspect)
 		}
-		dstFmt = stagingDepthStencilImageBufferFormat
 
 	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
 		sf, err = getImageFormatFromVulkanFormat(VkFormat_VK_FORMAT_S8_UINT)
 		if err != nil {
-			return []uint8{}, dstFmt, log.Errf(ctx, err, "[Getting image.Format for VkFormat: %v, aspect: %v]", srcFmt, aspect)
+			return []uint8{}, log.Errf(ctx, err, "[Getting image.Format for VkFormat: %v, aspect: %v]", srcFmt, aspect)
 		}
-		dstFmt = stagingDepthStencilImageBufferFormat
 
 	default:
-		return []uint8{}, dstFmt, log.Errf(ctx, nil, "unsupported aspect: %v", aspect)
+		return []uint8{}, log.Errf(ctx, nil, "unsupported aspect: %v", aspect)
 	}
 
 	df, err := getImageFormatFromVulkanFormat(dstFmt)
 	if err != nil {
-		return []uint8{}, dstFmt, log.Errf(ctx, err, "[Getting image.Format for VkFormat %v]", dstFmt)
+		return []uint8{}, log.Errf(ctx, err, "[Getting image.Format for VkFormat %v]", dstFmt)
 	}
 	unpacked, err := unpackData(ctx, data, sf, df)
 	if err != nil {
-		return []uint8{}, dstFmt, err
+		return []uint8{}, err
 	}
-	return unpacked, dstFmt, nil
+	return unpacked, nil
 }
 
 func unpackData(ctx context.Context, data []uint8, srcFmt, dstFmt *image.Format) ([]uint8, error) {
@@ -2213,9 +5348,70 @@ func unpackData(ctx context.Context, data []uint8, srcFmt, dstFmt *image.Format)
 	return converted, nil
 }
 
-func ebgrDataToRGB32SFloat(data []uint8, extent VkExtent3D) ([]uint8, VkFormat, error) {
+// isPackedFloatFormat returns true if the given format is a packed float
+// format, either with shared exponent or with separate small float channels,
+// whose data need to be converted to R32G32B32_SFLOAT before unpacking.
+func isPackedFloatFormat(vkFmt VkFormat) bool {
+	switch vkFmt {
+	case VkFormat_VK_FORMAT_E5B9G9R9_UFLOAT_PACK32,
+		VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32:
+		return true
+	}
+	return false
+}
+
+// packedFloatDataToRGB32SFloat converts the given data in the given packed float
+// format to R32G32B32_SFLOAT, returns the converted data, the new format and
+// error.
+func packedFloatDataToRGB32SFloat(data []uint8, srcFmt VkFormat, extent VkExtent3D) ([]uint8, VkFormat, error) {
 	dstFmt := VkFormat_VK_FORMAT_R32G32B32_SFLOAT
-	sf, err := getImageFormatFromVulkanFormat(VkFormat_VK_FORMAT_E5B9G9R9_UFLOAT_PACK32)
+	if !isPackedFloatFormat(srcFmt) {
+		return []uint8{}, dstFmt, fmt.Errorf("not a packed float format: %v", srcFmt)
+	}
+	sf, err := getImageFormatFromVulkanFormat(srcFmt)
+	if err != nil {
+		return []uint8{}, dstFmt, err
+	}
+	df, err := getImageFormatFromVulkanFormat(dstFmt)
+	if err != nil {
+		return []uint8{}, dstFmt, err
+	}
+	retData, err := image.Convert(data, int(extent.Width()), int(extent.Height()), int(extent.Depth()), sf, df)
+	if err != nil {
+		return []uint8{}, dstFmt, err
+	}
+	return retData, dstFmt, nil
+}
+
+// astcDecodedFormat returns the uncompressed format that the data in the given
+// ASTC format is decoded to, and true, or false if the given format is not an
+// ASTC format. The SFLOAT formats are decoded with the HDR profile, whose
+// values may be out of [0, 1], to R32G32B32A32_SFLOAT. The UNORM and SRGB
+// formats are decoded with the LDR profile to the 8-bit format of the same
+// encoding.
+func astcDecodedFormat(vkFmt VkFormat) (VkFormat, bool) {
+	f, err := getImageFormatFromVulkanFormat(vkFmt)
+	if err != nil || f.GetAstc() == nil {
+		return VkFormat_VK_FORMAT_UNDEFINED, false
+	}
+	switch {
+	case f.GetAstc().Hdr:
+		return VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT, true
+	case f.GetAstc().Srgb:
+		return VkFormat_VK_FORMAT_R8G8B8A8_SRGB, true
+	}
+	return VkFormat_VK_FORMAT_R8G8B8A8_UNORM, true
+}
+
+// astcDataToUncompressed decodes the given data in the given ASTC format to
+// the format returned by astcDecodedFormat, returns the decoded data, the new
+// format and error.
+func astcDataToUncompressed(data []uint8, srcFmt VkFormat, extent VkExtent3D) ([]uint8, VkFormat, error) {
+	dstFmt, ok := astcDecodedFormat(srcFmt)
+	if !ok {
+		return []uint8{}, dstFmt, fmt.Errorf("not an ASTC format: %v", srcFmt)
+	}
+	sf, err := getImageFormatFromVulkanFormat(srcFmt)
 	if err != nil {
 		return []uint8{}, dstFmt, err
 	}
@@ -2230,6 +5426,22 @@ func ebgrDataToRGB32SFloat(data []uint8, extent VkExtent3D) ([]uint8, VkFormat,
 	return retData, dstFmt, nil
 }
 
+// ipValidateImageInfo returns an error if the given image info describes an
+// image without any subresources, i.e. with zero array layers, zero mip levels
+// or an empty extent. Priming such an image would do nothing and report
+// success, which usually means the captured image info is corrupted.
+func ipValidateImageInfo(info ImageInfo) error {
+	switch {
+	case info.ArrayLayers() == 0:
+		return fmt.Errorf("Image has zero array layers")
+	case info.MipLevels() == 0:
+		return fmt.Errorf("Image has zero mip levels")
+	case info.Extent().Width() == 0 || info.Extent().Height() == 0 || info.Extent().Depth() == 0:
+		return fmt.Errorf("Image has empty extent: %v", info.Extent())
+	}
+	return nil
+}
+
 func isDenseBound(img ImageObjectʳ) bool {
 	return img.PlaneMemoryInfo().Len() > 0 && func() bool {
 		for _, m := range img.PlaneMemoryInfo().All() {
@@ -2241,6 +5453,91 @@ func isDenseBound(img ImageObjectʳ) bool {
 	}()
 }
 
+// ipImageMemoryBinding is a range of device memory bound to an image or a
+// plane of an image.
+type ipImageMemoryBinding struct {
+	img    VkImage
+	mem    VkDeviceMemory
+	offset VkDeviceSize
+	size   VkDeviceSize
+}
+
+// ipAliasedImageGroups returns the groups of images whose bindings overlap,
+// directly or through other images, in the same device memory. Only groups of
+// more than one image are returned, ordered by the memory handles and then by
+// the offsets of the bindings.
+func ipAliasedImageGroups(bindings []ipImageMemoryBinding) [][]VkImage {
+	mems := []VkDeviceMemory{}
+	bindingsOfMem := map[VkDeviceMemory][]ipImageMemoryBinding{}
+	for _, b := range bindings {
+		if b.size == 0 {
+			continue
+		}
+		if _, ok := bindingsOfMem[b.mem]; !ok {
+			mems = append(mems, b.mem)
+		}
+		bindingsOfMem[b.mem] = append(bindingsOfMem[b.mem], b)
+	}
+	sort.Slice(mems, func(i, j int) bool { return mems[i] < mems[j] })
+
+	groups := [][]VkImage{}
+	for _, mem := range mems {
+		bs := bindingsOfMem[mem]
+		sort.SliceStable(bs, func(i, j int) bool { return bs[i].offset < bs[j].offset })
+		group := []VkImage{}
+		end := VkDeviceSize(0)
+		for _, b := range bs {
+			if len(group) > 0 && b.offset >= end {
+				if len(group) > 1 {
+					groups = append(groups, group)
+				}
+				group = []VkImage{}
+			}
+			if len(group) == 0 || b.offset+b.size > end {
+				end = b.offset + b.size
+			}
+			found := false
+			for _, img := range group {
+				found = found || img == b.img
+			}
+			if !found {
+				group = append(group, b.img)
+			}
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// warnAliasedImages logs a warning for each group of dense bound images that
+// alias the same device memory in the old state. The recreated images are
+// bound to the same recreated memory, but each of them is primed with its own
+// data in the order of the image handles, so the memory contents will be
+// taken from the last primed image of the group, which may not be the one the
+// application wrote last.
+func (p *imagePrimer) warnAliasedImages() {
+	bindings := []ipImageMemoryBinding{}
+	for _, handle := range GetState(p.sb.oldState).Images().Keys() {
+		img := GetState(p.sb.oldState).Images().Get(handle)
+		if img.IsSwapchainImage() || !isDenseBound(img) {
+			continue
+		}
+		for _, planeMemInfo := range img.PlaneMemoryInfo().All() {
+			bindings = append(bindings, ipImageMemoryBinding{
+				img:    handle,
+				mem:    planeMemInfo.BoundMemory().VulkanHandle(),
+				offset: planeMemInfo.BoundMemoryOffset(),
+				size:   planeMemInfo.MemoryRequirements().Size(),
+			})
+		}
+	}
+	for _, group := range ipAliasedImageGroups(bindings) {
+		log.W(p.sb.ctx, "Images: %v alias the same device memory, their data are primed independently, the memory contents may not match the ones in the capture", group)
+	}
+}
+
 func isSparseBound(img ImageObjectʳ) bool {
 	return (img.SparseImageMemoryBindings().Len() > 0 || img.OpaqueSparseMemoryBindings().Len() > 0) && ((uint64(img.Info().Flags()) & uint64(VkImageCreateFlagBits_VK_IMAGE_CREATE_SPARSE_BINDING_BIT)) != 0)
 }
@@ -2261,6 +5558,25 @@ func vkCreateImage(sb *stateBuilder, dev VkDevice, info ImageInfo, handle VkImag
 			),
 		).Ptr())
 	}
+	if viewFormats := imageViewFormats(info); len(viewFormats) > 0 {
+		pNext = NewVoidᶜᵖ(sb.MustAllocReadData(
+			NewVkImageFormatListCreateInfoKHR(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_IMAGE_FORMAT_LIST_CREATE_INFO_KHR, // sType
+				pNext,                    // pNext
+				uint32(len(viewFormats)), // viewFormatCount
+				NewVkFormatᶜᵖ(sb.MustAllocReadData(viewFormats).Ptr()), // pViewFormats
+			),
+		).Ptr())
+	}
+	if !info.ExternalMemory().IsNil() {
+		pNext = NewVoidᶜᵖ(sb.MustAllocReadData(
+			NewVkExternalMemoryImageCreateInfo(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_EXTERNAL_MEMORY_IMAGE_CREATE_INFO, // sType
+				pNext,                               // pNext
+				info.ExternalMemory().HandleTypes(), // handleTypes
+			),
+		).Ptr())
+	}
 
 	create := sb.cb.VkCreateImage(
 		dev, sb.MustAllocReadData(
@@ -2307,13 +5623,13 @@ func vkGetImageMemoryRequirements(sb *stateBuilder, dev VkDevice, handle VkImage
 	))
 }
 
-func vkAllocateMemory(sb *stateBuilder, dev VkDevice, size VkDeviceSize, memTypeIndex uint32, handle VkDeviceMemory) {
+func vkAllocateMemory(sb *stateBuilder, dev VkDevice, size VkDeviceSize, memTypeIndex uint32, handle VkDeviceMemory, pNext Voidᶜᵖ) {
 	sb.write(sb.cb.VkAllocateMemory(
 		dev,
 		NewVkMemoryAllocateInfoᶜᵖ(sb.MustAllocReadData(
 			NewVkMemoryAllocateInfo(sb.ta,
 				VkStructureType_VK_STRUCTURE_TYPE_MEMORY_ALLOCATE_INFO, // sType
-				0,            // pNext
+				pNext,        // pNext
 				size,         // allocationSize
 				memTypeIndex, // memoryTypeIndex
 			)).Ptr()),
@@ -2323,12 +5639,128 @@ func vkAllocateMemory(sb *stateBuilder, dev VkDevice, size VkDeviceSize, memType
 	))
 }
 
+// ipMemoryAllocateFlagsPNext returns the given pNext chain of a
+// VkMemoryAllocateInfo, prepended with a VkMemoryAllocateFlagsInfo with the
+// allocate flags of the given memory, e.g. the device address flags of memory
+// allocated for the buffer device address feature, so the allocation
+// semantics are preserved. Returns the given pNext chain if the memory was
+// allocated without allocate flags.
+func ipMemoryAllocateFlagsPNext(sb *stateBuilder, mem DeviceMemoryObjectʳ, pNext Voidᶜᵖ) Voidᶜᵖ {
+	if mem.IsNil() || mem.AllocateFlags().IsNil() {
+		return pNext
+	}
+	return NewVoidᶜᵖ(sb.MustAllocReadData(
+		NewVkMemoryAllocateFlagsInfo(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_MEMORY_ALLOCATE_FLAGS_INFO, // sType
+			pNext,                            // pNext
+			mem.AllocateFlags().Flags(),      // flags
+			mem.AllocateFlags().DeviceMask(), // deviceMask
+		),
+	).Ptr())
+}
+
+// ipExportMemoryAllocatePNext returns the given pNext chain of a
+// VkMemoryAllocateInfo, prepended with a VkExportMemoryAllocateInfo with the
+// export handle types of the given memory, so the images created with
+// VkExternalMemoryImageCreateInfo can still be bound to the memory. Returns
+// the given pNext chain if the memory was not allocated to be exported.
+func ipExportMemoryAllocatePNext(sb *stateBuilder, mem DeviceMemoryObjectʳ, pNext Voidᶜᵖ) Voidᶜᵖ {
+	if mem.IsNil() || mem.ExportMemory().IsNil() {
+		return pNext
+	}
+	return NewVoidᶜᵖ(sb.MustAllocReadData(
+		NewVkExportMemoryAllocateInfo(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_EXPORT_MEMORY_ALLOCATE_INFO, // sType
+			pNext,                            // pNext
+			mem.ExportMemory().HandleTypes(), // handleTypes
+		),
+	).Ptr())
+}
+
+// ipExternalMemoryReproducible returns true if the VkExternalMemoryImageCreateInfo
+// of an image with the given external handle types can be preserved when the
+// image is recreated and bound to memory recreated with the given export
+// handle types, i.e. the memory is also external and exports at least one of
+// the handle types of the image. The memory imported from external handles is
+// not tracked, and is recreated as normal memory, whose export handle types are
+// 0.
+func ipExternalMemoryReproducible(imageHandleTypes, memExportHandleTypes VkExternalMemoryHandleTypeFlags) bool {
+	return imageHandleTypes&memExportHandleTypes != 0
+}
+
+// ipExternalMemoryImageInfo returns the info to recreate an image with the
+// given info and bound memory, and whether its
+// VkExternalMemoryImageCreateInfo is preserved. If the external memory create
+// info can not be preserved, see ipExternalMemoryReproducible, a clone of the
+// info without it is returned, so the image is recreated as a normal image
+// bound to normal memory. The given info is returned as is if the image was
+// not created with external memory create info.
+func ipExternalMemoryImageInfo(a arena.Arena, info ImageInfo, mem DeviceMemoryObjectʳ) (ImageInfo, bool) {
+	if info.ExternalMemory().IsNil() {
+		return info, false
+	}
+	exportHandleTypes := VkExternalMemoryHandleTypeFlags(0)
+	if !mem.IsNil() && !mem.ExportMemory().IsNil() {
+		exportHandleTypes = mem.ExportMemory().HandleTypes()
+	}
+	if ipExternalMemoryReproducible(info.ExternalMemory().HandleTypes(), exportHandleTypes) {
+		return info, true
+	}
+	stripped := info.Clone(a, api.CloneContext{})
+	stripped.SetExternalMemory(NilExternalMemoryImageInfoʳ)
+	return stripped, false
+}
+
 func vkBindImageMemory(sb *stateBuilder, dev VkDevice, img VkImage, mem VkDeviceMemory, offset VkDeviceSize) {
 	sb.write(sb.cb.VkBindImageMemory(
 		dev, img, mem, offset, VkResult_VK_SUCCESS,
 	))
 }
 
+// vkBindImagePlaneMemory binds the given plane of a disjoint multi-planar
+// image with the given memory through vkBindImageMemory2.
+func vkBindImagePlaneMemory(sb *stateBuilder, dev VkDevice, img VkImage, mem VkDeviceMemory, offset VkDeviceSize, plane VkImageAspectFlagBits) {
+	planeInfo := NewVkBindImagePlaneMemoryInfo(sb.ta,
+		VkStructureType_VK_STRUCTURE_TYPE_BIND_IMAGE_PLANE_MEMORY_INFO, // sType
+		0,     // pNext
+		plane, // planeAspect
+	)
+	sb.write(sb.cb.VkBindImageMemory2(
+		dev,
+		1,
+		NewVkBindImageMemoryInfoᶜᵖ(sb.MustAllocReadData(
+			NewVkBindImageMemoryInfo(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_BIND_IMAGE_MEMORY_INFO, // sType
+				NewVoidᶜᵖ(sb.MustAllocReadData(planeInfo).Ptr()),         // pNext
+				img,    // image
+				mem,    // memory
+				offset, // memoryOffset
+			)).Ptr()),
+		VkResult_VK_SUCCESS,
+	))
+}
+
+// imageViewFormats returns the view formats listed in the
+// VkImageFormatListCreateInfoKHR the image was created with, in the order
+// they were given. Returns nil if no format list was given.
+func imageViewFormats(info ImageInfo) []VkFormat {
+	if info.ViewFormatList().IsNil() {
+		return nil
+	}
+	formats := info.ViewFormatList().ViewFormats()
+	viewFormats := make([]VkFormat, 0, formats.Len())
+	for _, i := range formats.Keys() {
+		viewFormats = append(viewFormats, formats.Get(i))
+	}
+	return viewFormats
+}
+
+// isDisjointImageInfo returns true if the given image info has the
+// VK_IMAGE_CREATE_DISJOINT_BIT flag.
+func isDisjointImageInfo(info ImageInfo) bool {
+	return info.Flags()&VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_DISJOINT_BIT) != 0
+}
+
 func vkCreateDescriptorSetLayout(sb *stateBuilder, dev VkDevice, bindings []VkDescriptorSetLayoutBinding, handle VkDescriptorSetLayout) {
 	sb.write(sb.cb.VkCreateDescriptorSetLayout(
 		dev,
@@ -2437,8 +5869,82 @@ func vkCreateDescriptorPool(sb *stateBuilder, dev VkDevice, flags VkDescriptorPo
 	))
 }
 
+func vkCreateSampler(sb *stateBuilder, dev VkDevice, filter VkFilter, handle VkSampler) {
+	sb.write(sb.cb.VkCreateSampler(
+		dev,
+		sb.MustAllocReadData(NewVkSamplerCreateInfo(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_SAMPLER_CREATE_INFO, // sType
+			0,      // pNext
+			0,      // flags
+			filter, // magFilter
+			filter, // minFilter
+			VkSamplerMipmapMode_VK_SAMPLER_MIPMAP_MODE_NEAREST,         // mipmapMode
+			VkSamplerAddressMode_VK_SAMPLER_ADDRESS_MODE_CLAMP_TO_EDGE, // addressModeU
+			VkSamplerAddressMode_VK_SAMPLER_ADDRESS_MODE_CLAMP_TO_EDGE, // addressModeV
+			VkSamplerAddressMode_VK_SAMPLER_ADDRESS_MODE_CLAMP_TO_EDGE, // addressModeW
+			0,                               // mipLodBias
+			0,                               // anisotropyEnable
+			1,                               // maxAnisotropy
+			0,                               // compareEnable
+			VkCompareOp_VK_COMPARE_OP_NEVER, // compareOp
+			0,                               // minLod
+			0,                               // maxLod
+			VkBorderColor_VK_BORDER_COLOR_FLOAT_TRANSPARENT_BLACK, // borderColor
+			0, // unnormalizedCoordinates
+		)).Ptr(),
+		memory.Nullptr,
+		sb.MustAllocWriteData(handle).Ptr(),
+		VkResult_VK_SUCCESS,
+	))
+}
+
 func writeDescriptorSet(sb *stateBuilder, dev VkDevice, descSet VkDescriptorSet, dstBinding, dstArrayElement uint32, descType VkDescriptorType, imgInfoList []VkDescriptorImageInfo, bufInfoList []VkDescriptorBufferInfo, texelBufInfoList []VkBufferView) {
-	write := NewVkWriteDescriptorSet(sb.ta,
+	writeDescriptorSets(sb, dev, newDescriptorSetWrite(sb, descSet, dstBinding, dstArrayElement, descType, imgInfoList, bufInfoList, texelBufInfoList))
+}
+
+// writeDescriptorSets emits a single VkUpdateDescriptorSets command which
+// applies all the given descriptor writes. The descriptor type of each write is
+// checked against the layout of its descriptor set if the set is known in the
+// new state, and mismatches are logged as errors.
+func writeDescriptorSets(sb *stateBuilder, dev VkDevice, writes ...VkWriteDescriptorSet) {
+	if len(writes) == 0 {
+		return
+	}
+	for _, w := range writes {
+		types := descriptorSetBindingTypes(sb, w.DstSet())
+		if types == nil {
+			continue
+		}
+		if err := ipCheckDescriptorType(types, w.DstBinding(), w.DescriptorType()); err != nil {
+			log.E(sb.ctx, "Writing descriptor set: %v: %v", w.DstSet(), err)
+		}
+	}
+	sb.write(sb.cb.VkUpdateDescriptorSets(
+		dev,
+		uint32(len(writes)),
+		NewVkWriteDescriptorSetᶜᵖ(sb.MustAllocReadData(writes).Ptr()),
+		0,
+		memory.Nullptr,
+	))
+}
+
+// descriptorSetBindingTypes returns the descriptor types of the bindings of the
+// layout of the given descriptor set in the new state, by binding. Returns nil
+// if the descriptor set or its layout is unknown.
+func descriptorSetBindingTypes(sb *stateBuilder, descSet VkDescriptorSet) map[uint32]VkDescriptorType {
+	set := GetState(sb.newState).DescriptorSets().Get(descSet)
+	if set.IsNil() || set.Layout().IsNil() {
+		return nil
+	}
+	types := map[uint32]VkDescriptorType{}
+	for binding, b := range set.Layout().Bindings().All() {
+		types[binding] = b.Type()
+	}
+	return types
+}
+
+func newDescriptorSetWrite(sb *stateBuilder, descSet VkDescriptorSet, dstBinding, dstArrayElement uint32, descType VkDescriptorType, imgInfoList []VkDescriptorImageInfo, bufInfoList []VkDescriptorBufferInfo, texelBufInfoList []VkBufferView) VkWriteDescriptorSet {
+	return NewVkWriteDescriptorSet(sb.ta,
 		VkStructureType_VK_STRUCTURE_TYPE_WRITE_DESCRIPTOR_SET, // sType
 		0,               // pNext
 		descSet,         // dstSet
@@ -2450,14 +5956,6 @@ func writeDescriptorSet(sb *stateBuilder, dev VkDevice, descSet VkDescriptorSet,
 		NewVkDescriptorBufferInfoᶜᵖ(sb.MustAllocReadData(bufInfoList).Ptr()), // pBufferInfo
 		NewVkBufferViewᶜᵖ(sb.MustAllocReadData(texelBufInfoList).Ptr()),      // pTexelBufferView
 	)
-
-	sb.write(sb.cb.VkUpdateDescriptorSets(
-		dev,
-		1,
-		NewVkWriteDescriptorSetᶜᵖ(sb.MustAllocReadData(write).Ptr()),
-		0,
-		memory.Nullptr,
-	))
 }
 
 func walkImageSubresourceRange(sb *stateBuilder, img ImageObjectʳ, rng VkImageSubresourceRange, f func(aspect VkImageAspectFlagBits, layer, level uint32, levelSize byteSizeAndExtent)) {
@@ -2475,6 +5973,26 @@ func walkImageSubresourceRange(sb *stateBuilder, img ImageObjectʳ, rng VkImageS
 	}
 }
 
+// walkImageSubresourceRangeAspects is like walkImageSubresourceRange, but
+// calls f once for each subresource in the given range, with all the aspects
+// of the subresource in the range and their level sizes, e.g. with both the
+// depth and the stencil aspects of a depth/stencil image.
+func walkImageSubresourceRangeAspects(sb *stateBuilder, img ImageObjectʳ, rng VkImageSubresourceRange, f func(aspects []VkImageAspectFlagBits, layer, level uint32, levelSizes []byteSizeAndExtent)) {
+	layerCount, _ := subImageSubresourceLayerCount(sb.ctx, nil, api.CmdNoID, nil, sb.oldState, nil, 0, nil, nil, img, rng)
+	levelCount, _ := subImageSubresourceLevelCount(sb.ctx, nil, api.CmdNoID, nil, sb.oldState, nil, 0, nil, nil, img, rng)
+	aspects := sb.imageAspectFlagBits(img, rng.AspectMask())
+	for i := uint32(0); i < levelCount; i++ {
+		level := rng.BaseMipLevel() + i
+		levelSizes := make([]byteSizeAndExtent, len(aspects))
+		for k, aspect := range aspects {
+			levelSizes[k] = sb.levelSize(img.Info().Extent(), img.Info().Fmt(), level, aspect)
+		}
+		for j := uint32(0); j < layerCount; j++ {
+			f(aspects, rng.BaseArrayLayer()+j, level, levelSizes)
+		}
+	}
+}
+
 func walkSparseImageMemoryBindings(sb *stateBuilder, img ImageObjectʳ, f func(aspect VkImageAspectFlagBits, layer, level uint32, blockData SparseBoundImageBlockInfoʳ)) {
 	for aspect, aspectData := range img.SparseImageMemoryBindings().All() {
 		for layer, layerData := range aspectData.Layers().All() {
@@ -2487,6 +6005,43 @@ func walkSparseImageMemoryBindings(sb *stateBuilder, img ImageObjectʳ, f func(a
 	}
 }
 
+// ipSparseImageMemoryBinds returns the sparse image memory binds of the
+// residency blocks of the given image, which reconstruct the sparse residency
+// of the image.
+func ipSparseImageMemoryBinds(a arena.Arena, img ImageObjectʳ) []VkSparseImageMemoryBind {
+	binds := []VkSparseImageMemoryBind{}
+	walkSparseImageMemoryBindings(nil, img, func(aspect VkImageAspectFlagBits, layer, level uint32, block SparseBoundImageBlockInfoʳ) {
+		binds = append(binds, NewVkSparseImageMemoryBind(a,
+			NewVkImageSubresource(a, // subresource
+				VkImageAspectFlags(aspect), // aspectMask
+				level,                      // mipLevel
+				layer,                      // arrayLayer
+			),
+			block.Offset(),       // offset
+			block.Extent(),       // extent
+			block.Memory(),       // memory
+			block.MemoryOffset(), // memoryOffset
+			block.Flags(),        // flags
+		))
+	})
+	return binds
+}
+
+// ipResidentSubresources returns the subresources of the given image with at
+// least one bound residency block, in the order they are walked.
+func ipResidentSubresources(img ImageObjectʳ) []ipSubresource {
+	resident := []ipSubresource{}
+	seen := map[ipSubresource]bool{}
+	walkSparseImageMemoryBindings(nil, img, func(aspect VkImageAspectFlagBits, layer, level uint32, unused SparseBoundImageBlockInfoʳ) {
+		sr := ipSubresource{aspect: aspect, layer: layer, level: level}
+		if !seen[sr] {
+			seen[sr] = true
+			resident = append(resident, sr)
+		}
+	})
+	return resident
+}
+
 func roundUp(dividend, divisor uint64) uint64 {
 	return (dividend + divisor - 1) / divisor
 }
@@ -0,0 +1,70 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// ipPrimingCheckpoint records the images which have been fully primed by an
+// image primer. A rebuild interrupted after priming some of the images can be
+// restarted from a saved checkpoint, and the data of the images in it will not
+// be primed again, see imagePrimer.resumedImages.
+type ipPrimingCheckpoint struct {
+	// Primed are the images whose priming completed without error, ordered by
+	// the image handles.
+	Primed []VkImage `json:"primed"`
+}
+
+// encodePrimingCheckpoint serializes the given priming checkpoint.
+func encodePrimingCheckpoint(checkpoint ipPrimingCheckpoint) ([]byte, error) {
+	return json.Marshal(checkpoint)
+}
+
+// decodePrimingCheckpoint deserializes the priming checkpoint serialized by
+// encodePrimingCheckpoint, and returns the primed images in it.
+func decodePrimingCheckpoint(data []byte) (map[VkImage]bool, error) {
+	checkpoint := ipPrimingCheckpoint{}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, err
+	}
+	primed := make(map[VkImage]bool, len(checkpoint.Primed))
+	for _, img := range checkpoint.Primed {
+		primed[img] = true
+	}
+	return primed, nil
+}
+
+// markPrimed records the given image as fully primed if trackCompletion is
+// set, and makes it the source to copy from for the images with the same
+// content if dedupContent is set.
+func (p *imagePrimer) markPrimed(img VkImage) {
+	if p.trackCompletion {
+		p.primedImages[img] = true
+	}
+	p.primedContent(img)
+}
+
+// checkpoint returns the checkpoint of the images fully primed by this image
+// primer. It is empty unless trackCompletion is set.
+func (p *imagePrimer) checkpoint() ipPrimingCheckpoint {
+	checkpoint := ipPrimingCheckpoint{Primed: make([]VkImage, 0, len(p.primedImages))}
+	for img := range p.primedImages {
+		checkpoint.Primed = append(checkpoint.Primed, img)
+	}
+	sort.Slice(checkpoint.Primed, func(i, j int) bool { return checkpoint.Primed[i] < checkpoint.Primed[j] })
+	return checkpoint
+}
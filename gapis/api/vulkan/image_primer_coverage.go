@@ -0,0 +1,162 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"sort"
+
+	"github.com/google/gapid/core/log"
+)
+
+// auditPrimingCoverage reports the subresources of the given image bound by
+// the given ranges, or by sparse image memory bindings, for which the given
+// primeable image data has recorded no copy, render or store job, i.e. the
+// subresources which will be left undefined after priming. The audit is done
+// on the host from the recorded jobs, without reading back any data. Primeable
+// image data which only restores the layouts is not audited, as it
+// intentionally primes no data.
+func (p *imagePrimer) auditPrimingCoverage(img VkImage, opaqueBoundRanges []VkImageSubresourceRange, primeable primeableImageData) {
+	oldStateImgObj := GetState(p.sb.oldState).Images().Get(img)
+	if oldStateImgObj.IsNil() {
+		return
+	}
+	covered, ok := p.coveredSubresources(oldStateImgObj, primeable)
+	if !ok {
+		return
+	}
+	bound := p.boundSubresources(oldStateImgObj, opaqueBoundRanges)
+	uncovered := ipUncoveredSubresources(bound, covered)
+	if len(uncovered) == 0 {
+		log.D(p.sb.ctx, "All the %v bound subresources of image: %v are covered by priming jobs", len(bound), img)
+		return
+	}
+	log.W(p.sb.ctx, "%v of the %v bound subresources of image: %v are not covered by any priming job: %+v", len(uncovered), len(bound), img, uncovered)
+}
+
+// boundSubresources returns the subresources of the given image covered by
+// the given ranges, and for sparse residency images, by the sparse image
+// memory bindings.
+func (p *imagePrimer) boundSubresources(img ImageObjectʳ, rngs []VkImageSubresourceRange) map[ipSubresource]bool {
+	bound := map[ipSubresource]bool{}
+	for _, rng := range rngs {
+		walkImageSubresourceRange(p.sb, img, rng, func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			bound[ipSubresource{aspect: aspect, layer: layer, level: level}] = true
+		})
+	}
+	if isSparseResidency(img) {
+		walkSparseImageMemoryBindings(p.sb, img, func(aspect VkImageAspectFlagBits, layer, level uint32, unused SparseBoundImageBlockInfoʳ) {
+			bound[ipSubresource{aspect: aspect, layer: layer, level: level}] = true
+		})
+	}
+	return bound
+}
+
+// coveredSubresources returns the subresources of the given image for which
+// the given primeable image data has recorded a copy, render or store job.
+// Returns false if the primeable image data does not prime any data.
+func (p *imagePrimer) coveredSubresources(img ImageObjectʳ, primeable primeableImageData) (map[ipSubresource]bool, bool) {
+	covered := map[ipSubresource]bool{}
+	// A copy may cover several array layers, see appendCopy.
+	addCopy := func(copy VkBufferImageCopy, aspect VkImageAspectFlagBits) {
+		for i := uint32(0); i < copy.ImageSubresource().LayerCount(); i++ {
+			covered[ipSubresource{
+				aspect: aspect,
+				layer:  copy.ImageSubresource().BaseArrayLayer() + i,
+				level:  copy.ImageSubresource().MipLevel(),
+			}] = true
+		}
+	}
+	switch pi := primeable.(type) {
+	case *ipPrimeableByLayoutTransition:
+		return nil, false
+	case *ipPrimeableByBufferCopy:
+		for _, copies := range pi.copySession.copies {
+			for _, copy := range copies {
+				addCopy(copy, VkImageAspectFlagBits(copy.ImageSubresource().AspectMask()))
+			}
+		}
+	case *ipPrimeableByRendering:
+		// Every level of the staged aspects is rendered, but only the
+		// subresources with staged data are primed.
+		if pi.copySession == nil {
+			return covered, true
+		}
+		for aspect, stagingImgs := range pi.stagingImages {
+			for _, stagingImg := range stagingImgs {
+				for _, copy := range pi.copySession.copies[stagingImg] {
+					addCopy(copy, aspect)
+				}
+			}
+		}
+	case *ipPrimeableByImageStore:
+		for _, job := range pi.storeJobs {
+			rng := job.output.SubresourceRange()
+			covered[ipSubresource{
+				aspect: VkImageAspectFlagBits(rng.AspectMask()),
+				layer:  rng.BaseArrayLayer(),
+				level:  rng.BaseMipLevel(),
+			}] = true
+		}
+	case *ipPrimeableByPreinitialization:
+		covered = p.boundSubresources(img, pi.opaqueBoundRanges)
+	case *ipPrimeableByImageCopy:
+		// The whole image is copied, see regions.
+		for _, aspect := range pi.aspects {
+			for layer := uint32(0); layer < img.Info().ArrayLayers(); layer++ {
+				for level := uint32(0); level < img.Info().MipLevels(); level++ {
+					covered[ipSubresource{aspect: aspect, layer: layer, level: level}] = true
+				}
+			}
+		}
+	case *ipPrimeableByMipGeneration:
+		base, ok := p.coveredSubresources(img, pi.base)
+		if !ok {
+			return nil, false
+		}
+		// The other levels are generated from the primed base levels.
+		for sr := range base {
+			covered[sr] = true
+			if sr.level != 0 {
+				continue
+			}
+			for level := uint32(1); level < img.Info().MipLevels(); level++ {
+				covered[ipSubresource{aspect: sr.aspect, layer: sr.layer, level: level}] = true
+			}
+		}
+	}
+	return covered, true
+}
+
+// ipUncoveredSubresources returns the given bound subresources which are not
+// in the given covered subresources, ordered by aspect, layer and level.
+func ipUncoveredSubresources(bound, covered map[ipSubresource]bool) []ipSubresource {
+	uncovered := []ipSubresource{}
+	for sr := range bound {
+		if !covered[sr] {
+			uncovered = append(uncovered, sr)
+		}
+	}
+	sort.Slice(uncovered, func(i, j int) bool {
+		a, b := uncovered[i], uncovered[j]
+		if a.aspect != b.aspect {
+			return a.aspect < b.aspect
+		}
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		return a.level < b.level
+	})
+	return uncovered
+}
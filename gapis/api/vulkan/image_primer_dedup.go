@@ -0,0 +1,472 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/stream"
+)
+
+// ipContentKey identifies the content of an image for priming images with the
+// same content as an already primed one by copying, see
+// imagePrimer.dedupContent. Images with the same key can be copied to each
+// other with whole subresource image -> image copies.
+type ipContentKey struct {
+	device      VkDevice
+	imageType   VkImageType
+	flags       VkImageCreateFlags
+	tiling      VkImageTiling
+	format      VkFormat
+	width       uint32
+	height      uint32
+	depth       uint32
+	mipLevels   uint32
+	arrayLayers uint32
+	samples     VkSampleCountFlagBits
+	// hash is the hash of the data of the subresources, see
+	// ipHashSubresources.
+	hash [sha256.Size]byte
+}
+
+// ipHashSubresources returns the hash of the given data of the subresources.
+// The subresources are hashed in the order of aspect, layer and level, each
+// with its aspect, layer, level and size, so the same bytes in different
+// subresources hash differently.
+func ipHashSubresources(data map[ipSubresource][]uint8) [sha256.Size]byte {
+	subresources := make([]ipSubresource, 0, len(data))
+	for sr := range data {
+		subresources = append(subresources, sr)
+	}
+	sort.Slice(subresources, func(i, j int) bool {
+		a, b := subresources[i], subresources[j]
+		if a.aspect != b.aspect {
+			return a.aspect < b.aspect
+		}
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		return a.level < b.level
+	})
+	h := sha256.New()
+	for _, sr := range subresources {
+		binary.Write(h, binary.LittleEndian, []uint64{
+			uint64(sr.aspect), uint64(sr.layer), uint64(sr.level), uint64(len(data[sr])),
+		})
+		h.Write(data[sr])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// contentKeyOf returns the content key of the given image in the old state,
+// with the data of the subresources in the given ranges. Reading and hashing
+// all the data is costly, which is why deduplication is opt-in. Returns false
+// if the content of the image can not be deduplicated: sparse images, and
+// images primed with caller supplied data.
+func (p *imagePrimer) contentKeyOf(img ImageObjectʳ, rngs []VkImageSubresourceRange) (ipContentKey, bool) {
+	if p.srcData != nil || isSparseResidency(img) || len(rngs) == 0 {
+		return ipContentKey{}, false
+	}
+	data := map[ipSubresource][]uint8{}
+	for _, rng := range rngs {
+		walkImageSubresourceRange(p.sb, img, rng, func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			if !p.levelHasData(img, aspect, layer, level) {
+				return
+			}
+			levelData := img.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level).Data()
+			data[ipSubresource{aspect: aspect, layer: layer, level: level}] = levelData.MustRead(p.sb.ctx, nil, p.sb.oldState, nil)
+		})
+	}
+	return ipContentKeyOf(img.Device(), img.Info(), ipHashSubresources(data)), true
+}
+
+// ipContentKeyOf returns the content key of an image of the given device and
+// info, whose subresources hash to the given hash. The image type, flags and
+// tiling are part of the key as images differing in them can have the same
+// data but lay it out differently, or not be copyable to each other.
+func ipContentKeyOf(device VkDevice, info ImageInfo, hash [sha256.Size]byte) ipContentKey {
+	return ipContentKey{
+		device:      device,
+		imageType:   info.ImageType(),
+		flags:       info.Flags(),
+		tiling:      info.Tiling(),
+		format:      info.Fmt(),
+		width:       info.Extent().Width(),
+		height:      info.Extent().Height(),
+		depth:       info.Extent().Depth(),
+		mipLevels:   info.MipLevels(),
+		arrayLayers: info.ArrayLayers(),
+		samples:     info.Samples(),
+		hash:        hash,
+	}
+}
+
+// newPrimeableImageDataByImageCopy returns the primeable image data which
+// primes the given image by copying from an image already primed with the
+// same content, see imagePrimer.dedupContent. If the images lack the transfer
+// usages for an image -> image copy, the content is blitted by a compute
+// shader instead, see ipImageBlitUsable. Returns false if no such image has
+// been primed, or the images can be neither copied nor blitted.
+func (p *imagePrimer) newPrimeableImageDataByImageCopy(img ImageObjectʳ, key ipContentKey, aspects []VkImageAspectFlagBits) (primeableImageData, bool) {
+	src, ok := p.primedContents[key]
+	if !ok || src == img.VulkanHandle() {
+		return nil, false
+	}
+	srcObj := GetState(p.sb.newState).Images().Get(src)
+	dstObj := GetState(p.sb.newState).Images().Get(img.VulkanHandle())
+	if srcObj.IsNil() || dstObj.IsNil() {
+		return nil, false
+	}
+	if srcObj.Info().Usage()&VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_SRC_BIT) != 0 &&
+		dstObj.Info().Usage()&VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT) != 0 {
+		queue := p.queueForPriming(img, ipPrimingStrategyImageCopy)
+		if queue.IsNil() {
+			return nil, false
+		}
+		log.D(p.sb.ctx, "Image: %v has the same content as primed image: %v, priming by image -> image copy", img.VulkanHandle(), src)
+		return &ipPrimeableByImageCopy{p: p, img: img.VulkanHandle(), src: src, aspects: aspects, queue: queue.VulkanHandle()}, true
+	}
+	if !ipImageBlitUsable(srcObj.Info(), dstObj.Info(), aspects) {
+		return nil, false
+	}
+	queue := p.queueForPriming(img, ipPrimingStrategyImageBlit)
+	if queue.IsNil() {
+		return nil, false
+	}
+	log.D(p.sb.ctx, "Image: %v has the same content as primed image: %v, priming by compute blit", img.VulkanHandle(), src)
+	return &ipPrimeableByImageBlit{p: p, img: img.VulkanHandle(), src: src, aspects: aspects, queue: queue.VulkanHandle()}, true
+}
+
+// ipImageBlitUsable returns true if the given aspects of an image with the
+// given source info can be blitted to an image with the given destination
+// info by a compute shader which samples the source, see
+// ipComputeBlitShaderSpirv. The source must have SAMPLED usage and the
+// destination STORAGE usage, which also implies that the format supports
+// them, only single-sample color aspects are supported, and the format must
+// round trip exactly through the sampler, see ipImageBlitRoundTrips.
+func ipImageBlitUsable(src, dst ImageInfo, aspects []VkImageAspectFlagBits) bool {
+	if src.Usage()&VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT) == 0 ||
+		dst.Usage()&VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT) == 0 ||
+		src.Samples() != VkSampleCountFlagBits_VK_SAMPLE_COUNT_1_BIT ||
+		src.Fmt() != dst.Fmt() {
+		return false
+	}
+	for _, aspect := range aspects {
+		if aspect != VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+			return false
+		}
+	}
+	return ipImageBlitRoundTrips(src.Fmt())
+}
+
+// ipImageBlitRoundTrips returns true if the data of the given format is kept
+// exactly when blitted by a compute shader from an image to another image of
+// the same format. Integer and float values are fetched and stored as they
+// are, and the UNORM values are quantized back to the same values. SNORM
+// values are not, as both the lowest two values are fetched as -1.0, and
+// neither are SRGB values, which are decoded to linear values by the sampler
+// but stored through UNORM views. The format must also be supported by the
+// blit shaders, see ipStorageImageFormatQualifier.
+func ipImageBlitRoundTrips(format VkFormat) bool {
+	if _, err := ipStorageImageFormatQualifier(format); err != nil {
+		return false
+	}
+	f, err := getImageFormatFromVulkanFormat(format)
+	if err != nil || f.GetUncompressed() == nil {
+		return false
+	}
+	for _, c := range f.GetUncompressed().GetFormat().GetComponents() {
+		if c.GetSampling().GetCurve() == stream.Curve_sRGB ||
+			(c.IsNormalized() && c.GetDataType().GetSigned()) {
+			return false
+		}
+	}
+	return true
+}
+
+// ipPrimeableByImageCopy contains the data for priming through image -> image
+// copies from an image already primed with the same content.
+type ipPrimeableByImageCopy struct {
+	p       *imagePrimer
+	img     VkImage
+	src     VkImage
+	aspects []VkImageAspectFlagBits
+	queue   VkQueue
+}
+
+func (pi *ipPrimeableByImageCopy) free() {}
+
+func (pi *ipPrimeableByImageCopy) primingQueue() VkQueue { return pi.queue }
+
+// regions returns the image -> image copies of the whole image, one for each
+// aspect and mip level, covering all the array layers.
+func (pi *ipPrimeableByImageCopy) regions(img ImageObjectʳ) []VkImageCopy {
+	info := img.Info()
+	regions := []VkImageCopy{}
+	for _, aspect := range pi.aspects {
+		for level := uint32(0); level < info.MipLevels(); level++ {
+			size := pi.p.sb.levelSize(info.Extent(), info.Fmt(), level, aspect)
+			subresource := NewVkImageSubresourceLayers(pi.p.sb.ta,
+				VkImageAspectFlags(aspect), // aspectMask
+				level,                      // mipLevel
+				0,                          // baseArrayLayer
+				info.ArrayLayers(),         // layerCount
+			)
+			regions = append(regions, NewVkImageCopy(pi.p.sb.ta,
+				subresource,                // srcSubresource
+				MakeVkOffset3D(pi.p.sb.ta), // srcOffset
+				subresource,                // dstSubresource
+				MakeVkOffset3D(pi.p.sb.ta), // dstOffset
+				NewVkExtent3D(pi.p.sb.ta, // extent
+					uint32(size.width),
+					uint32(size.height),
+					uint32(size.depth),
+				),
+			))
+		}
+	}
+	return regions
+}
+
+func (pi *ipPrimeableByImageCopy) prime(srcLayout, dstLayout ipLayoutInfo) error {
+	srcObj := GetState(pi.p.sb.newState).Images().Get(pi.src)
+	if srcObj.IsNil() {
+		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil source Image in new state"), "[Priming by image copy from image: %v, image: %v]", pi.src, pi.img)
+	}
+	dstObj := GetState(pi.p.sb.newState).Images().Get(pi.img)
+	if dstObj.IsNil() {
+		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming by image copy from image: %v, image: %v]", pi.src, pi.img)
+	}
+
+	// The source image is borrowed from the queues and layouts it has been
+	// left in after being primed, and returned to them after the copy.
+	srcToTransfer, srcBack := ipBorrowSourceImage(pi.p.sb, srcObj, pi.aspects, VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL, pi.queue)
+	dstToTransfer, dstBack := []imageSubRangeInfo{}, []imageSubRangeInfo{}
+	walkImageSubresourceRange(pi.p.sb, dstObj, ipSubresourceRangeOfAspects(pi.p.sb, dstObj, pi.aspects),
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			info := imageSubRangeInfo{
+				aspectMask:     ipImageAspectBarrierFlags(pi.p.sb, dstObj, aspect),
+				baseMipLevel:   level,
+				levelCount:     1,
+				baseArrayLayer: layer,
+				layerCount:     1,
+				oldLayout:      srcLayout.layoutOf(aspect, layer, level),
+				newLayout:      VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,
+				oldQueue:       pi.queue,
+				newQueue:       pi.queue,
+			}
+			dstToTransfer = append(dstToTransfer, info)
+			info.oldLayout = VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL
+			info.newLayout = ipDstLayout(dstLayout.layoutOf(aspect, layer, level), VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL)
+			dstBack = append(dstBack, info)
+		})
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.src, srcToTransfer)
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, dstToTransfer)
+
+	regions := pi.regions(dstObj)
+	tsk := pi.p.sb.newScratchTaskOnQueue(pi.queue)
+	tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+		pi.p.sb.write(pi.p.sb.cb.VkCmdCopyImage(
+			commandBuffer,
+			pi.src,
+			VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL,
+			pi.img,
+			VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,
+			uint32(len(regions)),
+			pi.p.sb.MustAllocReadData(regions).Ptr(),
+		))
+	})
+	if err := tsk.commit(); err != nil {
+		return log.Errf(pi.p.sb.ctx, err, "[Committing scratch task for priming image: %v by copying from image: %v]", pi.img, pi.src)
+	}
+
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.src, srcBack)
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, dstBack)
+	return nil
+}
+
+// ipPrimeableByImageBlit contains the data for priming through a compute
+// shader which samples an image already primed with the same content and
+// stores the fetched texels to the image, for the images which can not be
+// copied to each other, see ipImageBlitUsable.
+type ipPrimeableByImageBlit struct {
+	p       *imagePrimer
+	img     VkImage
+	src     VkImage
+	aspects []VkImageAspectFlagBits
+	queue   VkQueue
+	// freeCallbacks destroy the image views created for the blit jobs.
+	freeCallbacks []func()
+}
+
+func (pi *ipPrimeableByImageBlit) free() {
+	// The image views will not be destroyed immediately, but wait until all
+	// the tasks committed before calling free on its queue are finished.
+	deferUntilAllCommittedExecuted(pi.p.sb, pi.queue, pi.freeCallbacks...)
+	pi.freeCallbacks = nil
+}
+
+func (pi *ipPrimeableByImageBlit) primingQueue() VkQueue { return pi.queue }
+
+// subresources returns the subresources of the given image to be blitted, one
+// blit job is recorded for each of them.
+func (pi *ipPrimeableByImageBlit) subresources(img ImageObjectʳ) []ipSubresource {
+	subresources := []ipSubresource{}
+	walkImageSubresourceRange(pi.p.sb, img, ipSubresourceRangeOfAspects(pi.p.sb, img, pi.aspects),
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			subresources = append(subresources, ipSubresource{aspect: aspect, layer: layer, level: level})
+		})
+	return subresources
+}
+
+// blitJob returns the job blitting the given subresource of the given image
+// from the given sampled input view to the given storage output view.
+func (pi *ipPrimeableByImageBlit) blitJob(img ImageObjectʳ, sr ipSubresource, input, output ImageViewObjectʳ) ipImageStoreJob {
+	info := img.Info()
+	size := pi.p.sb.levelSize(info.Extent(), info.Fmt(), sr.level, sr.aspect)
+	return ipImageStoreJob{
+		input:        input,
+		output:       output,
+		offset:       MakeVkOffset3D(pi.p.sb.ta),
+		extent:       NewVkExtent3D(pi.p.sb.ta, uint32(size.width), uint32(size.height), uint32(size.depth)),
+		sampledInput: true,
+		logCtx:       ipImageLogContext(pi.img, ipPrimingStrategyImageBlit).at(sr.aspect, sr.layer, sr.level),
+	}
+}
+
+func (pi *ipPrimeableByImageBlit) prime(srcLayout, dstLayout ipLayoutInfo) error {
+	srcObj := GetState(pi.p.sb.newState).Images().Get(pi.src)
+	if srcObj.IsNil() {
+		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil source Image in new state"), "[Priming by compute blit from image: %v, image: %v]", pi.src, pi.img)
+	}
+	dstObj := GetState(pi.p.sb.newState).Images().Get(pi.img)
+	if dstObj.IsNil() {
+		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming by compute blit from image: %v, image: %v]", pi.src, pi.img)
+	}
+
+	// The source image is borrowed like for the image -> image copies, but
+	// it is sampled, and the image is stored to in GENERAL layout.
+	srcToSampled, srcBack := ipBorrowSourceImage(pi.p.sb, srcObj, pi.aspects, ipImageStoreInputLayout(true), pi.queue)
+	dstToGeneral, dstBack := []imageSubRangeInfo{}, []imageSubRangeInfo{}
+	subresources := pi.subresources(dstObj)
+	for _, sr := range subresources {
+		info := imageSubRangeInfo{
+			aspectMask:     ipImageAspectBarrierFlags(pi.p.sb, dstObj, sr.aspect),
+			baseMipLevel:   sr.level,
+			levelCount:     1,
+			baseArrayLayer: sr.layer,
+			layerCount:     1,
+			oldLayout:      srcLayout.layoutOf(sr.aspect, sr.layer, sr.level),
+			newLayout:      VkImageLayout_VK_IMAGE_LAYOUT_GENERAL,
+			oldQueue:       pi.queue,
+			newQueue:       pi.queue,
+		}
+		dstToGeneral = append(dstToGeneral, info)
+		info.oldLayout = VkImageLayout_VK_IMAGE_LAYOUT_GENERAL
+		info.newLayout = ipDstLayout(dstLayout.layoutOf(sr.aspect, sr.layer, sr.level), VkImageLayout_VK_IMAGE_LAYOUT_GENERAL)
+		dstBack = append(dstBack, info)
+	}
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.src, srcToSampled)
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, dstToGeneral)
+
+	viewType := ipImageViewType(dstObj.Info().ImageType())
+	for _, sr := range subresources {
+		input, freeInput, err := pi.p.createImageViewForImageSubresource(srcObj, srcObj.Info().Fmt(),
+			sr.aspect, sr.layer, sr.level, viewType, VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT))
+		pi.freeCallbacks = append(pi.freeCallbacks, freeInput)
+		if err != nil {
+			return log.Errf(pi.p.sb.ctx, err, "[Creating sampled image view of image: %v, aspect: %v, layer: %v, level: %v]", pi.src, sr.aspect, sr.layer, sr.level)
+		}
+		output, freeOutput, err := pi.p.createImageViewForImageSubresource(dstObj, dstObj.Info().Fmt(),
+			sr.aspect, sr.layer, sr.level, viewType, VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT))
+		pi.freeCallbacks = append(pi.freeCallbacks, freeOutput)
+		if err != nil {
+			return log.Errf(pi.p.sb.ctx, err, "[Creating storage image view of image: %v, aspect: %v, layer: %v, level: %v]", pi.img, sr.aspect, sr.layer, sr.level)
+		}
+		job := pi.blitJob(dstObj, sr, input, output)
+		if err := pi.p.sh.store(job, pi.queue); err != nil {
+			log.E(job.logCtx.bind(pi.p.sb.ctx), "[Priming data by compute blit from image: %v] %v", pi.src, err)
+		}
+	}
+	// Submit all the blit jobs at once.
+	pi.p.sb.flushQueueFamilyScratchResources(pi.queue)
+
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.src, srcBack)
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, dstBack)
+	return nil
+}
+
+// ipBorrowSourceImage returns the transitions of the given aspects of the
+// given source image of a copy or blit on the given queue, from the queues and
+// layouts the source has been left in after being primed to the given layout
+// on the queue, and the transitions returning the source back to them.
+func ipBorrowSourceImage(sb *stateBuilder, srcObj ImageObjectʳ, aspects []VkImageAspectFlagBits, layout VkImageLayout, queue VkQueue) ([]imageSubRangeInfo, []imageSubRangeInfo) {
+	to, back := []imageSubRangeInfo{}, []imageSubRangeInfo{}
+	walkImageSubresourceRange(sb, srcObj, ipSubresourceRangeOfAspects(sb, srcObj, aspects),
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			if !srcObj.Aspects().Contains(aspect) ||
+				!srcObj.Aspects().Get(aspect).Layers().Contains(layer) ||
+				!srcObj.Aspects().Get(aspect).Layers().Get(layer).Levels().Contains(level) {
+				return
+			}
+			l := srcObj.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level)
+			oldQueue := queue
+			if !l.LastBoundQueue().IsNil() {
+				oldQueue = l.LastBoundQueue().VulkanHandle()
+			}
+			info := imageSubRangeInfo{
+				aspectMask:     ipImageAspectBarrierFlags(sb, srcObj, aspect),
+				baseMipLevel:   level,
+				levelCount:     1,
+				baseArrayLayer: layer,
+				layerCount:     1,
+				oldLayout:      l.Layout(),
+				newLayout:      layout,
+				oldQueue:       oldQueue,
+				newQueue:       queue,
+			}
+			to = append(to, info)
+			info.oldLayout, info.newLayout = info.newLayout, ipDstLayout(l.Layout(), layout)
+			info.oldQueue, info.newQueue = info.newQueue, info.oldQueue
+			back = append(back, info)
+		})
+	return to, back
+}
+
+// recordContent records the given content key of the given image, which will
+// be the source of the images with the same content once the image is fully
+// primed, see markPrimed.
+func (p *imagePrimer) recordContent(img VkImage, key ipContentKey) {
+	p.contentKeys[img] = key
+}
+
+// primedContent registers the content of the given fully primed image as the
+// source to copy from for the images with the same content.
+func (p *imagePrimer) primedContent(img VkImage) {
+	key, ok := p.contentKeys[img]
+	if !ok {
+		return
+	}
+	delete(p.contentKeys, img)
+	if _, ok := p.primedContents[key]; !ok {
+		p.primedContents[key] = img
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gapid/core/image"
+	"github.com/google/gapid/core/os/device"
+)
+
+// ipEndian returns the byte order of the memory in the states of the given
+// state builder, i.e. the byte order of the capture. The rebuilt state shares
+// the memory layout of the old state, so the data consumed by the replay
+// device, e.g. push constants and the content of staging buffers, must be in
+// the byte order of the capture too.
+func ipEndian(sb *stateBuilder) device.Endian {
+	return sb.newState.MemoryLayout.GetEndian()
+}
+
+// ipByteOrder returns the byte order of the given endianness. Unknown
+// endianness is treated as little endian.
+func ipByteOrder(endian device.Endian) binary.ByteOrder {
+	if endian == device.BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// ipUint32sData returns the given values as data in the given byte order.
+func ipUint32sData(endian device.Endian, values []uint32) []uint8 {
+	data := make([]uint8, 4*len(values))
+	order := ipByteOrder(endian)
+	for i, v := range values {
+		order.PutUint32(data[4*i:], v)
+	}
+	return data
+}
+
+// ipSwapWordSize returns the size in bytes of the words whose bytes must be
+// swapped to convert data of the given aspect of the given format between
+// byte orders. The words of formats whose components are byte aligned and of
+// the same size are the components, and the words of packed formats are the
+// texels. The decoded ASTC formats are byte streams, whose word size is 1.
+func ipSwapWordSize(vkFmt VkFormat, aspect VkImageAspectFlagBits) (int, error) {
+	if isPackedFloatFormat(vkFmt) {
+		return 4, nil
+	}
+	if _, ok := astcDecodedFormat(vkFmt); ok {
+		return 1, nil
+	}
+	var f *image.Format
+	var err error
+	switch aspect {
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
+		f, err = getImageFormatFromVulkanFormat(vkFmt)
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT:
+		f, err = getDepthImageFormatFromVulkanFormat(vkFmt)
+	default:
+		// Stencil data is 8-bit.
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	sf := f.GetUncompressed().GetFormat()
+	if sf == nil {
+		return 1, nil
+	}
+	if ipIsPacked8BitFormat(vkFmt) {
+		return sf.Stride(), nil
+	}
+	bits := sf.Components[0].DataType.Bits()
+	for _, c := range sf.Components {
+		if c.DataType.Bits() != bits {
+			return sf.Stride(), nil
+		}
+	}
+	if bits%8 != 0 || int(bits/8)*len(sf.Components) != sf.Stride() {
+		return sf.Stride(), nil
+	}
+	return int(bits / 8), nil
+}
+
+// ipIsPacked8BitFormat returns true if the given format has 8-bit components
+// packed in a 32-bit word, whose byte order depends on the endianness, unlike
+// the formats with unpacked 8-bit components.
+func ipIsPacked8BitFormat(vkFmt VkFormat) bool {
+	switch vkFmt {
+	case VkFormat_VK_FORMAT_A8B8G8R8_UNORM_PACK32,
+		VkFormat_VK_FORMAT_A8B8G8R8_SNORM_PACK32,
+		VkFormat_VK_FORMAT_A8B8G8R8_USCALED_PACK32,
+		VkFormat_VK_FORMAT_A8B8G8R8_SSCALED_PACK32,
+		VkFormat_VK_FORMAT_A8B8G8R8_UINT_PACK32,
+		VkFormat_VK_FORMAT_A8B8G8R8_SINT_PACK32,
+		VkFormat_VK_FORMAT_A8B8G8R8_SRGB_PACK32:
+		return true
+	}
+	return false
+}
+
+// ipSwapBytes returns a copy of the given data with the bytes of each word of
+// the given size reversed. The data is returned as is if the word size is 1.
+func ipSwapBytes(data []uint8, wordSize int) []uint8 {
+	if wordSize <= 1 {
+		return data
+	}
+	swapped := make([]uint8, len(data))
+	copy(swapped, data)
+	for i := 0; i+wordSize <= len(swapped); i += wordSize {
+		word := swapped[i : i+wordSize]
+		for j, k := 0, wordSize-1; j < k; j, k = j+1, k-1 {
+			word[j], word[k] = word[k], word[j]
+		}
+	}
+	return swapped
+}
+
+// ipSwapDataBytes converts data of the given aspect of the given format
+// between big and little endian byte orders. The host side unpacking and
+// conversion of the data assume little endian data, so the data of big endian
+// captures is converted before and after being unpacked.
+func ipSwapDataBytes(data []uint8, vkFmt VkFormat, aspect VkImageAspectFlagBits) ([]uint8, error) {
+	wordSize, err := ipSwapWordSize(vkFmt, aspect)
+	if err != nil {
+		return nil, err
+	}
+	return ipSwapBytes(data, wordSize), nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"context"
+
+	"github.com/google/gapid/core/log"
+)
+
+// ipLogContext is the context of the logs of priming an image: the image, the
+// priming strategy, and the subresource being primed, if any. It is carried by
+// the copy sessions and the store and render jobs, so the logs of the priming
+// handlers tell which image and subresource they are about, without every log
+// message formatting them.
+type ipLogContext struct {
+	img         VkImage
+	strategy    ipPrimingStrategy
+	subresource bool
+	aspect      VkImageAspectFlagBits
+	layer       uint32
+	level       uint32
+}
+
+// ipImageLogContext returns the log context of priming the given image with
+// the given strategy, the strategy may be empty if it is not decided yet.
+func ipImageLogContext(img VkImage, strategy ipPrimingStrategy) ipLogContext {
+	return ipLogContext{img: img, strategy: strategy}
+}
+
+// at returns the log context of priming the given subresource of the image.
+func (c ipLogContext) at(aspect VkImageAspectFlagBits, layer, level uint32) ipLogContext {
+	c.subresource = true
+	c.aspect = aspect
+	c.layer = layer
+	c.level = level
+	return c
+}
+
+// values returns the key-value pairs of the log context, or nil if the log
+// context is empty.
+func (c ipLogContext) values() log.V {
+	if c.img == VkImage(0) && c.strategy == "" && !c.subresource {
+		return nil
+	}
+	v := log.V{"image": c.img}
+	if c.strategy != "" {
+		v["strategy"] = c.strategy
+	}
+	if c.subresource {
+		v["aspect"] = c.aspect
+		v["layer"] = c.layer
+		v["level"] = c.level
+	}
+	return v
+}
+
+// bind returns a new context in the image priming scope, with the values of
+// the log context attached. The given context is returned as is if the log
+// context is empty.
+func (c ipLogContext) bind(ctx context.Context) context.Context {
+	v := c.values()
+	if v == nil {
+		return ctx
+	}
+	return v.Bind(log.Enter(ctx, "imagePrimer"))
+}
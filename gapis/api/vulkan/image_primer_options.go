@@ -0,0 +1,307 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/gapid/core/context/keys"
+	"github.com/google/gapid/core/event/task"
+	"github.com/google/gapid/core/log"
+)
+
+// ImagePrimerOptions configures how the image primer primes the data of the
+// images when the state is rebuilt. The zero value primes the images the
+// default way. The options are mostly for debugging the priming, see the
+// fields of imagePrimer with the same names for what each of them does.
+type ImagePrimerOptions struct {
+	NarrowStagingFormats      bool         `json:"narrowStagingFormats,omitempty"`
+	StagingColorFormat        VkFormat     `json:"stagingColorFormat,omitempty"`
+	StagingDepthStencilFormat VkFormat     `json:"stagingDepthStencilFormat,omitempty"`
+	GenerateMipLevels         bool         `json:"generateMipLevels,omitempty"`
+	DistributeQueues          bool         `json:"distributeQueues,omitempty"`
+	StrategyQueues            bool         `json:"strategyQueues,omitempty"`
+	StagingMemoryBudget       VkDeviceSize `json:"stagingMemoryBudget,omitempty"`
+	TrackCompletion           bool         `json:"trackCompletion,omitempty"`
+	AuditCoverage             bool         `json:"auditCoverage,omitempty"`
+	DedupContent              bool         `json:"dedupContent,omitempty"`
+	BatchSize                 int          `json:"batchSize,omitempty"`
+	PrefetchSourceData        bool         `json:"prefetchSourceData,omitempty"`
+	// CombineAspects makes the buffer image copy sessions walk the depth and
+	// stencil aspects of each subresource together, reading the source data
+	// of each aspect once for the copies to all its dst images. The number of
+	// the source data reads, and the ones saved, are logged once the images
+	// are primed.
+	CombineAspects   bool          `json:"combineAspects,omitempty"`
+	PrimedLayout     VkImageLayout `json:"primedLayout,omitempty"`
+	StagingBlockSize VkDeviceSize  `json:"stagingBlockSize,omitempty"`
+	// AllocationFailures is the number of the memory allocations of the
+	// rebuilt state which failed in a prior replay, as reported by
+	// QueryRebuildAllocationFailures. Each failure reduces the overallocation
+	// of the memory of the staging images, from 2 down to none.
+	AllocationFailures int `json:"allocationFailures,omitempty"`
+	// SkipImages are the images whose data is not primed, but only their
+	// layouts are restored.
+	SkipImages []VkImage `json:"skipImages,omitempty"`
+	// PrimeImages, if not empty, are the only images whose data is primed,
+	// e.g. the images used by the command being debugged, see primeSubset.
+	PrimeImages []VkImage `json:"primeImages,omitempty"`
+	// SourceLayer, if not nil, is the array layer whose data is used to prime
+	// all the array layers of the images which have that layer.
+	SourceLayer *uint32 `json:"sourceLayer,omitempty"`
+	// ReplayPlans are the priming plans, as logged with LogPlans, to be
+	// followed instead of deciding how to prime the images.
+	ReplayPlans json.RawMessage `json:"replayPlans,omitempty"`
+	// ForceStrategies are the strategies the images are primed with instead
+	// of the ones decided from their usages, e.g. to reproduce a problem of a
+	// strategy on an image which is usually primed with another one.
+	ForceStrategies []ImagePrimerStrategy `json:"forceStrategies,omitempty"`
+	// SignalSemaphore, if not 0, is the timeline semaphore signaled with
+	// SignalValue once all the images are primed, or if SignalEachImage is
+	// set, with SignalValue + i once the i-th image is primed. The value must
+	// be greater than the captured value of the semaphore.
+	SignalSemaphore VkSemaphore `json:"signalSemaphore,omitempty"`
+	SignalValue     uint64      `json:"signalValue,omitempty"`
+	SignalEachImage bool        `json:"signalEachImage,omitempty"`
+	// ValidateImages are the subresources whose primed data is read back and
+	// compared with reference images when the priming is validated, see
+	// QueryPrimedImageValidation.
+	ValidateImages []ImagePrimerValidation `json:"validateImages,omitempty"`
+	// LogPlans makes the priming plans of all the images be logged once the
+	// images are primed.
+	LogPlans bool `json:"logPlans,omitempty"`
+	// ResumeCheckpoint is the priming checkpoint, as logged when
+	// TrackCompletion is set, of an interrupted rebuild to resume from.
+	ResumeCheckpoint json.RawMessage `json:"resumeCheckpoint,omitempty"`
+	// ImageData are the data to be primed into the subresources of the images
+	// instead of their captured data, e.g. to replace the textures of a
+	// capture without making a new capture.
+	ImageData []ImagePrimerImageData `json:"imageData,omitempty"`
+	// DstLayouts are the layouts the subresource ranges of the images are
+	// left in once primed, instead of their captured layouts. Later ranges
+	// override earlier ones.
+	DstLayouts []ImagePrimerLayoutRange `json:"dstLayouts,omitempty"`
+	// SpirvCacheDir, if not empty, is the directory the generated SPIR-V of
+	// the priming shaders is cached in across rebuilds.
+	SpirvCacheDir string `json:"spirvCacheDir,omitempty"`
+	// DumpShadersDir, if not empty, is the directory the SPIR-V binaries of
+	// the priming shaders are written to, e.g. for disassembling the code used
+	// to prime a problematic format.
+	DumpShadersDir string `json:"dumpShadersDir,omitempty"`
+}
+
+// ImagePrimerLayoutRange is the layout a subresource range of an image is left
+// in once primed.
+type ImagePrimerLayoutRange struct {
+	Image      VkImage            `json:"image"`
+	AspectMask VkImageAspectFlags `json:"aspectMask"`
+	BaseLayer  uint32             `json:"baseLayer"`
+	LayerCount uint32             `json:"layerCount"`
+	BaseLevel  uint32             `json:"baseLevel"`
+	LevelCount uint32             `json:"levelCount"`
+	Layout     VkImageLayout      `json:"layout"`
+}
+
+// ImagePrimerStrategy is the priming strategy an image is primed with, by the
+// name used in the priming plans, e.g. "buffer-copy" or "rendering".
+type ImagePrimerStrategy struct {
+	Image    VkImage `json:"image"`
+	Strategy string  `json:"strategy"`
+}
+
+// ImagePrimerValidation is a subresource of an image whose primed data is
+// compared with a reference PNG or KTX image file. A pixel matches the
+// reference if none of its channels, normalized to [0, 1], differs from the
+// reference by more than Tolerance.
+type ImagePrimerValidation struct {
+	Image     VkImage               `json:"image"`
+	Aspect    VkImageAspectFlagBits `json:"aspect"`
+	Layer     uint32                `json:"layer"`
+	Level     uint32                `json:"level"`
+	Reference string                `json:"reference"`
+	Tolerance float32               `json:"tolerance,omitempty"`
+}
+
+// ImagePrimerImageData is the data to be primed into a subresource of an image
+// instead of its captured data. The data must be tightly packed in the format
+// of the image, and its size must match the size of the subresource. The data
+// is base64 encoded in JSON.
+type ImagePrimerImageData struct {
+	Image  VkImage               `json:"image"`
+	Aspect VkImageAspectFlagBits `json:"aspect"`
+	Layer  uint32                `json:"layer"`
+	Level  uint32                `json:"level"`
+	Data   []byte                `json:"data"`
+}
+
+// ParseImagePrimerOptions deserializes the given JSON image primer options.
+func ParseImagePrimerOptions(data []byte) (ImagePrimerOptions, error) {
+	opts := ImagePrimerOptions{}
+	err := json.Unmarshal(data, &opts)
+	return opts, err
+}
+
+type imagePrimerOptionsKeyTy string
+
+const imagePrimerOptionsKey = imagePrimerOptionsKeyTy("vulkanImagePrimerOptions")
+
+// PutImagePrimerOptions attaches the image primer options to a Context.
+func PutImagePrimerOptions(ctx context.Context, opts ImagePrimerOptions) context.Context {
+	return keys.WithValue(ctx, imagePrimerOptionsKey, opts)
+}
+
+// GetImagePrimerOptions retrieves the image primer options from a context
+// previously annotated by PutImagePrimerOptions, or the default options if the
+// context is not annotated.
+func GetImagePrimerOptions(ctx context.Context) ImagePrimerOptions {
+	val := ctx.Value(imagePrimerOptionsKey)
+	if val == nil {
+		return ImagePrimerOptions{}
+	}
+	return val.(ImagePrimerOptions)
+}
+
+// applyOptions sets up this image primer with the given options. Returns an
+// error if the replay plans, the checkpoint to resume from or the forced
+// strategies can not be decoded, or the semaphore to signal can not be
+// signaled, in which case the other options are still applied.
+func (p *imagePrimer) applyOptions(ctx context.Context, opts ImagePrimerOptions) error {
+	p.narrowStagingFormats = opts.NarrowStagingFormats
+	p.stagingColorFormat = opts.StagingColorFormat
+	p.stagingDepthStencilFormat = opts.StagingDepthStencilFormat
+	p.generateMipLevels = opts.GenerateMipLevels
+	p.distributeQueues = opts.DistributeQueues
+	p.strategyQueues = opts.StrategyQueues
+	p.stagingMemoryBudget = opts.StagingMemoryBudget
+	p.trackCompletion = opts.TrackCompletion
+	p.auditCoverage = opts.AuditCoverage
+	p.dedupContent = opts.DedupContent
+	p.batchSize = opts.BatchSize
+	p.prefetchSourceData = opts.PrefetchSourceData
+	p.combineAspects = opts.CombineAspects
+	p.primedLayout = opts.PrimedLayout
+	p.stagingBlockSize = opts.StagingBlockSize
+	p.allocationFailures = opts.AllocationFailures
+	if opts.AllocationFailures > 0 {
+		log.W(ctx, "%v memory allocations failed in a prior replay, overallocating the staging memory by: %v", opts.AllocationFailures, ipStagingOverallocation(opts.AllocationFailures))
+	}
+	p.rh.spirvCacheDir = opts.SpirvCacheDir
+	p.sh.spirvCacheDir = opts.SpirvCacheDir
+	p.rh.dumpShadersDir = opts.DumpShadersDir
+	p.sh.dumpShadersDir = opts.DumpShadersDir
+	if opts.BatchSize > 0 {
+		p.cancelPriming = func() bool { return task.Stopped(ctx) }
+	}
+	if len(opts.SkipImages) > 0 {
+		skipped := make(map[VkImage]bool, len(opts.SkipImages))
+		for _, img := range opts.SkipImages {
+			skipped[img] = true
+		}
+		p.skipPriming = func(img VkImage, info ImageInfo) bool { return skipped[img] }
+	}
+	if len(opts.PrimeImages) > 0 {
+		p.primeSubset(opts.PrimeImages)
+	}
+	if len(opts.ImageData) > 0 {
+		p.imageData = map[VkImage]map[ipSubresource][]uint8{}
+		for _, d := range opts.ImageData {
+			if p.imageData[d.Image] == nil {
+				p.imageData[d.Image] = map[ipSubresource][]uint8{}
+			}
+			p.imageData[d.Image][ipSubresource{aspect: d.Aspect, layer: d.Layer, level: d.Level}] = d.Data
+		}
+	}
+	if len(opts.DstLayouts) > 0 {
+		p.dstLayouts = map[VkImage]*ipLayoutInfoFromRanges{}
+		for _, r := range opts.DstLayouts {
+			if p.dstLayouts[r.Image] == nil {
+				p.dstLayouts[r.Image] = useLayoutsOfRanges(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED)
+			}
+			p.dstLayouts[r.Image].setLayout(NewVkImageSubresourceRange(p.sb.ta,
+				r.AspectMask, // aspectMask
+				r.BaseLevel,  // baseMipLevel
+				r.LevelCount, // levelCount
+				r.BaseLayer,  // baseArrayLayer
+				r.LayerCount, // layerCount
+			), r.Layout)
+		}
+	}
+	if opts.SourceLayer != nil {
+		layer := *opts.SourceLayer
+		p.sourceSubresource = func(img VkImage, dst ipSubresource) ipSubresource {
+			if layer < p.sb.s.Images().Get(img).Info().ArrayLayers() {
+				dst.layer = layer
+			}
+			return dst
+		}
+	}
+	if len(opts.ReplayPlans) > 0 {
+		plans, err := decodePrimingPlans(opts.ReplayPlans)
+		if err != nil {
+			return log.Errf(ctx, err, "[Decoding the priming plans to replay]")
+		}
+		p.replayPlans = plans
+	}
+	if len(opts.ResumeCheckpoint) > 0 {
+		resumed, err := decodePrimingCheckpoint(opts.ResumeCheckpoint)
+		if err != nil {
+			return log.Errf(ctx, err, "[Decoding the priming checkpoint to resume from]")
+		}
+		p.resumedImages = resumed
+	}
+	if opts.SignalSemaphore != VkSemaphore(0) {
+		if err := p.checkSignalSemaphore(opts.SignalSemaphore, opts.SignalValue); err != nil {
+			return log.Errf(ctx, err, "[Signaling semaphore: %v once the images are primed]", opts.SignalSemaphore)
+		}
+		p.signalSemaphore = opts.SignalSemaphore
+		p.signalValue = opts.SignalValue
+		p.signalEachImage = opts.SignalEachImage
+	}
+	if len(opts.ForceStrategies) > 0 {
+		p.forcedStrategies = map[VkImage]ipPrimingStrategy{}
+		for _, f := range opts.ForceStrategies {
+			strategy, err := ipParsePrimingStrategy(f.Strategy)
+			if err != nil {
+				return log.Errf(ctx, err, "[Forcing the priming strategy of image: %v]", f.Image)
+			}
+			p.forcedStrategies[f.Image] = strategy
+		}
+	}
+	return nil
+}
+
+// logResults logs the priming plans of the images if LogPlans is set, and the
+// checkpoint of the primed images if TrackCompletion is set in the given
+// options, so they can be given back with ReplayPlans and ResumeCheckpoint.
+func (p *imagePrimer) logResults(ctx context.Context, opts ImagePrimerOptions) {
+	if opts.LogPlans {
+		if data, err := encodePrimingPlans(p.primingPlans()); err != nil {
+			log.E(ctx, "Failed to encode the priming plans: %v", err)
+		} else {
+			log.I(ctx, "Image priming plans: %s", data)
+		}
+	}
+	if opts.CombineAspects {
+		log.I(ctx, "Read %v source data slices for the buffer image copies, %v reads saved by walking the aspects of the subresources together", p.sourceReads.reads, p.sourceReads.saved)
+	}
+	if opts.TrackCompletion {
+		if data, err := encodePrimingCheckpoint(p.checkpoint()); err != nil {
+			log.E(ctx, "Failed to encode the priming checkpoint: %v", err)
+		} else {
+			log.I(ctx, "Image priming checkpoint: %s", data)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/gapid/core/log"
+)
+
+// ipPrimingStrategy identifies the way the data of an image is primed.
+type ipPrimingStrategy string
+
+const (
+	ipPrimingStrategyLayoutTransition  ipPrimingStrategy = "layout-transition"
+	ipPrimingStrategyBufferCopy        ipPrimingStrategy = "buffer-copy"
+	ipPrimingStrategyRendering         ipPrimingStrategy = "rendering"
+	ipPrimingStrategyImageStore        ipPrimingStrategy = "image-store"
+	ipPrimingStrategyPreinitialization ipPrimingStrategy = "preinitialization"
+	ipPrimingStrategyImageCopy         ipPrimingStrategy = "image-copy"
+	ipPrimingStrategyImageBlit         ipPrimingStrategy = "image-blit"
+)
+
+// ipPrimingStrategies are all the priming strategies.
+var ipPrimingStrategies = []ipPrimingStrategy{
+	ipPrimingStrategyLayoutTransition,
+	ipPrimingStrategyBufferCopy,
+	ipPrimingStrategyRendering,
+	ipPrimingStrategyImageStore,
+	ipPrimingStrategyPreinitialization,
+	ipPrimingStrategyImageCopy,
+	ipPrimingStrategyImageBlit,
+}
+
+// ipParsePrimingStrategy returns the priming strategy of the given name, or an
+// error if there is no strategy of that name.
+func ipParsePrimingStrategy(name string) (ipPrimingStrategy, error) {
+	for _, strategy := range ipPrimingStrategies {
+		if string(strategy) == name {
+			return strategy, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown priming strategy: %v", name)
+}
+
+// ipPrimingPlan describes the decisions made by the image primer for priming
+// the data of an image. Which decisions are made depends on the properties of
+// the device, so the plans are recorded when the primeable image data are
+// built, and can be serialized to be logged or saved. A saved plan can be given
+// back to the image primer to reproduce the same decisions in another run,
+// possibly on another device, see imagePrimer.replayPlans.
+type ipPrimingPlan struct {
+	Image    VkImage           `json:"image"`
+	Strategy ipPrimingStrategy `json:"strategy"`
+	// StagingFormats are the formats of the staging images for each aspect,
+	// ordered by the aspects. Empty if no staging image is used.
+	StagingFormats []ipPlanStagingFormat `json:"stagingFormats,omitempty"`
+	// QueueFamily is the family of the queue on which the image is primed.
+	QueueFamily uint32 `json:"queueFamily"`
+	// BatchSize is the number of buffer -> image copies, staging images, store
+	// jobs, image -> image copy regions or blitted subresources used for
+	// priming, depending on the strategy.
+	BatchSize int `json:"batchSize"`
+	// GenerateMipLevels is true if only the base mip level is primed with the
+	// strategy, and the other levels are generated from it.
+	GenerateMipLevels bool `json:"generateMipLevels,omitempty"`
+}
+
+// ipPlanStagingFormat is the format of the staging images for an aspect.
+type ipPlanStagingFormat struct {
+	Aspect VkImageAspectFlagBits `json:"aspect"`
+	Format VkFormat              `json:"format"`
+}
+
+func (plan ipPrimingPlan) String() string {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// sameStagingFormats returns true if the two given plans use the same staging
+// formats.
+func (plan ipPrimingPlan) sameStagingFormats(other ipPrimingPlan) bool {
+	if len(plan.StagingFormats) != len(other.StagingFormats) {
+		return false
+	}
+	for i, f := range plan.StagingFormats {
+		if f != other.StagingFormats[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// encodePrimingPlans serializes the given priming plans.
+func encodePrimingPlans(plans []ipPrimingPlan) ([]byte, error) {
+	return json.Marshal(plans)
+}
+
+// decodePrimingPlans deserializes the priming plans serialized by
+// encodePrimingPlans, and returns them by their images.
+func decodePrimingPlans(data []byte) (map[VkImage]ipPrimingPlan, error) {
+	plans := []ipPrimingPlan{}
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, err
+	}
+	byImage := make(map[VkImage]ipPrimingPlan, len(plans))
+	for _, plan := range plans {
+		byImage[plan.Image] = plan
+	}
+	return byImage, nil
+}
+
+// primingPlans returns the plans of all the images for which primeable image
+// data has been built by this image primer, ordered by the image handles.
+func (p *imagePrimer) primingPlans() []ipPrimingPlan {
+	plans := make([]ipPrimingPlan, 0, len(p.plans))
+	for _, plan := range p.plans {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Image < plans[j].Image })
+	return plans
+}
+
+// planOf returns the priming plan of the given primeable image data built for
+// the given image.
+func (p *imagePrimer) planOf(img VkImage, primeable primeableImageData) ipPrimingPlan {
+	plan := ipPrimingPlan{Image: img}
+	if q := p.sb.s.Queues().Get(primeable.primingQueue()); !q.IsNil() {
+		plan.QueueFamily = q.Family()
+	}
+	stagingFormats := map[VkImageAspectFlagBits]VkFormat{}
+	switch pi := primeable.(type) {
+	case *ipPrimeableByLayoutTransition:
+		plan.Strategy = ipPrimingStrategyLayoutTransition
+	case *ipPrimeableByBufferCopy:
+		plan.Strategy = ipPrimingStrategyBufferCopy
+		for _, copies := range pi.copySession.copies {
+			plan.BatchSize += len(copies)
+		}
+	case *ipPrimeableByRendering:
+		plan.Strategy = ipPrimingStrategyRendering
+		for aspect, imgs := range pi.stagingImages {
+			if len(imgs) > 0 {
+				stagingFormats[aspect] = imgs[0].Info().Fmt()
+			}
+			plan.BatchSize += len(imgs)
+		}
+	case *ipPrimeableByImageStore:
+		plan.Strategy = ipPrimingStrategyImageStore
+		for _, job := range pi.storeJobs {
+			stagingFormats[VkImageAspectFlagBits(job.output.SubresourceRange().AspectMask())] = job.input.Fmt()
+		}
+		plan.BatchSize = len(pi.storeJobs)
+	case *ipPrimeableByPreinitialization:
+		plan.Strategy = ipPrimingStrategyPreinitialization
+		plan.BatchSize = len(pi.opaqueBoundRanges)
+	case *ipPrimeableByImageCopy:
+		plan.Strategy = ipPrimingStrategyImageCopy
+		if dst := GetState(p.sb.newState).Images().Get(img); !dst.IsNil() {
+			plan.BatchSize = len(pi.regions(dst))
+		}
+	case *ipPrimeableByImageBlit:
+		plan.Strategy = ipPrimingStrategyImageBlit
+		if dst := GetState(p.sb.newState).Images().Get(img); !dst.IsNil() {
+			plan.BatchSize = len(pi.subresources(dst))
+		}
+	case *ipPrimeableByMipGeneration:
+		plan = p.planOf(img, pi.base)
+		plan.GenerateMipLevels = true
+		return plan
+	}
+	for aspect, format := range stagingFormats {
+		plan.StagingFormats = append(plan.StagingFormats, ipPlanStagingFormat{Aspect: aspect, Format: format})
+	}
+	sort.Slice(plan.StagingFormats, func(i, j int) bool {
+		return plan.StagingFormats[i].Aspect < plan.StagingFormats[j].Aspect
+	})
+	return plan
+}
+
+// queueForPriming returns the queue to prime the given image on with the given
+// strategy, which supports the queue flags required by the strategy, see
+// ipStrategyQueueFlags. If a plan is being replayed for the image, a queue of
+// the plan's queue family is returned if there is one on the image's device
+// and the family is compatible with the image, see ipQueueFamilyCompatible.
+// Otherwise if strategyQueues is set, a queue of the family best suited for
+// the strategy is returned, and if distributeQueues is set, the least loaded
+// compatible queue is returned.
+func (p *imagePrimer) queueForPriming(img ImageObjectʳ, strategy ipPrimingStrategy) QueueObjectʳ {
+	if plan, ok := p.replayPlans[img.VulkanHandle()]; ok {
+		if ipQueueFamilyCompatible(img.Info(), plan.QueueFamily) {
+			queues := p.sb.s.Queues()
+			for _, q := range queues.Keys() {
+				queue := queues.Get(q)
+				if queue.Device() == img.Device() && queue.Family() == plan.QueueFamily {
+					return queue
+				}
+			}
+			log.W(p.sb.ctx, "No queue of family: %v for replaying the priming plan of image: %v", plan.QueueFamily, img.VulkanHandle())
+		} else {
+			log.W(p.sb.ctx, "Queue family: %v of the priming plan is not in the queue family indices of concurrent image: %v", plan.QueueFamily, img.VulkanHandle())
+		}
+	}
+	if p.strategyQueues {
+		return p.strategyQueueForPriming(img, strategy)
+	}
+	queueFlagBits := ipStrategyQueueFlags(strategy)
+	if p.distributeQueues {
+		return p.distributedQueueForPriming(img, queueFlagBits)
+	}
+	return getQueueForPriming(p.sb, img, queueFlagBits)
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+// ipPlaneFormats are the formats of the planes of the multi-planar formats,
+// i.e. the formats compatible with each plane for copies, and the chroma
+// subsampling factors of the planes after the first one.
+type ipPlaneFormats struct {
+	planes        []VkFormat
+	widthDivisor  uint32
+	heightDivisor uint32
+}
+
+var (
+	ip8BitPlanes2        = []VkFormat{VkFormat_VK_FORMAT_R8_UNORM, VkFormat_VK_FORMAT_R8G8_UNORM}
+	ip8BitPlanes3        = []VkFormat{VkFormat_VK_FORMAT_R8_UNORM, VkFormat_VK_FORMAT_R8_UNORM, VkFormat_VK_FORMAT_R8_UNORM}
+	ip10BitPlanes2       = []VkFormat{VkFormat_VK_FORMAT_R10X6_UNORM_PACK16, VkFormat_VK_FORMAT_R10X6G10X6_UNORM_2PACK16}
+	ip10BitPlanes3       = []VkFormat{VkFormat_VK_FORMAT_R10X6_UNORM_PACK16, VkFormat_VK_FORMAT_R10X6_UNORM_PACK16, VkFormat_VK_FORMAT_R10X6_UNORM_PACK16}
+	ip12BitPlanes2       = []VkFormat{VkFormat_VK_FORMAT_R12X4_UNORM_PACK16, VkFormat_VK_FORMAT_R12X4G12X4_UNORM_2PACK16}
+	ip12BitPlanes3       = []VkFormat{VkFormat_VK_FORMAT_R12X4_UNORM_PACK16, VkFormat_VK_FORMAT_R12X4_UNORM_PACK16, VkFormat_VK_FORMAT_R12X4_UNORM_PACK16}
+	ip16BitPlanes2       = []VkFormat{VkFormat_VK_FORMAT_R16_UNORM, VkFormat_VK_FORMAT_R16G16_UNORM}
+	ip16BitPlanes3       = []VkFormat{VkFormat_VK_FORMAT_R16_UNORM, VkFormat_VK_FORMAT_R16_UNORM, VkFormat_VK_FORMAT_R16_UNORM}
+	ipMultiPlanarFormats = map[VkFormat]ipPlaneFormats{
+		VkFormat_VK_FORMAT_G8_B8_R8_3PLANE_420_UNORM:                  {ip8BitPlanes3, 2, 2},
+		VkFormat_VK_FORMAT_G8_B8_R8_3PLANE_422_UNORM:                  {ip8BitPlanes3, 2, 1},
+		VkFormat_VK_FORMAT_G8_B8_R8_3PLANE_444_UNORM:                  {ip8BitPlanes3, 1, 1},
+		VkFormat_VK_FORMAT_G8_B8R8_2PLANE_420_UNORM:                   {ip8BitPlanes2, 2, 2},
+		VkFormat_VK_FORMAT_G8_B8R8_2PLANE_422_UNORM:                   {ip8BitPlanes2, 2, 1},
+		VkFormat_VK_FORMAT_G10X6_B10X6_R10X6_3PLANE_420_UNORM_3PACK16: {ip10BitPlanes3, 2, 2},
+		VkFormat_VK_FORMAT_G10X6_B10X6_R10X6_3PLANE_422_UNORM_3PACK16: {ip10BitPlanes3, 2, 1},
+		VkFormat_VK_FORMAT_G10X6_B10X6_R10X6_3PLANE_444_UNORM_3PACK16: {ip10BitPlanes3, 1, 1},
+		VkFormat_VK_FORMAT_G10X6_B10X6R10X6_2PLANE_420_UNORM_3PACK16:  {ip10BitPlanes2, 2, 2},
+		VkFormat_VK_FORMAT_G10X6_B10X6R10X6_2PLANE_422_UNORM_3PACK16:  {ip10BitPlanes2, 2, 1},
+		VkFormat_VK_FORMAT_G12X4_B12X4_R12X4_3PLANE_420_UNORM_3PACK16: {ip12BitPlanes3, 2, 2},
+		VkFormat_VK_FORMAT_G12X4_B12X4_R12X4_3PLANE_422_UNORM_3PACK16: {ip12BitPlanes3, 2, 1},
+		VkFormat_VK_FORMAT_G12X4_B12X4_R12X4_3PLANE_444_UNORM_3PACK16: {ip12BitPlanes3, 1, 1},
+		VkFormat_VK_FORMAT_G12X4_B12X4R12X4_2PLANE_420_UNORM_3PACK16:  {ip12BitPlanes2, 2, 2},
+		VkFormat_VK_FORMAT_G12X4_B12X4R12X4_2PLANE_422_UNORM_3PACK16:  {ip12BitPlanes2, 2, 1},
+		VkFormat_VK_FORMAT_G16_B16_R16_3PLANE_420_UNORM:               {ip16BitPlanes3, 2, 2},
+		VkFormat_VK_FORMAT_G16_B16_R16_3PLANE_422_UNORM:               {ip16BitPlanes3, 2, 1},
+		VkFormat_VK_FORMAT_G16_B16_R16_3PLANE_444_UNORM:               {ip16BitPlanes3, 1, 1},
+		VkFormat_VK_FORMAT_G16_B16R16_2PLANE_420_UNORM:                {ip16BitPlanes2, 2, 2},
+		VkFormat_VK_FORMAT_G16_B16R16_2PLANE_422_UNORM:                {ip16BitPlanes2, 2, 1},
+	}
+)
+
+// ipPlaneIndex returns the index of the given plane aspect, or false if the
+// aspect is not a plane aspect.
+func ipPlaneIndex(aspect VkImageAspectFlagBits) (int, bool) {
+	switch aspect {
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_0_BIT:
+		return 0, true
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_1_BIT:
+		return 1, true
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_2_BIT:
+		return 2, true
+	}
+	return 0, false
+}
+
+// ipPlaneFormat returns the format of the given plane of an image in the given
+// multi-planar format, and the divisors of the width and height of the image
+// extent to get the extent of the plane. Returns false if the format is not a
+// multi-planar one or has no such plane. The raw data of each plane is primed
+// in the plane aspect of the image, the sampler YCbCr conversion the image
+// may be sampled with does not change the data.
+func ipPlaneFormat(format VkFormat, plane VkImageAspectFlagBits) (VkFormat, uint32, uint32, bool) {
+	info, ok := ipMultiPlanarFormats[format]
+	if !ok {
+		return VkFormat_VK_FORMAT_UNDEFINED, 0, 0, false
+	}
+	i, ok := ipPlaneIndex(plane)
+	if !ok || i >= len(info.planes) {
+		return VkFormat_VK_FORMAT_UNDEFINED, 0, 0, false
+	}
+	if i == 0 {
+		return info.planes[i], 1, 1, true
+	}
+	return info.planes[i], info.widthDivisor, info.heightDivisor, true
+}
+
+// ipPlaneElementSizes are the element sizes of the plane formats.
+var ipPlaneElementSizes = map[VkFormat]uint32{
+	VkFormat_VK_FORMAT_R8_UNORM:                 1,
+	VkFormat_VK_FORMAT_R8G8_UNORM:               2,
+	VkFormat_VK_FORMAT_R10X6_UNORM_PACK16:       2,
+	VkFormat_VK_FORMAT_R10X6G10X6_UNORM_2PACK16: 4,
+	VkFormat_VK_FORMAT_R12X4_UNORM_PACK16:       2,
+	VkFormat_VK_FORMAT_R12X4G12X4_UNORM_2PACK16: 4,
+	VkFormat_VK_FORMAT_R16_UNORM:                2,
+	VkFormat_VK_FORMAT_R16G16_UNORM:             4,
+}
+
+// ipPlaneLevelSize returns the size and extent of the given mip level of the
+// given plane of an image with the given extent and multi-planar format. The
+// extent of the chroma planes of subsampled formats is rounded up. Returns
+// false if the format is not a multi-planar one or has no such plane.
+func ipPlaneLevelSize(extent VkExtent3D, format VkFormat, mipLevel uint32, plane VkImageAspectFlagBits) (byteSizeAndExtent, bool) {
+	planeFormat, widthDivisor, heightDivisor, ok := ipPlaneFormat(format, plane)
+	if !ok {
+		return byteSizeAndExtent{}, false
+	}
+	mipSize := func(size uint32) uint64 {
+		if size>>mipLevel == 0 {
+			return 1
+		}
+		return uint64(size >> mipLevel)
+	}
+	width := (mipSize(extent.Width()) + uint64(widthDivisor) - 1) / uint64(widthDivisor)
+	height := (mipSize(extent.Height()) + uint64(heightDivisor) - 1) / uint64(heightDivisor)
+	depth := mipSize(extent.Depth())
+	size := width * height * depth * uint64(ipPlaneElementSizes[planeFormat])
+	return byteSizeAndExtent{
+		levelSize:             size,
+		alignedLevelSize:      nextMultipleOf(size, 8),
+		levelSizeInBuf:        size,
+		alignedLevelSizeInBuf: nextMultipleOf(size, 8),
+		width:                 width,
+		height:                height,
+		depth:                 depth,
+	}, true
+}
@@ -0,0 +1,214 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"fmt"
+
+	"github.com/google/gapid/core/log"
+)
+
+// ipPrimingWork is the priming work of an image queued by an image primer
+// when batchSize is set, see queuePriming.
+type ipPrimingWork struct {
+	img               ImageObjectʳ
+	opaqueBoundRanges []VkImageSubresourceRange
+	primeable         primeableImageData
+	srcLayout         ipLayoutInfo
+	dstLayout         ipLayoutInfo
+}
+
+// queuePriming primes the given image with the given primeable image data, or
+// if batchSize is set, queues the priming work to be done in order with the
+// work of the other images when the queue is flushed. The queue is flushed
+// once it holds batchSize images, or the staging memory in use reaches
+// stagingMemoryBudget, so the number of images whose staging resources are
+// alive at the same time is bounded.
+func (p *imagePrimer) queuePriming(img ImageObjectʳ, opaqueBoundRanges []VkImageSubresourceRange, primeable primeableImageData, srcLayout, dstLayout ipLayoutInfo) {
+	work := ipPrimingWork{
+		img:               img,
+		opaqueBoundRanges: opaqueBoundRanges,
+		primeable:         primeable,
+		srcLayout:         srcLayout,
+		dstLayout:         dstLayout,
+	}
+	if p.batchSize <= 0 {
+		p.doPrimingWork(work)
+		return
+	}
+	p.primingWorks = append(p.primingWorks, work)
+	if ipShouldFlushPrimingWorks(len(p.primingWorks), p.batchSize, p.stagingMemoryInUse(), p.stagingMemoryBudget) {
+		p.flushPrimingWorks()
+	}
+}
+
+// ipShouldFlushPrimingWorks returns true if the given number of queued
+// priming works reaches the given batch size, or the given staging memory in
+// use reaches the given budget, if not 0.
+func ipShouldFlushPrimingWorks(queued, batchSize int, used, budget VkDeviceSize) bool {
+	return queued >= batchSize || (budget != 0 && used >= budget)
+}
+
+// flushPrimingWorks does the queued priming works in the order they are
+// queued, and frees their staging resources. If cancelPriming returns true
+// before priming an image, the data of the image and of all the images after
+// it will not be primed, but only their layouts are restored. The cancelled
+// images are not recorded as primed, so when trackCompletion is set, a rebuild
+// resumed from the checkpoint primes them.
+func (p *imagePrimer) flushPrimingWorks() {
+	works := p.primingWorks
+	p.primingWorks = nil
+	for i, work := range works {
+		if !p.cancelled && p.cancelPriming != nil && p.cancelPriming() {
+			log.W(p.sb.ctx, "Priming is cancelled, the data of the %v remaining queued images will not be primed, only layouts are restored", len(works)-i)
+			p.cancelled = true
+		}
+		if p.cancelled {
+			work.primeable.free()
+			work.primeable = &ipPrimeableByLayoutTransition{
+				p:       p,
+				img:     work.img.VulkanHandle(),
+				aspects: p.aspectsOfRanges(work.img, work.opaqueBoundRanges),
+				queue:   work.primeable.primingQueue(),
+			}
+		}
+		p.doPrimingWork(work)
+	}
+}
+
+// doPrimingWork primes the image of the given priming work, and frees the
+// staging resources of the work. If primedLayout is set, the primed
+// subresources are left in primedLayout instead of the destination layouts of
+// the work.
+func (p *imagePrimer) doPrimingWork(work ipPrimingWork) {
+	defer work.primeable.free()
+	img := work.img
+	dstLayout := work.dstLayout
+	if _, layoutOnly := work.primeable.(*ipPrimeableByLayoutTransition); !layoutOnly && p.primedLayout != VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED {
+		dstLayout = leaveInLayout(p.primedLayout, dstLayout)
+	}
+	if err := p.checkDstLayouts(img, dstLayout); err != nil {
+		log.E(p.sb.ctx, "[Priming image: %v] %v", img.VulkanHandle(), err)
+		return
+	}
+	if err := work.primeable.prime(work.srcLayout, dstLayout); err != nil {
+		log.E(p.sb.ctx, "Priming image data: %v", err)
+		return
+	}
+	// Image data priming is recorded successfully, transfer the queue family
+	// ownership if the image was primed on another queue family.
+	ipHandOffToLastBoundQueues(p.sb, img, work.primeable.primingQueue())
+	if p.signalEachImage {
+		p.signalPrimed()
+	}
+	if p.cancelled {
+		return
+	}
+	p.markPrimed(img.VulkanHandle())
+}
+
+// ipTimelineSemaphore returns true if VK_KHR_timeline_semaphore is enabled on
+// the given device, along with its timelineSemaphore feature, so the priming
+// can signal timeline semaphores.
+func ipTimelineSemaphore(sb *stateBuilder, dev VkDevice) bool {
+	devObj := GetState(sb.newState).Devices().Get(dev)
+	if devObj.IsNil() {
+		return false
+	}
+	features := devObj.TimelineSemaphoreFeatures()
+	if features.IsNil() || features.TimelineSemaphore() == VkBool32(0) {
+		return false
+	}
+	for _, ext := range devObj.EnabledExtensions().All() {
+		if ext == "VK_KHR_timeline_semaphore" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignalSemaphore returns an error if the given semaphore can not be
+// signaled with the given value once the images are primed: the semaphore must
+// be a timeline semaphore whose current value is less than the given value, on
+// a device with VK_KHR_timeline_semaphore enabled.
+func (p *imagePrimer) checkSignalSemaphore(sem VkSemaphore, value uint64) error {
+	semObj := p.sb.s.Semaphores().Get(sem)
+	if semObj.IsNil() {
+		return fmt.Errorf("Semaphore: %v does not exist", sem)
+	}
+	if semObj.Type() != VkSemaphoreTypeKHR_VK_SEMAPHORE_TYPE_TIMELINE_KHR {
+		return fmt.Errorf("Semaphore: %v is not a timeline semaphore", sem)
+	}
+	if value <= semObj.Value() {
+		return fmt.Errorf("Value: %v is not greater than the current value: %v of semaphore: %v", value, semObj.Value(), sem)
+	}
+	if !ipTimelineSemaphore(p.sb, semObj.Device()) {
+		return fmt.Errorf("VK_KHR_timeline_semaphore is not enabled on device: %v of semaphore: %v", semObj.Device(), sem)
+	}
+	return nil
+}
+
+// signalQueue returns the queue to signal the given semaphore on: its last
+// queue if it is created in the new state, otherwise the first queue of its
+// device in the new state.
+func (p *imagePrimer) signalQueue(sem SemaphoreObjectʳ) QueueObjectʳ {
+	queues := GetState(p.sb.newState).Queues()
+	if queues.Contains(sem.LastQueue()) {
+		return p.sb.s.Queues().Get(sem.LastQueue())
+	}
+	for _, q := range p.sb.s.Queues().Keys() {
+		if queue := p.sb.s.Queues().Get(q); queue.Device() == sem.Device() && queues.Contains(q) {
+			return queue
+		}
+	}
+	return NilQueueObjectʳ
+}
+
+// signalPrimed signals the next value to signalSemaphore, if set, once all the
+// priming work recorded so far is executed: signalValue the first time, then
+// signalValue + 1, and so on. The semaphore is created first if it is not in
+// the new state yet, as the semaphores are created after the images when the
+// state is rebuilt.
+func (p *imagePrimer) signalPrimed() {
+	if p.signalSemaphore == VkSemaphore(0) {
+		return
+	}
+	sem := p.sb.s.Semaphores().Get(p.signalSemaphore)
+	if !GetState(p.sb.newState).Semaphores().Contains(p.signalSemaphore) {
+		p.sb.createSemaphore(sem)
+	}
+	queue := p.signalQueue(sem)
+	if queue.IsNil() {
+		log.E(p.sb.ctx, "No queue to signal semaphore: %v on", p.signalSemaphore)
+		return
+	}
+	// The priming work may be pending on any of the queues.
+	p.sb.flushAllScratchResources()
+	value := p.signalValue + p.signaledValues
+	p.signaledValues++
+	task := p.sb.newScratchTaskOnQueue(queue.VulkanHandle())
+	task.signalTimelineSemaphore(p.signalSemaphore, value)
+	if err := task.commit(); err != nil {
+		log.E(p.sb.ctx, "[Signaling value: %v to semaphore: %v] %v", value, p.signalSemaphore, err)
+	}
+}
+
+// signalAllPrimed signals signalValue to signalSemaphore, if set, once all the
+// images are primed, unless a value is signaled for each image.
+func (p *imagePrimer) signalAllPrimed() {
+	if !p.signalEachImage {
+		p.signalPrimed()
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"fmt"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/api"
+)
+
+// ipSubresourceRegion is a region of a single subresource of an image, e.g. a
+// dirty tile to be primed again. The offset and extent are in texels.
+type ipSubresourceRegion struct {
+	ipSubresource
+	offset [3]uint32
+	extent [3]uint32
+}
+
+// ipRegionData returns the tightly packed data of the given region of a level
+// with the given extent, whose tightly packed data is the given data, with the
+// given element size. Returns an error if the region is empty or out of the
+// level, or the data is shorter than the level.
+func ipRegionData(data []uint8, levelExtent [3]uint32, elementSize uint32, offset, extent [3]uint32) ([]uint8, error) {
+	for i := range extent {
+		if extent[i] == 0 || uint64(offset[i])+uint64(extent[i]) > uint64(levelExtent[i]) {
+			return nil, fmt.Errorf("region at offset: %v with extent: %v is out of the level of extent: %v", offset, extent, levelExtent)
+		}
+	}
+	rowPitch := uint64(levelExtent[0]) * uint64(elementSize)
+	slicePitch := rowPitch * uint64(levelExtent[1])
+	if uint64(len(data)) < slicePitch*uint64(levelExtent[2]) {
+		return nil, fmt.Errorf("data size: %v is less than the level size: %v", len(data), slicePitch*uint64(levelExtent[2]))
+	}
+	rowSize := uint64(extent[0]) * uint64(elementSize)
+	region := make([]uint8, 0, rowSize*uint64(extent[1])*uint64(extent[2]))
+	for z := uint64(offset[2]); z < uint64(offset[2])+uint64(extent[2]); z++ {
+		for y := uint64(offset[1]); y < uint64(offset[1])+uint64(extent[1]); y++ {
+			start := z*slicePitch + y*rowPitch + uint64(offset[0])*uint64(elementSize)
+			region = append(region, data[start:start+rowSize]...)
+		}
+	}
+	return region, nil
+}
+
+// collectCopiesFromRegions collects the copies of exactly the given regions
+// of the source image to the dst images, e.g. for priming again only the
+// regions a dirty region tracker reports, instead of walking the whole
+// subresources. The regions covering whole subresources are copied straight
+// from the source data. For the other regions, the data of each source
+// subresource is read once for all its regions, and only the formats whose
+// texel blocks are single texels are supported, the regions of the other
+// formats fail with errors.
+func (h *ipBufferImageCopySession) collectCopiesFromRegions(regions []ipSubresourceRegion) {
+	srcImg := h.job.srcImg
+	levelData := map[ipSubresource][]uint8{}
+	srcData := h.srcData
+	defer func() { h.srcData = srcData }()
+	for _, region := range regions {
+		fail := func(err error) {
+			h.errs = append(h.errs, log.Errf(h.logCtx.at(region.aspect, region.layer, region.level).bind(h.sb.ctx), err, "[Getting VkBufferImageCopy and raw data for region at offset: %v, extent: %v]", region.offset, region.extent))
+		}
+		dsts, ok := h.job.srcAspectsToDsts[region.aspect]
+		if !ok {
+			// The aspect is not requested to be copied.
+			continue
+		}
+		extent := NewVkExtent3D(h.sb.ta, region.extent[0], region.extent[1], region.extent[2])
+		collect := func(offset VkOffset3D) {
+			for dstIndex, dstImg := range dsts.dstImgs {
+				// dstIndex is reserved for handling wide channel image format
+				// like R64G64B64A64
+				// TODO: handle wide format
+				bufFillInfo, bufImgCopy, err := h.getCopyAndData(
+					dstImg, dsts.dstAspect, srcImg, region.aspect, region.layer, region.level, MakeVkOffset3D(h.sb.ta), extent)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				bufImgCopy.SetImageOffset(offset)
+				h.appendCopy(dstImg, bufImgCopy, bufFillInfo)
+				h.indices[dstImg] = dstIndex
+				h.totalSize += bufFillInfo.size()
+			}
+		}
+		dstLevelSize := h.sb.levelSize(srcImg.Info().Extent(), srcImg.Info().Fmt(), region.level, region.aspect)
+		if region.offset == [3]uint32{} && region.extent == [3]uint32{uint32(dstLevelSize.width), uint32(dstLevelSize.height), uint32(dstLevelSize.depth)} {
+			h.srcData = srcData
+			collect(MakeVkOffset3D(h.sb.ta))
+			continue
+		}
+		if info, err := subGetElementAndTexelBlockSize(h.sb.ctx, nil, api.CmdNoID, nil, h.sb.oldState, GetState(h.sb.oldState), 0, nil, nil, srcImg.Info().Fmt()); err != nil {
+			fail(err)
+			continue
+		} else if info.TexelBlockSize().Width() != 1 || info.TexelBlockSize().Height() != 1 {
+			fail(fmt.Errorf("format: %v with texel blocks is not supported", srcImg.Info().Fmt()))
+			continue
+		}
+		src := h.sourceOf(region.ipSubresource)
+		data, ok := levelData[src]
+		if !ok {
+			var err error
+			data, err = h.subresourceData(srcData, src)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			levelData[src] = data
+		}
+		levelSize := h.sb.levelSize(srcImg.Info().Extent(), srcImg.Info().Fmt(), src.level, src.aspect)
+		levelExtent := [3]uint32{uint32(levelSize.width), uint32(levelSize.height), uint32(levelSize.depth)}
+		elementSize := uint32(levelSize.levelSize / (levelSize.width * levelSize.height * levelSize.depth))
+		regionData, err := ipRegionData(data, levelExtent, elementSize, region.offset, region.extent)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		// The tightly packed data of the region is supplied as the data of a
+		// subresource of the extent of the region, and the copies are moved
+		// to the offset of the region.
+		h.srcData = map[ipSubresource][]uint8{src: regionData}
+		collect(NewVkOffset3D(h.sb.ta, int32(region.offset[0]), int32(region.offset[1]), int32(region.offset[2])))
+	}
+}
+
+// subresourceData returns the tightly packed data of the given source
+// subresource, from the given caller supplied data if not nil, otherwise from
+// the prefetched data or the old state.
+func (h *ipBufferImageCopySession) subresourceData(srcData map[ipSubresource][]uint8, src ipSubresource) ([]uint8, error) {
+	if srcData != nil {
+		d, ok := srcData[src]
+		if !ok {
+			return nil, fmt.Errorf("no data supplied for subresource: %+v", src)
+		}
+		h.reads.reads++
+		return d, nil
+	}
+	if d, ok := h.prefetched[src]; ok {
+		return d, nil
+	}
+	h.reads.reads++
+	return h.job.srcImg.
+		Aspects().Get(src.aspect).
+		Layers().Get(src.layer).
+		Levels().Get(src.level).
+		Data().Read(h.sb.ctx, nil, h.sb.oldState, nil)
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+// reset prepares the image primer to be reused for another state rebuild
+// written by the given state builder, e.g. when scrubbing through the capture
+// rebuilds the state repeatedly. The options of the primer and its device
+// level caches, i.e. the pipelines, shader modules, pipeline and descriptor
+// set layouts and descriptor pools of the render and store handlers, are kept,
+// while the per-image state, e.g. the priming plans, the primed images and
+// the queued priming works, is cleared.
+//
+// The pending priming work is executed with the previous state builder, which
+// owns its scratch resources, before switching to the given one. The caches
+// of the devices not in the new state of the given state builder are dropped
+// without being destroyed, as their devices are gone.
+//
+// Reset is only safe if the given state builder writes to the same replay as
+// the previous one, and the devices still in its new state are the devices
+// the caches were created on, i.e. they were not destroyed and recreated with
+// the same handles in between. Otherwise, e.g. for a rebuild written to
+// another replay, the primer must be freed with free and a new one created.
+func (p *imagePrimer) reset(sb *stateBuilder) {
+	for _, work := range p.primingWorks {
+		work.primeable.free()
+	}
+	p.primingWorks = nil
+	p.sb.flushAllScratchResources()
+
+	newDevices := GetState(sb.newState).Devices()
+	alive := func(dev VkDevice) bool { return newDevices.Contains(dev) }
+	p.sb = sb
+	p.rh.reset(sb, alive)
+	p.sh.reset(sb, alive)
+
+	p.plans = map[VkImage]ipPrimingPlan{}
+	p.queueLoads = map[VkQueue]int{}
+	p.heapUsages = map[ipMemoryHeap]VkDeviceSize{}
+	p.primedImages = map[VkImage]bool{}
+	p.resumedImages = nil
+	p.contentKeys = map[VkImage]ipContentKey{}
+	p.primedContents = map[ipContentKey]VkImage{}
+	p.stagingBlocks = map[ipStagingBlockKey]*ipStagingMemoryBlock{}
+	p.stagingBlockOf = map[VkDeviceMemory]*ipStagingMemoryBlock{}
+	p.cancelled = false
+}
+
+// reset switches the render handler to the given state builder, and drops the
+// cached objects of the devices for which alive returns false.
+func (h *ipRenderHandler) reset(sb *stateBuilder, alive func(VkDevice) bool) {
+	h.sb = sb
+	for info := range h.descriptorSetLayouts {
+		if !alive(info.dev) {
+			delete(h.descriptorSetLayouts, info)
+		}
+	}
+	for info := range h.pipelineLayouts {
+		if !alive(info.dev) {
+			delete(h.pipelineLayouts, info)
+		}
+	}
+	for info := range h.pipelines {
+		if !alive(info.fragShaderInfo.dev) {
+			delete(h.pipelines, info)
+		}
+	}
+	for info := range h.shaders {
+		if !alive(info.dev) {
+			delete(h.shaders, info)
+		}
+	}
+}
+
+// reset switches the store handler to the given state builder, and drops the
+// cached objects of the devices for which alive returns false. The pending
+// store jobs must have been executed, so no descriptor set is pending.
+func (h *ipImageStoreHandler) reset(sb *stateBuilder, alive func(VkDevice) bool) {
+	h.sb = sb
+	h.pendingDescSets = ipPendingDescSets{}
+	for dev := range h.descSetLayouts {
+		if !alive(dev) {
+			delete(h.descSetLayouts, dev)
+		}
+	}
+	for dev := range h.descPools {
+		if !alive(dev) {
+			delete(h.descPools, dev)
+		}
+	}
+	for dev := range h.pipelineLayouts {
+		if !alive(dev) {
+			delete(h.pipelineLayouts, dev)
+		}
+	}
+	for dev := range h.blitDescSetLayouts {
+		if !alive(dev) {
+			delete(h.blitDescSetLayouts, dev)
+		}
+	}
+	for dev := range h.blitPipelineLayouts {
+		if !alive(dev) {
+			delete(h.blitPipelineLayouts, dev)
+		}
+	}
+	for dev := range h.samplers {
+		if !alive(dev) {
+			delete(h.samplers, dev)
+		}
+	}
+	for info := range h.pipelines {
+		if !alive(info.dev) {
+			delete(h.pipelines, info)
+		}
+	}
+	for info := range h.shaders {
+		if !alive(info.dev) {
+			delete(h.shaders, info)
+		}
+	}
+}
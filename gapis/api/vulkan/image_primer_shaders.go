@@ -16,26 +16,55 @@ package vulkan
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/google/gapid/gapis/shadertools"
 )
 
+// ipValidateShaders enables validating the generated SPIR-V of the priming
+// shaders before creating shader modules with them. The validation is slow,
+// so it is only enabled in tests.
+var ipValidateShaders = false
+
+// ipValidateShaderSpirv validates the given SPIR-V code if ipValidateShaders
+// is set, returns an error if the code is invalid.
+func ipValidateShaderSpirv(code []uint32) error {
+	if !ipValidateShaders {
+		return nil
+	}
+	return shadertools.ValidateSpirvBinary(code)
+}
+
+// ipRenderQuadPositions are the positions of the vertices of the two triangles
+// covering the whole viewport drawn for priming by rendering, in normalized
+// device coordinates. The fragment shaders load the input attachments at the
+// location of each fragment, so the primed data does not depend on the
+// orientation of the viewport, but the winding of the triangles does, and the
+// render pipelines must not cull any face.
+var ipRenderQuadPositions = [6][2]float32{
+	{1.0, 1.0},
+	{-1.0, -1.0},
+	{-1.0, 1.0},
+	{1.0, 1.0},
+	{1.0, -1.0},
+	{-1.0, -1.0},
+}
+
 // ipRenderVertexShaderSpirv returns a vertex shader for priming by rendering
-// with hard-coded vertex data, in SPIR-V words.
+// with hard-coded vertex data, see ipRenderQuadPositions, in SPIR-V words.
 func ipRenderVertexShaderSpirv() ([]uint32, error) {
+	positions := make([]string, len(ipRenderQuadPositions))
+	for i, p := range ipRenderQuadPositions {
+		positions[i] = fmt.Sprintf("vec2(%f, %f)", p[0], p[1])
+	}
 	return shadertools.CompileGlsl(
-		`#version 450
-vec2 positions[6] = vec2[](
-	vec2(1.0, 1.0),
-	vec2(-1.0, -1.0),
-	vec2(-1.0, 1.0),
-	vec2(1.0, 1.0),
-	vec2(1.0, -1.0),
-	vec2(-1.0, -1.0)
+		fmt.Sprintf(`#version 450
+vec2 positions[%d] = vec2[](
+	%s
 );
 void main() {
 	gl_Position = vec4(positions[gl_VertexIndex], 0.0, 1.0);
-}`,
+}`, len(positions), strings.Join(positions, ",\n\t")),
 		shadertools.CompileOptions{
 			ShaderType: shadertools.TypeVertex,
 			ClientType: shadertools.Vulkan,
@@ -45,6 +74,88 @@ void main() {
 // ipRenderColorShaderSpirv returns a fragment shader for priming by rendering
 // for color aspect data, in SPIR-V words.
 func ipRenderColorShaderSpirv(vkFmt VkFormat) ([]uint32, error) {
+	return ipRenderMultiTargetColorShaderSpirv(vkFmt, 1)
+}
+
+// ipRenderMultiTargetColorShaderSpirv returns a fragment shader for priming by
+// rendering for color aspect data to numTargets color attachments in one draw,
+// in SPIR-V words. The i'th color attachment is written with the data of the
+// i'th input attachment.
+func ipRenderMultiTargetColorShaderSpirv(vkFmt VkFormat, numTargets int) ([]uint32, error) {
+	src, err := ipRenderColorShaderSource(vkFmt, numTargets)
+	if err != nil {
+		return []uint32{}, err
+	}
+	return shadertools.CompileGlsl(src,
+		shadertools.CompileOptions{
+			ShaderType: shadertools.TypeFragment,
+			ClientType: shadertools.Vulkan,
+		})
+}
+
+// ipRenderColorConversion describes how the fragment shader for priming by
+// rendering converts the data of an input attachment to the color of a color
+// attachment of a format.
+type ipRenderColorConversion struct {
+	// outType is the GLSL type of the color outputs.
+	outType string
+	// helpers is the GLSL source of the functions used by the channels.
+	helpers string
+	// channels are the GLSL expressions of the r, g, b and a channels of the
+	// color, in which %[1]s is the uvec4 loaded from the input attachment. A
+	// channel with an empty expression is not written.
+	channels [4]string
+}
+
+// ipRenderColorShaderSource returns the GLSL source of the fragment shader for
+// priming by rendering for color aspect data to numTargets color attachments,
+// writing the out_color_i output with the data of the i'th element of the
+// in_color input attachment array.
+func ipRenderColorShaderSource(vkFmt VkFormat, numTargets int) (string, error) {
+	conv, err := ipRenderColorConversionOf(vkFmt)
+	if err != nil {
+		return "", err
+	}
+	src := []string{
+		"#version 450",
+		"precision highp int;",
+	}
+	if conv.outType == "vec4" {
+		src = append(src, "precision highp float;")
+	}
+	for t := 0; t < numTargets; t++ {
+		src = append(src, fmt.Sprintf("layout(location = %d) out %s out_color_%d;", t, conv.outType, t))
+	}
+	src = append(src, fmt.Sprintf("layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color[%d];", numTargets))
+	if conv.helpers != "" {
+		src = append(src, conv.helpers)
+	}
+	src = append(src, "void main() {")
+	for t := 0; t < numTargets; t++ {
+		in := fmt.Sprintf("subpassLoad(in_color[%d])", t)
+		for i, channel := range []string{"r", "g", "b", "a"} {
+			if conv.channels[i] == "" {
+				continue
+			}
+			src = append(src, fmt.Sprintf("\tout_color_%d.%s = %s;", t, channel, fmt.Sprintf(conv.channels[i], in)))
+		}
+	}
+	src = append(src, "}")
+	return strings.Join(src, "\n"), nil
+}
+
+// ipRenderColorConversionOf returns the conversion of the fragment shader for
+// priming by rendering for color aspect data of the given format.
+func ipRenderColorConversionOf(vkFmt VkFormat) (ipRenderColorConversion, error) {
+	// unorm divides each channel by the given max value, the channels without
+	// a max value are not written.
+	unorm := func(maxValues ...string) ipRenderColorConversion {
+		conv := ipRenderColorConversion{outType: "vec4"}
+		for i, m := range maxValues {
+			conv.channels[i] = fmt.Sprintf("%%[1]s.%c/%s", "rgba"[i], m)
+		}
+		return conv
+	}
 	switch vkFmt {
 	case VkFormat_VK_FORMAT_R8_UINT,
 		VkFormat_VK_FORMAT_R8G8_UINT,
@@ -63,21 +174,8 @@ func ipRenderColorShaderSpirv(vkFmt VkFormat) ([]uint32, error) {
 		VkFormat_VK_FORMAT_A8B8G8R8_UINT_PACK32,
 		VkFormat_VK_FORMAT_A2R10G10B10_UINT_PACK32,
 		VkFormat_VK_FORMAT_A2B10G10R10_UINT_PACK32:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-layout(location = 0) out uvec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = subpassLoad(in_color).r;
-	out_color.g = subpassLoad(in_color).g;
-	out_color.b = subpassLoad(in_color).b;
-	out_color.a = subpassLoad(in_color).a;
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return ipRenderColorConversion{outType: "uvec4", channels: [4]string{
+			"%[1]s.r", "%[1]s.g", "%[1]s.b", "%[1]s.a"}}, nil
 
 	case VkFormat_VK_FORMAT_R8_SINT,
 		VkFormat_VK_FORMAT_R8G8_SINT,
@@ -96,21 +194,8 @@ void main() {
 		VkFormat_VK_FORMAT_A8B8G8R8_SINT_PACK32,
 		VkFormat_VK_FORMAT_A2R10G10B10_SINT_PACK32,
 		VkFormat_VK_FORMAT_A2B10G10R10_SINT_PACK32:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-layout(location = 0) out ivec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = int(subpassLoad(in_color).r);
-	out_color.g = int(subpassLoad(in_color).g);
-	out_color.b = int(subpassLoad(in_color).b);
-	out_color.a = int(subpassLoad(in_color).a);
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return ipRenderColorConversion{outType: "ivec4", channels: [4]string{
+			"int(%[1]s.r)", "int(%[1]s.g)", "int(%[1]s.b)", "int(%[1]s.a)"}}, nil
 
 	case VkFormat_VK_FORMAT_R8_UNORM,
 		VkFormat_VK_FORMAT_R8G8_UNORM,
@@ -126,120 +211,31 @@ void main() {
 		VkFormat_VK_FORMAT_B8G8R8A8_SRGB,
 		VkFormat_VK_FORMAT_A8B8G8R8_UNORM_PACK32,
 		VkFormat_VK_FORMAT_A8B8G8R8_SRGB_PACK32:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = subpassLoad(in_color).r/255.0;
-	out_color.g = subpassLoad(in_color).g/255.0;
-	out_color.b = subpassLoad(in_color).b/255.0;
-	out_color.a = subpassLoad(in_color).a/255.0;
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return unorm("255.0", "255.0", "255.0", "255.0"), nil
 
 	case VkFormat_VK_FORMAT_R16_UNORM,
 		VkFormat_VK_FORMAT_R16G16_UNORM,
 		VkFormat_VK_FORMAT_R16G16B16_UNORM,
 		VkFormat_VK_FORMAT_R16G16B16A16_UNORM:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = subpassLoad(in_color).r/65535.0;
-	out_color.g = subpassLoad(in_color).g/65535.0;
-	out_color.b = subpassLoad(in_color).b/65535.0;
-	out_color.a = subpassLoad(in_color).a/65535.0;
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return unorm("65535.0", "65535.0", "65535.0", "65535.0"), nil
 
 	case VkFormat_VK_FORMAT_R4G4_UNORM_PACK8,
 		VkFormat_VK_FORMAT_R4G4B4A4_UNORM_PACK16,
 		VkFormat_VK_FORMAT_B4G4R4A4_UNORM_PACK16:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = subpassLoad(in_color).r/15.0;
-	out_color.g = subpassLoad(in_color).g/15.0;
-	out_color.b = subpassLoad(in_color).b/15.0;
-	out_color.a = subpassLoad(in_color).a/15.0;
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return unorm("15.0", "15.0", "15.0", "15.0"), nil
 
 	case VkFormat_VK_FORMAT_R5G6B5_UNORM_PACK16,
 		VkFormat_VK_FORMAT_B5G6R5_UNORM_PACK16:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = subpassLoad(in_color).r/31.0;
-	out_color.g = subpassLoad(in_color).g/63.0;
-	out_color.b = subpassLoad(in_color).b/31.0;
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return unorm("31.0", "63.0", "31.0"), nil
 
 	case VkFormat_VK_FORMAT_R5G5B5A1_UNORM_PACK16,
 		VkFormat_VK_FORMAT_B5G5R5A1_UNORM_PACK16,
 		VkFormat_VK_FORMAT_A1R5G5B5_UNORM_PACK16:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = subpassLoad(in_color).r/31.0;
-	out_color.g = subpassLoad(in_color).g/31.0;
-	out_color.b = subpassLoad(in_color).b/31.0;
-	out_color.a = subpassLoad(in_color).a/1.0;
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return unorm("31.0", "31.0", "31.0", "1.0"), nil
 
 	case VkFormat_VK_FORMAT_A2R10G10B10_UNORM_PACK32,
 		VkFormat_VK_FORMAT_A2B10G10R10_UNORM_PACK32:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = subpassLoad(in_color).r/1023.0;
-	out_color.g = subpassLoad(in_color).g/1023.0;
-	out_color.b = subpassLoad(in_color).b/1023.0;
-	out_color.a = subpassLoad(in_color).a/3.0;
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return unorm("1023.0", "1023.0", "1023.0", "3.0"), nil
 
 	case VkFormat_VK_FORMAT_R8_SNORM,
 		VkFormat_VK_FORMAT_R8G8_SNORM,
@@ -248,71 +244,29 @@ void main() {
 		VkFormat_VK_FORMAT_B8G8R8_SNORM,
 		VkFormat_VK_FORMAT_B8G8R8A8_SNORM,
 		VkFormat_VK_FORMAT_A8B8G8R8_SNORM_PACK32:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-float snorm(in uint u, in float d) {
+		return ipRenderColorConversion{outType: "vec4", helpers: `float snorm(in uint u, in float d) {
 	return (int(u) * 2.0  + 1.0) / d;
-}
-void main() {
-	out_color.r = snorm(subpassLoad(in_color).r, 255.0);
-	out_color.g = snorm(subpassLoad(in_color).g, 255.0);
-	out_color.b = snorm(subpassLoad(in_color).b, 255.0);
-	out_color.a = snorm(subpassLoad(in_color).a, 255.0);
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+}`, channels: [4]string{
+			"snorm(%[1]s.r, 255.0)", "snorm(%[1]s.g, 255.0)", "snorm(%[1]s.b, 255.0)", "snorm(%[1]s.a, 255.0)"}}, nil
 
 	case VkFormat_VK_FORMAT_R16_SNORM,
 		VkFormat_VK_FORMAT_R16G16_SNORM,
 		VkFormat_VK_FORMAT_R16G16B16_SNORM,
 		VkFormat_VK_FORMAT_R16G16B16A16_SNORM:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-float snorm(in uint u, in float d) {
+		return ipRenderColorConversion{outType: "vec4", helpers: `float snorm(in uint u, in float d) {
 	return (int(u) * 2.0  + 1.0) / d;
-}
-void main() {
-	out_color.r = snorm(subpassLoad(in_color).r, 65535.0);
-	out_color.g = snorm(subpassLoad(in_color).g, 65535.0);
-	out_color.b = snorm(subpassLoad(in_color).b, 65535.0);
-	out_color.a = snorm(subpassLoad(in_color).a, 65535.0);
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+}`, channels: [4]string{
+			"snorm(%[1]s.r, 65535.0)", "snorm(%[1]s.g, 65535.0)", "snorm(%[1]s.b, 65535.0)", "snorm(%[1]s.a, 65535.0)"}}, nil
 
 	case VkFormat_VK_FORMAT_A2R10G10B10_SNORM_PACK32,
 		VkFormat_VK_FORMAT_A2B10G10R10_SNORM_PACK32:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
+		return ipRenderColorConversion{outType: "vec4", helpers: `// The (2c + 1) / (2^b - 1) conversion does not reconstruct the negative
+// values and the 2-bit alpha channel exactly, use the SNORM conversion of
+// Vulkan: max(c / (2^(b-1) - 1), -1).
 float snorm(in uint u, in float d) {
-	return (int(u) * 2.0  + 1.0) / d;
-}
-void main() {
-	out_color.r = snorm(subpassLoad(in_color).r, 1023.0);
-	out_color.g = snorm(subpassLoad(in_color).g, 1023.0);
-	out_color.b = snorm(subpassLoad(in_color).b, 1023.0);
-	out_color.a = snorm(subpassLoad(in_color).a, 1.0);
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+	return max(int(u) / d, -1.0);
+}`, channels: [4]string{
+			"snorm(%[1]s.r, 511.0)", "snorm(%[1]s.g, 511.0)", "snorm(%[1]s.b, 511.0)", "snorm(%[1]s.a, 1.0)"}}, nil
 
 	case VkFormat_VK_FORMAT_R16_SFLOAT,
 		VkFormat_VK_FORMAT_R16G16_SFLOAT,
@@ -324,25 +278,11 @@ void main() {
 		VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT,
 		VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32,
 		VkFormat_VK_FORMAT_E5B9G9R9_UFLOAT_PACK32:
-		return shadertools.CompileGlsl(
-			`#version 450
-precision highp int;
-precision highp float;
-layout(location = 0) out vec4 out_color;
-layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color;
-void main() {
-	out_color.r = uintBitsToFloat(subpassLoad(in_color).r);
-	out_color.g = uintBitsToFloat(subpassLoad(in_color).g);
-	out_color.b = uintBitsToFloat(subpassLoad(in_color).b);
-	out_color.a = uintBitsToFloat(subpassLoad(in_color).a);
-}`,
-			shadertools.CompileOptions{
-				ShaderType: shadertools.TypeFragment,
-				ClientType: shadertools.Vulkan,
-			})
+		return ipRenderColorConversion{outType: "vec4", channels: [4]string{
+			"uintBitsToFloat(%[1]s.r)", "uintBitsToFloat(%[1]s.g)", "uintBitsToFloat(%[1]s.b)", "uintBitsToFloat(%[1]s.a)"}}, nil
 
 	}
-	return []uint32{}, fmt.Errorf("%v is not supported", vkFmt)
+	return ipRenderColorConversion{}, fmt.Errorf("%v is not supported", vkFmt)
 }
 
 // ipRenderDepthShaderSpirv returns a fragment shader for priming by rendering
@@ -406,8 +346,26 @@ void main() {
 }
 
 // ipRenderStencilShaderSpirv returns a fragment shader for priming by rendering
-// for stencil aspect data, in SPIR-V words.
-func ipRenderStencilShaderSpirv() ([]uint32, error) {
+// for stencil aspect data, in SPIR-V words. Without stencil export, fragment
+// shaders can not write the stencil value, so the shader discards the fragments
+// whose bit of the push constant index is not set, and the stencil data is
+// rendered bit by bit. With VK_EXT_shader_stencil_export, the shader exports
+// the whole stencil value, which is rendered in a single pass.
+func ipRenderStencilShaderSpirv(stencilExport bool) ([]uint32, error) {
+	if stencilExport {
+		return shadertools.CompileGlsl(
+			`#version 450
+#extension GL_ARB_shader_stencil_export : enable
+precision highp int;
+layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_stencil;
+void main() {
+  gl_FragStencilRefARB = int(subpassLoad(in_stencil).r & 0xFF);
+}`,
+			shadertools.CompileOptions{
+				ShaderType: shadertools.TypeFragment,
+				ClientType: shadertools.Vulkan,
+			})
+	}
 
 	return shadertools.CompileGlsl(
 		`#version 450
@@ -431,134 +389,169 @@ void main() {
 func ipComputeShaderSpirv(
 	outputFormat VkFormat, outputAspect VkImageAspectFlagBits, inputFormat VkFormat,
 	inputAspect VkImageAspectFlagBits, imageType VkImageType) ([]uint32, error) {
+	return ipGenerateComputeShaderSpirv(outputFormat, outputAspect, inputFormat, inputAspect, imageType, false)
+}
 
-	if outputAspect != VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT ||
-		inputAspect != VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
-		return []uint32{}, fmt.Errorf("Aspect other than COLOR is not supported")
-	}
+// ipComputeBlitShaderSpirv returns the compute shader to be used for priming
+// image data through a compute-based blit: the input image is read through a
+// combined image sampler with texelFetch, and the fetched value is cast to the
+// type of the output image and written with imageStore. Unlike the shaders of
+// ipComputeShaderSpirv, any pair of the supported color formats can be
+// converted, as the sampler does the decoding of the input format.
+//
+// The conversion is not bit exact. The cast converts values, not bits: a
+// float input written to an integer output is truncated, and an integer input
+// written to a float output keeps its value, so 32-bit integers beyond 2^24
+// lose precision. Normalized inputs are fetched as floats in [0, 1] or
+// [-1, 1], so they are only preserved if the output is normalized or float,
+// and are quantized again if the output has fewer bits. SRGB inputs are
+// decoded to linear values by the sampler, while the storage views of SRGB
+// outputs are UNORM, so a blit from an SRGB image to an SRGB image does not
+// round trip exactly.
+func ipComputeBlitShaderSpirv(
+	outputFormat VkFormat, outputAspect VkImageAspectFlagBits, inputFormat VkFormat,
+	inputAspect VkImageAspectFlagBits, imageType VkImageType) ([]uint32, error) {
+	return ipGenerateComputeShaderSpirv(outputFormat, outputAspect, inputFormat, inputAspect, imageType, true)
+}
 
-	fmtStr := func(format VkFormat) (string, error) {
-		switch format {
-		// uint formats
-		case VkFormat_VK_FORMAT_R8_UINT:
-			return "r8ui", nil
-		case VkFormat_VK_FORMAT_R16_UINT:
-			return "r16ui", nil
-		case VkFormat_VK_FORMAT_R32_UINT:
-			return "r32ui", nil
-
-		case VkFormat_VK_FORMAT_R8G8_UINT:
-			return "rg8ui", nil
-		case VkFormat_VK_FORMAT_R16G16_UINT:
-			return "rg16ui", nil
-		case VkFormat_VK_FORMAT_R32G32_UINT:
-			return "rg32ui", nil
-
-		case VkFormat_VK_FORMAT_R8G8B8A8_UINT,
-			VkFormat_VK_FORMAT_B8G8R8A8_UINT,
-			VkFormat_VK_FORMAT_A8B8G8R8_UINT_PACK32:
-			return "rgba8ui", nil
-		case VkFormat_VK_FORMAT_R16G16B16A16_UINT:
-			return "rgba16ui", nil
-		case VkFormat_VK_FORMAT_R32G32B32A32_UINT:
-			return "rgba32ui", nil
-
-		case VkFormat_VK_FORMAT_A2R10G10B10_UINT_PACK32,
-			VkFormat_VK_FORMAT_A2B10G10R10_UINT_PACK32:
-			return "rgb10_a2ui", nil
+// ipStorageImageFormatQualifier returns the GLSL layout format qualifier of
+// the storage images of the given format in the priming shaders, or an error
+// if the format is not supported by the shaders. The SRGB formats are accessed
+// through their UNORM qualifiers.
+func ipStorageImageFormatQualifier(format VkFormat) (string, error) {
+	switch format {
+	// uint formats
+	case VkFormat_VK_FORMAT_R8_UINT:
+		return "r8ui", nil
+	case VkFormat_VK_FORMAT_R16_UINT:
+		return "r16ui", nil
+	case VkFormat_VK_FORMAT_R32_UINT:
+		return "r32ui", nil
+
+	case VkFormat_VK_FORMAT_R8G8_UINT:
+		return "rg8ui", nil
+	case VkFormat_VK_FORMAT_R16G16_UINT:
+		return "rg16ui", nil
+	case VkFormat_VK_FORMAT_R32G32_UINT:
+		return "rg32ui", nil
+
+	case VkFormat_VK_FORMAT_R8G8B8A8_UINT,
+		VkFormat_VK_FORMAT_B8G8R8A8_UINT,
+		VkFormat_VK_FORMAT_A8B8G8R8_UINT_PACK32:
+		return "rgba8ui", nil
+	case VkFormat_VK_FORMAT_R16G16B16A16_UINT:
+		return "rgba16ui", nil
+	case VkFormat_VK_FORMAT_R32G32B32A32_UINT:
+		return "rgba32ui", nil
+
+	case VkFormat_VK_FORMAT_A2R10G10B10_UINT_PACK32,
+		VkFormat_VK_FORMAT_A2B10G10R10_UINT_PACK32:
+		return "rgb10_a2ui", nil
+
+	// sint formats
+	case VkFormat_VK_FORMAT_R8_SINT:
+		return "r8i", nil
+	case VkFormat_VK_FORMAT_R16_SINT:
+		return "r16i", nil
+	case VkFormat_VK_FORMAT_R32_SINT:
+		return "r32i", nil
+
+	case VkFormat_VK_FORMAT_R8G8_SINT:
+		return "rg8i", nil
+	case VkFormat_VK_FORMAT_R16G16_SINT:
+		return "rg16i", nil
+	case VkFormat_VK_FORMAT_R32G32_SINT:
+		return "rg32i", nil
+
+	case VkFormat_VK_FORMAT_R8G8B8A8_SINT,
+		VkFormat_VK_FORMAT_B8G8R8A8_SINT,
+		VkFormat_VK_FORMAT_A8B8G8R8_SINT_PACK32:
+		return "rgba8i", nil
+	case VkFormat_VK_FORMAT_R16G16B16A16_SINT:
+		return "rgba16i", nil
+	case VkFormat_VK_FORMAT_R32G32B32A32_SINT:
+		return "rgba32i", nil
+
+	// unorm formats
+	case VkFormat_VK_FORMAT_R8_UNORM,
+		VkFormat_VK_FORMAT_R8_SRGB:
+		return "r8", nil
+	case VkFormat_VK_FORMAT_R16_UNORM:
+		return "r16", nil
+
+	case VkFormat_VK_FORMAT_R8G8_UNORM,
+		VkFormat_VK_FORMAT_R8G8_SRGB:
+		return "rg8", nil
+	case VkFormat_VK_FORMAT_R16G16_UNORM:
+		return "rg16", nil
+
+	case VkFormat_VK_FORMAT_R8G8B8A8_UNORM,
+		VkFormat_VK_FORMAT_B8G8R8A8_UNORM,
+		VkFormat_VK_FORMAT_R8G8B8A8_SRGB,
+		VkFormat_VK_FORMAT_B8G8R8A8_SRGB:
+		return "rgba8", nil
 
-		// sint formats
-		case VkFormat_VK_FORMAT_R8_SINT:
-			return "r8i", nil
-		case VkFormat_VK_FORMAT_R16_SINT:
-			return "r16i", nil
-		case VkFormat_VK_FORMAT_R32_SINT:
-			return "r32i", nil
-
-		case VkFormat_VK_FORMAT_R8G8_SINT:
-			return "rg8i", nil
-		case VkFormat_VK_FORMAT_R16G16_SINT:
-			return "rg16i", nil
-		case VkFormat_VK_FORMAT_R32G32_SINT:
-			return "rg32i", nil
-
-		case VkFormat_VK_FORMAT_R8G8B8A8_SINT,
-			VkFormat_VK_FORMAT_B8G8R8A8_SINT,
-			VkFormat_VK_FORMAT_A8B8G8R8_SINT_PACK32:
-			return "rgba8i", nil
-		case VkFormat_VK_FORMAT_R16G16B16A16_SINT:
-			return "rgba16i", nil
-		case VkFormat_VK_FORMAT_R32G32B32A32_SINT:
-			return "rgba32i", nil
+	case VkFormat_VK_FORMAT_R16G16B16A16_UNORM:
+		return "rgba16", nil
 
-		// unorm formats
-		case VkFormat_VK_FORMAT_R8_UNORM,
-			VkFormat_VK_FORMAT_R8_SRGB:
-			return "r8", nil
-		case VkFormat_VK_FORMAT_R16_UNORM:
-			return "r16", nil
-
-		case VkFormat_VK_FORMAT_R8G8_UNORM,
-			VkFormat_VK_FORMAT_R8G8_SRGB:
-			return "rg8", nil
-		case VkFormat_VK_FORMAT_R16G16_UNORM:
-			return "rg16", nil
-
-		case VkFormat_VK_FORMAT_R8G8B8A8_UNORM,
-			VkFormat_VK_FORMAT_B8G8R8A8_UNORM,
-			VkFormat_VK_FORMAT_R8G8B8A8_SRGB,
-			VkFormat_VK_FORMAT_B8G8R8A8_SRGB:
-			return "rgba8", nil
+	case VkFormat_VK_FORMAT_A8B8G8R8_UNORM_PACK32,
+		VkFormat_VK_FORMAT_A8B8G8R8_SRGB_PACK32:
+		return "rgba8", nil
 
-		case VkFormat_VK_FORMAT_R16G16B16A16_UNORM:
-			return "rgba16", nil
+	case VkFormat_VK_FORMAT_A2R10G10B10_UNORM_PACK32,
+		VkFormat_VK_FORMAT_A2B10G10R10_UNORM_PACK32:
+		return "rgb10_a2", nil
 
-		case VkFormat_VK_FORMAT_A8B8G8R8_UNORM_PACK32,
-			VkFormat_VK_FORMAT_A8B8G8R8_SRGB_PACK32:
-			return "rgba8", nil
+	// snorm formats
+	case VkFormat_VK_FORMAT_R8_SNORM:
+		return "r8_snorm", nil
+	case VkFormat_VK_FORMAT_R16_SNORM:
+		return "r16_snorm", nil
 
-		case VkFormat_VK_FORMAT_A2R10G10B10_UNORM_PACK32,
-			VkFormat_VK_FORMAT_A2B10G10R10_UNORM_PACK32:
-			return "rgb10_a2", nil
+	case VkFormat_VK_FORMAT_R8G8_SNORM:
+		return "rg8_snorm", nil
+	case VkFormat_VK_FORMAT_R16G16_SNORM:
+		return "rg16_snorm", nil
 
-		// snorm formats
-		case VkFormat_VK_FORMAT_R8_SNORM:
-			return "r8_snorm", nil
-		case VkFormat_VK_FORMAT_R16_SNORM:
-			return "r16_snorm", nil
+	case VkFormat_VK_FORMAT_R8G8B8A8_SNORM,
+		VkFormat_VK_FORMAT_B8G8R8A8_SNORM,
+		VkFormat_VK_FORMAT_A8B8G8R8_SNORM_PACK32:
+		return "rgba8_snorm", nil
+	case VkFormat_VK_FORMAT_R16G16B16A16_SNORM:
+		return "rgba16_snorm", nil
+
+	// float formats
+	case VkFormat_VK_FORMAT_R16_SFLOAT:
+		return "r16f", nil
+	case VkFormat_VK_FORMAT_R32_SFLOAT:
+		return "r32f", nil
+
+	case VkFormat_VK_FORMAT_R16G16_SFLOAT:
+		return "rg16f", nil
+	case VkFormat_VK_FORMAT_R32G32_SFLOAT:
+		return "rg32f", nil
+
+	case VkFormat_VK_FORMAT_R16G16B16A16_SFLOAT:
+		return "rgba16f", nil
+	case VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT:
+		return "rgba32f", nil
+
+	case VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32:
+		return "r11f_g11f_b10f", nil
+	}
+	return "", fmt.Errorf("Unsupported format: %v", format)
+}
 
-		case VkFormat_VK_FORMAT_R8G8_SNORM:
-			return "rg8_snorm", nil
-		case VkFormat_VK_FORMAT_R16G16_SNORM:
-			return "rg16_snorm", nil
+// ipGenerateComputeShaderSpirv returns the compute shader storing the data of
+// the input image to the output image. If sampledInput is true, the input
+// image is a combined image sampler, otherwise it is a storage image.
+func ipGenerateComputeShaderSpirv(
+	outputFormat VkFormat, outputAspect VkImageAspectFlagBits, inputFormat VkFormat,
+	inputAspect VkImageAspectFlagBits, imageType VkImageType, sampledInput bool) ([]uint32, error) {
 
-		case VkFormat_VK_FORMAT_R8G8B8A8_SNORM,
-			VkFormat_VK_FORMAT_B8G8R8A8_SNORM,
-			VkFormat_VK_FORMAT_A8B8G8R8_SNORM_PACK32:
-			return "rgba8_snorm", nil
-		case VkFormat_VK_FORMAT_R16G16B16A16_SNORM:
-			return "rgba16_snorm", nil
-
-		// float formats
-		case VkFormat_VK_FORMAT_R16_SFLOAT:
-			return "r16f", nil
-		case VkFormat_VK_FORMAT_R32_SFLOAT:
-			return "r32f", nil
-
-		case VkFormat_VK_FORMAT_R16G16_SFLOAT:
-			return "rg16f", nil
-		case VkFormat_VK_FORMAT_R32G32_SFLOAT:
-			return "rg32f", nil
-
-		case VkFormat_VK_FORMAT_R16G16B16A16_SFLOAT:
-			return "rgba16f", nil
-		case VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT:
-			return "rgba32f", nil
-
-		case VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32:
-			return "r11f_g11f_b10f", nil
-		}
-		return "", fmt.Errorf("Unsupported format: %v", format)
+	if outputAspect != VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT ||
+		inputAspect != VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT {
+		return []uint32{}, fmt.Errorf("Aspect other than COLOR is not supported")
 	}
 
 	fmtG := func(format VkFormat) (string, error) {
@@ -785,14 +778,10 @@ func ipComputeShaderSpirv(
 		return "", fmt.Errorf("Unsupported format, input fomrat: %v, output format: %v", inputFmt, outputFmt)
 	}
 
-	outputFmtStr, err := fmtStr(outputFormat)
+	outputFmtStr, err := ipStorageImageFormatQualifier(outputFormat)
 	if err != nil {
 		return []uint32{}, fmt.Errorf("Generating output image format string, err: %v", err)
 	}
-	inputFmtStr, err := fmtStr(inputFormat)
-	if err != nil {
-		return []uint32{}, fmt.Errorf("Generating input image format string, err: %v", err)
-	}
 	outputG, err := fmtG(outputFormat)
 	if err != nil {
 		return []uint32{}, fmt.Errorf("Generating output image unit format string, err: %v", err)
@@ -809,36 +798,68 @@ func ipComputeShaderSpirv(
 	if err != nil {
 		return []uint32{}, fmt.Errorf("Generating position, err: %v", err)
 	}
-	color, err := colorStr(inputFormat, outputFormat)
-	if err != nil {
-		return []uint32{}, fmt.Errorf("Generating color, err: %v", err)
+
+	// The output is a storage image. The input is a storage image matching
+	// ipImageStoreDescriptorTypes, or a combined image sampler matching
+	// ipImageBlitDescriptorTypes if sampledInput is true.
+	var input, color string
+	if sampledInput {
+		input = fmt.Sprintf(`layout (set = 0, binding = %d) uniform %ssampler%s input_img;`,
+			ipImageStoreInputImageBinding, inputG, strings.TrimPrefix(imgTypeStr, "image"))
+		color = fmt.Sprintf(`%svec4 color = %svec4(texelFetch(input_img, pos, 0));`, outputG, outputG)
+	} else {
+		inputFmtStr, err := ipStorageImageFormatQualifier(inputFormat)
+		if err != nil {
+			return []uint32{}, fmt.Errorf("Generating input image format string, err: %v", err)
+		}
+		input = fmt.Sprintf(`layout (%s, set = 0, binding = %d) uniform %s%s input_img;`,
+			inputFmtStr, ipImageStoreInputImageBinding, inputG, imgTypeStr)
+		color, err = colorStr(inputFormat, outputFormat)
+		if err != nil {
+			return []uint32{}, fmt.Errorf("Generating color, err: %v", err)
+		}
 	}
 
-	// Generate source code
+	// Generate source code. The local work group size and the number of
+	// channels written are specialization constants, see
+	// ipImageStoreSpecConstants, so the pipelines with different values share
+	// the same code.
 	source := fmt.Sprintf(
 		`#version 450
 	precision highp int;
-	layout (local_size_x = 1, local_size_y = 1, local_size_z = 1) in;
+	layout (local_size_x_id = %d, local_size_y_id = %d, local_size_z_id = %d) in;
+	layout (constant_id = %d) const uint channel_count = 4u;
 	layout (%s, set = 0, binding = %d) uniform %s%s output_img;
-	layout (%s, set = 0, binding = %d) uniform %s%s input_img;
+	%s
 	layout (push_constant) uniform metadata2 {
 		uint offset_x;
 		uint offset_y;
 		uint offset_z;
 		// Reserved for handling image formats wider than 32 bit per channel
 		uint input_img_index;
+		uint end_x;
+		uint end_y;
+		uint end_z;
 	};
 	void main() {
 		int x = int(gl_GlobalInvocationID.x + offset_x);
 		int y = int(gl_GlobalInvocationID.y + offset_y);
 		int z = int(gl_GlobalInvocationID.z + offset_z);
+		if (x >= int(end_x) || y >= int(end_y) || z >= int(end_z)) {
+			return;
+		}
 		%s
 		%s
+		%svec4 defaults = %svec4(0, 0, 0, 1);
+		for (uint i = channel_count; i < 4u; i++) {
+			color[i] = defaults[i];
+		}
 		imageStore(output_img, pos, color);
 	}
-	`, outputFmtStr, ipImageStoreOutputImageBinding, outputG, imgTypeStr,
-		inputFmtStr, ipImageStoreInputImageBinding, inputG, imgTypeStr,
-		pos, color)
+	`, ipImageStoreSpecWorkGroupSizeX, ipImageStoreSpecWorkGroupSizeY, ipImageStoreSpecWorkGroupSizeZ,
+		ipImageStoreSpecChannelCount,
+		outputFmtStr, ipImageStoreOutputImageBinding, outputG, imgTypeStr,
+		input, pos, color, outputG, outputG)
 
 	opt := shadertools.CompileOptions{
 		ShaderType: shadertools.TypeCompute,
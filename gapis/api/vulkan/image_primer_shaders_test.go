@@ -22,10 +22,16 @@ import (
 	"github.com/google/gapid/core/log"
 )
 
+func init() {
+	// Validate the generated shaders in tests.
+	ipValidateShaders = true
+}
+
 func TestVertexShader(t *testing.T) {
 	ctx := log.Testing(t)
-	_, err := ipRenderVertexShaderSpirv()
+	code, err := ipRenderVertexShaderSpirv()
 	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "validation").ThatError(ipValidateShaderSpirv(code)).Succeeded()
 }
 
 func TestFragmentShader(t *testing.T) {
@@ -133,18 +139,63 @@ func TestFragmentShader(t *testing.T) {
 	} {
 		ctx := log.Testing(t)
 		var err error
+		var code []uint32
 		switch info.aspect {
 		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
-			_, err = ipRenderColorShaderSpirv(info.format)
+			code, err = ipRenderColorShaderSpirv(info.format)
 		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT:
-			_, err = ipRenderDepthShaderSpirv(info.format)
+			code, err = ipRenderDepthShaderSpirv(info.format)
 		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
-			_, err = ipRenderStencilShaderSpirv()
+			code, err = ipRenderStencilShaderSpirv(false)
 		default:
 			err = fmt.Errorf("Unsupported aspect")
 		}
-		assert.For(ctx, "err").ThatError(err).Succeeded()
+		if assert.For(ctx, "err").ThatError(err).Succeeded() {
+			assert.For(ctx, "validation of %v", info).ThatError(ipValidateShaderSpirv(code)).Succeeded()
+		}
+	}
+}
+
+func TestMultiTargetFragmentShader(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, format := range []VkFormat{
+		VkFormat_VK_FORMAT_R8G8B8A8_UINT,
+		VkFormat_VK_FORMAT_R8G8B8A8_SINT,
+		VkFormat_VK_FORMAT_R8G8B8A8_UNORM,
+		VkFormat_VK_FORMAT_R16G16B16A16_SNORM,
+		VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT,
+	} {
+		for _, numTargets := range []int{2, 4} {
+			code, err := ipRenderMultiTargetColorShaderSpirv(format, numTargets)
+			if assert.For(ctx, "err").ThatError(err).Succeeded() {
+				assert.For(ctx, "validation of %v with %v targets", format, numTargets).ThatError(ipValidateShaderSpirv(code)).Succeeded()
+			}
+		}
+	}
+}
+
+func TestMultiTargetColorShaderSource(t *testing.T) {
+	ctx := log.Testing(t)
+	src, err := ipRenderColorShaderSource(VkFormat_VK_FORMAT_R5G6B5_UNORM_PACK16, 2)
+	if !assert.For(ctx, "err").ThatError(err).Succeeded() {
+		return
 	}
+	assert.For(ctx, "source").That(src).Equals(`#version 450
+precision highp int;
+precision highp float;
+layout(location = 0) out vec4 out_color_0;
+layout(location = 1) out vec4 out_color_1;
+layout(input_attachment_index = 0, binding = 0, set = 0) uniform usubpassInput in_color[2];
+void main() {
+	out_color_0.r = subpassLoad(in_color[0]).r/31.0;
+	out_color_0.g = subpassLoad(in_color[0]).g/63.0;
+	out_color_0.b = subpassLoad(in_color[0]).b/31.0;
+	out_color_1.r = subpassLoad(in_color[1]).r/31.0;
+	out_color_1.g = subpassLoad(in_color[1]).g/63.0;
+	out_color_1.b = subpassLoad(in_color[1]).b/31.0;
+}`)
+	_, err = ipRenderColorShaderSource(VkFormat_VK_FORMAT_BC1_RGB_UNORM_BLOCK, 1)
+	assert.For(ctx, "unsupported format").ThatError(err).Failed()
 }
 
 func TestComputeShader(t *testing.T) {
@@ -208,22 +259,223 @@ func TestComputeShader(t *testing.T) {
 	// same input output format
 	for _, f := range formats {
 		for _, ty := range imageTypes {
-			_, err := ipComputeShaderSpirv(
+			code, err := ipComputeShaderSpirv(
 				f, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
 				f, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
 				ty)
-			assert.For(ctx, "err").ThatError(err).Succeeded()
+			if assert.For(ctx, "err").ThatError(err).Succeeded() {
+				assert.For(ctx, "validation of %v, type: %v", f, ty).ThatError(ipValidateShaderSpirv(code)).Succeeded()
+			}
 		}
 	}
 
 	// from R32G32B32A32_UINT to anything supported
 	for _, f := range formats {
 		for _, ty := range imageTypes {
-			_, err := ipComputeShaderSpirv(
+			code, err := ipComputeShaderSpirv(
 				f, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
 				VkFormat_VK_FORMAT_R32G32B32A32_UINT, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
 				ty)
-			assert.For(ctx, "err").ThatError(err).Succeeded()
+			if assert.For(ctx, "err").ThatError(err).Succeeded() {
+				assert.For(ctx, "validation of %v, type: %v", f, ty).ThatError(ipValidateShaderSpirv(code)).Succeeded()
+			}
+		}
+	}
+}
+
+// ipSpirvDescriptorTypes returns the descriptor types of the resources bound
+// in the given SPIR-V code, keyed by their binding numbers. Only the types
+// used by the image primer shaders are recognized.
+func ipSpirvDescriptorTypes(code []uint32) map[uint32]VkDescriptorType {
+	const (
+		opTypeImage        = 25
+		opTypeSampledImage = 27
+		opTypePointer      = 32
+		opVariable         = 59
+		opDecorate         = 71
+		decorationBinding  = 33
+		dimBuffer          = 5
+		storageUniform     = 2
+	)
+	types := map[uint32]VkDescriptorType{}
+	pointees := map[uint32]uint32{}
+	varTypes := map[uint32]uint32{}
+	varClasses := map[uint32]uint32{}
+	bindings := map[uint32]uint32{}
+	for i := 5; i < len(code); {
+		count, op := int(code[i]>>16), code[i]&0xffff
+		if count == 0 || i+count > len(code) {
+			break
+		}
+		inst := code[i : i+count]
+		switch op {
+		case opTypeImage:
+			// OpTypeImage result, sampled type, dim, depth, arrayed, ms, sampled
+			dim, sampled := inst[3], inst[7]
+			switch {
+			case sampled == 2 && dim == dimBuffer:
+				types[inst[1]] = VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_TEXEL_BUFFER
+			case sampled == 2:
+				types[inst[1]] = VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE
+			case dim == dimBuffer:
+				types[inst[1]] = VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_TEXEL_BUFFER
+			default:
+				types[inst[1]] = VkDescriptorType_VK_DESCRIPTOR_TYPE_SAMPLED_IMAGE
+			}
+		case opTypeSampledImage:
+			types[inst[1]] = VkDescriptorType_VK_DESCRIPTOR_TYPE_COMBINED_IMAGE_SAMPLER
+		case opTypePointer:
+			pointees[inst[1]] = inst[3]
+		case opVariable:
+			varTypes[inst[2]] = inst[1]
+			varClasses[inst[2]] = inst[3]
+		case opDecorate:
+			if inst[2] == decorationBinding {
+				bindings[inst[1]] = inst[3]
+			}
+		}
+		i += count
+	}
+	descTypes := map[uint32]VkDescriptorType{}
+	for v, binding := range bindings {
+		if t, ok := types[pointees[varTypes[v]]]; ok {
+			descTypes[binding] = t
+		} else if varClasses[v] == storageUniform {
+			descTypes[binding] = VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_BUFFER
+		}
+	}
+	return descTypes
+}
+
+func TestComputeShaderDescriptorTypes(t *testing.T) {
+	ctx := log.Testing(t)
+	// The bindings declared by the store shader must match the store descriptor
+	// set layout, and the input must be read from a storage image, not a texel
+	// buffer.
+	for _, ty := range []VkImageType{
+		VkImageType_VK_IMAGE_TYPE_1D,
+		VkImageType_VK_IMAGE_TYPE_2D,
+		VkImageType_VK_IMAGE_TYPE_3D,
+	} {
+		code, err := ipComputeShaderSpirv(
+			VkFormat_VK_FORMAT_R8G8B8A8_UNORM, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+			VkFormat_VK_FORMAT_R32G32B32A32_UINT, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+			ty)
+		if !assert.For(ctx, "err").ThatError(err).Succeeded() {
+			continue
+		}
+		assert.For(ctx, "validation of type: %v", ty).ThatError(ipValidateShaderSpirv(code)).Succeeded()
+		descTypes := ipSpirvDescriptorTypes(code)
+		for _, binding := range []uint32{ipImageStoreOutputImageBinding, ipImageStoreInputImageBinding} {
+			assert.For(ctx, "type: %v, binding %v", ty, binding).That(descTypes[binding]).Equals(
+				VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE)
+		}
+		for binding, descType := range descTypes {
+			assert.For(ctx, "type: %v, binding %v", ty, binding).ThatError(
+				ipCheckDescriptorType(ipImageStoreDescriptorTypes, binding, descType)).Succeeded()
+		}
+	}
+}
+
+func TestComputeBlitShaderDescriptorTypes(t *testing.T) {
+	ctx := log.Testing(t)
+	// The blit shader samples the input, so the formats need not be
+	// convertible by the store shader, and the bindings must match the blit
+	// descriptor set layout.
+	for _, ty := range []VkImageType{
+		VkImageType_VK_IMAGE_TYPE_1D,
+		VkImageType_VK_IMAGE_TYPE_2D,
+		VkImageType_VK_IMAGE_TYPE_3D,
+	} {
+		code, err := ipComputeBlitShaderSpirv(
+			VkFormat_VK_FORMAT_R16G16B16A16_SFLOAT, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+			VkFormat_VK_FORMAT_R8G8B8A8_SRGB, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+			ty)
+		if !assert.For(ctx, "err").ThatError(err).Succeeded() {
+			continue
+		}
+		assert.For(ctx, "validation of type: %v", ty).ThatError(ipValidateShaderSpirv(code)).Succeeded()
+		descTypes := ipSpirvDescriptorTypes(code)
+		assert.For(ctx, "type: %v, output", ty).That(descTypes[ipImageStoreOutputImageBinding]).Equals(
+			VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE)
+		assert.For(ctx, "type: %v, input", ty).That(descTypes[ipImageStoreInputImageBinding]).Equals(
+			VkDescriptorType_VK_DESCRIPTOR_TYPE_COMBINED_IMAGE_SAMPLER)
+		for binding, descType := range descTypes {
+			assert.For(ctx, "type: %v, binding %v", ty, binding).ThatError(
+				ipCheckDescriptorType(ipImageBlitDescriptorTypes, binding, descType)).Succeeded()
 		}
 	}
+	// Integer inputs are sampled with integer samplers.
+	_, err := ipComputeBlitShaderSpirv(
+		VkFormat_VK_FORMAT_R32_SFLOAT, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+		VkFormat_VK_FORMAT_R16G16_UINT, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+		VkImageType_VK_IMAGE_TYPE_2D)
+	assert.For(ctx, "uint input").ThatError(err).Succeeded()
+	_, err = ipComputeBlitShaderSpirv(
+		VkFormat_VK_FORMAT_D32_SFLOAT, VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT,
+		VkFormat_VK_FORMAT_R32_SFLOAT, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+		VkImageType_VK_IMAGE_TYPE_2D)
+	assert.For(ctx, "depth output").ThatError(err).Failed()
+}
+
+func TestStencilExportShader(t *testing.T) {
+	ctx := log.Testing(t)
+	code, err := ipRenderStencilShaderSpirv(true)
+	if assert.For(ctx, "err").ThatError(err).Succeeded() {
+		assert.For(ctx, "validation").ThatError(ipValidateShaderSpirv(code)).Succeeded()
+	}
+}
+
+func TestRenderQuadOrientation(t *testing.T) {
+	ctx := log.Testing(t)
+	// signedArea returns the signed area of the triangle in framebuffer
+	// coordinates as defined by the Vulkan spec, which is positive for
+	// counter-clockwise triangles. flipY flips the viewport vertically, as a
+	// negative height viewport does.
+	signedArea := func(tri [][2]float32, flipY bool) float32 {
+		y := func(i int) float32 {
+			if flipY {
+				return -tri[i][1]
+			}
+			return tri[i][1]
+		}
+		a := float32(0)
+		for i := range tri {
+			j := (i + 1) % len(tri)
+			a += tri[i][0]*y(j) - tri[j][0]*y(i)
+		}
+		return -a / 2
+	}
+	positions := ipRenderQuadPositions[:]
+	assert.For(ctx, "vertex count").That(len(positions)).Equals(6)
+	total := float32(0)
+	for i := 0; i < len(positions); i += 3 {
+		tri := positions[i : i+3]
+		up, down := signedArea(tri, false), signedArea(tri, true)
+		total += up
+		// The facing of each triangle flips with the viewport, which is why
+		// the render pipelines cull no face.
+		assert.For(ctx, "triangle %v facing", i/3).That(up > 0).Equals(down < 0)
+	}
+	// The two triangles cover the whole [-1, 1] x [-1, 1] viewport.
+	assert.For(ctx, "covered area").That(total).Equals(float32(4))
+}
+
+func TestRenderRasterizationState(t *testing.T) {
+	ctx := log.Testing(t)
+	// Culling any face would drop the draw with one of the viewport
+	// orientations, leaving the target unprimed without any error.
+	assert.For(ctx, "cull mode").That(ipRenderCullMode).Equals(VkCullModeFlagBits_VK_CULL_MODE_NONE)
+	// With the viewport set by beginRenderPassAndDraw, which has a positive
+	// height, both triangles are front facing.
+	assert.For(ctx, "front face").That(ipRenderFrontFace).Equals(VkFrontFace_VK_FRONT_FACE_COUNTER_CLOCKWISE)
+	for i := 0; i < len(ipRenderQuadPositions); i += 3 {
+		p := ipRenderQuadPositions[i : i+3]
+		// Twice the signed area in framebuffer coordinates, positive for
+		// counter-clockwise triangles.
+		area := -((p[0][0]*p[1][1] - p[1][0]*p[0][1]) +
+			(p[1][0]*p[2][1] - p[2][0]*p[1][1]) +
+			(p[2][0]*p[0][1] - p[0][0]*p[2][1]))
+		assert.For(ctx, "triangle %v counter-clockwise", i/3).That(area > 0).Equals(true)
+	}
 }
@@ -0,0 +1,218 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/gapid/core/log"
+)
+
+// ipSpirvMagic is the magic number of SPIR-V modules.
+const ipSpirvMagic = 0x07230203
+
+// spirvKey returns the key identifying the generated SPIR-V of the shader.
+// The device and the specialization constants do not change the code.
+func (info ipImageStoreShaderInfo) spirvKey() string {
+	kind := "store"
+	if info.sampledInput {
+		kind = "blit"
+	}
+	return fmt.Sprintf("%v-%v-%v-%v-%v-%v", kind, info.outputFormat, info.outputAspect, info.inputFormat, info.inputAspect, info.imgType)
+}
+
+// spirv generates the SPIR-V of the shader.
+func (info ipImageStoreShaderInfo) spirv() ([]uint32, error) {
+	if info.sampledInput {
+		return ipComputeBlitShaderSpirv(info.outputFormat, info.outputAspect, info.inputFormat, info.inputAspect, info.imgType)
+	}
+	return ipComputeShaderSpirv(info.outputFormat, info.outputAspect, info.inputFormat, info.inputAspect, info.imgType)
+}
+
+// spirvKey returns the key identifying the generated SPIR-V of the shader.
+// The device does not change the code.
+func (info ipRenderShaderInfo) spirvKey() string {
+	if info.isVertex {
+		return "render-vertex"
+	}
+	return fmt.Sprintf("render-%v-%v-%v-%v", info.aspect, info.format, info.numTargets, info.stencilExport)
+}
+
+// spirv generates the SPIR-V of the shader.
+func (info ipRenderShaderInfo) spirv() ([]uint32, error) {
+	if info.isVertex {
+		return ipRenderVertexShaderSpirv()
+	}
+	switch info.aspect {
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT:
+		return ipRenderMultiTargetColorShaderSpirv(info.format, info.numTargets)
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT:
+		return ipRenderDepthShaderSpirv(info.format)
+	case VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
+		return ipRenderStencilShaderSpirv(info.stencilExport)
+	}
+	return nil, fmt.Errorf("Unsupported aspect bit: %v", info.aspect)
+}
+
+// shaderSpirv returns the SPIR-V of the shader with the given info, loaded
+// from spirvCacheDir if it is set.
+func (h *ipImageStoreHandler) shaderSpirv(info ipImageStoreShaderInfo) ([]uint32, error) {
+	return ipLoadOrGenerateSpirv(h.sb.ctx, h.spirvCacheDir, info.spirvKey(), info.spirv)
+}
+
+// dumpShaderSpirv writes the SPIR-V binary of the shader with the given info
+// to the given writer, e.g. for disassembling the code used to prime a
+// problematic format.
+func (h *ipImageStoreHandler) dumpShaderSpirv(info ipImageStoreShaderInfo, w io.Writer) error {
+	code, err := h.shaderSpirv(info)
+	if err != nil {
+		return log.Errf(h.sb.ctx, err, "[Generating SPIR-V for: %v]", info)
+	}
+	_, err = w.Write(ipSpirvData(code))
+	return err
+}
+
+// dumpShader writes the SPIR-V binary of the shader with the given info to
+// dumpShadersDir, see ipDumpShaderSpirv.
+func (h *ipImageStoreHandler) dumpShader(info ipImageStoreShaderInfo) {
+	ipDumpShaderSpirv(h.sb.ctx, h.dumpShadersDir, info.spirvKey(), func(w io.Writer) error {
+		return h.dumpShaderSpirv(info, w)
+	})
+}
+
+// shaderSpirv returns the SPIR-V of the shader with the given info, loaded
+// from spirvCacheDir if it is set.
+func (h *ipRenderHandler) shaderSpirv(info ipRenderShaderInfo) ([]uint32, error) {
+	return ipLoadOrGenerateSpirv(h.sb.ctx, h.spirvCacheDir, info.spirvKey(), info.spirv)
+}
+
+// dumpShaderSpirv writes the SPIR-V binary of the shader with the given info
+// to the given writer, e.g. for disassembling the code used to prime a
+// problematic format.
+func (h *ipRenderHandler) dumpShaderSpirv(info ipRenderShaderInfo, w io.Writer) error {
+	code, err := h.shaderSpirv(info)
+	if err != nil {
+		return log.Errf(h.sb.ctx, err, "[Generating shader SPIR-V for: %v]", info)
+	}
+	_, err = w.Write(ipSpirvData(code))
+	return err
+}
+
+// dumpShader writes the SPIR-V binary of the shader with the given info to
+// dumpShadersDir, see ipDumpShaderSpirv.
+func (h *ipRenderHandler) dumpShader(info ipRenderShaderInfo) {
+	ipDumpShaderSpirv(h.sb.ctx, h.dumpShadersDir, info.spirvKey(), func(w io.Writer) error {
+		return h.dumpShaderSpirv(info, w)
+	})
+}
+
+// ipDumpShaderSpirv writes the SPIR-V binary of the shader with the given key
+// with the given dump function to the file <key>.spv in the given directory.
+// The dumps are only for debugging, so failing to write one is logged but does
+// not fail the priming.
+func ipDumpShaderSpirv(ctx context.Context, dir, key string, dump func(w io.Writer) error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.W(ctx, "Failed to create the SPIR-V dump directory: %v: %v", dir, err)
+		return
+	}
+	path := filepath.Join(dir, key+".spv")
+	f, err := os.Create(path)
+	if err != nil {
+		log.W(ctx, "Failed to create the SPIR-V dump: %v: %v", path, err)
+		return
+	}
+	defer f.Close()
+	if err := dump(f); err != nil {
+		log.W(ctx, "Failed to dump the SPIR-V of: %v to: %v: %v", key, path, err)
+	}
+}
+
+// ipSpirvData returns the SPIR-V binary of the given code. SPIR-V tools
+// detect the byte order from the magic number, little endian is used.
+func ipSpirvData(code []uint32) []uint8 {
+	data := make([]uint8, 4*len(code))
+	for i, w := range code {
+		binary.LittleEndian.PutUint32(data[4*i:], w)
+	}
+	return data
+}
+
+// ipSpirvFromData returns the code of the given SPIR-V binary, in either byte
+// order. Returns an error if the data is not a SPIR-V binary.
+func ipSpirvFromData(data []uint8) ([]uint32, error) {
+	if len(data) < 4 || len(data)%4 != 0 {
+		return nil, fmt.Errorf("size of SPIR-V binary: %v is not a positive multiple of 4", len(data))
+	}
+	var order binary.ByteOrder
+	switch ipSpirvMagic {
+	case binary.LittleEndian.Uint32(data):
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(data):
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid SPIR-V magic number: %#x", binary.LittleEndian.Uint32(data))
+	}
+	code := make([]uint32, len(data)/4)
+	for i := range code {
+		code[i] = order.Uint32(data[4*i:])
+	}
+	return code, nil
+}
+
+// ipSpirvCachePath returns the path of the cached SPIR-V with the given key in
+// the given cache directory.
+func ipSpirvCachePath(dir, key string) string {
+	return filepath.Join(dir, fmt.Sprintf("%x.spv", sha1.Sum([]byte(key))))
+}
+
+// ipLoadOrGenerateSpirv returns the SPIR-V with the given key loaded from the
+// given cache directory, or if it is not cached, generates it with the given
+// function and saves it in the directory. If the directory is empty, the
+// SPIR-V is always generated. Failing to load or save the cached SPIR-V is not
+// fatal, the generated code is used.
+func ipLoadOrGenerateSpirv(ctx context.Context, dir, key string, generate func() ([]uint32, error)) ([]uint32, error) {
+	if dir == "" {
+		return generate()
+	}
+	path := ipSpirvCachePath(dir, key)
+	if data, err := ioutil.ReadFile(path); err == nil {
+		code, err := ipSpirvFromData(data)
+		if err == nil {
+			return code, nil
+		}
+		log.W(ctx, "Ignoring cached SPIR-V: %v of %v: %v", path, key, err)
+	} else if !os.IsNotExist(err) {
+		log.W(ctx, "Failed to load cached SPIR-V: %v of %v: %v", path, key, err)
+	}
+	code, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.W(ctx, "Failed to create SPIR-V cache directory: %v: %v", dir, err)
+		return code, nil
+	}
+	if err := ioutil.WriteFile(path, ipSpirvData(code), 0644); err != nil {
+		log.W(ctx, "Failed to save SPIR-V: %v of %v: %v", path, key, err)
+	}
+	return code, nil
+}
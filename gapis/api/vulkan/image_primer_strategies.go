@@ -0,0 +1,293 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/gapid/core/image"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/api"
+	"github.com/google/gapid/gapis/api/transform"
+	"github.com/google/gapid/gapis/replay"
+)
+
+// ipReadback reads back the data of the given subresource of the given image
+// on the replay device, and reports it to res as *image.Data.
+type ipReadback func(img ImageObjectʳ, sub ipSubresource, res replay.Result)
+
+// ipPostImageDataReadback returns the readback which reads the subresources
+// with postImageData, the same way the framebuffer attachments are read.
+func ipPostImageDataReadback(ctx context.Context, cb CommandBuilder, s *api.GlobalState, out transform.Writer) ipReadback {
+	return func(img ImageObjectʳ, sub ipSubresource, res replay.Result) {
+		level := img.Aspects().Get(sub.aspect).Layers().Get(sub.layer).Levels().Get(sub.level)
+		width, height := level.Width(), level.Height()
+		postImageData(ctx, cb, s, img, img.Info().Fmt(), sub.aspect, sub.layer, sub.level,
+			width, height, width, height, nil, out, res)
+	}
+}
+
+// PrimingStrategies primes the given image with each of the priming strategies
+// applicable to it after the command with the given id, reads back the primed
+// data after each of them, and reports to res the names of the checked
+// strategies, or an error if any strategy primes different data, see
+// checkPrimingStrategies.
+func (t *readFramebuffer) PrimingStrategies(id api.CmdID, img VkImage, res replay.Result) {
+	t.injections[id] = append(t.injections[id], func(ctx context.Context, cmd api.Cmd, out transform.Writer) {
+		s := out.State()
+		sb := GetState(s).newStateBuilder(ctx, newTransformerOutput(out))
+		sb.cb = CommandBuilder{Thread: cmd.Thread(), Arena: s.Arena}
+		p := newImagePrimer(sb)
+		imgObj := GetState(s).Images().Get(img)
+		if imgObj.IsNil() {
+			res(nil, log.Errf(ctx, fmt.Errorf("Nil Image"), "[Checking the priming strategies of image: %v]", img))
+			return
+		}
+		p.checkPrimingStrategies(img, p.applicableStrategies(imgObj), ipPostImageDataReadback(ctx, sb.cb, s, out), res)
+		p.free()
+		sb.flushAllScratchResources()
+		sb.freeAllScratchResources()
+	})
+}
+
+// ipApplicableStrategies returns the strategies which can prime the data of an
+// image with the given info and usage, in the order they are checked. The depth
+// aspect needs depthTransfer to be primed with buffer -> image copies, see
+// ipDepthTransferSupported. Only the linear images created in PREINITIALIZED
+// layout can be primed by preinitialization.
+func ipApplicableStrategies(info ImageInfo, usage VkImageUsageFlags, depthTransfer bool) []ipPrimingStrategy {
+	has := func(bits VkImageUsageFlagBits) bool { return usage&VkImageUsageFlags(bits) != 0 }
+	isDepth := has(VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT)
+	strategies := []ipPrimingStrategy{}
+	if has(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT) && (!isDepth || depthTransfer) {
+		strategies = append(strategies, ipPrimingStrategyBufferCopy)
+	}
+	if has(VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT | VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT) {
+		strategies = append(strategies, ipPrimingStrategyRendering)
+	}
+	if has(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT) {
+		strategies = append(strategies, ipPrimingStrategyImageStore)
+	}
+	if info.Tiling() == VkImageTiling_VK_IMAGE_TILING_LINEAR && info.InitialLayout() == VkImageLayout_VK_IMAGE_LAYOUT_PREINITIALIZED {
+		strategies = append(strategies, ipPrimingStrategyPreinitialization)
+	}
+	return strategies
+}
+
+// applicableStrategies returns the strategies which can prime the data of the
+// given image, see ipApplicableStrategies.
+func (p *imagePrimer) applicableStrategies(img ImageObjectʳ) []ipPrimingStrategy {
+	usage := p.viewableUsage(img, img.Info().Usage())
+	return ipApplicableStrategies(img.Info(), usage, p.depthTransferSupported(img, usage))
+}
+
+// checkPrimingStrategies primes the data of the given image with each of the
+// given strategies in turn, forcing the strategy, and reads back all the
+// primed subresources with readback after each of them. Once all the data is
+// read back, the data primed with each strategy is compared with the data
+// primed with the first strategy, and for the color aspect also with the
+// captured data, see ipCompareStrategyReadbacks. The result is reported to
+// res: the names of the checked strategies if all the data matches, otherwise
+// an error listing the mismatches, the strategies which failed to prime the
+// image and the subresources which failed to be read back.
+func (p *imagePrimer) checkPrimingStrategies(img VkImage, strategies []ipPrimingStrategy, readback ipReadback, res replay.Result) {
+	imgObj := GetState(p.sb.oldState).Images().Get(img)
+	if imgObj.IsNil() {
+		res(nil, log.Errf(p.sb.ctx, fmt.Errorf("Nil Image in old state"), "[Checking the priming strategies of image: %v]", img))
+		return
+	}
+	if len(strategies) == 0 {
+		res(nil, log.Errf(p.sb.ctx, nil, "No priming strategy is applicable to image: %v", img))
+		return
+	}
+	rng := p.sb.imageWholeSubresourceRange(imgObj)
+	subresources := []ipSubresource{}
+	captured := map[ipSubresource][]uint8{}
+	walkImageSubresourceRange(p.sb, imgObj, rng, func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+		sub := ipSubresource{aspect: aspect, layer: layer, level: level}
+		subresources = append(subresources, sub)
+		data, err := imgObj.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level).Data().Read(p.sb.ctx, nil, p.sb.oldState, nil)
+		if err != nil {
+			log.W(p.sb.ctx, "[Reading the captured data of image: %v, subresource: %+v] %v, it is not compared with the primed data", img, sub, err)
+			return
+		}
+		captured[sub] = data
+	})
+
+	readbacks := newIPStrategyReadbacks(strategies, subresources, captured, res)
+	if p.forcedStrategies == nil {
+		p.forcedStrategies = map[VkImage]ipPrimingStrategy{}
+	}
+	defer delete(p.forcedStrategies, img)
+	for _, strategy := range strategies {
+		p.forcedStrategies[img] = strategy
+		if err := p.primeWithStrategy(imgObj, rng, strategy); err != nil {
+			readbacks.fail(strategy, err)
+			continue
+		}
+		// The primed data must be in the image before it is read back.
+		p.sb.flushAllScratchResources()
+		for _, sub := range subresources {
+			readback(imgObj, sub, readbacks.result(strategy, sub))
+		}
+	}
+}
+
+// primeWithStrategy primes the given range of the given image, which must be
+// forced to be primed with the given strategy, and leaves the range in its
+// current layouts. Returns an error if the image is not primed with the given
+// strategy.
+func (p *imagePrimer) primeWithStrategy(img ImageObjectʳ, rng VkImageSubresourceRange, strategy ipPrimingStrategy) error {
+	return p.primeRange(img, rng, func(plan ipPrimingPlan) error {
+		if plan.Strategy != strategy {
+			return fmt.Errorf("image: %v is primed with strategy: %v instead", img.VulkanHandle(), plan.Strategy)
+		}
+		return nil
+	})
+}
+
+// primeRange primes the given range of the given image and leaves the range in
+// its current layouts. The priming plan of the image is checked with check, if
+// not nil, before priming. Returns an error if the image fails to be primed or
+// its plan is rejected.
+func (p *imagePrimer) primeRange(img ImageObjectʳ, rng VkImageSubresourceRange, check func(plan ipPrimingPlan) error) error {
+	primeable, err := p.newPrimeableImageData(img.VulkanHandle(), []VkImageSubresourceRange{rng}, true)
+	if err != nil {
+		return err
+	}
+	defer primeable.free()
+	if check != nil {
+		if err := check(p.plans[img.VulkanHandle()]); err != nil {
+			return err
+		}
+	}
+	layouts := p.layoutsInNewState(img.VulkanHandle())
+	if err := primeable.prime(layouts, layouts); err != nil {
+		return err
+	}
+	ipHandOffToLastBoundQueues(p.sb, img, primeable.primingQueue())
+	return nil
+}
+
+// ipStrategyReadbacks collects the data read back after priming an image with
+// each strategy, and reports the result of the check once all the data is read
+// back or failed to be, see checkPrimingStrategies.
+type ipStrategyReadbacks struct {
+	mutex        sync.Mutex
+	strategies   []ipPrimingStrategy
+	subresources []ipSubresource
+	captured     map[ipSubresource][]uint8
+	data         map[ipPrimingStrategy]map[ipSubresource][]uint8
+	errs         []error
+	pending      int
+	res          replay.Result
+}
+
+func newIPStrategyReadbacks(strategies []ipPrimingStrategy, subresources []ipSubresource, captured map[ipSubresource][]uint8, res replay.Result) *ipStrategyReadbacks {
+	data := make(map[ipPrimingStrategy]map[ipSubresource][]uint8, len(strategies))
+	for _, strategy := range strategies {
+		data[strategy] = map[ipSubresource][]uint8{}
+	}
+	return &ipStrategyReadbacks{
+		strategies:   strategies,
+		subresources: subresources,
+		captured:     captured,
+		data:         data,
+		pending:      len(strategies) * len(subresources),
+		res:          res,
+	}
+}
+
+// result returns the replay.Result which collects the data of the given
+// subresource read back after priming with the given strategy.
+func (r *ipStrategyReadbacks) result(strategy ipPrimingStrategy, sub ipSubresource) replay.Result {
+	return func(val interface{}, err error) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("reading back subresource: %+v primed with %v: %v", sub, strategy, err))
+		} else if data, ok := val.(*image.Data); ok {
+			r.data[strategy][sub] = data.Bytes
+		} else {
+			r.errs = append(r.errs, fmt.Errorf("reading back subresource: %+v primed with %v: unexpected result: %T", sub, strategy, val))
+		}
+		r.done(1)
+	}
+}
+
+// fail records that the given strategy failed to prime the image, so none of
+// its subresources is read back.
+func (r *ipStrategyReadbacks) fail(strategy ipPrimingStrategy, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.errs = append(r.errs, fmt.Errorf("priming with %v: %v", strategy, err))
+	r.done(len(r.subresources))
+}
+
+func (r *ipStrategyReadbacks) done(count int) {
+	r.pending -= count
+	if r.pending > 0 {
+		return
+	}
+	errs := append(r.errs, ipCompareStrategyReadbacks(r.strategies, r.subresources, r.captured, r.data)...)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		r.res(nil, fmt.Errorf("Priming strategies mismatch: %v", strings.Join(msgs, "; ")))
+		return
+	}
+	names := make([]string, len(r.strategies))
+	for i, strategy := range r.strategies {
+		names[i] = string(strategy)
+	}
+	r.res(names, nil)
+}
+
+// ipCompareStrategyReadbacks compares the data of each of the given
+// subresources read back after priming with each of the given strategies with
+// the data read back after priming with the first strategy which has data of
+// the subresource, and returns an error for each mismatch. The data of the
+// color aspect is also compared with the given captured data. The read back
+// depth and stencil data are in the formats used to read the attachments, which
+// may differ from the layout of the captured data, see postImageData, so they
+// are only compared across the strategies.
+func ipCompareStrategyReadbacks(strategies []ipPrimingStrategy, subresources []ipSubresource, captured map[ipSubresource][]uint8, data map[ipPrimingStrategy]map[ipSubresource][]uint8) []error {
+	errs := []error{}
+	for _, sub := range subresources {
+		var ref []uint8
+		var refStrategy ipPrimingStrategy
+		for _, strategy := range strategies {
+			d, ok := data[strategy][sub]
+			if !ok {
+				continue
+			}
+			if src, ok := captured[sub]; ok && sub.aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT && !bytes.Equal(d, src) {
+				errs = append(errs, fmt.Errorf("subresource: %+v primed with %v differs from the captured data", sub, strategy))
+			}
+			if ref == nil {
+				ref, refStrategy = d, strategy
+			} else if !bytes.Equal(d, ref) {
+				errs = append(errs, fmt.Errorf("subresource: %+v primed with %v differs from the one primed with %v", sub, strategy, refStrategy))
+			}
+		}
+	}
+	return errs
+}
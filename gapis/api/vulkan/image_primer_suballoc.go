@@ -0,0 +1,131 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/memory"
+)
+
+// ipStagingSuballocationAlignment is the alignment of the offsets of the
+// staging images suballocated from a memory block. The replay side memory
+// requirements of the staging images are not known when building the
+// commands, so the offsets are aligned to the granularity the allocation
+// sizes are rounded up to, which is larger than the alignment and the buffer
+// image granularity required by the drivers.
+const ipStagingSuballocationAlignment = VkDeviceSize(256 * 1024)
+
+// ipStagingBlockKey identifies the staging memory blocks whose memory is
+// allocated with the same memory type and allocate flags on the same device,
+// from which the memory of the same kind of staging images can be
+// suballocated.
+type ipStagingBlockKey struct {
+	dev           VkDevice
+	memTypeIndex  uint32
+	allocateFlags VkMemoryAllocateFlags
+	deviceMask    uint32
+}
+
+// ipStagingMemoryBlock is a memory block from which the memory of several
+// staging images is suballocated when stagingBlockSize is set.
+type ipStagingMemoryBlock struct {
+	key ipStagingBlockKey
+	mem DeviceMemoryObjectʳ
+	// next is the offset after the last suballocation.
+	next VkDeviceSize
+	// live is the number of staging images bound to the block, which are not
+	// freed yet. The block is freed once it drops to 0.
+	live int
+}
+
+// ipSuballocate returns the offset of a suballocation of the given size in a
+// block of the given size, whose next free offset is the given one, aligned to
+// the given alignment. Returns false if the suballocation does not fit in the
+// block.
+func ipSuballocate(next, size, blockSize, alignment VkDeviceSize) (VkDeviceSize, bool) {
+	offset := VkDeviceSize(nextMultipleOf(uint64(next), uint64(alignment)))
+	if uint64(offset)+uint64(size) > uint64(blockSize) {
+		return 0, false
+	}
+	return offset, true
+}
+
+// ipStagingBlockKeyOf returns the key of the staging memory blocks from which the
+// memory of a staging image of the given memory type on the given device can
+// be suballocated, with the allocate flags of the given source memory.
+func ipStagingBlockKeyOf(dev VkDevice, memTypeIndex int, srcMem DeviceMemoryObjectʳ) ipStagingBlockKey {
+	key := ipStagingBlockKey{dev: dev, memTypeIndex: uint32(memTypeIndex)}
+	if !srcMem.IsNil() && !srcMem.AllocateFlags().IsNil() {
+		key.allocateFlags = srcMem.AllocateFlags().Flags()
+		key.deviceMask = srcMem.AllocateFlags().DeviceMask()
+	}
+	return key
+}
+
+// suballocateStagingMemory binds the given staging image to a range of the
+// given size in a staging memory block of the given memory type, allocating a
+// new block if the current one of the memory type has no room, and returns
+// the memory of the block. Returns false if the size does not fit in a block
+// of stagingBlockSize, in which case the image needs its own allocation.
+func (p *imagePrimer) suballocateStagingMemory(dev VkDevice, img VkImage, size VkDeviceSize, memTypeIndex int, srcMem DeviceMemoryObjectʳ) (DeviceMemoryObjectʳ, bool) {
+	if _, ok := ipSuballocate(0, size, p.stagingBlockSize, ipStagingSuballocationAlignment); !ok {
+		return NilDeviceMemoryObjectʳ, false
+	}
+	key := ipStagingBlockKeyOf(dev, memTypeIndex, srcMem)
+	block := p.stagingBlocks[key]
+	var offset VkDeviceSize
+	ok := false
+	if block != nil {
+		offset, ok = ipSuballocate(block.next, size, p.stagingBlockSize, ipStagingSuballocationAlignment)
+	}
+	if !ok {
+		memHandle := VkDeviceMemory(newUnusedID(true, func(x uint64) bool {
+			return GetState(p.sb.newState).DeviceMemories().Contains(VkDeviceMemory(x))
+		}))
+		vkAllocateMemory(p.sb, dev, p.stagingBlockSize, uint32(memTypeIndex), memHandle, ipMemoryAllocateFlagsPNext(p.sb, srcMem, NewVoidᶜᵖ(memory.Nullptr)))
+		mem := GetState(p.sb.newState).DeviceMemories().Get(memHandle)
+		p.trackHeapUsage(mem, true)
+		block = &ipStagingMemoryBlock{key: key, mem: mem}
+		p.stagingBlocks[key] = block
+		p.stagingBlockOf[memHandle] = block
+		offset = 0
+		log.D(p.sb.ctx, "Allocated staging memory block: %v of size: %v", memHandle, p.stagingBlockSize)
+	}
+	vkBindImageMemory(p.sb, dev, img, block.mem.VulkanHandle(), offset)
+	block.next = offset + size
+	block.live++
+	return block.mem, true
+}
+
+// releaseStagingMemory releases the suballocation of a staging image from the
+// given memory, and returns true if the memory is a staging memory block. The
+// block is freed once all the staging images bound to it are released.
+func (p *imagePrimer) releaseStagingMemory(mem DeviceMemoryObjectʳ) bool {
+	block, ok := p.stagingBlockOf[mem.VulkanHandle()]
+	if !ok {
+		return false
+	}
+	block.live--
+	if block.live > 0 {
+		return true
+	}
+	delete(p.stagingBlockOf, mem.VulkanHandle())
+	if p.stagingBlocks[block.key] == block {
+		delete(p.stagingBlocks, block.key)
+	}
+	p.trackHeapUsage(mem, false)
+	p.sb.write(p.sb.cb.VkFreeMemory(mem.Device(), mem.VulkanHandle(), memory.Nullptr))
+	return true
+}
@@ -15,11 +15,25 @@
 package vulkan
 
 import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/event/task"
 	"github.com/google/gapid/core/image"
 	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/memory/arena"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/api"
+	"github.com/google/gapid/gapis/database"
+	"github.com/google/gapid/gapis/memory"
+	"github.com/google/gapid/gapis/replay"
 )
 
 func TestUnpackData(t *testing.T) {
@@ -141,3 +155,3422 @@ func TestUnpackData(t *testing.T) {
 			0xC2, 0xF3, 0x8E, 0xCD,
 		})
 }
+
+func TestRenderAspectOrder(t *testing.T) {
+	ctx := log.Testing(t)
+
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+
+	for _, test := range []struct {
+		aspects  []VkImageAspectFlagBits
+		expected []VkImageAspectFlagBits
+	}{
+		{[]VkImageAspectFlagBits{depth, stencil}, []VkImageAspectFlagBits{depth, stencil}},
+		{[]VkImageAspectFlagBits{stencil, depth}, []VkImageAspectFlagBits{depth, stencil}},
+		{[]VkImageAspectFlagBits{stencil}, []VkImageAspectFlagBits{stencil}},
+		{[]VkImageAspectFlagBits{color}, []VkImageAspectFlagBits{color}},
+		{[]VkImageAspectFlagBits{}, []VkImageAspectFlagBits{}},
+	} {
+		assert.For(ctx, "aspects %v", test.aspects).ThatSlice(ipRenderAspectOrder(test.aspects)).Equals(test.expected)
+	}
+}
+
+func TestRenderDepthStencilAspectsSurvive(t *testing.T) {
+	ctx := log.Testing(t)
+
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	load := VkAttachmentLoadOp_VK_ATTACHMENT_LOAD_OP_LOAD
+
+	// Replay the effects of the render passes priming each aspect of a
+	// depth-stencil image on its depth and stencil data, in the order they
+	// are rendered. The stencil data is always loaded, and only written when
+	// rendering the stencil aspect.
+	const undefined, primed = "undefined", "primed"
+	depthData, stencilData := undefined, undefined
+	for _, aspect := range ipRenderAspectOrder([]VkImageAspectFlagBits{stencil, depth}) {
+		if ipRenderTargetLoadOp(aspect) != load {
+			depthData = undefined
+		}
+		if ipDefaultRenderDepthState(aspect).writeEnable {
+			depthData = primed
+		}
+		if aspect == stencil {
+			stencilData = primed
+		}
+	}
+	assert.For(ctx, "depth data").That(depthData).Equals(primed)
+	assert.For(ctx, "stencil data").That(stencilData).Equals(primed)
+	assert.For(ctx, "stencil pass depth test").That(ipDefaultRenderDepthState(stencil).testEnable).Equals(false)
+}
+
+func TestStagingImageExclusiveSharing(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	info := MakeImageInfo(a)
+	info.SetSharingMode(VkSharingMode_VK_SHARING_MODE_CONCURRENT)
+	info.QueueFamilyIndices().Add(0, 0)
+	info.QueueFamilyIndices().Add(1, 2)
+
+	stagingInfo := info.Clone(a, api.CloneContext{})
+	ipSetExclusiveSharing(stagingInfo, a)
+
+	assert.For(ctx, "staging sharing mode").That(stagingInfo.SharingMode()).Equals(VkSharingMode_VK_SHARING_MODE_EXCLUSIVE)
+	assert.For(ctx, "staging queue family indices").That(stagingInfo.QueueFamilyIndices().Len()).Equals(0)
+	// The source image info must not be modified.
+	assert.For(ctx, "source sharing mode").That(info.SharingMode()).Equals(VkSharingMode_VK_SHARING_MODE_CONCURRENT)
+	assert.For(ctx, "source queue family indices").That(info.QueueFamilyIndices().Len()).Equals(2)
+
+	// Priming on family 1, which the source image does not share with.
+	assert.For(ctx, "source compatible with family 1").That(ipQueueFamilyCompatible(info, 1)).Equals(false)
+	assert.For(ctx, "source compatible with family 2").That(ipQueueFamilyCompatible(info, 2)).Equals(true)
+	assert.For(ctx, "staging compatible with family 1").That(ipQueueFamilyCompatible(stagingInfo, 1)).Equals(true)
+}
+
+func TestImageViewFormats(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	info := MakeImageInfo(a)
+	info.SetFlags(VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_MUTABLE_FORMAT_BIT))
+	info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+	assert.For(ctx, "without format list").That(len(imageViewFormats(info))).Equals(0)
+
+	formatList := MakeImageFormatListInfoʳ(a)
+	formatList.ViewFormats().Add(1, VkFormat_VK_FORMAT_R8G8B8A8_SRGB)
+	formatList.ViewFormats().Add(0, VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+	info.SetViewFormatList(formatList)
+	expected := []VkFormat{
+		VkFormat_VK_FORMAT_R8G8B8A8_UNORM,
+		VkFormat_VK_FORMAT_R8G8B8A8_SRGB,
+	}
+	assert.For(ctx, "with format list").ThatSlice(imageViewFormats(info)).Equals(expected)
+
+	// The format list must be carried over when the image info is cloned.
+	clonedInfo := info.Clone(a, api.CloneContext{})
+	assert.For(ctx, "cloned format list").ThatSlice(imageViewFormats(clonedInfo)).Equals(expected)
+}
+
+func TestExternalMemoryImageInfo(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	opaqueFd := VkExternalMemoryHandleTypeFlags(VkExternalMemoryHandleTypeFlagBits_VK_EXTERNAL_MEMORY_HANDLE_TYPE_OPAQUE_FD_BIT)
+	opaqueWin32 := VkExternalMemoryHandleTypeFlags(VkExternalMemoryHandleTypeFlagBits_VK_EXTERNAL_MEMORY_HANDLE_TYPE_OPAQUE_WIN32_BIT)
+
+	info := MakeImageInfo(a)
+	info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+	normalMem := MakeDeviceMemoryObjectʳ(a)
+	_, preserved := ipExternalMemoryImageInfo(a, info, normalMem)
+	assert.For(ctx, "without external memory").That(preserved).Equals(false)
+
+	info.SetExternalMemory(NewExternalMemoryImageInfoʳ(a, opaqueFd))
+	exportedMem := MakeDeviceMemoryObjectʳ(a)
+	exportedMem.SetExportMemory(NewExportMemoryInfoʳ(a, opaqueFd))
+	recreated, preserved := ipExternalMemoryImageInfo(a, info, exportedMem)
+	assert.For(ctx, "exported memory").That(preserved).Equals(true)
+	assert.For(ctx, "exported memory").That(recreated.ExternalMemory().HandleTypes()).Equals(opaqueFd)
+
+	// Imported memory is recreated as normal memory.
+	recreated, preserved = ipExternalMemoryImageInfo(a, info, normalMem)
+	assert.For(ctx, "normal memory").That(preserved).Equals(false)
+	assert.For(ctx, "normal memory").That(recreated.ExternalMemory().IsNil()).Equals(true)
+	assert.For(ctx, "original info").That(info.ExternalMemory().IsNil()).Equals(false)
+
+	otherMem := MakeDeviceMemoryObjectʳ(a)
+	otherMem.SetExportMemory(NewExportMemoryInfoʳ(a, opaqueWin32))
+	_, preserved = ipExternalMemoryImageInfo(a, info, otherMem)
+	assert.For(ctx, "other handle types").That(preserved).Equals(false)
+
+	_, preserved = ipExternalMemoryImageInfo(a, info, NilDeviceMemoryObjectʳ)
+	assert.For(ctx, "no memory").That(preserved).Equals(false)
+}
+
+func TestStagingColorFormat(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		srcFmt   VkFormat
+		narrow   bool
+		expected VkFormat
+	}{
+		{VkFormat_VK_FORMAT_R32_UINT, false, VkFormat_VK_FORMAT_R32G32B32A32_UINT},
+		{VkFormat_VK_FORMAT_R32_UINT, true, VkFormat_VK_FORMAT_R32_UINT},
+		{VkFormat_VK_FORMAT_R8_UNORM, true, VkFormat_VK_FORMAT_R32_UINT},
+		{VkFormat_VK_FORMAT_R16G16_SFLOAT, true, VkFormat_VK_FORMAT_R32G32_UINT},
+		{VkFormat_VK_FORMAT_R8G8B8A8_UNORM, true, VkFormat_VK_FORMAT_R32G32B32A32_UINT},
+		{VkFormat_VK_FORMAT_UNDEFINED, true, VkFormat_VK_FORMAT_R32G32B32A32_UINT},
+	} {
+		assert.For(ctx, "staging format for %v, narrow: %v", test.srcFmt, test.narrow).That(
+			ipStagingColorFormat(test.srcFmt, test.narrow)).Equals(test.expected)
+	}
+}
+
+func TestDispatchTiles(t *testing.T) {
+	ctx := log.Testing(t)
+	max := [3]uint32{4, 4, 1}
+
+	tiles := ipDispatchTiles([3]uint32{3, 2, 1}, max)
+	assert.For(ctx, "within limits").ThatSlice(tiles).Equals([]ipDispatchTile{
+		{base: [3]uint32{0, 0, 0}, count: [3]uint32{3, 2, 1}},
+	})
+
+	tiles = ipDispatchTiles([3]uint32{6, 5, 2}, max)
+	assert.For(ctx, "exceeding limits").ThatSlice(tiles).Equals([]ipDispatchTile{
+		{base: [3]uint32{0, 0, 0}, count: [3]uint32{4, 4, 1}},
+		{base: [3]uint32{4, 0, 0}, count: [3]uint32{2, 4, 1}},
+		{base: [3]uint32{0, 4, 0}, count: [3]uint32{4, 1, 1}},
+		{base: [3]uint32{4, 4, 0}, count: [3]uint32{2, 1, 1}},
+		{base: [3]uint32{0, 0, 1}, count: [3]uint32{4, 4, 1}},
+		{base: [3]uint32{4, 0, 1}, count: [3]uint32{2, 4, 1}},
+		{base: [3]uint32{0, 4, 1}, count: [3]uint32{4, 1, 1}},
+		{base: [3]uint32{4, 4, 1}, count: [3]uint32{2, 1, 1}},
+	})
+}
+
+func TestPackedFloatDataToRGB32SFloat(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	assert.For(ctx, "B10G11R11 is packed float").That(
+		isPackedFloatFormat(VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32)).Equals(true)
+	assert.For(ctx, "E5B9G9R9 is packed float").That(
+		isPackedFloatFormat(VkFormat_VK_FORMAT_E5B9G9R9_UFLOAT_PACK32)).Equals(true)
+	assert.For(ctx, "R32G32B32_SFLOAT is packed float").That(
+		isPackedFloatFormat(VkFormat_VK_FORMAT_R32G32B32_SFLOAT)).Equals(false)
+
+	// 2x1x1 image, the first texel is (1.0, 2.0, 0.5), the second one is
+	// (0.0, 0.0, 0.0).
+	data, dstFmt, err := packedFloatDataToRGB32SFloat([]uint8{
+		0xC0, 0x03, 0x20, 0x07,
+		0x00, 0x00, 0x00, 0x00,
+	}, VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32, NewVkExtent3D(a, 2, 1, 1))
+	if assert.For(ctx, "err").ThatError(err).Succeeded() {
+		assert.For(ctx, "dstFmt").That(dstFmt).Equals(VkFormat_VK_FORMAT_R32G32B32_SFLOAT)
+		assert.For(ctx, "data").ThatSlice(data).Equals([]uint8{
+			0x00, 0x00, 0x80, 0x3F,
+			0x00, 0x00, 0x00, 0x40,
+			0x00, 0x00, 0x00, 0x3F,
+			0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+		})
+	}
+
+	_, _, err = packedFloatDataToRGB32SFloat([]uint8{0x00, 0x00, 0x00, 0x00},
+		VkFormat_VK_FORMAT_R8G8B8A8_UNORM, NewVkExtent3D(a, 1, 1, 1))
+	assert.For(ctx, "err").ThatError(err).Failed()
+}
+
+func TestRenderJobInputLayout(t *testing.T) {
+	ctx := log.Testing(t)
+
+	job := &ipRenderJob{}
+	assert.For(ctx, "default input layout").That(job.inputLayout()).Equals(
+		VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL)
+
+	job.inputAttachmentLayout = VkImageLayout_VK_IMAGE_LAYOUT_GENERAL
+	assert.For(ctx, "specified input layout").That(job.inputLayout()).Equals(
+		VkImageLayout_VK_IMAGE_LAYOUT_GENERAL)
+}
+
+func TestNeedsUnpacking(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+
+	srcFmt := VkFormat_VK_FORMAT_R32G32B32A32_UINT
+	assert.For(ctx, "RGBA32_UINT to its staging format").That(
+		ipNeedsUnpacking(srcFmt, ipStagingColorFormat(srcFmt, false), color)).Equals(false)
+	assert.For(ctx, "RGBA32_SFLOAT to RGBA32_UINT").That(
+		ipNeedsUnpacking(VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT, VkFormat_VK_FORMAT_R32G32B32A32_UINT, color)).Equals(false)
+	assert.For(ctx, "R32_SINT to R32_UINT").That(
+		ipNeedsUnpacking(VkFormat_VK_FORMAT_R32_SINT, VkFormat_VK_FORMAT_R32_UINT, color)).Equals(false)
+	assert.For(ctx, "R32_UINT to RGBA32_UINT").That(
+		ipNeedsUnpacking(VkFormat_VK_FORMAT_R32_UINT, VkFormat_VK_FORMAT_R32G32B32A32_UINT, color)).Equals(true)
+	assert.For(ctx, "RGB32_UINT to RGBA32_UINT").That(
+		ipNeedsUnpacking(VkFormat_VK_FORMAT_R32G32B32_UINT, VkFormat_VK_FORMAT_R32G32B32A32_UINT, color)).Equals(true)
+	assert.For(ctx, "RGBA8_UNORM to RGBA32_UINT").That(
+		ipNeedsUnpacking(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, VkFormat_VK_FORMAT_R32G32B32A32_UINT, color)).Equals(true)
+	assert.For(ctx, "D32_SFLOAT depth to R32_UINT").That(
+		ipNeedsUnpacking(VkFormat_VK_FORMAT_D32_SFLOAT, VkFormat_VK_FORMAT_R32_UINT,
+			VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT)).Equals(true)
+}
+
+func TestAliasedImageGroups(t *testing.T) {
+	ctx := log.Testing(t)
+
+	groups := ipAliasedImageGroups([]ipImageMemoryBinding{
+		{img: 1, mem: 10, offset: 0, size: 256},
+		{img: 2, mem: 10, offset: 256, size: 256},
+		{img: 3, mem: 10, offset: 128, size: 64},
+		{img: 4, mem: 10, offset: 1024, size: 256},
+		{img: 5, mem: 10, offset: 1024, size: 512},
+		{img: 6, mem: 20, offset: 0, size: 256},
+		{img: 7, mem: 30, offset: 0, size: 0},
+		{img: 8, mem: 30, offset: 0, size: 256},
+	})
+	assert.For(ctx, "aliased groups").ThatSlice(groups).DeepEquals([][]VkImage{
+		{1, 3},
+		{4, 5},
+	})
+}
+
+func TestViewableUsage(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	usage := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_SRC_BIT |
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT |
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	// e.g. an SRGB format which supports sampling but not storage.
+	features := VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_SAMPLED_IMAGE_BIT |
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_TRANSFER_SRC_BIT)
+
+	info := MakeImageInfo(a)
+	info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_SRGB)
+	info.SetUsage(usage)
+	assert.For(ctx, "without extended usage").That(
+		ipViewableUsage(info, usage, features)).Equals(usage)
+
+	info.SetFlags(VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_MUTABLE_FORMAT_BIT |
+		VkImageCreateFlagBits_VK_IMAGE_CREATE_EXTENDED_USAGE_BIT))
+	assert.For(ctx, "with extended usage").That(
+		ipViewableUsage(info, usage, features)).Equals(VkImageUsageFlags(
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_SRC_BIT |
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT))
+}
+
+func TestPrimingPlanEncoding(t *testing.T) {
+	ctx := log.Testing(t)
+	plans := []ipPrimingPlan{
+		{
+			Image:       VkImage(1),
+			Strategy:    ipPrimingStrategyBufferCopy,
+			QueueFamily: 1,
+			BatchSize:   3,
+		},
+		{
+			Image:    VkImage(2),
+			Strategy: ipPrimingStrategyRendering,
+			StagingFormats: []ipPlanStagingFormat{
+				{VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT, VkFormat_VK_FORMAT_R32_UINT},
+				{VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT, VkFormat_VK_FORMAT_R32_UINT},
+			},
+			BatchSize:         2,
+			GenerateMipLevels: true,
+		},
+	}
+	data, err := encodePrimingPlans(plans)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	decoded, err := decodePrimingPlans(data)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "decoded").That(len(decoded)).Equals(len(plans))
+	for _, plan := range plans {
+		assert.For(ctx, "plan of image: %v", plan.Image).That(decoded[plan.Image]).DeepEquals(plan)
+	}
+}
+
+func TestPrimingCheckpoint(t *testing.T) {
+	ctx := log.Testing(t)
+	p := &imagePrimer{primedImages: map[VkImage]bool{}}
+	p.markPrimed(VkImage(3))
+	assert.For(ctx, "untracked").That(len(p.checkpoint().Primed)).Equals(0)
+
+	p.trackCompletion = true
+	p.markPrimed(VkImage(3))
+	p.markPrimed(VkImage(1))
+	checkpoint := p.checkpoint()
+	assert.For(ctx, "primed").ThatSlice(checkpoint.Primed).Equals([]VkImage{1, 3})
+
+	data, err := encodePrimingCheckpoint(checkpoint)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	primed, err := decodePrimingCheckpoint(data)
+	if assert.For(ctx, "err").ThatError(err).Succeeded() {
+		assert.For(ctx, "decoded").ThatMap(primed).Equals(map[VkImage]bool{1: true, 3: true})
+	}
+	_, err = decodePrimingCheckpoint([]byte("{"))
+	assert.For(ctx, "invalid checkpoint").ThatError(err).Failed()
+}
+
+func TestValidateImageInfo(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	info := MakeImageInfo(a)
+	info.SetExtent(NewVkExtent3D(a, 4, 4, 1))
+	info.SetArrayLayers(1)
+	info.SetMipLevels(1)
+	assert.For(ctx, "valid image").ThatError(ipValidateImageInfo(info)).Succeeded()
+
+	info.SetArrayLayers(0)
+	assert.For(ctx, "zero array layers").ThatError(ipValidateImageInfo(info)).Failed()
+
+	info.SetArrayLayers(1)
+	info.SetMipLevels(0)
+	assert.For(ctx, "zero mip levels").ThatError(ipValidateImageInfo(info)).Failed()
+
+	info.SetMipLevels(1)
+	info.SetExtent(NewVkExtent3D(a, 4, 0, 1))
+	assert.For(ctx, "empty extent").ThatError(ipValidateImageInfo(info)).Failed()
+}
+
+func TestUnpack10BitPackedData(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	// Texels as (r, g, b, a), covering the extreme values of the 10-bit and the
+	// 2-bit channels.
+	unsignedTexels := [][4]int32{{0, 0, 0, 0}, {1023, 512, 1, 3}, {5, 1000, 300, 2}, {511, 0, 1023, 1}}
+	signedTexels := [][4]int32{{0, 0, 0, 0}, {511, -512, -1, 1}, {-511, 255, -256, -2}, {1, -1, 0, -1}}
+	pack := func(bgra bool, texel [4]int32) []uint8 {
+		lo, hi := texel[0], texel[2]
+		if bgra {
+			lo, hi = texel[2], texel[0]
+		}
+		v := uint32(lo)&0x3ff | (uint32(texel[1])&0x3ff)<<10 | (uint32(hi)&0x3ff)<<20 | (uint32(texel[3])&0x3)<<30
+		return []uint8{uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24)}
+	}
+	for _, tc := range []struct {
+		format VkFormat
+		bgra   bool
+		signed bool
+	}{
+		{VkFormat_VK_FORMAT_A2B10G10R10_UNORM_PACK32, false, false},
+		{VkFormat_VK_FORMAT_A2B10G10R10_UINT_PACK32, false, false},
+		{VkFormat_VK_FORMAT_A2B10G10R10_SNORM_PACK32, false, true},
+		{VkFormat_VK_FORMAT_A2B10G10R10_SINT_PACK32, false, true},
+		{VkFormat_VK_FORMAT_A2R10G10B10_UNORM_PACK32, true, false},
+		{VkFormat_VK_FORMAT_A2R10G10B10_UINT_PACK32, true, false},
+		{VkFormat_VK_FORMAT_A2R10G10B10_SNORM_PACK32, true, true},
+		{VkFormat_VK_FORMAT_A2R10G10B10_SINT_PACK32, true, true},
+	} {
+		texels := unsignedTexels
+		if tc.signed {
+			texels = signedTexels
+		}
+		src := []uint8{}
+		expected := []uint8{}
+		for _, texel := range texels {
+			src = append(src, pack(tc.bgra, texel)...)
+			for _, c := range texel {
+				expected = append(expected, uint8(c), uint8(c>>8), uint8(c>>16), uint8(c>>24))
+			}
+		}
+		unpacked, err := unpackDataForPriming(ctx, src, tc.format, VkFormat_VK_FORMAT_R32G32B32A32_UINT, color)
+		if assert.For(ctx, "unpacking %v", tc.format).ThatError(err).Succeeded() {
+			assert.For(ctx, "unpacked %v", tc.format).ThatSlice(unpacked).Equals(expected)
+		}
+	}
+}
+
+func TestLeastLoadedQueue(t *testing.T) {
+	ctx := log.Testing(t)
+	candidates := []ipQueueCandidate{
+		{queue: VkQueue(3), family: 0},
+		{queue: VkQueue(1), family: 1},
+		{queue: VkQueue(2), family: 1},
+	}
+	loads := map[VkQueue]int{}
+
+	_, ok := ipLeastLoadedQueue(nil, nil, loads)
+	assert.For(ctx, "no candidates").That(ok).Equals(false)
+
+	q, _ := ipLeastLoadedQueue(candidates, nil, loads)
+	assert.For(ctx, "lowest handle").That(q).Equals(VkQueue(1))
+
+	q, _ = ipLeastLoadedQueue(candidates, map[uint32]bool{0: true}, loads)
+	assert.For(ctx, "preferred family").That(q).Equals(VkQueue(3))
+
+	loads[VkQueue(1)] = 1
+	loads[VkQueue(3)] = 1
+	q, _ = ipLeastLoadedQueue(candidates, map[uint32]bool{0: true}, loads)
+	assert.For(ctx, "least loaded").That(q).Equals(VkQueue(2))
+}
+
+func TestCoalesceCopies(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlags(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT)
+	newCopy := func(level, layer, layerCount uint32, width uint32) VkBufferImageCopy {
+		return NewVkBufferImageCopy(a,
+			VkDeviceSize(0), 0, 0,
+			NewVkImageSubresourceLayers(a, color, level, layer, layerCount),
+			MakeVkOffset3D(a),
+			NewVkExtent3D(a, width, 4, 1),
+		)
+	}
+	prev := newCopy(1, 2, 2, 4)
+	for _, test := range []struct {
+		name     string
+		next     VkBufferImageCopy
+		dataSize uint64
+		expected bool
+	}{
+		{"next layer", newCopy(1, 4, 1, 4), 64, true},
+		{"padded data", newCopy(1, 4, 1, 4), 72, false},
+		{"other level", newCopy(0, 4, 1, 4), 64, false},
+		{"layer gap", newCopy(1, 5, 1, 4), 64, false},
+		{"other extent", newCopy(1, 4, 1, 2), 64, false},
+	} {
+		assert.For(ctx, test.name).That(ipCanCoalesceCopies(prev, test.next, test.dataSize, 64)).Equals(test.expected)
+	}
+}
+
+func TestHeapHasRoom(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		used, size, heapSize VkDeviceSize
+		expected             bool
+	}{
+		{0, 100, 1000, true},
+		{800, 100, 1000, true},
+		{800, 101, 1000, false},
+		{1000, 1, 1000, false},
+		{1000, 1, 0, true},
+	} {
+		assert.For(ctx, "used: %v, size: %v, heap size: %v", test.used, test.size, test.heapSize).
+			That(ipHeapHasRoom(test.used, test.size, test.heapSize)).Equals(test.expected)
+	}
+}
+
+func TestWithinBudget(t *testing.T) {
+	ctx := log.Testing(t)
+	assert.For(ctx, "no budget").That(ipWithinBudget(1<<40, 1<<40, 0)).Equals(true)
+	assert.For(ctx, "fits").That(ipWithinBudget(64, 64, 128)).Equals(true)
+	assert.For(ctx, "exceeds").That(ipWithinBudget(64, 65, 128)).Equals(false)
+
+	p := &imagePrimer{heapUsages: map[ipMemoryHeap]VkDeviceSize{
+		{dev: 1, index: 0}: 100,
+		{dev: 1, index: 1}: 20,
+		{dev: 2, index: 0}: 3,
+	}}
+	assert.For(ctx, "in use").That(p.stagingMemoryInUse()).Equals(VkDeviceSize(123))
+}
+
+func TestASTCDataToUncompressed(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	// Void-extent blocks of a constant color, bit 9 tells whether the color is
+	// in UNORM16 (LDR) or FP16 (HDR).
+	ldrBlock := []uint8{
+		0xFC, 0xFD, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0xFF, 0xFF, 0x00, 0x80, 0x00, 0x00, 0xFF, 0xFF, // (1.0, 0.5, 0.0, 1.0)
+	}
+	hdrBlock := []uint8{
+		0xFC, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0x00, 0x40, 0x00, 0x38, 0x00, 0x00, 0x00, 0x3C, // (2.0, 0.5, 0.0, 1.0)
+	}
+	extent := NewVkExtent3D(a, 1, 1, 1)
+
+	data, dstFmt, err := astcDataToUncompressed(ldrBlock, VkFormat_VK_FORMAT_ASTC_4x4_UNORM_BLOCK, extent)
+	if assert.For(ctx, "LDR err").ThatError(err).Succeeded() {
+		assert.For(ctx, "LDR dstFmt").That(dstFmt).Equals(VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+		assert.For(ctx, "LDR data").ThatSlice(data).Equals([]uint8{0xFF, 0x80, 0x00, 0xFF})
+	}
+
+	data, dstFmt, err = astcDataToUncompressed(hdrBlock, VkFormat_VK_FORMAT_ASTC_4x4_SFLOAT_BLOCK_EXT, extent)
+	if assert.For(ctx, "HDR err").ThatError(err).Succeeded() {
+		assert.For(ctx, "HDR dstFmt").That(dstFmt).Equals(VkFormat_VK_FORMAT_R32G32B32A32_SFLOAT)
+		assert.For(ctx, "HDR data").ThatSlice(data).Equals([]uint8{
+			0x00, 0x00, 0x00, 0x40,
+			0x00, 0x00, 0x00, 0x3F,
+			0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x80, 0x3F,
+		})
+	}
+
+	_, ok := astcDecodedFormat(VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+	assert.For(ctx, "R8G8B8A8_UNORM is ASTC").That(ok).Equals(false)
+	dstFmt, _ = astcDecodedFormat(VkFormat_VK_FORMAT_ASTC_8x8_SRGB_BLOCK)
+	assert.For(ctx, "SRGB dstFmt").That(dstFmt).Equals(VkFormat_VK_FORMAT_R8G8B8A8_SRGB)
+}
+
+func TestClampBlockExtent(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	// A 100x60 level of a sparse image with 64x64 sparse blocks.
+	block := NewVkExtent3D(a, 64, 64, 1)
+	for _, test := range []struct {
+		x, y                 int32
+		width, height, depth uint32
+	}{
+		{0, 0, 64, 60, 1},
+		{64, 0, 36, 60, 1},
+		{128, 0, 0, 60, 1},
+	} {
+		extent := ipClampBlockExtent(a, NewVkOffset3D(a, test.x, test.y, 0), block, 100, 60, 1)
+		assert.For(ctx, "width at (%v, %v)", test.x, test.y).That(extent.Width()).Equals(test.width)
+		assert.For(ctx, "height at (%v, %v)", test.x, test.y).That(extent.Height()).Equals(test.height)
+		assert.For(ctx, "depth at (%v, %v)", test.x, test.y).That(extent.Depth()).Equals(test.depth)
+	}
+}
+
+func TestPrimingStrategyForUsage(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT
+	depth := VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT
+	transDst := VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT
+	sampled := VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT
+	storage := VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT
+	transient := VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSIENT_ATTACHMENT_BIT
+	layoutOnly := VkImageUsageFlags(transient)
+	for _, test := range []struct {
+		name     string
+		usage    VkImageUsageFlagBits
+		strategy ipPrimingStrategy
+	}{
+		// Resolve targets are usually not TRANSFER_DST.
+		{"resolve target", color | sampled, ipPrimingStrategyRendering},
+		{"resolve target with transfer dst", color | sampled | transDst, ipPrimingStrategyBufferCopy},
+		{"depth with transfer dst", depth | transDst, ipPrimingStrategyRendering},
+		{"storage", storage | sampled, ipPrimingStrategyImageStore},
+		{"transient", color | transient, ipPrimingStrategyLayoutTransition},
+		{"sampled only", sampled, ""},
+	} {
+		strategy := ipPrimingStrategyForUsage(VkImageUsageFlags(test.usage), layoutOnly)
+		assert.For(ctx, "%v", test.name).That(strategy).Equals(test.strategy)
+	}
+}
+
+func TestDepthTransferSupported(t *testing.T) {
+	ctx := log.Testing(t)
+	depth := VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT
+	transDst := VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT
+	sampled := VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT
+	dstFeature := VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_TRANSFER_DST_BIT
+	srcFeature := VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_TRANSFER_SRC_BIT
+	attFeature := VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_DEPTH_STENCIL_ATTACHMENT_BIT
+	for _, test := range []struct {
+		name      string
+		usage     VkImageUsageFlagBits
+		features  VkFormatFeatureFlagBits
+		supported bool
+	}{
+		{"transfer dst supported", depth | transDst, attFeature | dstFeature, true},
+		{"transfer src only", depth | transDst, attFeature | srcFeature, false},
+		// Without VK_KHR_maintenance1, no transfer feature is reported.
+		{"no transfer features", depth | transDst, attFeature, false},
+		{"no transfer dst usage", depth | sampled, attFeature | dstFeature, false},
+		{"not depth", transDst | sampled, dstFeature, false},
+	} {
+		assert.For(ctx, "%v", test.name).That(ipDepthTransferSupported(
+			VkImageUsageFlags(test.usage), VkFormatFeatureFlags(test.features))).Equals(test.supported)
+	}
+}
+
+func TestLogContext(t *testing.T) {
+	ctx := log.Testing(t)
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	assert.For(ctx, "empty").That(ipLogContext{}.values() == nil).Equals(true)
+
+	img := ipImageLogContext(VkImage(1), "")
+	assert.For(ctx, "image").That(len(img.values())).Equals(1)
+	assert.For(ctx, "image").That(img.values()["image"]).Equals(VkImage(1))
+
+	rendering := ipImageLogContext(VkImage(1), ipPrimingStrategyRendering)
+	assert.For(ctx, "strategy").That(rendering.values()["strategy"]).Equals(ipPrimingStrategyRendering)
+
+	sub := rendering.at(depth, 2, 3).values()
+	assert.For(ctx, "subresource").That(len(sub)).Equals(5)
+	assert.For(ctx, "aspect").That(sub["aspect"]).Equals(depth)
+	assert.For(ctx, "layer").That(sub["layer"]).Equals(uint32(2))
+	assert.For(ctx, "level").That(sub["level"]).Equals(uint32(3))
+	// at does not modify the image log context.
+	assert.For(ctx, "unmodified").That(len(rendering.values())).Equals(2)
+}
+
+func TestSplitRenderJobs(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	assert.For(ctx, "no jobs").That(len(ipSplitRenderJobs(nil, ipMaxRenderCommandsPerTask))).Equals(0)
+
+	// A 256 layers x 12 levels array image.
+	jobs := []*ipRenderJob{}
+	for layer := uint32(0); layer < 256; layer++ {
+		for level := uint32(0); level < 12; level++ {
+			jobs = append(jobs, &ipRenderJob{renderTarget: ipRenderImage{aspect: color, layer: layer, level: level}})
+		}
+	}
+	batches := ipSplitRenderJobs(jobs, ipMaxRenderCommandsPerTask)
+	assert.For(ctx, "batches").That(len(batches) > 1).Equals(true)
+	split := []*ipRenderJob{}
+	for i, batch := range batches {
+		commands := 0
+		for _, job := range batch {
+			commands += ipRenderJobCommandCount(job)
+		}
+		assert.For(ctx, "commands of batch %v", i).That(commands <= ipMaxRenderCommandsPerTask).Equals(true)
+		split = append(split, batch...)
+	}
+	assert.For(ctx, "jobs in order").ThatSlice(split).Equals(jobs)
+
+	// A job exceeding the max number of commands is in a batch of its own.
+	stencilJob := &ipRenderJob{renderTarget: ipRenderImage{aspect: stencil}}
+	batches = ipSplitRenderJobs([]*ipRenderJob{jobs[0], stencilJob, jobs[1]}, ipRenderJobCommandCount(stencilJob)-1)
+	assert.For(ctx, "large job").That(len(batches)).Equals(3)
+	assert.For(ctx, "large job").ThatSlice(batches[1]).Equals([]*ipRenderJob{stencilJob})
+}
+
+func TestStagingImageCount(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name               string
+		srcElementSize     uint32
+		stagingElementSize uint32
+		count              uint32
+	}{
+		{"R8G8B8A8 in R32G32B32A32", 4, 16, 1},
+		{"R32G32B32A32 in R32G32B32A32", 16, 16, 1},
+		{"R64G64B64A64 in R32G32B32A32", 32, 16, 2},
+		{"R64G64B64A64 in R32", 32, 4, 8},
+		{"R64G64B64 in R32G32B32A32", 24, 16, 2},
+		{"unknown staging format", 4, 0, 0},
+	} {
+		assert.For(ctx, "%v", test.name).That(ipStagingImageCount(test.srcElementSize, test.stagingElementSize)).Equals(test.count)
+	}
+	// The widest formats in the default staging format are within the default
+	// max number of staging images.
+	assert.For(ctx, "default max").That(ipStagingImageCount(32, 16) <= defaultMaxStagingImagesPerAspect).Equals(true)
+}
+
+func TestResetKeepsAliveDeviceCaches(t *testing.T) {
+	ctx := log.Testing(t)
+	alive, gone := VkDevice(1), VkDevice(2)
+	isAlive := func(dev VkDevice) bool { return dev == alive }
+
+	rh := newImagePrimerRenderHandler(nil)
+	for _, dev := range []VkDevice{alive, gone} {
+		rh.shaders[ipRenderShaderInfo{dev: dev}] = NilShaderModuleObjectʳ
+		rh.pipelines[ipGfxPipelineInfo{fragShaderInfo: ipRenderShaderInfo{dev: dev}}] = NilGraphicsPipelineObjectʳ
+		rh.pipelineLayouts[ipRenderDescriptorSetInfo{dev: dev}] = NilPipelineLayoutObjectʳ
+		rh.descriptorSetLayouts[ipRenderDescriptorSetInfo{dev: dev}] = NilDescriptorSetLayoutObjectʳ
+	}
+	rh.reset(nil, isAlive)
+	assert.For(ctx, "render shaders").That(len(rh.shaders)).Equals(1)
+	assert.For(ctx, "render pipelines").That(len(rh.pipelines)).Equals(1)
+	assert.For(ctx, "render pipeline layouts").That(len(rh.pipelineLayouts)).Equals(1)
+	assert.For(ctx, "render descriptor set layouts").That(len(rh.descriptorSetLayouts)).Equals(1)
+	_, ok := rh.shaders[ipRenderShaderInfo{dev: alive}]
+	assert.For(ctx, "alive device render shader").That(ok).Equals(true)
+
+	sh := newImagePrimerStoreHandler(nil)
+	for _, dev := range []VkDevice{alive, gone} {
+		sh.shaders[ipImageStoreShaderInfo{dev: dev}] = NilShaderModuleObjectʳ
+		sh.pipelines[ipImageStoreShaderInfo{dev: dev}] = NilComputePipelineObjectʳ
+		sh.pipelineLayouts[dev] = VkPipelineLayout(dev)
+		sh.descPools[dev] = VkDescriptorPool(dev)
+		sh.descSetLayouts[dev] = VkDescriptorSetLayout(dev)
+	}
+	sh.pendingDescSets.reserve(alive)
+	sh.reset(nil, isAlive)
+	assert.For(ctx, "store shaders").That(len(sh.shaders)).Equals(1)
+	assert.For(ctx, "store pipelines").That(len(sh.pipelines)).Equals(1)
+	assert.For(ctx, "store pipeline layouts").That(sh.pipelineLayouts).DeepEquals(map[VkDevice]VkPipelineLayout{alive: VkPipelineLayout(alive)})
+	assert.For(ctx, "store descriptor pools").That(sh.descPools).DeepEquals(map[VkDevice]VkDescriptorPool{alive: VkDescriptorPool(alive)})
+	assert.For(ctx, "store descriptor set layouts").That(sh.descSetLayouts).DeepEquals(map[VkDevice]VkDescriptorSetLayout{alive: VkDescriptorSetLayout(alive)})
+	assert.For(ctx, "pending descriptor sets").That(sh.pendingDescSets[alive]).Equals(0)
+}
+
+func TestColorBlendAttachments(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+	attachment := MakeVkPipelineColorBlendAttachmentState(a)
+	attachment.SetColorWriteMask(0xf)
+	assert.For(ctx, "depth or stencil").That(ipColorBlendAttachments(0, attachment) == nil).Equals(true)
+	attachments := ipColorBlendAttachments(3, attachment)
+	assert.For(ctx, "color attachments").That(len(attachments)).Equals(3)
+	for i, att := range attachments {
+		assert.For(ctx, "color write mask %v", i).That(att.ColorWriteMask()).Equals(VkColorComponentFlags(0xf))
+	}
+}
+
+func TestStrategyQueues(t *testing.T) {
+	ctx := log.Testing(t)
+	graphics := VkQueueFlags(VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT | VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT | VkQueueFlagBits_VK_QUEUE_TRANSFER_BIT)
+	compute := VkQueueFlags(VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT | VkQueueFlagBits_VK_QUEUE_TRANSFER_BIT)
+	transfer := VkQueueFlags(VkQueueFlagBits_VK_QUEUE_TRANSFER_BIT)
+	dev := VkDevice(10)
+	queues := []ipQueueCandidate{
+		{queue: VkQueue(1), family: 0, device: dev, flags: graphics},
+		{queue: VkQueue(2), family: 1, device: dev, flags: compute},
+		{queue: VkQueue(3), family: 2, device: dev, flags: transfer},
+	}
+	for _, test := range []struct {
+		strategy ipPrimingStrategy
+		queue    VkQueue
+	}{
+		{ipPrimingStrategyBufferCopy, VkQueue(3)},
+		{ipPrimingStrategyImageCopy, VkQueue(3)},
+		{ipPrimingStrategyImageStore, VkQueue(2)},
+		{ipPrimingStrategyRendering, VkQueue(1)},
+		// Layout transitions prefer the last bound family.
+		{ipPrimingStrategyLayoutTransition, VkQueue(1)},
+	} {
+		candidates := ipDeviceQueueCandidates(queues, dev, ipStrategyQueueFlags(test.strategy), nil)
+		q, ok := ipLeastLoadedQueue(ipBestRankedQueues(candidates, test.strategy), map[uint32]bool{0: true}, nil)
+		if assert.For(ctx, "%v has a queue", test.strategy).That(ok).Equals(true) {
+			assert.For(ctx, "%v queue", test.strategy).That(q).Equals(test.queue)
+		}
+	}
+
+	// Without a dedicated transfer family, copies fall back to the async
+	// compute family.
+	candidates := ipDeviceQueueCandidates(queues[:2], dev, ipStrategyQueueFlags(ipPrimingStrategyBufferCopy), nil)
+	q, _ := ipLeastLoadedQueue(ipBestRankedQueues(candidates, ipPrimingStrategyBufferCopy), map[uint32]bool{0: true}, nil)
+	assert.For(ctx, "buffer copy without transfer family").That(q).Equals(VkQueue(2))
+	assert.For(ctx, "no candidates").That(len(ipBestRankedQueues(nil, ipPrimingStrategyBufferCopy))).Equals(0)
+}
+
+func TestSuballocate(t *testing.T) {
+	ctx := log.Testing(t)
+	align := ipStagingSuballocationAlignment
+	blockSize := 8 * align
+	offsets := []VkDeviceSize{}
+	next := VkDeviceSize(0)
+	for {
+		offset, ok := ipSuballocate(next, align+1, blockSize, align)
+		if !ok {
+			break
+		}
+		offsets = append(offsets, offset)
+		next = offset + align + 1
+	}
+	assert.For(ctx, "offsets").ThatSlice(offsets).Equals([]VkDeviceSize{0, 2 * align, 4 * align, 6 * align})
+	offset, ok := ipSuballocate(align, blockSize-align, blockSize, align)
+	assert.For(ctx, "fits till the end").That(ok).Equals(true)
+	assert.For(ctx, "offset till the end").That(offset).Equals(align)
+	_, ok = ipSuballocate(0, blockSize+1, blockSize, align)
+	assert.For(ctx, "larger than block").That(ok).Equals(false)
+}
+
+func TestImageStoreTransitionsOfPartiallyBoundImage(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	queue := VkQueue(1)
+	src := VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
+	// A sparse storage image with 2 layers and 2 levels, of which only the
+	// levels of layer 0 are bound to memory.
+	info := MakeImageInfo(a)
+	info.SetFlags(VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_SPARSE_BINDING_BIT |
+		VkImageCreateFlagBits_VK_IMAGE_CREATE_SPARSE_RESIDENCY_BIT))
+	info.SetUsage(VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT))
+	info.SetExtent(NewVkExtent3D(a, 64, 64, 1))
+	info.SetMipLevels(2)
+	info.SetArrayLayers(2)
+	layer := MakeSparseBoundImageLayerInfoʳ(a)
+	for level := uint32(0); level < 2; level++ {
+		block := MakeSparseBoundImageBlockInfoʳ(a)
+		block.SetExtent(NewVkExtent3D(a, 64>>level, 64>>level, 1))
+		block.SetMemory(1)
+		levelInfo := MakeSparseBoundImageLevelInfoʳ(a)
+		levelInfo.Blocks().Add(0, block)
+		layer.Levels().Add(level, levelInfo)
+	}
+	aspect := MakeSparseBoundImageAspectInfoʳ(a)
+	aspect.Layers().Add(0, layer)
+	img := MakeImageObjectʳ(a)
+	img.SetInfo(info)
+	img.SparseImageMemoryBindings().Add(color, aspect)
+
+	p := &imagePrimer{sb: &stateBuilder{ctx: ctx}}
+	bound := p.boundSubresources(img, nil)
+	assert.For(ctx, "bound subresources").That(len(bound)).Equals(2)
+	for layer := uint32(0); layer < 2; layer++ {
+		for level := uint32(0); level < 2; level++ {
+			sr := ipSubresource{aspect: color, layer: layer, level: level}
+			transition, ok := ipImageStoreTransition(bound, sr, queue, useSpecifiedLayout(src))
+			if layer != 0 {
+				assert.For(ctx, "unbound %+v transitioned", sr).That(ok).Equals(false)
+				continue
+			}
+			if assert.For(ctx, "bound %+v transitioned", sr).That(ok).Equals(true) {
+				assert.For(ctx, "%+v layer", sr).That(transition.baseArrayLayer).Equals(layer)
+				assert.For(ctx, "%+v level", sr).That(transition.baseMipLevel).Equals(level)
+				assert.For(ctx, "%+v old layout", sr).That(transition.oldLayout).Equals(src)
+				assert.For(ctx, "%+v new layout", sr).That(transition.newLayout).Equals(VkImageLayout_VK_IMAGE_LAYOUT_GENERAL)
+				assert.For(ctx, "%+v queue", sr).That(transition.newQueue).Equals(queue)
+			}
+		}
+	}
+}
+
+func TestReadConcurrently(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, workers := range []int{0, 1, 3, 100} {
+		var mutex sync.Mutex
+		running, maxRunning := 0, 0
+		read := make([]int, 20)
+		ipReadConcurrently(len(read), workers, func(i int) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			read[i]++
+			mutex.Unlock()
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		})
+		for i, n := range read {
+			assert.For(ctx, "workers: %v, reads of %v", workers, i).That(n).Equals(1)
+		}
+		if workers > 0 {
+			assert.For(ctx, "workers: %v, max running", workers).That(maxRunning <= workers).Equals(true)
+		}
+	}
+	ipReadConcurrently(0, 4, func(i int) {
+		assert.For(ctx, "no reads").That(i).Equals(-1)
+	})
+}
+
+func TestRegionData(t *testing.T) {
+	ctx := log.Testing(t)
+	// A 4x4x2 level with 2 byte elements, whose each element is its index.
+	levelExtent := [3]uint32{4, 4, 2}
+	data := make([]uint8, 0, 4*4*2*2)
+	for i := 0; i < 4*4*2; i++ {
+		data = append(data, uint8(i), 0)
+	}
+	for _, test := range []struct {
+		name     string
+		offset   [3]uint32
+		extent   [3]uint32
+		elements []uint8
+	}{
+		{"top left", [3]uint32{0, 0, 0}, [3]uint32{2, 2, 1}, []uint8{0, 1, 4, 5}},
+		{"bottom right", [3]uint32{2, 2, 0}, [3]uint32{2, 2, 1}, []uint8{10, 11, 14, 15}},
+		{"row", [3]uint32{1, 3, 0}, [3]uint32{3, 1, 1}, []uint8{13, 14, 15}},
+		{"second slice", [3]uint32{3, 0, 1}, [3]uint32{1, 2, 1}, []uint8{19, 23}},
+		{"across slices", [3]uint32{0, 1, 0}, [3]uint32{1, 1, 2}, []uint8{4, 20}},
+	} {
+		region, err := ipRegionData(data, levelExtent, 2, test.offset, test.extent)
+		if assert.For(ctx, "%v", test.name).ThatError(err).Succeeded() {
+			expected := []uint8{}
+			for _, e := range test.elements {
+				expected = append(expected, e, 0)
+			}
+			assert.For(ctx, "%v data", test.name).ThatSlice(region).Equals(expected)
+		}
+	}
+	_, err := ipRegionData(data, levelExtent, 2, [3]uint32{3, 0, 0}, [3]uint32{2, 1, 1})
+	assert.For(ctx, "out of level").ThatError(err).Failed()
+	_, err = ipRegionData(data, levelExtent, 2, [3]uint32{0, 0, 0}, [3]uint32{0, 1, 1})
+	assert.For(ctx, "empty region").ThatError(err).Failed()
+	_, err = ipRegionData(data[:10], levelExtent, 2, [3]uint32{0, 0, 0}, [3]uint32{1, 1, 1})
+	assert.For(ctx, "short data").ThatError(err).Failed()
+}
+
+func TestCheckStagingCoverage(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name               string
+		srcElementSize     uint32
+		stagingElementSize uint32
+		count              uint32
+		ok                 bool
+	}{
+		{"R8G8B8A8 in R32G32B32A32", 4, 16, 1, true},
+		{"R32G32B32A32 in R32G32B32A32", 16, 16, 1, true},
+		{"R64G64B64A64 in R32G32B32A32", 32, 16, 2, true},
+		{"R64G64B64 in R32G32B32A32", 24, 16, 2, true},
+		{"R16G16B16 in R32G32", 6, 8, 1, true},
+		{"R64G64B64 in R32", 24, 4, 6, true},
+		{"R64G64B64 in a single R32G32B32A32", 24, 16, 1, false},
+		{"R64G64B64 in R32G32B32A32 with a spare image", 24, 16, 3, false},
+		{"no staging image", 4, 16, 0, false},
+		{"unknown staging format", 4, 0, 1, false},
+	} {
+		err := ipCheckStagingCoverage(test.srcElementSize, test.stagingElementSize, test.count)
+		if test.ok {
+			assert.For(ctx, "%v", test.name).ThatError(err).Succeeded()
+		} else {
+			assert.For(ctx, "%v", test.name).ThatError(err).Failed()
+		}
+		if count := ipStagingImageCount(test.srcElementSize, test.stagingElementSize); count != 0 {
+			assert.For(ctx, "%v staging image count", test.name).ThatError(
+				ipCheckStagingCoverage(test.srcElementSize, test.stagingElementSize, count)).Succeeded()
+		}
+	}
+}
+
+func TestSpecConstants(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	c, err := newIPSpecConstants(8, 0x01020304)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "data").ThatSlice(c.data(device.LittleEndian)).Equals([]uint8{
+		0x08, 0x00, 0x00, 0x00,
+		0x04, 0x03, 0x02, 0x01,
+	})
+	assert.For(ctx, "big endian data").ThatSlice(c.data(device.BigEndian)).Equals([]uint8{
+		0x00, 0x00, 0x00, 0x08,
+		0x01, 0x02, 0x03, 0x04,
+	})
+	entries := c.mapEntries(a)
+	assert.For(ctx, "len(entries)").That(len(entries)).Equals(2)
+	for i, e := range entries {
+		assert.For(ctx, "entry %v constantID", i).That(e.ConstantID()).Equals(uint32(i))
+		assert.For(ctx, "entry %v offset", i).That(e.Offset()).Equals(uint32(i * 4))
+		assert.For(ctx, "entry %v size", i).That(e.Size()).Equals(memory.Size(4))
+	}
+
+	empty, _ := newIPSpecConstants()
+	assert.For(ctx, "empty data").That(len(empty.data(device.LittleEndian))).Equals(0)
+	_, err = newIPSpecConstants(1, 2, 3, 4, 5)
+	assert.For(ctx, "too many constants").ThatError(err).Failed()
+}
+
+func TestImageStoreSpecConstants(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		format   VkFormat
+		imgType  VkImageType
+		expected []uint32
+	}{
+		{VkFormat_VK_FORMAT_R8G8_UNORM, VkImageType_VK_IMAGE_TYPE_2D, []uint32{8, 8, 1, 2}},
+		{VkFormat_VK_FORMAT_R32G32B32A32_UINT, VkImageType_VK_IMAGE_TYPE_1D, []uint32{64, 1, 1, 4}},
+		{VkFormat_VK_FORMAT_R32_SFLOAT, VkImageType_VK_IMAGE_TYPE_3D, []uint32{4, 4, 4, 1}},
+	} {
+		c, err := ipImageStoreSpecConstants(test.format, test.imgType)
+		if assert.For(ctx, "%v %v", test.format, test.imgType).ThatError(err).Succeeded() {
+			assert.For(ctx, "%v %v constants", test.format, test.imgType).ThatSlice(c.values[:c.count]).Equals(test.expected)
+		}
+	}
+
+	// The pipelines storing to formats with different channel counts share the
+	// shader module of the same formats.
+	shader := ipImageStoreShaderInfo{outputFormat: VkFormat_VK_FORMAT_R8G8_UINT, imgType: VkImageType_VK_IMAGE_TYPE_2D}
+	withConstants := shader
+	withConstants.specConstants, _ = ipImageStoreSpecConstants(VkFormat_VK_FORMAT_R8G8_UINT, VkImageType_VK_IMAGE_TYPE_2D)
+	assert.For(ctx, "spirv key").That(withConstants.spirvKey()).Equals(shader.spirvKey())
+
+	// The work groups at the end of the store extent are partially covered.
+	assert.For(ctx, "group counts").That(ipWorkGroupCounts([3]uint32{17, 8, 1}, [3]uint32{8, 8, 1})).Equals([3]uint32{3, 1, 1})
+}
+
+func TestDeviceQueueCandidates(t *testing.T) {
+	ctx := log.Testing(t)
+	graphics := VkQueueFlags(VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT | VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT)
+	compute := VkQueueFlags(VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT)
+	// Two logical devices, priming images of both with the same loads.
+	queues := []ipQueueCandidate{
+		{queue: VkQueue(1), family: 0, device: VkDevice(10), flags: graphics},
+		{queue: VkQueue(2), family: 1, device: VkDevice(10), flags: compute},
+		{queue: VkQueue(3), family: 0, device: VkDevice(20), flags: graphics},
+		{queue: VkQueue(4), family: 0, device: VkDevice(20), flags: graphics},
+	}
+	deviceOf := map[VkQueue]VkDevice{}
+	for _, q := range queues {
+		deviceOf[q.queue] = q.device
+	}
+	loads := map[VkQueue]int{}
+	for i, dev := range []VkDevice{10, 20, 10, 20, 20, 10} {
+		candidates := ipDeviceQueueCandidates(queues, dev, VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT, nil)
+		q, ok := ipLeastLoadedQueue(candidates, nil, loads)
+		if assert.For(ctx, "image %v has a queue", i).That(ok).Equals(true) {
+			assert.For(ctx, "device of queue of image %v", i).That(deviceOf[q]).Equals(dev)
+			loads[q]++
+		}
+	}
+	assert.For(ctx, "loads").ThatMap(loads).Equals(map[VkQueue]int{1: 2, 2: 1, 3: 2, 4: 1})
+
+	candidates := ipDeviceQueueCandidates(queues, VkDevice(10), VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT, nil)
+	assert.For(ctx, "graphics candidates").That(len(candidates)).Equals(1)
+	candidates = ipDeviceQueueCandidates(queues, VkDevice(10), VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT, map[uint32]bool{1: true})
+	if assert.For(ctx, "shared family candidates").That(len(candidates)).Equals(1) {
+		assert.For(ctx, "shared family queue").That(candidates[0].queue).Equals(VkQueue(2))
+	}
+	candidates = ipDeviceQueueCandidates(queues, VkDevice(30), VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT, nil)
+	assert.For(ctx, "unknown device candidates").That(len(candidates)).Equals(0)
+}
+
+func TestDefaultRenderDepthState(t *testing.T) {
+	ctx := log.Testing(t)
+	depth := ipDefaultRenderDepthState(VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT)
+	assert.For(ctx, "depth").That(depth).Equals(ipRenderDepthState{
+		testEnable: true, writeEnable: true, compareOp: VkCompareOp_VK_COMPARE_OP_ALWAYS})
+	color := ipDefaultRenderDepthState(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT)
+	assert.For(ctx, "color test").That(color.testEnable).Equals(false)
+	assert.For(ctx, "color write").That(color.writeEnable).Equals(false)
+}
+
+func TestDstLayout(t *testing.T) {
+	ctx := log.Testing(t)
+	fallback := ipAttachmentLayout(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT)
+	assert.For(ctx, "fallback").That(fallback).Equals(VkImageLayout_VK_IMAGE_LAYOUT_COLOR_ATTACHMENT_OPTIMAL)
+	for _, test := range []struct {
+		layout   VkImageLayout
+		expected VkImageLayout
+	}{
+		// Swapchain images are left in PRESENT_SRC_KHR after being rendered to.
+		{VkImageLayout_VK_IMAGE_LAYOUT_PRESENT_SRC_KHR, VkImageLayout_VK_IMAGE_LAYOUT_PRESENT_SRC_KHR},
+		{VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL, VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL},
+		{VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED, fallback},
+		{VkImageLayout_VK_IMAGE_LAYOUT_PREINITIALIZED, fallback},
+	} {
+		assert.For(ctx, "%v", test.layout).That(ipDstLayout(test.layout, fallback)).Equals(test.expected)
+	}
+	assert.For(ctx, "depth attachment layout").That(
+		ipAttachmentLayout(VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT)).Equals(
+		VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_STENCIL_ATTACHMENT_OPTIMAL)
+}
+
+func TestCheckSourceSubresource(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	extent := func(w, h, d uint64) byteSizeAndExtent {
+		return byteSizeAndExtent{width: w, height: h, depth: d}
+	}
+	dst := ipSubresource{aspect: color, layer: 0, level: 1}
+	for _, test := range []struct {
+		name      string
+		src       ipSubresource
+		srcExtent byteSizeAndExtent
+		ok        bool
+	}{
+		{"same extent", ipSubresource{aspect: color, layer: 1, level: 2}, extent(4, 4, 1), true},
+		{"other aspect", ipSubresource{aspect: depth, layer: 0, level: 2}, extent(4, 4, 1), false},
+		{"layer out of range", ipSubresource{aspect: color, layer: 2, level: 2}, extent(4, 4, 1), false},
+		{"level out of range", ipSubresource{aspect: color, layer: 0, level: 3}, extent(4, 4, 1), false},
+		// Scaling would require a blit, which is not supported.
+		{"other extent", ipSubresource{aspect: color, layer: 0, level: 0}, extent(8, 8, 1), false},
+	} {
+		err := ipCheckSourceSubresource(dst, test.src, extent(4, 4, 1), test.srcExtent, 2, 3)
+		if test.ok {
+			assert.For(ctx, test.name).ThatError(err).Succeeded()
+		} else {
+			assert.For(ctx, test.name).ThatError(err).Failed()
+		}
+	}
+}
+
+func TestImageStoreDescriptorTypes(t *testing.T) {
+	ctx := log.Testing(t)
+	// The descriptors written by the store handler must match the store
+	// descriptor set layout.
+	for _, write := range []struct {
+		binding  uint32
+		descType VkDescriptorType
+	}{
+		{ipImageStoreOutputImageBinding, VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE},
+		{ipImageStoreInputImageBinding, VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE},
+	} {
+		assert.For(ctx, "binding %v", write.binding).ThatError(
+			ipCheckDescriptorType(ipImageStoreDescriptorTypes, write.binding, write.descType)).Succeeded()
+	}
+	assert.For(ctx, "texel buffer input").ThatError(
+		ipCheckDescriptorType(ipImageStoreDescriptorTypes, ipImageStoreInputImageBinding,
+			VkDescriptorType_VK_DESCRIPTOR_TYPE_UNIFORM_TEXEL_BUFFER)).Failed()
+	assert.For(ctx, "unknown binding").ThatError(
+		ipCheckDescriptorType(ipImageStoreDescriptorTypes, 3,
+			VkDescriptorType_VK_DESCRIPTOR_TYPE_STORAGE_IMAGE)).Failed()
+}
+
+func TestBlockTexelView(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		blockSize uint32
+		expected  VkFormat
+		ok        bool
+	}{
+		{8, VkFormat_VK_FORMAT_R32G32_UINT, true},        // e.g. BC1, ETC2 RGB
+		{16, VkFormat_VK_FORMAT_R32G32B32A32_UINT, true}, // e.g. BC3, ASTC
+		{4, VkFormat_VK_FORMAT_UNDEFINED, false},
+	} {
+		f, ok := ipBlockTexelViewFormat(test.blockSize)
+		assert.For(ctx, "block size %v", test.blockSize).That(ok).Equals(test.ok)
+		assert.For(ctx, "block size %v format", test.blockSize).That(f).Equals(test.expected)
+	}
+
+	for _, test := range []struct {
+		name          string
+		width, height uint32
+		mipLevels     uint32
+		expected      bool
+	}{
+		{"power of two", 64, 32, 7, true},
+		{"single level", 20, 12, 1, true},
+		// Level 1 is 10x6 texels, i.e. 3x2 blocks, but 5x3 blocks halved is 2x1.
+		{"not a multiple of blocks", 20, 12, 2, false},
+	} {
+		assert.For(ctx, test.name).That(
+			ipBlockTexelLevelsMatch(test.width, test.height, 4, 4, test.mipLevels)).Equals(test.expected)
+	}
+}
+
+func TestUncoveredSubresources(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	bound := map[ipSubresource]bool{}
+	for layer := uint32(0); layer < 2; layer++ {
+		for level := uint32(0); level < 2; level++ {
+			bound[ipSubresource{aspect: color, layer: layer, level: level}] = true
+		}
+	}
+	covered := map[ipSubresource]bool{
+		{aspect: color, layer: 0, level: 0}: true,
+		{aspect: color, layer: 0, level: 1}: true,
+		// Covered subresources which are not bound are ignored.
+		{aspect: color, layer: 2, level: 0}: true,
+	}
+	assert.For(ctx, "uncovered").ThatSlice(ipUncoveredSubresources(bound, covered)).Equals([]ipSubresource{
+		{aspect: color, layer: 1, level: 0},
+		{aspect: color, layer: 1, level: 1},
+	})
+	assert.For(ctx, "all covered").ThatSlice(ipUncoveredSubresources(bound, bound)).IsEmpty()
+}
+
+func TestPrimingPreservesChannelOrder(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	// The views created for priming never swizzle the channels.
+	m := ipIdentityComponentMapping(a)
+	for name, swizzle := range map[string]VkComponentSwizzle{"r": m.R(), "g": m.G(), "b": m.B(), "a": m.A()} {
+		assert.For(ctx, "swizzle %v", name).That(swizzle).Equals(VkComponentSwizzle_VK_COMPONENT_SWIZZLE_IDENTITY)
+	}
+
+	// The staging data is unpacked by channel, so a BGRA texel is staged as
+	// RGBA, and rendered back to the B, G, R and A channels of the image in
+	// its stored order.
+	sf, _ := getImageFormatFromVulkanFormat(VkFormat_VK_FORMAT_B8G8R8A8_UINT)
+	df, _ := getImageFormatFromVulkanFormat(VkFormat_VK_FORMAT_R32G32B32A32_UINT)
+	r, err := unpackData(ctx, []uint8{0x11, 0x22, 0x33, 0x44}, sf, df)
+	if assert.For(ctx, "unpack BGRA").ThatError(err).Succeeded() {
+		assert.For(ctx, "unpacked BGRA").ThatSlice(r).Equals([]uint8{
+			0x33, 0x00, 0x00, 0x00,
+			0x22, 0x00, 0x00, 0x00,
+			0x11, 0x00, 0x00, 0x00,
+			0x44, 0x00, 0x00, 0x00,
+		})
+	}
+}
+
+func TestStagingUsage(t *testing.T) {
+	ctx := log.Testing(t)
+	transferDst := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
+	for _, test := range []struct {
+		strategy ipPrimingStrategy
+		expected VkImageUsageFlags
+	}{
+		{ipPrimingStrategyRendering, transferDst | VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_INPUT_ATTACHMENT_BIT)},
+		{ipPrimingStrategyImageStore, transferDst | VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)},
+		{ipPrimingStrategyBufferCopy, 0},
+	} {
+		usage := ipStagingUsage(test.strategy)
+		assert.For(ctx, "%v", test.strategy).That(usage).Equals(test.expected)
+		assert.For(ctx, "%v sampled", test.strategy).That(
+			usage & VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT)).Equals(VkImageUsageFlags(0))
+	}
+}
+
+func TestHashSubresources(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	data := []uint8{0x01, 0x02, 0x03, 0x04}
+	hash := ipHashSubresources(map[ipSubresource][]uint8{
+		{aspect: color, layer: 0, level: 0}: data,
+		{aspect: color, layer: 1, level: 0}: data,
+	})
+	assert.For(ctx, "same data").That(ipHashSubresources(map[ipSubresource][]uint8{
+		{aspect: color, layer: 1, level: 0}: data,
+		{aspect: color, layer: 0, level: 0}: data,
+	})).Equals(hash)
+	assert.For(ctx, "different subresource").That(ipHashSubresources(map[ipSubresource][]uint8{
+		{aspect: color, layer: 0, level: 0}: data,
+		{aspect: color, layer: 0, level: 1}: data,
+	}) == hash).Equals(false)
+	assert.For(ctx, "different data").That(ipHashSubresources(map[ipSubresource][]uint8{
+		{aspect: color, layer: 0, level: 0}: data,
+		{aspect: color, layer: 1, level: 0}: {0x01, 0x02, 0x03, 0x05},
+	}) == hash).Equals(false)
+
+	key := ipContentKey{format: VkFormat_VK_FORMAT_R8G8B8A8_UNORM, width: 4, height: 4, depth: 1, mipLevels: 1, arrayLayers: 2, hash: hash}
+	otherFormat := key
+	otherFormat.format = VkFormat_VK_FORMAT_R8G8B8A8_SRGB
+	assert.For(ctx, "different format").That(key == otherFormat).Equals(false)
+}
+
+func TestDedupContentByImageCopy(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	dev, queue := VkDevice(1), VkQueue(2)
+	src, dst, other := VkImage(10), VkImage(11), VkImage(12)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	q := MakeQueueObjectʳ(a)
+	q.SetDevice(dev)
+	q.SetFamily(0)
+	q.SetVulkanHandle(queue)
+	GetState(oldState).Queues().Add(queue, q)
+
+	newInfo := func(imageType VkImageType) ImageInfo {
+		info := MakeImageInfo(a)
+		info.SetImageType(imageType)
+		info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+		info.SetExtent(NewVkExtent3D(a, 4, 4, 1))
+		info.SetMipLevels(2)
+		info.SetArrayLayers(3)
+		info.SetSamples(VkSampleCountFlagBits_VK_SAMPLE_COUNT_1_BIT)
+		info.SetTiling(VkImageTiling_VK_IMAGE_TILING_OPTIMAL)
+		info.SetUsage(VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_SRC_BIT |
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT))
+		return info
+	}
+	images := map[VkImage]ImageObjectʳ{}
+	for handle, imageType := range map[VkImage]VkImageType{
+		src:   VkImageType_VK_IMAGE_TYPE_2D,
+		dst:   VkImageType_VK_IMAGE_TYPE_2D,
+		other: VkImageType_VK_IMAGE_TYPE_3D,
+	} {
+		img := MakeImageObjectʳ(a)
+		img.SetDevice(dev)
+		img.SetVulkanHandle(handle)
+		img.SetInfo(newInfo(imageType))
+		GetState(newState).Images().Add(handle, img)
+		images[handle] = img
+	}
+
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	p := &imagePrimer{
+		sb:             sb,
+		replayPlans:    map[VkImage]ipPrimingPlan{dst: {Image: dst, QueueFamily: 0}},
+		contentKeys:    map[VkImage]ipContentKey{},
+		primedContents: map[ipContentKey]VkImage{},
+	}
+	var hash [sha256.Size]byte
+	hash[0] = 1
+	key := ipContentKeyOf(dev, images[src].Info(), hash)
+	assert.For(ctx, "same content key").That(ipContentKeyOf(dev, images[dst].Info(), hash)).Equals(key)
+	otherKey := ipContentKeyOf(dev, images[other].Info(), hash)
+	assert.For(ctx, "2D and 3D content keys").That(otherKey == key).Equals(false)
+
+	p.recordContent(src, key)
+	_, ok := p.newPrimeableImageDataByImageCopy(images[dst], key, []VkImageAspectFlagBits{color})
+	assert.For(ctx, "source not primed yet").That(ok).Equals(false)
+	p.primedContent(src)
+
+	_, ok = p.newPrimeableImageDataByImageCopy(images[other], otherKey, []VkImageAspectFlagBits{color})
+	assert.For(ctx, "3D image primed by copy").That(ok).Equals(false)
+	_, ok = p.newPrimeableImageDataByImageCopy(images[src], key, []VkImageAspectFlagBits{color})
+	assert.For(ctx, "source primed by copy from itself").That(ok).Equals(false)
+
+	primeable, ok := p.newPrimeableImageDataByImageCopy(images[dst], key, []VkImageAspectFlagBits{color})
+	if !assert.For(ctx, "primed by copy").That(ok).Equals(true) {
+		return
+	}
+	byCopy := primeable.(*ipPrimeableByImageCopy)
+	assert.For(ctx, "copy source").That(byCopy.src).Equals(src)
+	assert.For(ctx, "copy queue").That(byCopy.primingQueue()).Equals(queue)
+	regions := byCopy.regions(images[dst])
+	if assert.For(ctx, "len(regions)").That(len(regions)).Equals(2) {
+		for level, region := range regions {
+			assert.For(ctx, "region %v level", level).That(region.DstSubresource().MipLevel()).Equals(uint32(level))
+			assert.For(ctx, "region %v layers", level).That(region.DstSubresource().LayerCount()).Equals(uint32(3))
+			assert.For(ctx, "region %v width", level).That(region.Extent().Width()).Equals(uint32(4 >> uint(level)))
+		}
+	}
+}
+
+func TestDedupContentByImageBlit(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	dev, queue := VkDevice(1), VkQueue(2)
+	src, dst := VkImage(10), VkImage(11)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	sampled := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT)
+	storage := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	q := MakeQueueObjectʳ(a)
+	q.SetDevice(dev)
+	q.SetFamily(0)
+	q.SetVulkanHandle(queue)
+	GetState(oldState).Queues().Add(queue, q)
+
+	newInfo := func(format VkFormat, usage VkImageUsageFlags) ImageInfo {
+		info := MakeImageInfo(a)
+		info.SetImageType(VkImageType_VK_IMAGE_TYPE_2D)
+		info.SetFmt(format)
+		info.SetExtent(NewVkExtent3D(a, 4, 4, 1))
+		info.SetMipLevels(2)
+		info.SetArrayLayers(3)
+		info.SetSamples(VkSampleCountFlagBits_VK_SAMPLE_COUNT_1_BIT)
+		info.SetTiling(VkImageTiling_VK_IMAGE_TILING_OPTIMAL)
+		info.SetUsage(usage)
+		return info
+	}
+	unorm := VkFormat_VK_FORMAT_R8G8B8A8_UNORM
+	usage := sampled | storage
+	for _, test := range []struct {
+		name     string
+		src, dst ImageInfo
+		aspects  []VkImageAspectFlagBits
+		expected bool
+	}{
+		{"unorm", newInfo(unorm, usage), newInfo(unorm, usage), []VkImageAspectFlagBits{color}, true},
+		{"uint", newInfo(VkFormat_VK_FORMAT_R32G32_UINT, usage), newInfo(VkFormat_VK_FORMAT_R32G32_UINT, usage), []VkImageAspectFlagBits{color}, true},
+		{"float", newInfo(VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32, usage), newInfo(VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32, usage), []VkImageAspectFlagBits{color}, true},
+		{"source not sampled", newInfo(unorm, storage), newInfo(unorm, usage), []VkImageAspectFlagBits{color}, false},
+		{"destination not storage", newInfo(unorm, usage), newInfo(unorm, sampled), []VkImageAspectFlagBits{color}, false},
+		{"srgb", newInfo(VkFormat_VK_FORMAT_R8G8B8A8_SRGB, usage), newInfo(VkFormat_VK_FORMAT_R8G8B8A8_SRGB, usage), []VkImageAspectFlagBits{color}, false},
+		{"snorm", newInfo(VkFormat_VK_FORMAT_R8G8B8A8_SNORM, usage), newInfo(VkFormat_VK_FORMAT_R8G8B8A8_SNORM, usage), []VkImageAspectFlagBits{color}, false},
+		{"not in the shaders", newInfo(VkFormat_VK_FORMAT_R5G6B5_UNORM_PACK16, usage), newInfo(VkFormat_VK_FORMAT_R5G6B5_UNORM_PACK16, usage), []VkImageAspectFlagBits{color}, false},
+		{"depth", newInfo(VkFormat_VK_FORMAT_D32_SFLOAT, usage), newInfo(VkFormat_VK_FORMAT_D32_SFLOAT, usage), []VkImageAspectFlagBits{VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT}, false},
+	} {
+		assert.For(ctx, "%v blit usable", test.name).That(ipImageBlitUsable(test.src, test.dst, test.aspects)).Equals(test.expected)
+	}
+
+	images := map[VkImage]ImageObjectʳ{}
+	for _, handle := range []VkImage{src, dst} {
+		img := MakeImageObjectʳ(a)
+		img.SetDevice(dev)
+		img.SetVulkanHandle(handle)
+		img.SetInfo(newInfo(unorm, usage))
+		GetState(newState).Images().Add(handle, img)
+		images[handle] = img
+	}
+
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	p := &imagePrimer{
+		sb:             sb,
+		replayPlans:    map[VkImage]ipPrimingPlan{dst: {Image: dst, QueueFamily: 0}},
+		contentKeys:    map[VkImage]ipContentKey{},
+		primedContents: map[ipContentKey]VkImage{},
+	}
+	var hash [sha256.Size]byte
+	key := ipContentKeyOf(dev, images[src].Info(), hash)
+	p.recordContent(src, key)
+	p.primedContent(src)
+
+	primeable, ok := p.newPrimeableImageDataByImageCopy(images[dst], key, []VkImageAspectFlagBits{color})
+	if !assert.For(ctx, "primed by blit").That(ok).Equals(true) {
+		return
+	}
+	byBlit, ok := primeable.(*ipPrimeableByImageBlit)
+	if !assert.For(ctx, "primeable is a blit").That(ok).Equals(true) {
+		return
+	}
+	assert.For(ctx, "blit source").That(byBlit.src).Equals(src)
+	assert.For(ctx, "blit queue").That(byBlit.primingQueue()).Equals(queue)
+	assert.For(ctx, "blit plan strategy").That(p.planOf(dst, byBlit).Strategy).Equals(ipPrimingStrategyImageBlit)
+	subresources := byBlit.subresources(images[dst])
+	if !assert.For(ctx, "len(subresources)").That(len(subresources)).Equals(2 * 3) {
+		return
+	}
+
+	// The blit jobs sample the source view, which is rejected if the image of
+	// the view lacks SAMPLED usage.
+	newView := func(img ImageObjectʳ) ImageViewObjectʳ {
+		view := MakeImageViewObjectʳ(a)
+		view.SetImage(img)
+		return view
+	}
+	job := byBlit.blitJob(images[dst], ipSubresource{aspect: color, layer: 2, level: 1}, newView(images[src]), newView(images[dst]))
+	assert.For(ctx, "sampled input").That(job.sampledInput).Equals(true)
+	assert.For(ctx, "job extent").That(job.extent.Width()).Equals(uint32(2))
+	assert.For(ctx, "sampled input check").ThatError(ipCheckSampledInput(job)).Succeeded()
+	notSampled := MakeImageObjectʳ(a)
+	notSampled.SetInfo(newInfo(unorm, storage))
+	job.input = newView(notSampled)
+	assert.For(ctx, "sampled input check without SAMPLED usage").ThatError(ipCheckSampledInput(job)).Failed()
+	job.sampledInput = false
+	assert.For(ctx, "storage input check").ThatError(ipCheckSampledInput(job)).Succeeded()
+}
+
+func TestShouldFlushPrimingWorks(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		queued, batchSize int
+		used, budget      VkDeviceSize
+		expected          bool
+	}{
+		{1, 4, 0, 0, false},
+		{4, 4, 0, 0, true},
+		{5, 4, 0, 0, true},
+		{1, 4, 1024, 0, false},
+		{1, 4, 512, 1024, false},
+		{1, 4, 1024, 1024, true},
+	} {
+		assert.For(ctx, "%v queued of %v, %v used of %v", test.queued, test.batchSize, test.used, test.budget).That(
+			ipShouldFlushPrimingWorks(test.queued, test.batchSize, test.used, test.budget)).Equals(test.expected)
+	}
+}
+
+func TestCheckCopyAspects(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	depthStencil := VkImageAspectFlags(depth | stencil)
+	assert.For(ctx, "color to color").ThatError(
+		ipCheckCopyAspects(VkImageAspectFlags(color), color, color, VkImageAspectFlags(color))).Succeeded()
+	assert.For(ctx, "stencil to color staging").ThatError(
+		ipCheckCopyAspects(depthStencil, stencil, color, VkImageAspectFlags(color), VkImageAspectFlags(color))).Succeeded()
+	assert.For(ctx, "missing src aspect").ThatError(
+		ipCheckCopyAspects(VkImageAspectFlags(color), stencil, color, VkImageAspectFlags(color))).Failed()
+	assert.For(ctx, "stencil dst for color image").ThatError(
+		ipCheckCopyAspects(depthStencil, stencil, stencil, VkImageAspectFlags(color))).Failed()
+	assert.For(ctx, "one mismatching dst").ThatError(
+		ipCheckCopyAspects(depthStencil, depth, depth, depthStencil, VkImageAspectFlags(color))).Failed()
+}
+
+func TestPendingDescSetsAcrossStoreJobs(t *testing.T) {
+	ctx := log.Testing(t)
+	dev, other := VkDevice(1), VkDevice(2)
+	pending := ipPendingDescSets{}
+	// The store jobs not executed yet, whose descriptor sets are released when
+	// the scratch resources are flushed.
+	notExecuted := 0
+	flushes := 0
+	for i := 0; i < 3*ipImageStoreMaxDescSets; i++ {
+		if pending.reserve(dev) {
+			flushes++
+			for ; notExecuted > 0; notExecuted-- {
+				pending.release(dev)
+			}
+		}
+		notExecuted++
+		assert.For(ctx, "store job %v within pool", i).That(pending[dev] <= ipImageStoreMaxDescSets).Equals(true)
+	}
+	assert.For(ctx, "flushes").That(flushes).Equals(2)
+	assert.For(ctx, "pending").That(pending[dev]).Equals(ipImageStoreMaxDescSets)
+	assert.For(ctx, "other device").That(pending.reserve(other)).Equals(false)
+	pending.release(other)
+	pending.release(other)
+	assert.For(ctx, "released other device").That(pending[other]).Equals(0)
+}
+
+func TestCheckStagingFormat(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name           string
+		format         VkFormat
+		srcChannels    int
+		srcElementSize uint32
+		valid          bool
+	}{
+		{"rgba8 in rgba32", VkFormat_VK_FORMAT_R32G32B32A32_UINT, 4, 4, true},
+		{"rg16 in rg32", VkFormat_VK_FORMAT_R32G32_UINT, 2, 4, true},
+		{"depth in r32", VkFormat_VK_FORMAT_R32_UINT, 1, 4, true},
+		{"depth in rg32", VkFormat_VK_FORMAT_R32G32_UINT, 1, 4, true},
+		{"rgba64 split in rgba32", VkFormat_VK_FORMAT_R32G32B32A32_UINT, 4, 32, true},
+		{"rgba8 in rg32", VkFormat_VK_FORMAT_R32G32_UINT, 4, 4, false},
+		{"rg32 sfloat", VkFormat_VK_FORMAT_R32G32_SFLOAT, 2, 8, false},
+		{"rgba8 uint", VkFormat_VK_FORMAT_R8G8B8A8_UINT, 4, 4, false},
+		{"r64 in r32", VkFormat_VK_FORMAT_R32_UINT, 1, 8, false},
+	} {
+		err := ipCheckStagingFormat(test.format, test.srcChannels, test.srcElementSize, 16)
+		if test.valid {
+			assert.For(ctx, test.name).ThatError(err).Succeeded()
+		} else {
+			assert.For(ctx, test.name).ThatError(err).Failed()
+		}
+	}
+}
+
+func TestTransientAttachment(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT)
+	transient := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSIENT_ATTACHMENT_BIT)
+	deviceLocal := VkMemoryPropertyFlags(VkMemoryPropertyFlagBits_VK_MEMORY_PROPERTY_DEVICE_LOCAL_BIT)
+	lazy := VkMemoryPropertyFlags(VkMemoryPropertyFlagBits_VK_MEMORY_PROPERTY_LAZILY_ALLOCATED_BIT)
+	for _, test := range []struct {
+		usage    VkImageUsageFlags
+		memProps VkMemoryPropertyFlags
+		expected bool
+	}{
+		{color, deviceLocal, false},
+		{color | transient, deviceLocal, true},
+		{color, deviceLocal | lazy, true},
+		{color | transient, deviceLocal | lazy, true},
+		{color, 0, false},
+	} {
+		assert.For(ctx, "usage: %v, memory properties: %v", test.usage, test.memProps).That(
+			ipTransientAttachment(test.usage, test.memProps)).Equals(test.expected)
+	}
+}
+
+func TestLayoutInfoFromRanges(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	shaderRead := VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL
+	transferSrc := VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL
+	general := VkImageLayout_VK_IMAGE_LAYOUT_GENERAL
+	undefined := VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED
+
+	layouts := useLayoutsOfRanges(undefined).
+		// All levels and layers.
+		setLayout(NewVkImageSubresourceRange(a, VkImageAspectFlags(color), 0, ^uint32(0), 0, ^uint32(0)), shaderRead).
+		// Levels 1 and 2 of layer 2.
+		setLayout(NewVkImageSubresourceRange(a, VkImageAspectFlags(color), 1, 2, 2, 1), transferSrc).
+		// Level 0 of layers 0 to 3.
+		setLayout(NewVkImageSubresourceRange(a, VkImageAspectFlags(depth|stencil), 0, 1, 0, 4), general).
+		setLayout(NewVkImageSubresourceRange(a, VkImageAspectFlags(stencil), 0, 0, 0, 4), shaderRead)
+
+	for _, test := range []struct {
+		aspect   VkImageAspectFlagBits
+		layer    uint32
+		level    uint32
+		expected VkImageLayout
+	}{
+		{color, 0, 0, shaderRead},
+		{color, 99, 0, shaderRead},
+		{color, 2, 1, transferSrc},
+		{color, 2, 2, transferSrc},
+		{color, 2, 3, shaderRead},
+		{color, 0, 1, shaderRead},
+		{depth, 3, 0, general},
+		{depth, 4, 0, undefined},
+		{depth, 0, 1, undefined},
+		// The empty stencil range is ignored.
+		{stencil, 0, 0, general},
+	} {
+		assert.For(ctx, "%v level: %v layer: %v", test.aspect, test.level, test.layer).That(
+			layouts.layoutOf(test.aspect, test.layer, test.level)).Equals(test.expected)
+	}
+}
+
+func TestCoalescedLayoutRanges(t *testing.T) {
+	ctx := log.Testing(t)
+	shaderRead := VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL
+	general := VkImageLayout_VK_IMAGE_LAYOUT_GENERAL
+
+	// Subresources sharing the same layout are transitioned with one barrier.
+	uniform := ipCoalescedLayoutRanges(3, 4, func(layer, level uint32) VkImageLayout {
+		return shaderRead
+	})
+	assert.For(ctx, "uniform").ThatSlice(uniform).DeepEquals([]ipLayoutRange{
+		{layerBegin: 0, layerEnd: 3, levelBegin: 0, levelEnd: 4, layout: shaderRead},
+	})
+
+	// Otherwise each subresource has its own range.
+	mixed := ipCoalescedLayoutRanges(2, 2, func(layer, level uint32) VkImageLayout {
+		if layer == 1 && level == 1 {
+			return general
+		}
+		return shaderRead
+	})
+	assert.For(ctx, "mixed").ThatSlice(mixed).DeepEquals([]ipLayoutRange{
+		{layerBegin: 0, layerEnd: 1, levelBegin: 0, levelEnd: 1, layout: shaderRead},
+		{layerBegin: 0, layerEnd: 1, levelBegin: 1, levelEnd: 2, layout: shaderRead},
+		{layerBegin: 1, layerEnd: 2, levelBegin: 0, levelEnd: 1, layout: shaderRead},
+		{layerBegin: 1, layerEnd: 2, levelBegin: 1, levelEnd: 2, layout: general},
+	})
+
+	assert.For(ctx, "empty").ThatSlice(ipCoalescedLayoutRanges(0, 4, func(layer, level uint32) VkImageLayout {
+		return shaderRead
+	})).IsEmpty()
+}
+
+func TestLeaveInLayout(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	transferDst := VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL
+	dst := useLayoutsOfRanges(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED).
+		setLayout(NewVkImageSubresourceRange(a, VkImageAspectFlags(color), 0, 1, 0, 1), VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL).
+		setLayout(NewVkImageSubresourceRange(a, VkImageAspectFlags(color), 1, 1, 0, 1), VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL)
+	layouts := leaveInLayout(transferDst, dst)
+
+	assert.For(ctx, "level 0").That(layouts.layoutOf(color, 0, 0)).Equals(transferDst)
+	assert.For(ctx, "level 1").That(layouts.layoutOf(color, 0, 1)).Equals(transferDst)
+	// Subresources not to be primed are left UNDEFINED.
+	assert.For(ctx, "level 2").That(layouts.layoutOf(color, 0, 2)).Equals(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED)
+}
+
+func TestSwapWordSize(t *testing.T) {
+	ctx := log.Testing(t)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	for _, test := range []struct {
+		format   VkFormat
+		aspect   VkImageAspectFlagBits
+		expected int
+	}{
+		{VkFormat_VK_FORMAT_R8G8B8A8_UNORM, color, 1},
+		{VkFormat_VK_FORMAT_A8B8G8R8_UNORM_PACK32, color, 4},
+		{VkFormat_VK_FORMAT_R16G16_SFLOAT, color, 2},
+		{VkFormat_VK_FORMAT_R32G32B32A32_UINT, color, 4},
+		{VkFormat_VK_FORMAT_R5G6B5_UNORM_PACK16, color, 2},
+		{VkFormat_VK_FORMAT_A2B10G10R10_UNORM_PACK32, color, 4},
+		{VkFormat_VK_FORMAT_B10G11R11_UFLOAT_PACK32, color, 4},
+		{VkFormat_VK_FORMAT_D16_UNORM, depth, 2},
+		{VkFormat_VK_FORMAT_D32_SFLOAT_S8_UINT, depth, 4},
+		{VkFormat_VK_FORMAT_D32_SFLOAT_S8_UINT, stencil, 1},
+	} {
+		size, err := ipSwapWordSize(test.format, test.aspect)
+		if assert.For(ctx, "%v %v", test.format, test.aspect).ThatError(err).Succeeded() {
+			assert.For(ctx, "%v %v word size", test.format, test.aspect).That(size).Equals(test.expected)
+		}
+	}
+
+	data := []uint8{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	assert.For(ctx, "16-bit words").ThatSlice(ipSwapBytes(data, 2)).Equals([]uint8{0x02, 0x01, 0x04, 0x03, 0x06, 0x05, 0x08, 0x07})
+	assert.For(ctx, "32-bit words").ThatSlice(ipSwapBytes(data, 4)).Equals([]uint8{0x04, 0x03, 0x02, 0x01, 0x08, 0x07, 0x06, 0x05})
+	assert.For(ctx, "bytes").ThatSlice(ipSwapBytes(data, 1)).Equals(data)
+	// The source data must not be modified.
+	assert.For(ctx, "source").ThatSlice(data).Equals([]uint8{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+}
+
+func TestSparseImageMemoryBinds(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	block := func(x int32, mem VkDeviceMemory, memOffset VkDeviceSize) SparseBoundImageBlockInfoʳ {
+		b := MakeSparseBoundImageBlockInfoʳ(a)
+		b.SetOffset(NewVkOffset3D(a, x, 0, 0))
+		b.SetExtent(NewVkExtent3D(a, 64, 64, 1))
+		b.SetMemory(mem)
+		b.SetMemoryOffset(memOffset)
+		b.SetSize(0x10000)
+		return b
+	}
+	// Only levels 0 and 2 of layer 1 are resident, level 0 with two blocks.
+	level0 := MakeSparseBoundImageLevelInfoʳ(a)
+	level0.Blocks().Add(0, block(0, 1, 0))
+	level0.Blocks().Add(0x10000, block(64, 1, 0x10000))
+	level2 := MakeSparseBoundImageLevelInfoʳ(a)
+	level2.Blocks().Add(0, block(0, 2, 0))
+	layer := MakeSparseBoundImageLayerInfoʳ(a)
+	layer.Levels().Add(0, level0)
+	layer.Levels().Add(2, level2)
+	aspect := MakeSparseBoundImageAspectInfoʳ(a)
+	aspect.Layers().Add(1, layer)
+	img := MakeImageObjectʳ(a)
+	img.SparseImageMemoryBindings().Add(color, aspect)
+
+	binds := ipSparseImageMemoryBinds(a, img)
+	if assert.For(ctx, "len(binds)").That(len(binds)).Equals(3) {
+		for i, expected := range []struct {
+			level     uint32
+			x         int32
+			mem       VkDeviceMemory
+			memOffset VkDeviceSize
+		}{
+			{0, 0, 1, 0},
+			{0, 64, 1, 0x10000},
+			{2, 0, 2, 0},
+		} {
+			b := binds[i]
+			assert.For(ctx, "bind %v aspect", i).That(b.Subresource().AspectMask()).Equals(VkImageAspectFlags(color))
+			assert.For(ctx, "bind %v layer", i).That(b.Subresource().ArrayLayer()).Equals(uint32(1))
+			assert.For(ctx, "bind %v level", i).That(b.Subresource().MipLevel()).Equals(expected.level)
+			assert.For(ctx, "bind %v offset", i).That(b.Offset().X()).Equals(expected.x)
+			assert.For(ctx, "bind %v memory", i).That(b.Memory()).Equals(expected.mem)
+			assert.For(ctx, "bind %v memory offset", i).That(b.MemoryOffset()).Equals(expected.memOffset)
+		}
+	}
+
+	resident := ipResidentSubresources(img)
+	assert.For(ctx, "resident subresources").ThatSlice(resident).Equals([]ipSubresource{
+		{aspect: color, layer: 1, level: 0},
+		{aspect: color, layer: 1, level: 2},
+	})
+}
+
+func TestLoadOrGenerateSpirv(t *testing.T) {
+	ctx := log.Testing(t)
+	dir, err := ioutil.TempDir("", "spirv_cache")
+	if !assert.For(ctx, "temp dir").ThatError(err).Succeeded() {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	code := []uint32{ipSpirvMagic, 0x00010000, 0, 1, 0}
+	generated := 0
+	generate := func() ([]uint32, error) {
+		generated++
+		return code, nil
+	}
+	for i := 0; i < 2; i++ {
+		loaded, err := ipLoadOrGenerateSpirv(ctx, dir, "key", generate)
+		assert.For(ctx, "load %v", i).ThatError(err).Succeeded()
+		assert.For(ctx, "load %v code", i).ThatSlice(loaded).Equals(code)
+	}
+	assert.For(ctx, "generated with cache").That(generated).Equals(1)
+
+	// Another key is generated again.
+	_, err = ipLoadOrGenerateSpirv(ctx, dir, "another key", generate)
+	assert.For(ctx, "another key").ThatError(err).Succeeded()
+	assert.For(ctx, "generated with another key").That(generated).Equals(2)
+
+	// Invalid cached data is ignored.
+	err = ioutil.WriteFile(ipSpirvCachePath(dir, "key"), []uint8{1, 2, 3, 4}, 0644)
+	assert.For(ctx, "corrupt cache").ThatError(err).Succeeded()
+	loaded, err := ipLoadOrGenerateSpirv(ctx, dir, "key", generate)
+	assert.For(ctx, "load corrupt").ThatError(err).Succeeded()
+	assert.For(ctx, "load corrupt code").ThatSlice(loaded).Equals(code)
+	assert.For(ctx, "generated with corrupt cache").That(generated).Equals(3)
+
+	// No cache directory.
+	_, err = ipLoadOrGenerateSpirv(ctx, "", "key", generate)
+	assert.For(ctx, "no cache").ThatError(err).Succeeded()
+	assert.For(ctx, "generated without cache").That(generated).Equals(4)
+}
+
+func TestDumpShaderSpirv(t *testing.T) {
+	ctx := log.Testing(t)
+	dir, err := ioutil.TempDir("", "spirv_dump")
+	if !assert.For(ctx, "temp dir").ThatError(err).Succeeded() {
+		return
+	}
+	defer os.RemoveAll(dir)
+	sb := &stateBuilder{ctx: ctx}
+	dumpDir := filepath.Join(dir, "dumps")
+
+	// Each shader is written to the file named after its key, created along
+	// with the directory.
+	rh := &ipRenderHandler{sb: sb, dumpShadersDir: dumpDir}
+	vertex := ipRenderShaderInfo{isVertex: true}
+	rh.dumpShader(vertex)
+	code, err := rh.shaderSpirv(vertex)
+	assert.For(ctx, "generate render").ThatError(err).Succeeded()
+	data, err := ioutil.ReadFile(filepath.Join(dumpDir, vertex.spirvKey()+".spv"))
+	assert.For(ctx, "read render dump").ThatError(err).Succeeded()
+	assert.For(ctx, "render dump").ThatSlice(data).Equals(ipSpirvData(code))
+
+	sh := &ipImageStoreHandler{sb: sb, dumpShadersDir: dumpDir}
+	store := ipImageStoreShaderInfo{
+		outputFormat: VkFormat_VK_FORMAT_R8G8B8A8_UINT,
+		outputAspect: VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+		inputFormat:  VkFormat_VK_FORMAT_R8G8B8A8_UINT,
+		inputAspect:  VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+		imgType:      VkImageType_VK_IMAGE_TYPE_2D,
+	}
+	sh.dumpShader(store)
+	code, err = sh.shaderSpirv(store)
+	assert.For(ctx, "generate store").ThatError(err).Succeeded()
+	data, err = ioutil.ReadFile(filepath.Join(dumpDir, store.spirvKey()+".spv"))
+	assert.For(ctx, "read store dump").ThatError(err).Succeeded()
+	assert.For(ctx, "store dump").ThatSlice(data).Equals(ipSpirvData(code))
+}
+
+func TestSpirvData(t *testing.T) {
+	ctx := log.Testing(t)
+	code := []uint32{ipSpirvMagic, 0x01020304}
+	data := ipSpirvData(code)
+	assert.For(ctx, "data").ThatSlice(data).Equals([]uint8{0x03, 0x02, 0x23, 0x07, 0x04, 0x03, 0x02, 0x01})
+	decoded, err := ipSpirvFromData(data)
+	assert.For(ctx, "decode").ThatError(err).Succeeded()
+	assert.For(ctx, "decoded").ThatSlice(decoded).Equals(code)
+	decoded, err = ipSpirvFromData(ipSwapBytes(data, 4))
+	assert.For(ctx, "decode big endian").ThatError(err).Succeeded()
+	assert.For(ctx, "decoded big endian").ThatSlice(decoded).Equals(code)
+	_, err = ipSpirvFromData([]uint8{1, 2, 3, 4})
+	assert.For(ctx, "invalid magic").ThatError(err).Failed()
+	_, err = ipSpirvFromData(data[:6])
+	assert.For(ctx, "invalid size").ThatError(err).Failed()
+}
+
+func TestPlaneLevelSize(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	plane0 := VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_0_BIT
+	plane1 := VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_1_BIT
+	plane2 := VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_2_BIT
+	nv12 := VkFormat_VK_FORMAT_G8_B8R8_2PLANE_420_UNORM
+	for _, test := range []struct {
+		format VkFormat
+		extent VkExtent3D
+		level  uint32
+		plane  VkImageAspectFlagBits
+		width  uint64
+		height uint64
+		size   uint64
+	}{
+		// The luma plane is of the full extent, one byte for each texel.
+		{nv12, NewVkExtent3D(a, 64, 32, 1), 0, plane0, 64, 32, 64 * 32},
+		// The chroma plane is half the width and height, B and R in two bytes.
+		{nv12, NewVkExtent3D(a, 64, 32, 1), 0, plane1, 32, 16, 32 * 16 * 2},
+		{nv12, NewVkExtent3D(a, 64, 32, 1), 1, plane0, 32, 16, 32 * 16},
+		{nv12, NewVkExtent3D(a, 64, 32, 1), 1, plane1, 16, 8, 16 * 8 * 2},
+		// Odd extents are rounded up.
+		{nv12, NewVkExtent3D(a, 5, 3, 1), 0, plane1, 3, 2, 3 * 2 * 2},
+		{VkFormat_VK_FORMAT_G16_B16_R16_3PLANE_422_UNORM, NewVkExtent3D(a, 8, 8, 1), 0, plane2, 4, 8, 4 * 8 * 2},
+		{VkFormat_VK_FORMAT_G8_B8_R8_3PLANE_444_UNORM, NewVkExtent3D(a, 8, 8, 1), 0, plane2, 8, 8, 8 * 8},
+	} {
+		size, ok := ipPlaneLevelSize(test.extent, test.format, test.level, test.plane)
+		if assert.For(ctx, "%v level: %v %v", test.format, test.level, test.plane).That(ok).Equals(true) {
+			assert.For(ctx, "%v level: %v %v width", test.format, test.level, test.plane).That(size.width).Equals(test.width)
+			assert.For(ctx, "%v level: %v %v height", test.format, test.level, test.plane).That(size.height).Equals(test.height)
+			assert.For(ctx, "%v level: %v %v size", test.format, test.level, test.plane).That(size.levelSize).Equals(test.size)
+		}
+	}
+
+	_, ok := ipPlaneLevelSize(NewVkExtent3D(a, 8, 8, 1), nv12, 0, plane2)
+	assert.For(ctx, "third plane of two-plane format").That(ok).Equals(false)
+	_, ok = ipPlaneLevelSize(NewVkExtent3D(a, 8, 8, 1), VkFormat_VK_FORMAT_R8G8B8A8_UNORM, 0, plane0)
+	assert.For(ctx, "single-planar format").That(ok).Equals(false)
+	_, ok = ipPlaneLevelSize(NewVkExtent3D(a, 8, 8, 1), nv12, 0, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT)
+	assert.For(ctx, "color aspect").That(ok).Equals(false)
+}
+
+func TestPlaneSizes(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	plane0 := VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_0_BIT
+	plane1 := VkImageAspectFlagBits_VK_IMAGE_ASPECT_PLANE_1_BIT
+	nv12 := VkFormat_VK_FORMAT_G8_B8R8_2PLANE_420_UNORM
+	extent := NewVkExtent3D(a, 64, 32, 1)
+
+	// Each plane is sized by its own extent and format, over all the levels
+	// and layers, rather than by the size of the whole image.
+	sizes, ok := ipPlaneSizes(extent, nv12, 2, 3, []VkImageAspectFlagBits{plane0, plane1})
+	if assert.For(ctx, "nv12").That(ok).Equals(true) {
+		assert.For(ctx, "nv12 sizes").ThatSlice(sizes).Equals([]VkDeviceSize{
+			(64*32 + 32*16) * 3,
+			(32*16*2 + 16*8*2) * 3,
+		})
+	}
+	_, ok = ipPlaneSizes(extent, VkFormat_VK_FORMAT_R8G8B8A8_UNORM, 1, 1, []VkImageAspectFlagBits{plane0})
+	assert.For(ctx, "single-planar format").That(ok).Equals(false)
+
+	offsets, total := ipPlaneOffsets([]VkDeviceSize{ipPlaneAllocationAlignment, 100}, ipStagingOverallocation(0))
+	assert.For(ctx, "offsets").ThatSlice(offsets).Equals([]VkDeviceSize{0, 2 * ipPlaneAllocationAlignment})
+	assert.For(ctx, "total").That(total).Equals(VkDeviceSize(3 * ipPlaneAllocationAlignment))
+}
+
+func TestPrimeSubset(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	info := MakeImageInfo(a)
+	p := &imagePrimer{}
+	assert.For(ctx, "no subset").That(p.skipped(1, info)).Equals(false)
+
+	p.primeSubset([]VkImage{2, 3})
+	assert.For(ctx, "image 1 not in subset").That(p.skipped(1, info)).Equals(true)
+	assert.For(ctx, "image 2 in subset").That(p.skipped(2, info)).Equals(false)
+	assert.For(ctx, "image 3 in subset").That(p.skipped(3, info)).Equals(false)
+
+	// skipPriming still applies to the images in the subset.
+	p.skipPriming = func(img VkImage, info ImageInfo) bool { return img == 3 }
+	assert.For(ctx, "image 2 not skipped").That(p.skipped(2, info)).Equals(false)
+	assert.For(ctx, "image 3 skipped").That(p.skipped(3, info)).Equals(true)
+
+	// The subset is replaced.
+	p.primeSubset([]VkImage{1})
+	assert.For(ctx, "image 1 in new subset").That(p.skipped(1, info)).Equals(false)
+	assert.For(ctx, "image 2 not in new subset").That(p.skipped(2, info)).Equals(true)
+
+	// An empty subset primes no image.
+	p.primeSubset(nil)
+	assert.For(ctx, "empty subset").That(p.skipped(1, info)).Equals(true)
+}
+
+// ipTestPrimeable is a primeable image data which records the layouts it is
+// primed with, instead of recording priming commands.
+type ipTestPrimeable struct {
+	queue     VkQueue
+	dstLayout ipLayoutInfo
+	primed    bool
+	freed     bool
+}
+
+func (i *ipTestPrimeable) prime(srcLayout, dstLayout ipLayoutInfo) error {
+	i.dstLayout = dstLayout
+	i.primed = true
+	return nil
+}
+
+func (i *ipTestPrimeable) free() { i.freed = true }
+
+func (i *ipTestPrimeable) primingQueue() VkQueue { return i.queue }
+
+func TestImagePrimerOptions(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	dev := VkDevice(1)
+	layered, single := VkImage(10), VkImage(11)
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	for handle, family := range map[VkQueue]uint32{2: 0, 3: 1} {
+		q := MakeQueueObjectʳ(a)
+		q.SetDevice(dev)
+		q.SetFamily(family)
+		q.SetVulkanHandle(handle)
+		GetState(oldState).Queues().Add(handle, q)
+	}
+	images := map[VkImage]ImageObjectʳ{}
+	for handle, layers := range map[VkImage]uint32{layered: 3, single: 1} {
+		info := MakeImageInfo(a)
+		info.SetFmt(VkFormat_VK_FORMAT_R16G16_UINT)
+		info.SetExtent(NewVkExtent3D(a, 4, 4, 1))
+		info.SetMipLevels(1)
+		info.SetArrayLayers(layers)
+		img := MakeImageObjectʳ(a)
+		img.SetDevice(dev)
+		img.SetVulkanHandle(handle)
+		img.SetInfo(info)
+		GetState(oldState).Images().Add(handle, img)
+		images[handle] = img
+	}
+
+	assert.For(ctx, "default options").That(GetImagePrimerOptions(ctx).GenerateMipLevels).Equals(false)
+
+	// The plans and checkpoint are given back as they are logged.
+	plans, err := encodePrimingPlans([]ipPrimingPlan{{Image: layered, Strategy: ipPrimingStrategyBufferCopy, QueueFamily: 1}})
+	assert.For(ctx, "encode plans").ThatError(err).Succeeded()
+	checkpoint, err := encodePrimingCheckpoint(ipPrimingCheckpoint{Primed: []VkImage{single}})
+	assert.For(ctx, "encode checkpoint").ThatError(err).Succeeded()
+	config := fmt.Sprintf(`{
+		"narrowStagingFormats": true,
+		"stagingColorFormat": %v,
+		"generateMipLevels": true,
+		"distributeQueues": true,
+		"strategyQueues": true,
+		"stagingMemoryBudget": 1024,
+		"trackCompletion": true,
+		"auditCoverage": true,
+		"dedupContent": true,
+		"batchSize": 2,
+		"prefetchSourceData": true,
+		"primedLayout": %v,
+		"stagingBlockSize": 1048576,
+		"skipImages": [%v],
+		"primeImages": [%v, %v],
+		"sourceLayer": 1,
+		"replayPlans": %s,
+		"resumeCheckpoint": %s,
+		"imageData": [{"image": %v, "aspect": %v, "layer": 2, "level": 0, "data": "AAEC"}],
+		"dstLayouts": [{"image": %v, "aspectMask": %v, "baseLayer": 1, "layerCount": 2, "baseLevel": 0, "levelCount": 1, "layout": %v}],
+		"spirvCacheDir": "cache",
+		"dumpShadersDir": "dumps"
+	}`, uint32(VkFormat_VK_FORMAT_R32G32_UINT), uint32(VkImageLayout_VK_IMAGE_LAYOUT_GENERAL), uint64(single), uint64(single), uint64(layered), plans, checkpoint, uint64(layered), uint32(color),
+		uint64(layered), uint32(color), uint32(VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL))
+	opts, err := ParseImagePrimerOptions([]byte(config))
+	if !assert.For(ctx, "parse").ThatError(err).Succeeded() {
+		return
+	}
+	ctx, cancel := task.WithCancel(PutImagePrimerOptions(ctx, opts))
+	defer cancel()
+
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	p := newImagePrimer(sb)
+	if !assert.For(ctx, "apply").ThatError(p.applyOptions(ctx, GetImagePrimerOptions(ctx))).Succeeded() {
+		return
+	}
+	assert.For(ctx, "narrowStagingFormats").That(p.narrowStagingFormats).Equals(true)
+	assert.For(ctx, "generateMipLevels").That(p.generateMipLevels).Equals(true)
+	assert.For(ctx, "distributeQueues").That(p.distributeQueues).Equals(true)
+	assert.For(ctx, "strategyQueues").That(p.strategyQueues).Equals(true)
+	assert.For(ctx, "auditCoverage").That(p.auditCoverage).Equals(true)
+	assert.For(ctx, "render spirvCacheDir").That(p.rh.spirvCacheDir).Equals("cache")
+	assert.For(ctx, "store spirvCacheDir").That(p.sh.spirvCacheDir).Equals("cache")
+	assert.For(ctx, "render dumpShadersDir").That(p.rh.dumpShadersDir).Equals("dumps")
+	assert.For(ctx, "store dumpShadersDir").That(p.sh.dumpShadersDir).Equals("dumps")
+
+	// The staging formats.
+	assert.For(ctx, "narrow staging format").That(ipStagingColorFormat(VkFormat_VK_FORMAT_R32_UINT, p.narrowStagingFormats)).Equals(VkFormat_VK_FORMAT_R32_UINT)
+	assert.For(ctx, "staging color format override").That(p.stagingFormatOverride(images[layered], color, p.stagingColorFormat,
+		stagingColorImageBufferFormat, 4, VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT))).Equals(VkFormat_VK_FORMAT_R32G32_UINT)
+
+	// The skipped images and the images primed before the checkpoint only
+	// get their layouts restored.
+	assert.For(ctx, "skipped").That(p.skipped(single, images[single].Info())).Equals(true)
+	assert.For(ctx, "not skipped").That(p.skipped(layered, images[layered].Info())).Equals(false)
+	// Only the images of the subset are primed.
+	assert.For(ctx, "not in subset").That(p.skipped(VkImage(12), images[layered].Info())).Equals(true)
+	assert.For(ctx, "resumed").That(p.resumedImages[single]).Equals(true)
+
+	// The supplied data replaces the captured data of the subresource.
+	assert.For(ctx, "image data").ThatSlice(p.imageData[layered][ipSubresource{aspect: color, layer: 2}]).Equals([]uint8{0, 1, 2})
+	assert.For(ctx, "no image data").That(p.imageData[single] == nil).Equals(true)
+
+	// The given destination layouts override the captured layouts of the
+	// primed subresources only.
+	for layer, layout := range []VkImageLayout{
+		VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL,
+		VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL,
+		VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED,
+	} {
+		level := MakeImageLevelʳ(a)
+		level.SetLayout(layout)
+		imgLayer := MakeImageLayerʳ(a)
+		imgLayer.Levels().Add(0, level)
+		if layer == 0 {
+			images[layered].Aspects().Add(color, MakeImageAspectʳ(a))
+		}
+		images[layered].Aspects().Get(color).Layers().Add(uint32(layer), imgLayer)
+	}
+	dstLayouts := p.dstLayoutsOf(layered)
+	assert.For(ctx, "captured layout").That(dstLayouts.layoutOf(color, 0, 0)).Equals(VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL)
+	assert.For(ctx, "overridden layout").That(dstLayouts.layoutOf(color, 1, 0)).Equals(VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL)
+	assert.For(ctx, "undefined layout").That(dstLayouts.layoutOf(color, 2, 0)).Equals(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED)
+
+	// All the layers are primed from the source layer, and the copies of the
+	// source data are prefetched.
+	session := p.newBufferImageCopySession(newImagePrimerBufferImageCopyJob(images[layered]), ipPrimingStrategyBufferCopy)
+	assert.For(ctx, "prefetch").That(session.prefetchData).Equals(true)
+	assert.For(ctx, "source of layer 2").That(session.sourceOf(ipSubresource{aspect: color, layer: 2})).Equals(ipSubresource{aspect: color, layer: 1})
+	session = p.newBufferImageCopySession(newImagePrimerBufferImageCopyJob(images[single]), ipPrimingStrategyBufferCopy)
+	assert.For(ctx, "source of image without the layer").That(session.sourceOf(ipSubresource{aspect: color})).Equals(ipSubresource{aspect: color})
+
+	// The replayed plan picks the queue family.
+	assert.For(ctx, "replayed queue").That(p.queueForPriming(images[layered], ipPrimingStrategyBufferCopy).VulkanHandle()).Equals(VkQueue(3))
+
+	// The staging memory is suballocated from blocks.
+	offset, ok := ipSuballocate(1000, 1000, p.stagingBlockSize, ipStagingSuballocationAlignment)
+	assert.For(ctx, "suballocated").That(ok).Equals(true)
+	assert.For(ctx, "suballocated offset").That(offset).Equals(ipStagingSuballocationAlignment)
+
+	// The priming works are queued until a batch is full, then the primed
+	// subresources are left in the primed layout, and the primed images are
+	// tracked and become the sources of the images with the same content. The
+	// test primeables are on a queue not in the state, so no ownership is
+	// handed off.
+	key := ipContentKey{device: dev}
+	p.contentKeys[layered] = key
+	dstLayout := useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL)
+	first, second := &ipTestPrimeable{queue: 99}, &ipTestPrimeable{queue: 99}
+	p.queuePriming(images[layered], nil, first, dstLayout, dstLayout)
+	assert.For(ctx, "queued").That(first.primed).Equals(false)
+	p.queuePriming(images[layered], nil, second, dstLayout, dstLayout)
+	assert.For(ctx, "batch primed").That(first.primed && second.primed && first.freed && second.freed).Equals(true)
+	assert.For(ctx, "primed layout").That(first.dstLayout.layoutOf(color, 0, 0)).Equals(VkImageLayout_VK_IMAGE_LAYOUT_GENERAL)
+	assert.For(ctx, "checkpoint").ThatSlice(p.checkpoint().Primed).Equals([]VkImage{layered})
+	assert.For(ctx, "dedup source").That(p.primedContents[key]).Equals(layered)
+
+	// Reaching the staging memory budget flushes the queue before the batch
+	// is full.
+	p.heapUsages[ipMemoryHeap{dev: dev}] = p.stagingMemoryBudget
+	third := &ipTestPrimeable{queue: 99}
+	p.queuePriming(images[layered], nil, third, dstLayout, dstLayout)
+	assert.For(ctx, "budget reached").That(third.primed).Equals(true)
+
+	// Priming is cancelled once the rebuild is stopped.
+	assert.For(ctx, "not cancelled").That(p.cancelPriming()).Equals(false)
+	cancel()
+	assert.For(ctx, "cancelled").That(p.cancelPriming()).Equals(true)
+
+	// Broken plans are reported, the other options are still applied.
+	p = newImagePrimer(sb)
+	err = p.applyOptions(ctx, ImagePrimerOptions{DedupContent: true, ReplayPlans: []byte("{")})
+	assert.For(ctx, "broken plans").ThatError(err).Failed()
+	assert.For(ctx, "dedupContent with broken plans").That(p.dedupContent).Equals(true)
+	_, err = ParseImagePrimerOptions([]byte(`{"batchSize": "2"}`))
+	assert.For(ctx, "broken config").ThatError(err).Failed()
+}
+
+func TestImageSizeOrFallback(t *testing.T) {
+	ctx := log.Testing(t)
+	img := VkImage(10)
+	inferErr := fmt.Errorf("Image size not inferred")
+
+	size, err := ipImageSizeOrFallback(ctx, img, 1024, nil, 4096)
+	assert.For(ctx, "inferred err").ThatError(err).Succeeded()
+	assert.For(ctx, "inferred size").That(size).Equals(VkDeviceSize(1024))
+
+	size, err = ipImageSizeOrFallback(ctx, img, 0, inferErr, 4096)
+	assert.For(ctx, "fallback err").ThatError(err).Succeeded()
+	assert.For(ctx, "fallback size").That(size).Equals(VkDeviceSize(4096))
+
+	_, err = ipImageSizeOrFallback(ctx, img, 0, inferErr, 0)
+	assert.For(ctx, "no fallback err").ThatError(err).Failed()
+}
+
+func TestCheckCapturedImageFormatSupported(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	dev, phyDev := VkDevice(1), VkPhysicalDevice(2)
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	phyDevObj := MakePhysicalDeviceObjectʳ(a)
+	phyDevObj.SetVulkanHandle(phyDev)
+	// Only sampled with optimal tiling, and stored to with linear tiling.
+	phyDevObj.FormatProperties().Add(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, NewVkFormatProperties(a,
+		VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_STORAGE_IMAGE_BIT), // linearTilingFeatures
+		VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_SAMPLED_IMAGE_BIT), // optimalTilingFeatures
+		0, // bufferFeatures
+	))
+	GetState(oldState).PhysicalDevices().Add(phyDev, phyDevObj)
+	devObj := MakeDeviceObjectʳ(a)
+	devObj.SetVulkanHandle(dev)
+	devObj.SetPhysicalDevice(phyDev)
+	GetState(oldState).Devices().Add(dev, devObj)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, ta: a}
+	p := &imagePrimer{sb: sb}
+
+	newInfo := func(format VkFormat, tiling VkImageTiling, usage VkImageUsageFlagBits) ImageInfo {
+		info := MakeImageInfo(a)
+		info.SetFmt(format)
+		info.SetTiling(tiling)
+		info.SetUsage(VkImageUsageFlags(usage))
+		return info
+	}
+	optimal, linear := VkImageTiling_VK_IMAGE_TILING_OPTIMAL, VkImageTiling_VK_IMAGE_TILING_LINEAR
+	sampled, storage := VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT, VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT
+	for _, test := range []struct {
+		name      string
+		info      ImageInfo
+		supported bool
+	}{
+		{"sampled optimal", newInfo(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, optimal, sampled), true},
+		{"storage optimal", newInfo(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, optimal, storage), false},
+		{"storage linear", newInfo(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, linear, storage), true},
+		{"sampled linear", newInfo(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, linear, sampled), false},
+		// The properties of the format were not captured.
+		{"unknown format", newInfo(VkFormat_VK_FORMAT_R32_UINT, optimal, storage), true},
+	} {
+		err := p.checkCapturedImageFormatSupported(dev, test.info)
+		if test.supported {
+			assert.For(ctx, test.name).ThatError(err).Succeeded()
+		} else {
+			assert.For(ctx, test.name).ThatError(err).Failed()
+		}
+	}
+	assert.For(ctx, "unknown device").ThatError(
+		p.checkCapturedImageFormatSupported(VkDevice(3), newInfo(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, optimal, sampled))).Failed()
+}
+
+func TestSubresourceDataRanges(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	info := MakeImageInfo(a)
+	info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_UINT)
+	info.SetExtent(NewVkExtent3D(a, 4, 4, 1))
+	info.SetMipLevels(2)
+	info.SetArrayLayers(2)
+	img := MakeImageObjectʳ(a)
+	img.SetVulkanHandle(10)
+	img.SetInfo(info)
+	img.Aspects().Add(color, MakeImageAspectʳ(a))
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+
+	// The ranges are sorted, one for each subresource.
+	rngs, err := ipSubresourceDataRanges(sb, img, map[ipSubresource][]uint8{
+		{aspect: color, layer: 1, level: 1}: make([]uint8, 2*2*4),
+		{aspect: color, layer: 0, level: 0}: make([]uint8, 4*4*4),
+		{aspect: color, layer: 1, level: 0}: make([]uint8, 4*4*4),
+	})
+	if assert.For(ctx, "valid data").ThatError(err).Succeeded() {
+		expected := []ipSubresource{{color, 0, 0}, {color, 1, 0}, {color, 1, 1}}
+		if assert.For(ctx, "len(rngs)").That(len(rngs)).Equals(len(expected)) {
+			for i, rng := range rngs {
+				assert.For(ctx, "range %v layer", i).That(rng.BaseArrayLayer()).Equals(expected[i].layer)
+				assert.For(ctx, "range %v level", i).That(rng.BaseMipLevel()).Equals(expected[i].level)
+				assert.For(ctx, "range %v counts", i).That(rng.LayerCount() == 1 && rng.LevelCount() == 1).Equals(true)
+			}
+		}
+	}
+
+	// The data of a wrong length is rejected.
+	for _, length := range []int{0, 4*4*4 - 1, 4*4*4 + 1, 2 * 2 * 4} {
+		_, err = ipSubresourceDataRanges(sb, img, map[ipSubresource][]uint8{
+			{aspect: color, layer: 0, level: 0}: make([]uint8, length),
+		})
+		assert.For(ctx, "data of %v bytes", length).ThatError(err).Failed()
+	}
+
+	// The subresources not in the image are rejected.
+	for _, sr := range []ipSubresource{
+		{aspect: VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT},
+		{aspect: color, layer: 2},
+		{aspect: color, level: 2},
+	} {
+		_, err = ipSubresourceDataRanges(sb, img, map[ipSubresource][]uint8{sr: make([]uint8, 4*4*4)})
+		assert.For(ctx, "subresource %+v", sr).ThatError(err).Failed()
+	}
+}
+
+func TestCopyOfSuppliedData(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	newImage := func(handle VkImage, format VkFormat) ImageObjectʳ {
+		info := MakeImageInfo(a)
+		info.SetFmt(format)
+		info.SetExtent(NewVkExtent3D(a, 2, 1, 1))
+		info.SetMipLevels(1)
+		info.SetArrayLayers(1)
+		img := MakeImageObjectʳ(a)
+		img.SetVulkanHandle(handle)
+		img.SetInfo(info)
+		img.SetImageAspect(VkImageAspectFlags(color))
+		return img
+	}
+	// The source image has no captured data, only the supplied data is read.
+	src := newImage(10, VkFormat_VK_FORMAT_R8G8B8A8_UINT)
+	supplied := []uint8{1, 2, 3, 4, 5, 6, 7, 8}
+	srcData := map[ipSubresource][]uint8{{aspect: color}: supplied}
+	offset, extent := NewVkOffset3D(a, 0, 0, 0), NewVkExtent3D(a, 2, 1, 1)
+
+	// Copied as it is to an image of the same format.
+	same := newImage(11, VkFormat_VK_FORMAT_R8G8B8A8_UINT)
+	job := newImagePrimerBufferImageCopyJob(src)
+	assert.For(ctx, "add same format dst").ThatError(job.addDst(ctx, color, color, same)).Succeeded()
+	session := newImagePrimerBufferImageCopySession(sb, job, srcData)
+	fill, bufImgCopy, err := session.getCopyAndData(same, color, src, color, 0, 0, offset, extent)
+	if assert.For(ctx, "same format copy").ThatError(err).Succeeded() {
+		assert.For(ctx, "same format data").ThatSlice(fill.data).Equals(supplied)
+		assert.For(ctx, "copy extent").That(bufImgCopy.ImageExtent().Width()).Equals(uint32(2))
+		fill.data[0] = 0
+		assert.For(ctx, "supplied data not modified").That(supplied[0]).Equals(uint8(1))
+	}
+
+	// Unpacked to the staging format.
+	staging := newImage(12, VkFormat_VK_FORMAT_R32G32B32A32_UINT)
+	job = newImagePrimerBufferImageCopyJob(src)
+	assert.For(ctx, "add staging dst").ThatError(job.addDst(ctx, color, color, staging)).Succeeded()
+	session = newImagePrimerBufferImageCopySession(sb, job, srcData)
+	fill, _, err = session.getCopyAndData(staging, color, src, color, 0, 0, offset, extent)
+	if assert.For(ctx, "staging copy").ThatError(err).Succeeded() {
+		expected := []uint8{}
+		for _, c := range supplied {
+			expected = append(expected, c, 0, 0, 0)
+		}
+		assert.For(ctx, "staging data").ThatSlice(fill.data).Equals(expected)
+	}
+
+	// The subresources without supplied data are not copied.
+	srcData = map[ipSubresource][]uint8{{aspect: color, level: 1}: supplied}
+	session = newImagePrimerBufferImageCopySession(sb, job, srcData)
+	_, _, err = session.getCopyAndData(staging, color, src, color, 0, 0, offset, extent)
+	assert.For(ctx, "no supplied data").ThatError(err).Failed()
+}
+
+func TestCollectCopiesFromRegions(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	newImage := func(handle VkImage) ImageObjectʳ {
+		info := MakeImageInfo(a)
+		info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_UINT)
+		info.SetExtent(NewVkExtent3D(a, 4, 2, 1))
+		info.SetMipLevels(1)
+		info.SetArrayLayers(1)
+		img := MakeImageObjectʳ(a)
+		img.SetVulkanHandle(handle)
+		img.SetInfo(info)
+		img.SetImageAspect(VkImageAspectFlags(color))
+		return img
+	}
+	src, dst := newImage(10), newImage(11)
+	supplied := make([]uint8, 4*2*4)
+	for i := range supplied {
+		supplied[i] = uint8(i)
+	}
+	job := newImagePrimerBufferImageCopyJob(src)
+	assert.For(ctx, "add dst").ThatError(job.addDst(ctx, color, color, dst)).Succeeded()
+	session := newImagePrimerBufferImageCopySession(sb, job, map[ipSubresource][]uint8{{aspect: color}: supplied})
+	session.collectCopiesFromRegions([]ipSubresourceRegion{
+		// The whole subresource.
+		{ipSubresource: ipSubresource{aspect: color}, extent: [3]uint32{4, 2, 1}},
+		// Disjoint regions of the subresource.
+		{ipSubresource: ipSubresource{aspect: color}, offset: [3]uint32{1, 0, 0}, extent: [3]uint32{2, 1, 1}},
+		{ipSubresource: ipSubresource{aspect: color}, offset: [3]uint32{3, 1, 0}, extent: [3]uint32{1, 1, 1}},
+		// The aspects not requested are not copied.
+		{ipSubresource: ipSubresource{aspect: VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT}, extent: [3]uint32{4, 2, 1}},
+		// The regions out of the level fail.
+		{ipSubresource: ipSubresource{aspect: color}, offset: [3]uint32{3, 1, 0}, extent: [3]uint32{2, 1, 1}},
+	})
+	assert.For(ctx, "errors").That(len(session.errs)).Equals(1)
+	copies, content := session.copies[dst], session.content[dst]
+	if !assert.For(ctx, "copies").That(len(copies)).Equals(3) {
+		return
+	}
+	for i, expected := range []struct {
+		offset [3]int32
+		extent [3]uint32
+		data   []uint8
+	}{
+		{[3]int32{0, 0, 0}, [3]uint32{4, 2, 1}, supplied},
+		{[3]int32{1, 0, 0}, [3]uint32{2, 1, 1}, supplied[4:12]},
+		// The data is padded to a multiple of 8 bytes.
+		{[3]int32{3, 1, 0}, [3]uint32{1, 1, 1}, []uint8{28, 29, 30, 31, 0, 0, 0, 0}},
+	} {
+		c := copies[i]
+		assert.For(ctx, "copy %v offset", i).That([3]int32{c.ImageOffset().X(), c.ImageOffset().Y(), c.ImageOffset().Z()}).Equals(expected.offset)
+		assert.For(ctx, "copy %v extent", i).That([3]uint32{c.ImageExtent().Width(), c.ImageExtent().Height(), c.ImageExtent().Depth()}).Equals(expected.extent)
+		assert.For(ctx, "copy %v data", i).ThatSlice(content[i][0].data).Equals(expected.data)
+	}
+	assert.For(ctx, "total size").That(session.totalSize).Equals(uint64(32 + 8 + 8))
+	assert.For(ctx, "supplied data restored").That(session.srcData[ipSubresource{aspect: color}] != nil).Equals(true)
+}
+
+func TestReportCopyErrors(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	p := &imagePrimer{sb: sb}
+	img := MakeImageObjectʳ(a)
+	img.SetVulkanHandle(10)
+	img.SetInfo(MakeImageInfo(a))
+	bcs := newImagePrimerBufferImageCopySession(sb, newImagePrimerBufferImageCopyJob(img), nil)
+	assert.For(ctx, "no errors").That(p.reportCopyErrors(10, bcs)).Equals(0)
+	assert.For(ctx, "no collect error").ThatError(bcs.collectErr()).Succeeded()
+
+	bcs.errs = append(bcs.errs, fmt.Errorf("layer 0"), fmt.Errorf("layer 1"))
+	assert.For(ctx, "errors").That(p.reportCopyErrors(10, bcs)).Equals(2)
+	assert.For(ctx, "collect error").ThatError(bcs.collectErr()).Failed()
+}
+
+func TestDispatchBase(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	vulkan10 := uint32(1 << 22)
+	addDevice := func(dev VkDevice, instVersion, phyDevVersion uint32, exts ...string) {
+		inst := MakeInstanceObjectʳ(a)
+		inst.SetVulkanHandle(VkInstance(dev))
+		inst.SetApiVersion(instVersion)
+		GetState(newState).Instances().Add(inst.VulkanHandle(), inst)
+		props := MakeVkPhysicalDeviceProperties(a)
+		props.SetApiVersion(phyDevVersion)
+		phyDev := MakePhysicalDeviceObjectʳ(a)
+		phyDev.SetVulkanHandle(VkPhysicalDevice(dev))
+		phyDev.SetInstance(inst.VulkanHandle())
+		phyDev.SetPhysicalDeviceProperties(props)
+		GetState(newState).PhysicalDevices().Add(phyDev.VulkanHandle(), phyDev)
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		devObj.SetPhysicalDevice(phyDev.VulkanHandle())
+		for i, ext := range exts {
+			devObj.EnabledExtensions().Add(uint32(i), ext)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1, vulkan10, vulkan10)
+	addDevice(2, vulkan10, ipVulkanVersion11)
+	addDevice(3, vulkan10, ipVulkanVersion11, "VK_KHR_device_group")
+	addDevice(4, ipVulkanVersion11, ipVulkanVersion11)
+	addDevice(5, ipVulkanVersion11, vulkan10, "VK_KHR_device_group")
+
+	for dev, expected := range map[VkDevice]ipDispatchBaseCommand{
+		1: ipDispatchBaseUnsupported,
+		2: ipDispatchBaseUnsupported,
+		3: ipDispatchBaseKHR,
+		4: ipDispatchBaseCore,
+		5: ipDispatchBaseKHR,
+		6: ipDispatchBaseUnsupported,
+	} {
+		assert.For(ctx, "dispatch base of device %v", dev).That(ipDispatchBase(sb, dev)).Equals(expected)
+	}
+
+	// The base offsets are given to the dispatch base commands, or pushed for
+	// vkCmdDispatch.
+	cb := CommandBuilder{Thread: 0, Arena: a}
+	tile := ipDispatchTile{base: [3]uint32{4, 8, 1}, count: [3]uint32{2, 3, 1}}
+	if cmd, ok := ipDispatchTileCmd(cb, 1, ipDispatchBaseCore, tile).(*VkCmdDispatchBase); assert.For(ctx, "core command").That(ok).Equals(true) {
+		assert.For(ctx, "core base").ThatSlice([]uint32{cmd.BaseGroupX(), cmd.BaseGroupY(), cmd.BaseGroupZ()}).Equals(tile.base[:])
+		assert.For(ctx, "core count").ThatSlice([]uint32{cmd.GroupCountX(), cmd.GroupCountY(), cmd.GroupCountZ()}).Equals(tile.count[:])
+	}
+	if cmd, ok := ipDispatchTileCmd(cb, 1, ipDispatchBaseKHR, tile).(*VkCmdDispatchBaseKHR); assert.For(ctx, "KHR command").That(ok).Equals(true) {
+		assert.For(ctx, "KHR base").ThatSlice([]uint32{cmd.BaseGroupX(), cmd.BaseGroupY(), cmd.BaseGroupZ()}).Equals(tile.base[:])
+		assert.For(ctx, "KHR count").ThatSlice([]uint32{cmd.GroupCountX(), cmd.GroupCountY(), cmd.GroupCountZ()}).Equals(tile.count[:])
+	}
+	if cmd, ok := ipDispatchTileCmd(cb, 1, ipDispatchBaseUnsupported, tile).(*VkCmdDispatch); assert.For(ctx, "fallback command").That(ok).Equals(true) {
+		assert.For(ctx, "fallback count").ThatSlice([]uint32{cmd.GroupCountX(), cmd.GroupCountY(), cmd.GroupCountZ()}).Equals(tile.count[:])
+	}
+	assert.For(ctx, "pushed base with dispatch base").That(ipPushedTileBase(ipDispatchBaseKHR, tile)).Equals([3]uint32{})
+	assert.For(ctx, "pushed base without dispatch base").That(ipPushedTileBase(ipDispatchBaseUnsupported, tile)).Equals(tile.base)
+}
+
+// ipRecordingOutput records the commands written by a state builder, without
+// mutating the states.
+type ipRecordingOutput struct {
+	oldState *api.GlobalState
+	newState *api.GlobalState
+	cmds     []api.Cmd
+}
+
+func (o *ipRecordingOutput) write(ctx context.Context, cmd api.Cmd, id api.CmdID) {
+	o.cmds = append(o.cmds, cmd)
+}
+
+func (o *ipRecordingOutput) getOldState() *api.GlobalState { return o.oldState }
+
+func (o *ipRecordingOutput) getNewState() *api.GlobalState { return o.newState }
+
+func TestMipGenerationRange(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	dev, phyDev := VkDevice(1), VkPhysicalDevice(2)
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	phyDevObj := MakePhysicalDeviceObjectʳ(a)
+	phyDevObj.SetVulkanHandle(phyDev)
+	blitFeatures := VkFormatFeatureFlags(
+		VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_BLIT_SRC_BIT |
+			VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_BLIT_DST_BIT)
+	phyDevObj.FormatProperties().Add(VkFormat_VK_FORMAT_R8G8B8A8_UNORM, NewVkFormatProperties(a,
+		0,            // linearTilingFeatures
+		blitFeatures, // optimalTilingFeatures
+		0,            // bufferFeatures
+	))
+	// Only sampled, can not be blitted.
+	phyDevObj.FormatProperties().Add(VkFormat_VK_FORMAT_R32G32B32A32_UINT, NewVkFormatProperties(a,
+		0, // linearTilingFeatures
+		VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_SAMPLED_IMAGE_BIT), // optimalTilingFeatures
+		0, // bufferFeatures
+	))
+	GetState(oldState).PhysicalDevices().Add(phyDev, phyDevObj)
+	devObj := MakeDeviceObjectʳ(a)
+	devObj.SetVulkanHandle(dev)
+	devObj.SetPhysicalDevice(phyDev)
+	GetState(oldState).Devices().Add(dev, devObj)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, ta: a}
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	newImage := func(format VkFormat) ImageObjectʳ {
+		info := MakeImageInfo(a)
+		info.SetFmt(format)
+		info.SetTiling(VkImageTiling_VK_IMAGE_TILING_OPTIMAL)
+		info.SetSamples(VkSampleCountFlagBits_VK_SAMPLE_COUNT_1_BIT)
+		info.SetExtent(NewVkExtent3D(a, 8, 8, 1))
+		info.SetMipLevels(3)
+		info.SetArrayLayers(2)
+		img := MakeImageObjectʳ(a)
+		img.SetVulkanHandle(10)
+		img.SetDevice(dev)
+		img.SetInfo(info)
+		img.SetImageAspect(VkImageAspectFlags(color))
+		return img
+	}
+	// Only the base level of each layer has data.
+	baseData := map[ipSubresource][]uint8{
+		{aspect: color, layer: 0, level: 0}: {},
+		{aspect: color, layer: 1, level: 0}: {},
+	}
+	allLevels := []VkImageSubresourceRange{NewVkImageSubresourceRange(a,
+		VkImageAspectFlags(color), // aspectMask
+		0,                         // baseMipLevel
+		3,                         // levelCount
+		0,                         // baseArrayLayer
+		2,                         // layerCount
+	)}
+	transfer := VkImageUsageFlags(
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_SRC_BIT |
+			VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
+
+	p := &imagePrimer{sb: sb, srcData: baseData}
+	rng, ok := p.mipGenerationRange(newImage(VkFormat_VK_FORMAT_R8G8B8A8_UNORM), transfer, allLevels)
+	if assert.For(ctx, "only base level data").That(ok).Equals(true) {
+		assert.For(ctx, "base level").That(rng.BaseMipLevel()).Equals(uint32(0))
+		assert.For(ctx, "level count").That(rng.LevelCount()).Equals(uint32(1))
+		assert.For(ctx, "base layer").That(rng.BaseArrayLayer()).Equals(uint32(0))
+		assert.For(ctx, "layer count").That(rng.LayerCount()).Equals(uint32(2))
+	}
+
+	// The format without the blit feature falls back to priming all the
+	// levels.
+	_, ok = p.mipGenerationRange(newImage(VkFormat_VK_FORMAT_R32G32B32A32_UINT), transfer, allLevels)
+	assert.For(ctx, "no blit feature").That(ok).Equals(false)
+	// So do the formats whose features are unknown.
+	_, ok = p.mipGenerationRange(newImage(VkFormat_VK_FORMAT_R8_UNORM), transfer, allLevels)
+	assert.For(ctx, "unknown format features").That(ok).Equals(false)
+
+	// The image must be a transfer source and destination.
+	_, ok = p.mipGenerationRange(newImage(VkFormat_VK_FORMAT_R8G8B8A8_UNORM),
+		VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT), allLevels)
+	assert.For(ctx, "no transfer src usage").That(ok).Equals(false)
+
+	// Only the base level is requested, nothing to generate.
+	_, ok = p.mipGenerationRange(newImage(VkFormat_VK_FORMAT_R8G8B8A8_UNORM), transfer, []VkImageSubresourceRange{
+		NewVkImageSubresourceRange(a, VkImageAspectFlags(color), 0, 1, 0, 2)})
+	assert.For(ctx, "base level only requested").That(ok).Equals(false)
+
+	// The captured data of an upper level would be overwritten.
+	p.srcData = map[ipSubresource][]uint8{
+		{aspect: color, layer: 0, level: 0}: {},
+		{aspect: color, layer: 1, level: 0}: {},
+		{aspect: color, layer: 1, level: 2}: {},
+	}
+	_, ok = p.mipGenerationRange(newImage(VkFormat_VK_FORMAT_R8G8B8A8_UNORM), transfer, allLevels)
+	assert.For(ctx, "upper level data").That(ok).Equals(false)
+
+	// A layer without base level data can not be generated.
+	p.srcData = map[ipSubresource][]uint8{{aspect: color, layer: 0, level: 0}: {}}
+	_, ok = p.mipGenerationRange(newImage(VkFormat_VK_FORMAT_R8G8B8A8_UNORM), transfer, allLevels)
+	assert.For(ctx, "layer without base data").That(ok).Equals(false)
+}
+
+func TestMipGenerationBlits(t *testing.T) {
+	ctx := log.Testing(t)
+	ctx = database.Put(ctx, database.NewInMemory(ctx))
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	out := &ipRecordingOutput{oldState: oldState, newState: newState}
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a,
+		out: out, cb: CommandBuilder{Thread: 0, Arena: a}}
+	p := &imagePrimer{sb: sb}
+
+	info := MakeImageInfo(a)
+	info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+	info.SetExtent(NewVkExtent3D(a, 8, 4, 1))
+	info.SetMipLevels(3)
+	info.SetArrayLayers(2)
+	pi := &ipPrimeableByMipGeneration{p: p, img: 10, filter: VkFilter_VK_FILTER_LINEAR}
+	pi.recordMipGeneration(20, info)
+
+	// Each level is blitted from the previous level, after the previous level
+	// is transitioned to TRANSFER_SRC, then the last level is transitioned.
+	if !assert.For(ctx, "command count").That(len(out.cmds)).Equals(5) {
+		return
+	}
+	for i, level := range []uint32{1, 2} {
+		_, ok := out.cmds[2*i].(*VkCmdPipelineBarrier)
+		assert.For(ctx, "barrier before level %v", level).That(ok).Equals(true)
+		blit, ok := out.cmds[2*i+1].(*VkCmdBlitImage)
+		if !assert.For(ctx, "blit of level %v", level).That(ok).Equals(true) {
+			continue
+		}
+		assert.For(ctx, "command buffer").That(blit.CommandBuffer()).Equals(VkCommandBuffer(20))
+		assert.For(ctx, "src image").That(blit.SrcImage()).Equals(VkImage(10))
+		assert.For(ctx, "dst image").That(blit.DstImage()).Equals(VkImage(10))
+		assert.For(ctx, "src layout").That(blit.SrcImageLayout()).Equals(VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL)
+		assert.For(ctx, "dst layout").That(blit.DstImageLayout()).Equals(VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL)
+		assert.For(ctx, "region count").That(blit.RegionCount()).Equals(uint32(1))
+		assert.For(ctx, "filter").That(blit.Filter()).Equals(VkFilter_VK_FILTER_LINEAR)
+	}
+	_, ok := out.cmds[4].(*VkCmdPipelineBarrier)
+	assert.For(ctx, "barrier of last level").That(ok).Equals(true)
+
+	// The blit of level 2 covers all the layers, from the 4x2 level 1 to the
+	// 2x1 level 2.
+	region := ipMipGenerationBlit(sb, info, 2)
+	assert.For(ctx, "src level").That(region.SrcSubresource().MipLevel()).Equals(uint32(1))
+	assert.For(ctx, "dst level").That(region.DstSubresource().MipLevel()).Equals(uint32(2))
+	assert.For(ctx, "layer count").That(region.DstSubresource().LayerCount()).Equals(uint32(2))
+	src, dst := region.SrcOffsets().Get(1), region.DstOffsets().Get(1)
+	assert.For(ctx, "src extent").ThatSlice([]int32{src.X(), src.Y(), src.Z()}).Equals([]int32{4, 2, 1})
+	assert.For(ctx, "dst extent").ThatSlice([]int32{dst.X(), dst.Y(), dst.Z()}).Equals([]int32{2, 1, 1})
+}
+
+func TestSeparateDepthStencilLayouts(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	addDevice := func(dev VkDevice, feature bool, exts ...string) {
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		for i, ext := range exts {
+			devObj.EnabledExtensions().Add(uint32(i), ext)
+		}
+		if feature {
+			features := MakeSeparateDepthStencilLayoutsFeaturesʳ(a)
+			features.SetSeparateDepthStencilLayouts(VkBool32(1))
+			devObj.SetSeparateDepthStencilLayoutsFeatures(features)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1, false)
+	addDevice(2, false, "VK_KHR_separate_depth_stencil_layouts")
+	addDevice(3, true, "VK_KHR_separate_depth_stencil_layouts")
+	// The feature struct can only be chained when the extension is enabled.
+	addDevice(4, true)
+	for dev, expected := range map[VkDevice]bool{1: false, 2: false, 3: true, 4: false, 5: false} {
+		assert.For(ctx, "separate layouts on device %v", dev).That(ipSeparateDepthStencilLayouts(sb, dev)).Equals(expected)
+	}
+
+	// The aspects of a combined depth/stencil image are transitioned together
+	// unless the separate layouts are enabled.
+	info := MakeImageInfo(a)
+	info.SetFmt(VkFormat_VK_FORMAT_D24_UNORM_S8_UINT)
+	img := MakeImageObjectʳ(a)
+	img.SetInfo(info)
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	depthStencil := VkImageAspectFlags(depth | VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT)
+	img.SetDevice(2)
+	assert.For(ctx, "extension only").That(ipImageAspectBarrierFlags(sb, img, depth)).Equals(depthStencil)
+	img.SetDevice(3)
+	assert.For(ctx, "feature enabled").That(ipImageAspectBarrierFlags(sb, img, depth)).Equals(VkImageAspectFlags(depth))
+}
+
+func TestShaderStencilExport(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	addDevice := func(dev VkDevice, exts ...string) {
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		for i, ext := range exts {
+			devObj.EnabledExtensions().Add(uint32(i), ext)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1)
+	addDevice(2, "VK_KHR_swapchain", "VK_EXT_shader_stencil_export")
+	for dev, expected := range map[VkDevice]bool{1: false, 2: true, 3: false} {
+		assert.For(ctx, "stencil export on device %v", dev).That(ipShaderStencilExport(sb, dev)).Equals(expected)
+	}
+
+	// The stencil exporting shader renders all the bits in one pass, it must
+	// not share the cached code of the shader rendering one bit per pass.
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	perBit := ipRenderShaderInfo{dev: 1, aspect: stencil, format: VkFormat_VK_FORMAT_S8_UINT}
+	export := ipRenderShaderInfo{dev: 2, aspect: stencil, format: VkFormat_VK_FORMAT_S8_UINT, stencilExport: true}
+	assert.For(ctx, "spirv keys differ").That(perBit.spirvKey() != export.spirvKey()).Equals(true)
+	perBitCode, err := perBit.spirv()
+	assert.For(ctx, "per bit spirv").ThatError(err).Succeeded()
+	exportCode, err := export.spirv()
+	if assert.For(ctx, "export spirv").ThatError(err).Succeeded() {
+		assert.For(ctx, "export validation").ThatError(ipValidateShaderSpirv(exportCode)).Succeeded()
+		assert.For(ctx, "codes differ").That(fmt.Sprint(perBitCode) != fmt.Sprint(exportCode)).Equals(true)
+	}
+}
+
+func TestImagelessFramebuffer(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	out := &ipRecordingOutput{oldState: oldState, newState: newState}
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a,
+		out: out, cb: CommandBuilder{Thread: 0, Arena: a}}
+	addDevice := func(dev VkDevice, feature bool, exts ...string) {
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		for i, ext := range exts {
+			devObj.EnabledExtensions().Add(uint32(i), ext)
+		}
+		if feature {
+			features := MakeImagelessFramebufferFeaturesʳ(a)
+			features.SetImagelessFramebuffer(VkBool32(1))
+			devObj.SetImagelessFramebufferFeatures(features)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1, false)
+	addDevice(2, false, "VK_KHR_imageless_framebuffer")
+	addDevice(3, true, "VK_KHR_imageless_framebuffer")
+	addDevice(4, true)
+	for dev, expected := range map[VkDevice]bool{1: false, 2: false, 3: true, 4: false, 5: false} {
+		assert.For(ctx, "imageless framebuffer on device %v", dev).That(ipImagelessFramebuffer(sb, dev)).Equals(expected)
+	}
+
+	// The render jobs with the same framebuffer info share one framebuffer,
+	// which is created imageless and given the infos of the attachments.
+	h := newImagePrimerRenderHandler(sb)
+	attachments := []ipFramebufferAttachmentInfo{
+		{usage: VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_INPUT_ATTACHMENT_BIT), width: 8, height: 4, format: VkFormat_VK_FORMAT_R32_UINT},
+		{usage: VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT), width: 8, height: 4, format: VkFormat_VK_FORMAT_R8G8B8A8_UNORM},
+	}
+	info := ipImagelessFramebufferInfo{
+		renderPassInfo: ipRenderPassInfo{dev: 3, numInputAttachments: 1, numTargets: 1},
+		width:          8,
+		height:         4,
+		attachments:    fmt.Sprint(attachments),
+	}
+	h.getOrCreateImagelessFramebuffer(info, 10, attachments)
+	h.getOrCreateImagelessFramebuffer(info, 11, attachments)
+	if !assert.For(ctx, "command count").That(len(out.cmds)).Equals(1) {
+		return
+	}
+	create, ok := out.cmds[0].(*VkCreateFramebuffer)
+	assert.For(ctx, "create framebuffer").That(ok).Equals(true)
+	if ok {
+		assert.For(ctx, "device").That(create.Device()).Equals(VkDevice(3))
+	}
+
+	info.width = 4
+	h.getOrCreateImagelessFramebuffer(info, 10, attachments)
+	assert.For(ctx, "command count of another size").That(len(out.cmds)).Equals(2)
+}
+
+func TestSynchronization2Barriers(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	out := &ipRecordingOutput{oldState: oldState, newState: newState}
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a,
+		out: out, cb: CommandBuilder{Thread: 0, Arena: a}}
+	addDevice := func(dev VkDevice, feature bool, exts ...string) {
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		for i, ext := range exts {
+			devObj.EnabledExtensions().Add(uint32(i), ext)
+		}
+		if feature {
+			features := MakeSynchronization2Featuresʳ(a)
+			features.SetSynchronization2(VkBool32(1))
+			devObj.SetSynchronization2Features(features)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1, false)
+	addDevice(2, false, "VK_KHR_synchronization2")
+	addDevice(3, true, "VK_KHR_synchronization2")
+	addDevice(4, true)
+	for dev, expected := range map[VkDevice]bool{1: false, 2: false, 3: true, 4: false, 5: false} {
+		assert.For(ctx, "synchronization2 on device %v", dev).That(sb.synchronization2(dev)).Equals(expected)
+	}
+
+	// The barriers are written with vkCmdPipelineBarrier2KHR only to the
+	// command buffers of the devices with synchronization2 enabled.
+	for _, cb := range []struct {
+		handle VkCommandBuffer
+		dev    VkDevice
+	}{{10, 1}, {30, 3}} {
+		cmdBuf := MakeCommandBufferObjectʳ(a)
+		cmdBuf.SetVulkanHandle(cb.handle)
+		cmdBuf.SetDevice(cb.dev)
+		GetState(newState).CommandBuffers().Add(cb.handle, cmdBuf)
+	}
+	barrier := NewVkImageMemoryBarrier(a,
+		VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
+		0, // pNext
+		VkAccessFlags(VkAccessFlagBits_VK_ACCESS_TRANSFER_WRITE_BIT), // srcAccessMask
+		VkAccessFlags(VkAccessFlagBits_VK_ACCESS_SHADER_READ_BIT),    // dstAccessMask
+		VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,           // oldLayout
+		VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL,       // newLayout
+		queueFamilyIgnore, // srcQueueFamilyIndex
+		queueFamilyIgnore, // dstQueueFamilyIndex
+		100,               // image
+		NewVkImageSubresourceRange(a,
+			VkImageAspectFlags(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT), 0, 1, 0, 1), // subresourceRange
+	)
+	stage := VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT)
+	for _, commandBuffer := range []VkCommandBuffer{10, 20, 30} {
+		sb.writeImageBarriers(commandBuffer, stage, stage, []VkImageMemoryBarrier{barrier})
+	}
+	if !assert.For(ctx, "command count").That(len(out.cmds)).Equals(3) {
+		return
+	}
+	legacy, ok := out.cmds[0].(*VkCmdPipelineBarrier)
+	if assert.For(ctx, "legacy barrier without feature").That(ok).Equals(true) {
+		assert.For(ctx, "legacy barrier count").That(legacy.ImageMemoryBarrierCount()).Equals(uint32(1))
+	}
+	_, ok = out.cmds[1].(*VkCmdPipelineBarrier)
+	assert.For(ctx, "legacy barrier of unknown command buffer").That(ok).Equals(true)
+	barrier2, ok := out.cmds[2].(*VkCmdPipelineBarrier2KHR)
+	if assert.For(ctx, "synchronization2 barrier").That(ok).Equals(true) {
+		assert.For(ctx, "command buffer").That(barrier2.CommandBuffer()).Equals(VkCommandBuffer(30))
+	}
+}
+
+func TestExtendedDynamicState(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	out := &ipRecordingOutput{oldState: oldState, newState: newState}
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a,
+		out: out, cb: CommandBuilder{Thread: 0, Arena: a}}
+	addDevice := func(dev VkDevice, feature bool, exts ...string) {
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		for i, ext := range exts {
+			devObj.EnabledExtensions().Add(uint32(i), ext)
+		}
+		if feature {
+			features := MakeExtendedDynamicStateFeaturesʳ(a)
+			features.SetExtendedDynamicState(VkBool32(1))
+			devObj.SetExtendedDynamicStateFeatures(features)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1, false)
+	addDevice(2, false, "VK_EXT_extended_dynamic_state")
+	addDevice(3, true, "VK_EXT_extended_dynamic_state")
+	addDevice(4, true)
+	for dev, expected := range map[VkDevice]bool{1: false, 2: false, 3: true, 4: false, 5: false} {
+		assert.For(ctx, "extended dynamic state on device %v", dev).That(ipExtendedDynamicState(sb, dev)).Equals(expected)
+	}
+
+	// The depth and stencil states are only dynamic with the extension.
+	depth := ipRenderPassInfo{dev: 3, targetAspect: VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT}
+	assert.For(ctx, "static dynamic states").ThatSlice(ipRenderDynamicStates(ipGfxPipelineInfo{renderPassInfo: depth})).Equals([]VkDynamicState{
+		VkDynamicState_VK_DYNAMIC_STATE_VIEWPORT,
+		VkDynamicState_VK_DYNAMIC_STATE_SCISSOR,
+	})
+	assert.For(ctx, "extended dynamic states").ThatSlice(ipRenderDynamicStates(ipGfxPipelineInfo{renderPassInfo: depth, dynamicDepthStencil: true})).Equals([]VkDynamicState{
+		VkDynamicState_VK_DYNAMIC_STATE_VIEWPORT,
+		VkDynamicState_VK_DYNAMIC_STATE_SCISSOR,
+		VkDynamicState_VK_DYNAMIC_STATE_CULL_MODE_EXT,
+		VkDynamicState_VK_DYNAMIC_STATE_DEPTH_TEST_ENABLE_EXT,
+		VkDynamicState_VK_DYNAMIC_STATE_DEPTH_WRITE_ENABLE_EXT,
+		VkDynamicState_VK_DYNAMIC_STATE_DEPTH_COMPARE_OP_EXT,
+		VkDynamicState_VK_DYNAMIC_STATE_STENCIL_OP_EXT,
+	})
+
+	// The depth test state is set when drawing.
+	h := newImagePrimerRenderHandler(sb)
+	h.setDynamicDepthStencilState(20, ipRenderDepthState{testEnable: true, compareOp: VkCompareOp_VK_COMPARE_OP_LESS})
+	if !assert.For(ctx, "command count").That(len(out.cmds)).Equals(6) {
+		return
+	}
+	cull, ok := out.cmds[0].(*VkCmdSetCullModeEXT)
+	if assert.For(ctx, "cull mode").That(ok).Equals(true) {
+		assert.For(ctx, "cull mode value").That(cull.CullMode()).Equals(VkCullModeFlags(ipRenderCullMode))
+	}
+	test, ok := out.cmds[1].(*VkCmdSetDepthTestEnableEXT)
+	if assert.For(ctx, "depth test").That(ok).Equals(true) {
+		assert.For(ctx, "depth test value").That(test.DepthTestEnable()).Equals(VkBool32(1))
+	}
+	write, ok := out.cmds[2].(*VkCmdSetDepthWriteEnableEXT)
+	if assert.For(ctx, "depth write").That(ok).Equals(true) {
+		assert.For(ctx, "depth write value").That(write.DepthWriteEnable()).Equals(VkBool32(0))
+	}
+	compareOp, ok := out.cmds[3].(*VkCmdSetDepthCompareOpEXT)
+	if assert.For(ctx, "depth compare op").That(ok).Equals(true) {
+		assert.For(ctx, "depth compare op value").That(compareOp.DepthCompareOp()).Equals(VkCompareOp_VK_COMPARE_OP_LESS)
+	}
+	for i, face := range []VkStencilFaceFlagBits{VkStencilFaceFlagBits_VK_STENCIL_FACE_FRONT_BIT, VkStencilFaceFlagBits_VK_STENCIL_FACE_BACK_BIT} {
+		op, ok := out.cmds[4+i].(*VkCmdSetStencilOpEXT)
+		if assert.For(ctx, "stencil op %v", face).That(ok).Equals(true) {
+			assert.For(ctx, "stencil face mask").That(op.FaceMask()).Equals(VkStencilFaceFlags(face))
+		}
+	}
+}
+
+func TestPrimingStrategies(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	strategy, err := ipParsePrimingStrategy("rendering")
+	assert.For(ctx, "parse").ThatError(err).Succeeded()
+	assert.For(ctx, "parsed strategy").That(strategy).Equals(ipPrimingStrategyRendering)
+	_, err = ipParsePrimingStrategy("painting")
+	assert.For(ctx, "unknown strategy").ThatError(err).Failed()
+
+	// The strategies are forced with the options.
+	img := VkImage(10)
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	p := newImagePrimer(sb)
+	err = p.applyOptions(ctx, ImagePrimerOptions{ForceStrategies: []ImagePrimerStrategy{{Image: img, Strategy: "image-store"}}})
+	assert.For(ctx, "force").ThatError(err).Succeeded()
+	assert.For(ctx, "forced strategy").That(p.forcedStrategies[img]).Equals(ipPrimingStrategyImageStore)
+	p = newImagePrimer(sb)
+	err = p.applyOptions(ctx, ImagePrimerOptions{ForceStrategies: []ImagePrimerStrategy{{Image: img, Strategy: "painting"}}})
+	assert.For(ctx, "force unknown").ThatError(err).Failed()
+
+	info := MakeImageInfo(a)
+	info.SetTiling(VkImageTiling_VK_IMAGE_TILING_LINEAR)
+	info.SetInitialLayout(VkImageLayout_VK_IMAGE_LAYOUT_PREINITIALIZED)
+	color := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT |
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT |
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	assert.For(ctx, "color strategies").ThatSlice(ipApplicableStrategies(info, color, false)).Equals([]ipPrimingStrategy{
+		ipPrimingStrategyBufferCopy,
+		ipPrimingStrategyRendering,
+		ipPrimingStrategyImageStore,
+		ipPrimingStrategyPreinitialization,
+	})
+	info.SetTiling(VkImageTiling_VK_IMAGE_TILING_OPTIMAL)
+	depth := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT |
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT)
+	assert.For(ctx, "depth strategies").ThatSlice(ipApplicableStrategies(info, depth, false)).Equals([]ipPrimingStrategy{
+		ipPrimingStrategyRendering,
+	})
+	assert.For(ctx, "depth transfer strategies").ThatSlice(ipApplicableStrategies(info, depth, true)).Equals([]ipPrimingStrategy{
+		ipPrimingStrategyBufferCopy,
+		ipPrimingStrategyRendering,
+	})
+
+	// The result is reported once all the data is read back.
+	colorSub := ipSubresource{aspect: VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT}
+	depthSub := ipSubresource{aspect: VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT}
+	subresources := []ipSubresource{colorSub, depthSub}
+	captured := map[ipSubresource][]uint8{colorSub: {1, 2, 3, 4}, depthSub: {5, 6, 7}}
+	strategies := []ipPrimingStrategy{ipPrimingStrategyBufferCopy, ipPrimingStrategyRendering}
+	type result struct {
+		val interface{}
+		err error
+	}
+	check := func(name string, renderedColor []uint8, failRendering bool) []result {
+		results := []result{}
+		readbacks := newIPStrategyReadbacks(strategies, subresources, captured, func(val interface{}, err error) {
+			results = append(results, result{val, err})
+		})
+		readbacks.result(ipPrimingStrategyBufferCopy, colorSub)(&image.Data{Bytes: []uint8{1, 2, 3, 4}}, nil)
+		readbacks.result(ipPrimingStrategyBufferCopy, depthSub)(&image.Data{Bytes: []uint8{0, 5, 6, 7}}, nil)
+		if failRendering {
+			readbacks.fail(ipPrimingStrategyRendering, fmt.Errorf("no staging image"))
+		} else {
+			readbacks.result(ipPrimingStrategyRendering, colorSub)(&image.Data{Bytes: renderedColor}, nil)
+			assert.For(ctx, "%v pending", name).That(len(results)).Equals(0)
+			readbacks.result(ipPrimingStrategyRendering, depthSub)(&image.Data{Bytes: []uint8{0, 5, 6, 7}}, nil)
+		}
+		assert.For(ctx, "%v reported", name).That(len(results)).Equals(1)
+		return results
+	}
+	results := check("same data", []uint8{1, 2, 3, 4}, false)
+	if len(results) == 1 {
+		assert.For(ctx, "same data").ThatError(results[0].err).Succeeded()
+		assert.For(ctx, "checked strategies").ThatSlice(results[0].val).Equals([]string{"buffer-copy", "rendering"})
+	}
+	results = check("different data", []uint8{1, 2, 3, 0}, false)
+	if len(results) == 1 {
+		assert.For(ctx, "different data").ThatError(results[0].err).Failed()
+	}
+	results = check("failed strategy", nil, true)
+	if len(results) == 1 {
+		assert.For(ctx, "failed strategy").ThatError(results[0].err).Failed()
+	}
+
+	// The color data is compared with the captured data, and all the data
+	// across the strategies.
+	data := map[ipPrimingStrategy]map[ipSubresource][]uint8{
+		ipPrimingStrategyBufferCopy: {colorSub: {1, 2, 3, 0}, depthSub: {0, 5, 6, 7}},
+		ipPrimingStrategyRendering:  {colorSub: {1, 2, 3, 0}, depthSub: {0, 5, 6, 8}},
+	}
+	errs := ipCompareStrategyReadbacks(strategies, subresources, captured, data)
+	assert.For(ctx, "mismatches").That(len(errs)).Equals(3)
+}
+
+func TestTimelineSemaphoreSignal(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a,
+		out: &ipRecordingOutput{oldState: oldState, newState: newState}, cb: CommandBuilder{Thread: 0, Arena: a}}
+	addDevice := func(dev VkDevice, feature bool) {
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		devObj.EnabledExtensions().Add(0, "VK_KHR_timeline_semaphore")
+		if feature {
+			features := MakeTimelineSemaphoreFeaturesʳ(a)
+			features.SetTimelineSemaphore(VkBool32(1))
+			devObj.SetTimelineSemaphoreFeatures(features)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1, true)
+	addDevice(2, false)
+	addSemaphore := func(sem VkSemaphore, dev VkDevice, semType VkSemaphoreTypeKHR, value uint64) {
+		semObj := MakeSemaphoreObjectʳ(a)
+		semObj.SetVulkanHandle(sem)
+		semObj.SetDevice(dev)
+		semObj.SetType(semType)
+		semObj.SetValue(value)
+		sb.s.Semaphores().Add(sem, semObj)
+	}
+	addSemaphore(10, 1, VkSemaphoreTypeKHR_VK_SEMAPHORE_TYPE_TIMELINE_KHR, 4)
+	addSemaphore(11, 1, VkSemaphoreTypeKHR_VK_SEMAPHORE_TYPE_BINARY_KHR, 0)
+	addSemaphore(12, 2, VkSemaphoreTypeKHR_VK_SEMAPHORE_TYPE_TIMELINE_KHR, 0)
+
+	p := newImagePrimer(sb)
+	for _, test := range []struct {
+		sem   VkSemaphore
+		value uint64
+		ok    bool
+	}{
+		{10, 5, true},
+		{10, 4, false},
+		{11, 5, false},
+		{12, 5, false},
+		{13, 5, false},
+	} {
+		err := p.checkSignalSemaphore(test.sem, test.value)
+		assert.For(ctx, "signal semaphore %v with %v", test.sem, test.value).That(err == nil).Equals(test.ok)
+	}
+
+	// A semaphore that can not be signaled is not set up to be signaled.
+	opts := ImagePrimerOptions{SignalSemaphore: 11, SignalValue: 5, SignalEachImage: true}
+	assert.For(ctx, "apply binary semaphore").That(p.applyOptions(ctx, opts) != nil).Equals(true)
+	assert.For(ctx, "binary semaphore").That(p.signalSemaphore).Equals(VkSemaphore(0))
+	opts.SignalSemaphore = 10
+	assert.For(ctx, "apply timeline semaphore").ThatError(p.applyOptions(ctx, opts)).Succeeded()
+	assert.For(ctx, "timeline semaphore").That(p.signalSemaphore).Equals(VkSemaphore(10))
+	assert.For(ctx, "value").That(p.signalValue).Equals(uint64(5))
+	assert.For(ctx, "each image").That(p.signalEachImage).Equals(true)
+
+	// The signals of the committed tasks are added to the next submission of
+	// their queue.
+	task := &scratchTask{sb: sb, queue: 20}
+	task.signalTimelineSemaphore(10, 5).signalTimelineSemaphore(10, 6)
+	assert.For(ctx, "task signals").That(len(task.timelineSignals)).Equals(2)
+	qr := &queueFamilyScratchResources{sb: sb, timelineSignals: map[VkQueue][]scratchTimelineSignal{20: task.timelineSignals}}
+	info := qr.submitInfo(20, 30)
+	assert.For(ctx, "signal semaphore count").That(info.SignalSemaphoreCount()).Equals(uint32(2))
+	assert.For(ctx, "timeline info").That(info.PNext().IsNullptr()).Equals(false)
+	info = qr.submitInfo(21, 30)
+	assert.For(ctx, "signal semaphore count of another queue").That(info.SignalSemaphoreCount()).Equals(uint32(0))
+	assert.For(ctx, "no timeline info").That(info.PNext().IsNullptr()).Equals(true)
+}
+
+func TestCollectCopiesFromCombinedAspects(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	depth := VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT
+	stencil := VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	newImage := func(handle VkImage) ImageObjectʳ {
+		info := MakeImageInfo(a)
+		info.SetFmt(VkFormat_VK_FORMAT_D32_SFLOAT_S8_UINT)
+		info.SetExtent(NewVkExtent3D(a, 4, 2, 1))
+		info.SetMipLevels(1)
+		info.SetArrayLayers(2)
+		img := MakeImageObjectʳ(a)
+		img.SetVulkanHandle(handle)
+		img.SetInfo(info)
+		img.SetImageAspect(VkImageAspectFlags(depth | stencil))
+		return img
+	}
+	src, dst0, dst1 := newImage(10), newImage(11), newImage(12)
+	srcData := map[ipSubresource][]uint8{}
+	for layer := uint32(0); layer < 2; layer++ {
+		srcData[ipSubresource{aspect: depth, layer: layer}] = make([]uint8, 4*2*4)
+		srcData[ipSubresource{aspect: stencil, layer: layer}] = make([]uint8, 4*2)
+	}
+	rng := NewVkImageSubresourceRange(a,
+		VkImageAspectFlags(depth|stencil), // aspectMask
+		0,                                 // baseMipLevel
+		1,                                 // levelCount
+		0,                                 // baseArrayLayer
+		2,                                 // layerCount
+	)
+
+	// The walk visits each subresource once with both of its aspects.
+	walked := []ipSubresource{}
+	walkImageSubresourceRangeAspects(sb, src, rng, func(aspects []VkImageAspectFlagBits, layer, level uint32, levelSizes []byteSizeAndExtent) {
+		assert.For(ctx, "aspects of layer %v", layer).ThatSlice(aspects).Equals([]VkImageAspectFlagBits{depth, stencil})
+		assert.For(ctx, "level sizes of layer %v", layer).That(len(levelSizes)).Equals(2)
+		walked = append(walked, ipSubresource{layer: layer, level: level})
+	})
+	assert.For(ctx, "walked").ThatSlice(walked).Equals([]ipSubresource{{layer: 0}, {layer: 1}})
+
+	// The depth data is copied to two dst images, walking the aspects together
+	// reads it once for both of them.
+	collect := func(combine bool) *ipBufferImageCopySession {
+		job := newImagePrimerBufferImageCopyJob(src)
+		assert.For(ctx, "add depth dsts").ThatError(job.addDst(ctx, depth, depth, dst0, dst1)).Succeeded()
+		assert.For(ctx, "add stencil dst").ThatError(job.addDst(ctx, stencil, stencil, dst0)).Succeeded()
+		session := newImagePrimerBufferImageCopySession(sb, job, srcData)
+		session.combineAspects = combine
+		session.collectCopiesFromSubresourceRanges([]VkImageSubresourceRange{rng})
+		assert.For(ctx, "errors").That(len(session.errs)).Equals(0)
+		return session
+	}
+	separate, combined := collect(false), collect(true)
+	assert.For(ctx, "separate reads").That(*separate.reads).Equals(ipSourceReads{reads: 6})
+	assert.For(ctx, "combined reads").That(*combined.reads).Equals(ipSourceReads{reads: 4, saved: 2})
+	// The copies of the layers are coalesced for each aspect unless the
+	// aspects of the layers are copied to the same dst image one after
+	// another.
+	assert.For(ctx, "separate copies to both aspects").That(len(separate.copies[dst0])).Equals(2)
+	assert.For(ctx, "combined copies to both aspects").That(len(combined.copies[dst0])).Equals(4)
+	assert.For(ctx, "separate copies to depth").That(len(separate.copies[dst1])).Equals(1)
+	assert.For(ctx, "combined copies to depth").That(len(combined.copies[dst1])).Equals(1)
+	assert.For(ctx, "total size").That(combined.totalSize).Equals(separate.totalSize)
+	assert.For(ctx, "walked data dropped").That(combined.walked == nil).Equals(true)
+}
+
+func TestValidatePrimedImage(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	color := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	rgba := func(bytes ...uint8) *image.Data {
+		return &image.Data{Bytes: bytes, Width: 2, Height: 1, Depth: 1, Format: image.RGBA_U8_NORM}
+	}
+	primed := rgba(0, 0, 0, 255, 255, 255, 255, 255)
+	dir, err := ioutil.TempDir("", "image_primer_reference")
+	assert.For(ctx, "temp dir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	// The reference as a PNG file.
+	png, err := rgba(0, 0, 0, 255, 255, 250, 255, 255).Convert(image.PNG)
+	assert.For(ctx, "png").ThatError(err).Succeeded()
+	pngPath := filepath.Join(dir, "reference.png")
+	assert.For(ctx, "write png").ThatError(ioutil.WriteFile(pngPath, png.Bytes, 0644)).Succeeded()
+
+	// The same reference as a GL_RGBA8 KTX file with a key/value pair.
+	u32 := func(values ...uint32) []uint8 {
+		b := []uint8{}
+		for _, v := range values {
+			b = append(b, uint8(v), uint8(v>>8), uint8(v>>16), uint8(v>>24))
+		}
+		return b
+	}
+	ktx := append([]uint8{}, ipKTXIdentifier...)
+	ktx = append(ktx, u32(0x04030201, 0x1401, 1, 0x1908, 0x8058, 0x1908, 2, 1, 0, 0, 1, 1, 8)...)
+	ktx = append(ktx, u32(4)...)
+	ktx = append(ktx, 'k', 0, 'v', 0)
+	ktx = append(ktx, u32(8)...)
+	ktx = append(ktx, 0, 0, 0, 255, 255, 250, 255, 255)
+	ktxPath := filepath.Join(dir, "reference.ktx")
+	assert.For(ctx, "write ktx").ThatError(ioutil.WriteFile(ktxPath, ktx, 0644)).Succeeded()
+
+	for _, path := range []string{pngPath, ktxPath} {
+		reference, err := ipLoadReferenceImage(path)
+		if !assert.For(ctx, "load %v", path).ThatError(err).Succeeded() {
+			continue
+		}
+		diffs, err := ipCompareImageData(primed, reference, 0.05)
+		assert.For(ctx, "%v within tolerance", path).ThatError(err).Succeeded()
+		assert.For(ctx, "%v within tolerance", path).That(len(diffs)).Equals(0)
+		diffs, err = ipCompareImageData(primed, reference, 0.01)
+		assert.For(ctx, "%v above tolerance", path).ThatError(err).Succeeded()
+		if assert.For(ctx, "%v above tolerance", path).That(len(diffs)).Equals(1) {
+			assert.For(ctx, "%v diff at", path).That([2]uint32{diffs[0].x, diffs[0].y}).Equals([2]uint32{1, 0})
+		}
+	}
+	_, err = ipKTXFrom(ktx[:len(ktx)-1])
+	assert.For(ctx, "truncated ktx").ThatError(err).Failed()
+	_, err = ipLoadReferenceImage(filepath.Join(dir, "reference.bmp"))
+	assert.For(ctx, "unsupported reference").ThatError(err).Failed()
+	smaller := &image.Data{Bytes: []uint8{0, 0, 0, 255}, Width: 1, Height: 1, Depth: 1, Format: image.RGBA_U8_NORM}
+	_, err = ipCompareImageData(smaller, primed, 0.05)
+	assert.For(ctx, "size mismatch").ThatError(err).Failed()
+
+	// The validations are parsed from the options.
+	opts, err := ParseImagePrimerOptions([]byte(fmt.Sprintf(`{"validateImages": [{"image": 10, "aspect": %v, "reference": %q, "tolerance": 0.01}]}`, color, pngPath)))
+	if !assert.For(ctx, "parse").ThatError(err).Succeeded() || !assert.For(ctx, "validations").That(len(opts.ValidateImages)).Equals(1) {
+		return
+	}
+	v := opts.ValidateImages[0]
+	assert.For(ctx, "validation").That(v).Equals(ImagePrimerValidation{Image: 10, Aspect: color, Reference: pngPath, Tolerance: 0.01})
+
+	// The primed data is read back and compared with the reference, the
+	// results of all the validations are reported once.
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	p := newImagePrimer(sb)
+	img := MakeImageObjectʳ(a)
+	img.SetVulkanHandle(10)
+	GetState(newState).Images().Add(10, img)
+	readback := func(img ImageObjectʳ, sub ipSubresource, res replay.Result) {
+		assert.For(ctx, "read back subresource").That(sub).Equals(ipSubresource{aspect: color})
+		res(primed, nil)
+	}
+	var val interface{}
+	results := newIPImageValidations(2, func(v interface{}, e error) { val, err = v, e })
+	p.validatePrimedImage(v, readback, results.result(v))
+	assert.For(ctx, "pending").That(val == nil && err == nil).Equals(true)
+	p.validatePrimedImage(ImagePrimerValidation{Image: 10, Aspect: color, Reference: pngPath, Tolerance: 0.05}, readback, results.result(v))
+	assert.For(ctx, "mismatch").ThatError(err).Failed()
+
+	results = newIPImageValidations(1, func(v interface{}, e error) { val, err = v, e })
+	p.validatePrimedImage(ImagePrimerValidation{Image: 10, Aspect: color, Reference: ktxPath, Tolerance: 0.05}, readback, results.result(v))
+	assert.For(ctx, "match").ThatError(err).Succeeded()
+	assert.For(ctx, "validated").That(val).Equals(1)
+
+	// The images not in the state fail to be primed.
+	p.validatePrimedImages([]ImagePrimerValidation{{Image: 11, Aspect: color, Reference: pngPath}}, readback, func(v interface{}, e error) { val, err = v, e })
+	assert.For(ctx, "nil image").ThatError(err).Failed()
+}
+
+func TestStagingOverallocation(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	for _, test := range []struct {
+		failures int
+		factor   float64
+	}{
+		{0, 2.0},
+		{1, 1.75},
+		{2, 1.5},
+		{4, 1.0},
+		{10, 1.0},
+	} {
+		assert.For(ctx, "factor for %v failures", test.failures).That(ipStagingOverallocation(test.failures)).Equals(test.factor)
+	}
+
+	offsets, total := ipPlaneOffsets([]VkDeviceSize{ipPlaneAllocationAlignment, 100}, ipStagingOverallocation(4))
+	assert.For(ctx, "offsets").ThatSlice(offsets).Equals([]VkDeviceSize{0, ipPlaneAllocationAlignment})
+	assert.For(ctx, "total").That(total).Equals(VkDeviceSize(2 * ipPlaneAllocationAlignment))
+	assert.For(ctx, "rounded up").That(ipOverallocatedSize(3, ipStagingOverallocation(1))).Equals(VkDeviceSize(6))
+
+	// The allocation failures are counted from the results read back from the
+	// replay, and given back to the primer through the options.
+	q := newQueryAllocationFailures(4)
+	for _, res := range []VkResult{
+		VkResult_VK_SUCCESS,
+		VkResult_VK_ERROR_OUT_OF_DEVICE_MEMORY,
+		VkResult_VK_SUCCESS,
+		VkResult_VK_ERROR_OUT_OF_HOST_MEMORY,
+	} {
+		q.record(res)
+	}
+	assert.For(ctx, "allocations").That(q.allocations).Equals(4)
+	assert.For(ctx, "failures").That(q.failures).Equals(2)
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a}
+	p := newImagePrimer(sb)
+	assert.For(ctx, "apply").ThatError(p.applyOptions(ctx, ImagePrimerOptions{AllocationFailures: q.failures})).Succeeded()
+	assert.For(ctx, "reduced factor").That(ipStagingOverallocation(p.allocationFailures)).Equals(1.5)
+}
+
+func TestSynchronization2Layouts(t *testing.T) {
+	ctx := log.Testing(t)
+	a := arena.New()
+	defer a.Dispose()
+
+	oldState := api.NewStateWithEmptyAllocator(device.Little32)
+	newState := api.NewStateWithEmptyAllocator(device.Little32)
+	out := &ipRecordingOutput{oldState: oldState, newState: newState}
+	sb := &stateBuilder{ctx: ctx, s: GetState(oldState), oldState: oldState, newState: newState, ta: a,
+		out: out, cb: CommandBuilder{Thread: 0, Arena: a}}
+	addDevice := func(dev VkDevice, feature bool) {
+		devObj := MakeDeviceObjectʳ(a)
+		devObj.SetVulkanHandle(dev)
+		devObj.EnabledExtensions().Add(0, "VK_KHR_synchronization2")
+		if feature {
+			features := MakeSynchronization2Featuresʳ(a)
+			features.SetSynchronization2(VkBool32(1))
+			devObj.SetSynchronization2Features(features)
+		}
+		GetState(newState).Devices().Add(dev, devObj)
+	}
+	addDevice(1, false)
+	addDevice(2, true)
+
+	for layout, expected := range map[VkImageLayout]bool{
+		VkImageLayout_VK_IMAGE_LAYOUT_READ_ONLY_OPTIMAL_KHR:       true,
+		VkImageLayout_VK_IMAGE_LAYOUT_ATTACHMENT_OPTIMAL_KHR:      true,
+		VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL:    false,
+		VkImageLayout_VK_IMAGE_LAYOUT_DEPTH_READ_ONLY_OPTIMAL_KHR: false,
+	} {
+		assert.For(ctx, "%v", layout).That(ipSynchronization2Layout(layout)).Equals(expected)
+	}
+
+	info := MakeImageInfo(a)
+	info.SetFmt(VkFormat_VK_FORMAT_R8G8B8A8_UNORM)
+	info.SetExtent(NewVkExtent3D(a, 4, 4, 1))
+	info.SetMipLevels(2)
+	info.SetArrayLayers(1)
+	img := MakeImageObjectʳ(a)
+	img.SetVulkanHandle(100)
+	img.SetInfo(info)
+	img.SetImageAspect(VkImageAspectFlags(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT))
+	readOnly := VkImageLayout_VK_IMAGE_LAYOUT_READ_ONLY_OPTIMAL_KHR
+
+	// Priming into READ_ONLY_OPTIMAL fails clearly without the feature, even
+	// if only one level is to be left in the layout.
+	p := newImagePrimer(sb)
+	rng := NewVkImageSubresourceRange(a, VkImageAspectFlags(VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT), 1, 1, 0, 1)
+	dstLayout := useLayoutsOfRanges(VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL).setLayout(rng, readOnly)
+	img.SetDevice(1)
+	assert.For(ctx, "without feature").ThatError(p.checkDstLayouts(img, dstLayout)).Failed()
+	assert.For(ctx, "legacy layouts without feature").ThatError(
+		p.checkDstLayouts(img, useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL))).Succeeded()
+	img.SetDevice(2)
+	assert.For(ctx, "with feature").ThatError(p.checkDstLayouts(img, dstLayout)).Succeeded()
+
+	// With the feature, the image is transitioned to READ_ONLY_OPTIMAL with
+	// vkCmdPipelineBarrier2KHR.
+	cmdBuf := MakeCommandBufferObjectʳ(a)
+	cmdBuf.SetVulkanHandle(20)
+	cmdBuf.SetDevice(2)
+	GetState(newState).CommandBuffers().Add(20, cmdBuf)
+	barrier := NewVkImageMemoryBarrier(a,
+		VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
+		0, // pNext
+		VkAccessFlags(VkAccessFlagBits_VK_ACCESS_TRANSFER_WRITE_BIT), // srcAccessMask
+		VkAccessFlags(VkAccessFlagBits_VK_ACCESS_SHADER_READ_BIT),    // dstAccessMask
+		VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,           // oldLayout
+		readOnly,          // newLayout
+		queueFamilyIgnore, // srcQueueFamilyIndex
+		queueFamilyIgnore, // dstQueueFamilyIndex
+		100,               // image
+		rng,               // subresourceRange
+	)
+	stage := VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT)
+	sb.writeImageBarriers(20, stage, stage, []VkImageMemoryBarrier{barrier})
+	if !assert.For(ctx, "command count").That(len(out.cmds)).Equals(1) {
+		return
+	}
+	barrier2, ok := out.cmds[0].(*VkCmdPipelineBarrier2KHR)
+	if assert.For(ctx, "synchronization2 barrier").That(ok).Equals(true) {
+		assert.For(ctx, "command buffer").That(barrier2.CommandBuffer()).Equals(VkCommandBuffer(20))
+	}
+}
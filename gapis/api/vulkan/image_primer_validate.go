@@ -0,0 +1,336 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/gapid/core/image"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/api"
+	"github.com/google/gapid/gapis/api/transform"
+	"github.com/google/gapid/gapis/replay"
+)
+
+// maxReportedPixelDiffs is the max number of the pixels differing from the
+// reference image listed in the error of a validation.
+const maxReportedPixelDiffs = 16
+
+// ipPixelDiff is a pixel of a primed image which differs from the reference
+// image by more than the tolerance.
+type ipPixelDiff struct {
+	x, y uint32
+	// diff is the max absolute difference of the channels of the pixel.
+	diff float32
+}
+
+// ValidatePrimedImages primes the images of the given validations with the
+// given options after the command with the given id, reads back the primed
+// subresources and compares them with the reference images. The result is
+// reported to res: the number of the validated subresources if all of them
+// match their references, otherwise an error listing the differences, see
+// validatePrimedImage.
+func (t *readFramebuffer) ValidatePrimedImages(id api.CmdID, opts ImagePrimerOptions, res replay.Result) {
+	t.injections[id] = append(t.injections[id], func(ctx context.Context, cmd api.Cmd, out transform.Writer) {
+		s := out.State()
+		sb := GetState(s).newStateBuilder(ctx, newTransformerOutput(out))
+		sb.cb = CommandBuilder{Thread: cmd.Thread(), Arena: s.Arena}
+		p := newImagePrimer(sb)
+		if err := p.applyOptions(ctx, opts); err != nil {
+			log.W(ctx, "[Applying the image primer options for validating primed images] %v", err)
+		}
+		p.validatePrimedImages(opts.ValidateImages, ipPostImageDataReadback(ctx, sb.cb, s, out), res)
+		p.free()
+		sb.flushAllScratchResources()
+		sb.freeAllScratchResources()
+	})
+}
+
+// validatePrimedImages primes the whole images of the given validations, once
+// each, and validates their primed subresources with validatePrimedImage, the
+// readbacks of all of them being collected by an ipImageValidations.
+func (p *imagePrimer) validatePrimedImages(validations []ImagePrimerValidation, readback ipReadback, res replay.Result) {
+	if len(validations) == 0 {
+		res(nil, log.Errf(p.sb.ctx, nil, "No primed image to validate"))
+		return
+	}
+	results := newIPImageValidations(len(validations), res)
+	primed := map[VkImage]error{}
+	for _, v := range validations {
+		err, ok := primed[v.Image]
+		if !ok {
+			if imgObj := GetState(p.sb.oldState).Images().Get(v.Image); imgObj.IsNil() {
+				err = fmt.Errorf("Nil Image in old state")
+			} else {
+				err = p.primeRange(imgObj, p.sb.imageWholeSubresourceRange(imgObj), nil)
+			}
+			primed[v.Image] = err
+		}
+		if err != nil {
+			results.result(v)(nil, fmt.Errorf("priming: %v", err))
+			continue
+		}
+		p.validatePrimedImage(v, readback, results.result(v))
+	}
+}
+
+// validatePrimedImage reads back the primed data of the subresource of the
+// given validation with readback and compares it with the reference image of
+// the validation, see ipCompareImageData. The queued priming works and the
+// scratch resources are flushed first, so the data is read after it is primed.
+// The result is reported to res: the pixels which differ from the reference
+// by more than the tolerance of the validation, or an error if the data can
+// not be read back or compared.
+func (p *imagePrimer) validatePrimedImage(v ImagePrimerValidation, readback ipReadback, res replay.Result) {
+	reference, err := ipLoadReferenceImage(v.Reference)
+	if err != nil {
+		res(nil, log.Errf(p.sb.ctx, err, "[Loading reference image: %v]", v.Reference))
+		return
+	}
+	imgObj := GetState(p.sb.newState).Images().Get(v.Image)
+	if imgObj.IsNil() {
+		res(nil, log.Errf(p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Validating primed image: %v]", v.Image))
+		return
+	}
+	p.flushPrimingWorks()
+	p.sb.flushAllScratchResources()
+	readback(imgObj, ipSubresource{aspect: v.Aspect, layer: v.Layer, level: v.Level}, func(val interface{}, err error) {
+		if err != nil {
+			res(nil, err)
+			return
+		}
+		primed, ok := val.(*image.Data)
+		if !ok {
+			res(nil, fmt.Errorf("unexpected readback result: %T", val))
+			return
+		}
+		diffs, err := ipCompareImageData(primed, reference, v.Tolerance)
+		if err != nil {
+			res(nil, err)
+			return
+		}
+		res(diffs, nil)
+	})
+}
+
+// ipImageValidations collects the results of the validations of the primed
+// images, and reports the result of all of them once all the validations are
+// done, see validatePrimedImages.
+type ipImageValidations struct {
+	mutex     sync.Mutex
+	validated int
+	errs      []error
+	pending   int
+	res       replay.Result
+}
+
+func newIPImageValidations(count int, res replay.Result) *ipImageValidations {
+	return &ipImageValidations{pending: count, res: res}
+}
+
+// result returns the replay.Result which collects the pixel diffs of the given
+// validation, see validatePrimedImage.
+func (r *ipImageValidations) result(v ImagePrimerValidation) replay.Result {
+	return func(val interface{}, err error) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		at := fmt.Sprintf("image: %v aspect: %v, layer: %v, level: %v", v.Image, v.Aspect, v.Layer, v.Level)
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("validating %v: %v", at, err))
+		} else if diffs, ok := val.([]ipPixelDiff); !ok {
+			r.errs = append(r.errs, fmt.Errorf("validating %v: unexpected result: %T", at, val))
+		} else if len(diffs) > 0 {
+			r.errs = append(r.errs, ipPixelDiffsError(at, v.Reference, v.Tolerance, diffs))
+		} else {
+			r.validated++
+		}
+		r.pending--
+		if r.pending > 0 {
+			return
+		}
+		if len(r.errs) > 0 {
+			msgs := make([]string, len(r.errs))
+			for i, err := range r.errs {
+				msgs[i] = err.Error()
+			}
+			r.res(nil, fmt.Errorf("Primed images mismatch: %v", strings.Join(msgs, "; ")))
+			return
+		}
+		r.res(r.validated, nil)
+	}
+}
+
+// ipPixelDiffsError returns the error listing the given pixels of the given
+// subresource which differ from the given reference image by more than the
+// given tolerance, at most maxReportedPixelDiffs of them.
+func ipPixelDiffsError(at, reference string, tolerance float32, diffs []ipPixelDiff) error {
+	listed := diffs
+	if len(listed) > maxReportedPixelDiffs {
+		listed = listed[:maxReportedPixelDiffs]
+	}
+	pixels := make([]string, len(listed))
+	for i, d := range listed {
+		pixels[i] = fmt.Sprintf("(%v, %v) by %v", d.x, d.y, d.diff)
+	}
+	more := ""
+	if len(diffs) > len(listed) {
+		more = fmt.Sprintf(" and %v more", len(diffs)-len(listed))
+	}
+	return fmt.Errorf("%v pixel(s) of %v differ from reference: %v by more than %v: %v%v",
+		len(diffs), at, reference, tolerance, strings.Join(pixels, ", "), more)
+}
+
+// ipLoadReferenceImage loads the reference image at the given path, which must
+// be a PNG or a KTX file.
+func ipLoadReferenceImage(path string) (*image.Data, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".png" && ext != ".ktx" {
+		return nil, fmt.Errorf("Unsupported reference image file: %v, only PNG and KTX files are supported", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext == ".ktx" {
+		return ipKTXFrom(data)
+	}
+	return image.PNGFrom(data)
+}
+
+// ipKTXFormats are the image formats of the KTX glInternalFormats supported
+// for the reference images. The uncompressed formats are the ones whose rows
+// need no padding to 4 bytes.
+var ipKTXFormats = map[uint32]*image.Format{
+	0x8058: image.RGBA_U8_NORM,             // GL_RGBA8
+	0x8C43: image.SRGBA_U8_NORM,            // GL_SRGB8_ALPHA8
+	0x9270: image.ETC2_R_U11_NORM,          // GL_COMPRESSED_R11_EAC
+	0x9271: image.ETC2_R_S11_NORM,          // GL_COMPRESSED_SIGNED_R11_EAC
+	0x9272: image.ETC2_RG_U11_NORM,         // GL_COMPRESSED_RG11_EAC
+	0x9273: image.ETC2_RG_S11_NORM,         // GL_COMPRESSED_SIGNED_RG11_EAC
+	0x9274: image.ETC2_RGB_U8_NORM,         // GL_COMPRESSED_RGB8_ETC2
+	0x9275: image.ETC2_SRGB_U8_NORM,        // GL_COMPRESSED_SRGB8_ETC2
+	0x9276: image.ETC2_RGBA_U8U8U8U1_NORM,  // GL_COMPRESSED_RGB8_PUNCHTHROUGH_ALPHA1_ETC2
+	0x9277: image.ETC2_SRGBA_U8U8U8U1_NORM, // GL_COMPRESSED_SRGB8_PUNCHTHROUGH_ALPHA1_ETC2
+	0x9278: image.ETC2_RGBA_U8_NORM,        // GL_COMPRESSED_RGBA8_ETC2_EAC
+	0x9279: image.ETC2_SRGBA_U8_NORM,       // GL_COMPRESSED_SRGB8_ALPHA8_ETC2_EAC
+}
+
+// ipKTXIdentifier is the identifier which starts KTX files.
+var ipKTXIdentifier = []uint8{0xAB, 0x4B, 0x54, 0x58, 0x20, 0x31, 0x31, 0xBB, 0x0D, 0x0A, 0x1A, 0x0A}
+
+// ipKTXFrom returns the data of the first mip level of the given little endian
+// KTX file. Only 2D textures of single face in the formats of ipKTXFormats are
+// supported.
+// See: https://www.khronos.org/opengles/sdk/tools/KTX/file_format_spec/
+func ipKTXFrom(data []uint8) (*image.Data, error) {
+	const headerSize = 64
+	if len(data) < headerSize || !bytes.Equal(data[:len(ipKTXIdentifier)], ipKTXIdentifier) {
+		return nil, fmt.Errorf("Invalid KTX header")
+	}
+	header := make([]uint32, (headerSize-len(ipKTXIdentifier))/4)
+	for i := range header {
+		header[i] = binary.LittleEndian.Uint32(data[len(ipKTXIdentifier)+i*4:])
+	}
+	endianness, glInternalFormat := header[0], header[4]
+	width, height, depth := header[6], header[7], header[8]
+	arrayElements, faces, keyValueSize := header[9], header[10], header[12]
+	if endianness != 0x04030201 {
+		return nil, fmt.Errorf("Unsupported KTX endianness: 0x%x", endianness)
+	}
+	if depth != 0 || arrayElements != 0 || faces != 1 {
+		return nil, fmt.Errorf("Unsupported KTX texture of depth: %v, array elements: %v, faces: %v", depth, arrayElements, faces)
+	}
+	format, ok := ipKTXFormats[glInternalFormat]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported KTX glInternalFormat: 0x%x", glInternalFormat)
+	}
+	offset := uint64(headerSize) + uint64(keyValueSize)
+	if uint64(len(data)) < offset+4 {
+		return nil, fmt.Errorf("Truncated KTX file")
+	}
+	imageSize := uint64(binary.LittleEndian.Uint32(data[offset:]))
+	offset += 4
+	if uint64(len(data)) < offset+imageSize {
+		return nil, fmt.Errorf("Truncated KTX image data of size: %v", imageSize)
+	}
+	if height == 0 {
+		height = 1
+	}
+	img := &image.Data{
+		Format: format,
+		Width:  width,
+		Height: height,
+		Depth:  1,
+		Bytes:  data[offset : offset+imageSize],
+	}
+	if err := format.Check(img.Bytes, int(width), int(height), 1); err != nil {
+		return nil, fmt.Errorf("KTX image data in %v: %v", format, err)
+	}
+	return img, nil
+}
+
+// ipRGBAF32Pixels returns the pixels of the given image data converted to
+// RGBA_F32, four channels per pixel.
+func ipRGBAF32Pixels(data *image.Data) ([]float32, error) {
+	converted, err := data.Convert(image.RGBA_F32)
+	if err != nil {
+		return nil, err
+	}
+	pixels := make([]float32, len(converted.Bytes)/4)
+	for i := range pixels {
+		pixels[i] = math.Float32frombits(binary.LittleEndian.Uint32(converted.Bytes[i*4:]))
+	}
+	return pixels, nil
+}
+
+// ipCompareImageData compares the given primed image data with the given
+// reference image data, both converted to RGBA_F32, and returns the pixels
+// whose channels differ by more than the given tolerance, ordered by row.
+func ipCompareImageData(primed, reference *image.Data, tolerance float32) ([]ipPixelDiff, error) {
+	if primed.Width != reference.Width || primed.Height != reference.Height {
+		return nil, fmt.Errorf("Primed image size: %vx%v does not match reference image size: %vx%v",
+			primed.Width, primed.Height, reference.Width, reference.Height)
+	}
+	primedPixels, err := ipRGBAF32Pixels(primed)
+	if err != nil {
+		return nil, fmt.Errorf("Converting primed image data in %v: %v", primed.Format, err)
+	}
+	referencePixels, err := ipRGBAF32Pixels(reference)
+	if err != nil {
+		return nil, fmt.Errorf("Converting reference image data in %v: %v", reference.Format, err)
+	}
+	diffs := []ipPixelDiff{}
+	for y := uint32(0); y < primed.Height; y++ {
+		for x := uint32(0); x < primed.Width; x++ {
+			i := (y*primed.Width + x) * 4
+			diff := float32(0)
+			for c := uint32(0); c < 4; c++ {
+				diff = float32(math.Max(float64(diff), math.Abs(float64(primedPixels[i+c]-referencePixels[i+c]))))
+			}
+			if diff > tolerance {
+				diffs = append(diffs, ipPixelDiff{x: x, y: y, diff: diff})
+			}
+		}
+	}
+	return diffs, nil
+}
@@ -16,10 +16,12 @@ package vulkan
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/google/gapid/core/log"
 	"github.com/google/gapid/gapis/api"
+	"github.com/google/gapid/gapis/memory"
 )
 
 // primeableImageData can be built by imagePrimer for a specific image, whose
@@ -36,6 +38,14 @@ type primeableImageData interface {
 	primingQueue() VkQueue
 }
 
+// getQueueForPriming returns a queue that supports the given queue flags to
+// prime the given image on. The last bound queues of the image are preferred.
+// If none of them support the flags, e.g. the image is only used on a
+// transfer-only queue but needs to be primed by rendering, another capable
+// queue is returned, and the ownership of the image has to be handed off to the
+// last bound queues after priming, see ipHandOffToLastBoundQueues. Images with
+// concurrent sharing mode can only be primed on the queue families they are
+// shared with.
 func getQueueForPriming(sb *stateBuilder, oldStateImgObj ImageObjectʳ, queueFlagBits VkQueueFlagBits) QueueObjectʳ {
 	queueCandidates := []QueueObjectʳ{}
 	for _, q := range sb.imageAllLastBoundQueues(oldStateImgObj) {
@@ -43,9 +53,245 @@ func getQueueForPriming(sb *stateBuilder, oldStateImgObj ImageObjectʳ, queueFla
 			queueCandidates = append(queueCandidates, GetState(sb.newState).Queues().Get(q))
 		}
 	}
-	return sb.getQueueFor(queueFlagBits,
-		queueFamilyIndicesToU32Slice(oldStateImgObj.Info().QueueFamilyIndices()),
-		oldStateImgObj.Device(), queueCandidates...)
+	// The queue family indices are ignored for images with exclusive sharing
+	// mode, whose ownership can be transferred to any queue family.
+	queueFamilyIndices := []uint32{}
+	if oldStateImgObj.Info().SharingMode() == VkSharingMode_VK_SHARING_MODE_CONCURRENT {
+		queueFamilyIndices = queueFamilyIndicesToU32Slice(oldStateImgObj.Info().QueueFamilyIndices())
+	}
+	queue := sb.getQueueFor(queueFlagBits, queueFamilyIndices, oldStateImgObj.Device(), queueCandidates...)
+	if !queue.IsNil() && len(queueCandidates) > 0 {
+		handOff := true
+		for _, c := range queueCandidates {
+			if c.Family() == queue.Family() {
+				handOff = false
+				break
+			}
+		}
+		if handOff {
+			log.D(sb.ctx, "Image: %v is primed on queue: %v of family: %v, ownership is handed off to its last bound queues afterwards",
+				oldStateImgObj.VulkanHandle(), queue.VulkanHandle(), queue.Family())
+		}
+	}
+	return queue
+}
+
+// ipQueueCandidate is a queue that can be used for priming an image.
+type ipQueueCandidate struct {
+	queue  VkQueue
+	family uint32
+	// device is the logical device of the queue, and flags are the flags of
+	// its queue family.
+	device VkDevice
+	flags  VkQueueFlags
+}
+
+// ipDeviceQueueCandidates returns the given queues which are of the given
+// device and support the given queue flags. If families is not nil, only the
+// queues of the families in it are returned. Captures may use several logical
+// devices, and an image can only be primed on a queue of its own device.
+func ipDeviceQueueCandidates(queues []ipQueueCandidate, dev VkDevice, queueFlagBits VkQueueFlagBits, families map[uint32]bool) []ipQueueCandidate {
+	candidates := []ipQueueCandidate{}
+	for _, q := range queues {
+		if q.device != dev || (families != nil && !families[q.family]) {
+			continue
+		}
+		if uint32(q.flags)&uint32(queueFlagBits) == 0 {
+			continue
+		}
+		candidates = append(candidates, q)
+	}
+	return candidates
+}
+
+// ipLeastLoadedQueue returns the candidate queue with the fewest images
+// assigned in loads. Ties are broken by preferring the queues of the preferred
+// families, then the queues with lower handles. Returns false if there is no
+// candidate.
+func ipLeastLoadedQueue(candidates []ipQueueCandidate, preferredFamilies map[uint32]bool, loads map[VkQueue]int) (VkQueue, bool) {
+	if len(candidates) == 0 {
+		return VkQueue(0), false
+	}
+	best := candidates[0]
+	better := func(c ipQueueCandidate) bool {
+		if loads[c.queue] != loads[best.queue] {
+			return loads[c.queue] < loads[best.queue]
+		}
+		if preferredFamilies[c.family] != preferredFamilies[best.family] {
+			return preferredFamilies[c.family]
+		}
+		return c.queue < best.queue
+	}
+	for _, c := range candidates[1:] {
+		if better(c) {
+			best = c
+		}
+	}
+	return best.queue, true
+}
+
+// ipStrategyQueueFlags returns the queue flags of which a queue must support
+// at least one to prime an image with the given strategy. Rendering requires
+// graphics and image store and image blit require compute, while the other
+// strategies only record transfer and layout transition commands, which are
+// supported by graphics and compute queues too.
+func ipStrategyQueueFlags(strategy ipPrimingStrategy) VkQueueFlagBits {
+	switch strategy {
+	case ipPrimingStrategyRendering:
+		return VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT
+	case ipPrimingStrategyImageStore, ipPrimingStrategyImageBlit:
+		return VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT
+	default:
+		return VkQueueFlagBits_VK_QUEUE_TRANSFER_BIT | VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT | VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT
+	}
+}
+
+// ipStrategyQueueFamilyRank returns the rank of a queue family with the given
+// flags for priming with the given strategy, lower is better. The copy
+// strategies prefer dedicated transfer families, then async compute families,
+// and image store and image blit prefer async compute families, so the priming
+// work does not occupy the graphics queues. Rendering can only use graphics
+// families.
+func ipStrategyQueueFamilyRank(strategy ipPrimingStrategy, flags VkQueueFlags) int {
+	graphics := flags&VkQueueFlags(VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT) != 0
+	compute := flags&VkQueueFlags(VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT) != 0
+	switch strategy {
+	case ipPrimingStrategyBufferCopy, ipPrimingStrategyImageCopy:
+		switch {
+		case !graphics && !compute:
+			return 0
+		case !graphics:
+			return 1
+		default:
+			return 2
+		}
+	case ipPrimingStrategyImageStore, ipPrimingStrategyImageBlit:
+		if !graphics {
+			return 0
+		}
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ipBestRankedQueues returns the given candidate queues whose families have
+// the best rank for priming with the given strategy, see
+// ipStrategyQueueFamilyRank.
+func ipBestRankedQueues(candidates []ipQueueCandidate, strategy ipPrimingStrategy) []ipQueueCandidate {
+	best := []ipQueueCandidate{}
+	bestRank := 0
+	for _, c := range candidates {
+		rank := ipStrategyQueueFamilyRank(strategy, c.flags)
+		if len(best) > 0 && rank > bestRank {
+			continue
+		}
+		if len(best) == 0 || rank < bestRank {
+			best = best[:0]
+			bestRank = rank
+		}
+		best = append(best, c)
+	}
+	return best
+}
+
+// queueCandidates returns the queues in the new state on the device of the
+// given image which support the given queue flags and can be used for
+// priming it, and the families of the last bound queues of the image, which
+// are preferred as priming on other families requires handing off the
+// ownership afterwards.
+func (p *imagePrimer) queueCandidates(img ImageObjectʳ, queueFlagBits VkQueueFlagBits) ([]ipQueueCandidate, map[uint32]bool) {
+	var sharedFamilies map[uint32]bool
+	if img.Info().SharingMode() == VkSharingMode_VK_SHARING_MODE_CONCURRENT {
+		sharedFamilies = map[uint32]bool{}
+		for _, i := range queueFamilyIndicesToU32Slice(img.Info().QueueFamilyIndices()) {
+			sharedFamilies[i] = true
+		}
+	}
+	preferredFamilies := map[uint32]bool{}
+	for _, q := range p.sb.imageAllLastBoundQueues(img) {
+		if queue := p.sb.s.Queues().Get(q); !queue.IsNil() {
+			preferredFamilies[queue.Family()] = true
+		}
+	}
+	queues := GetState(p.sb.newState).Queues()
+	all := []ipQueueCandidate{}
+	for _, q := range queues.Keys() {
+		queue := queues.Get(q)
+		familyProps := p.sb.s.PhysicalDevices().Get(p.sb.s.Devices().Get(queue.Device()).PhysicalDevice()).QueueFamilyProperties().Get(queue.Family())
+		all = append(all, ipQueueCandidate{queue: q, family: queue.Family(), device: queue.Device(), flags: familyProps.QueueFlags()})
+	}
+	return ipDeviceQueueCandidates(all, img.Device(), queueFlagBits, sharedFamilies), preferredFamilies
+}
+
+// distributedQueueForPriming returns the least loaded queue that supports the
+// given queue flags on the device of the given image, and assigns the image to
+// it. The families of the last bound queues of the image are preferred, as
+// priming on other families requires handing off the ownership afterwards.
+func (p *imagePrimer) distributedQueueForPriming(img ImageObjectʳ, queueFlagBits VkQueueFlagBits) QueueObjectʳ {
+	candidates, preferredFamilies := p.queueCandidates(img, queueFlagBits)
+	q, ok := ipLeastLoadedQueue(candidates, preferredFamilies, p.queueLoads)
+	if !ok {
+		return getQueueForPriming(p.sb, img, queueFlagBits)
+	}
+	p.queueLoads[q]++
+	return GetState(p.sb.newState).Queues().Get(q)
+}
+
+// strategyQueueForPriming returns a queue of the family best suited for
+// priming the given image with the given strategy, see
+// ipStrategyQueueFamilyRank. Among the queues of the best ranked families, the
+// least loaded one is returned if distributeQueues is set, and the families of
+// the last bound queues of the image are preferred.
+func (p *imagePrimer) strategyQueueForPriming(img ImageObjectʳ, strategy ipPrimingStrategy) QueueObjectʳ {
+	queueFlagBits := ipStrategyQueueFlags(strategy)
+	candidates, preferredFamilies := p.queueCandidates(img, queueFlagBits)
+	var loads map[VkQueue]int
+	if p.distributeQueues {
+		loads = p.queueLoads
+	}
+	q, ok := ipLeastLoadedQueue(ipBestRankedQueues(candidates, strategy), preferredFamilies, loads)
+	if !ok {
+		return getQueueForPriming(p.sb, img, queueFlagBits)
+	}
+	if p.distributeQueues {
+		p.queueLoads[q]++
+	}
+	return GetState(p.sb.newState).Queues().Get(q)
+}
+
+// ipHandOffToLastBoundQueues transfers the ownership of the subresources of the
+// given image, which have been primed on the given queue, to the last bound
+// queues of the subresources, if they are of other queue families. Images with
+// concurrent sharing mode do not need ownership transfers.
+func ipHandOffToLastBoundQueues(sb *stateBuilder, img ImageObjectʳ, primingQueue VkQueue) {
+	queue := sb.s.Queues().Get(primingQueue)
+	if queue.IsNil() || img.Info().SharingMode() == VkSharingMode_VK_SHARING_MODE_CONCURRENT {
+		return
+	}
+	ownerTransferInfo := []imageSubRangeInfo{}
+	walkImageSubresourceRange(sb, img, sb.imageWholeSubresourceRange(img),
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			// No need to handle for undefined layout
+			imgLevel := img.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level)
+			if imgLevel.Layout() == VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED || imgLevel.LastBoundQueue().IsNil() {
+				return
+			}
+			if queue.Family() != imgLevel.LastBoundQueue().Family() {
+				ownerTransferInfo = append(ownerTransferInfo, imageSubRangeInfo{
+					aspectMask:     VkImageAspectFlags(aspect),
+					baseMipLevel:   level,
+					levelCount:     1,
+					baseArrayLayer: layer,
+					layerCount:     1,
+					oldLayout:      imgLevel.Layout(),
+					newLayout:      imgLevel.Layout(),
+					oldQueue:       queue.VulkanHandle(),
+					newQueue:       imgLevel.LastBoundQueue().VulkanHandle(),
+				})
+			}
+		})
+	sb.changeImageSubRangeLayoutAndOwnership(img.VulkanHandle(), ownerTransferInfo)
 }
 
 func deferUntilAllCommittedExecuted(sb *stateBuilder, queue VkQueue, f ...func()) {
@@ -70,7 +316,7 @@ type ipPrimeableByBufferCopy struct {
 func (pi *ipPrimeableByBufferCopy) prime(srcLayout, dstLayout ipLayoutInfo) error {
 	err := pi.copySession.rolloutBufCopies(pi.queue, srcLayout, dstLayout)
 	if err != nil {
-		return log.Errf(pi.p.sb.ctx, err, "[Rolling out the buf->img copy commands for image: %v]", pi.img)
+		return log.Errf(pi.copySession.logCtx.bind(pi.p.sb.ctx), err, "[Rolling out the buf->img copy commands]")
 	}
 	return nil
 }
@@ -85,6 +331,7 @@ type ipPrimeableByRendering struct {
 	p                    *imagePrimer
 	img                  VkImage
 	stagingImages        map[VkImageAspectFlagBits][]ImageObjectʳ
+	copySession          *ipBufferImageCopySession
 	freeCallbacks        []func()
 	queue                VkQueue
 	renderTaskCommitLock sync.Mutex
@@ -100,17 +347,30 @@ func (pi *ipPrimeableByRendering) free() {
 func (pi *ipPrimeableByRendering) primingQueue() VkQueue { return pi.queue }
 
 func (pi *ipPrimeableByRendering) prime(srcLayout, dstLayout ipLayoutInfo) error {
+	logCtx := ipImageLogContext(pi.img, ipPrimingStrategyRendering)
+	ctx := logCtx.bind(pi.p.sb.ctx)
 	oldStateImgObj := GetState(pi.p.sb.oldState).Images().Get(pi.img)
 	if oldStateImgObj.IsNil() {
-		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in old state"), "[Priming by rendering, image: %v]", pi.img)
+		return log.Errf(ctx, fmt.Errorf("Nil Image in old state"), "[Priming by rendering]")
 	}
 	newStateImgObj := GetState(pi.p.sb.newState).Images().Get(pi.img)
 	if newStateImgObj.IsNil() {
-		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming by rendering, image: %v]", pi.img)
+		return log.Errf(ctx, fmt.Errorf("Nil Image in new state"), "[Priming by rendering]")
 	}
-	renderTsk := pi.p.sb.newScratchTaskOnQueue(pi.queue)
 	renderJobs := []*ipRenderJob{}
-	for _, aspect := range pi.p.sb.imageAspectFlagBits(oldStateImgObj, oldStateImgObj.ImageAspect()) {
+	// The render jobs are executed in the order of the aspects, and the
+	// stencil reconstruction renders multiple passes with the image in
+	// DEPTH_STENCIL_ATTACHMENT_OPTIMAL layout. On some drivers, these
+	// repeated transitions interfere with the depth result if the depth
+	// aspect is rendered after the stencil one, so the depth aspect is always
+	// rendered first, and the stencil passes load and keep its data, see
+	// ipRenderTargetLoadOp.
+	aspects := make([]VkImageAspectFlagBits, 0, len(pi.stagingImages))
+	for aspect := range pi.stagingImages {
+		aspects = append(aspects, aspect)
+	}
+	sort.Slice(aspects, func(i, j int) bool { return aspects[i] < aspects[j] })
+	for _, aspect := range ipRenderAspectOrder(aspects) {
 		for layer := uint32(0); layer < oldStateImgObj.Info().ArrayLayers(); layer++ {
 			for level := uint32(0); level < oldStateImgObj.Info().MipLevels(); level++ {
 				inputImageObjects := pi.stagingImages[aspect]
@@ -133,37 +393,204 @@ func (pi *ipPrimeableByRendering) prime(srcLayout, dstLayout ipLayoutInfo) error
 						layer:         layer,
 						level:         level,
 						initialLayout: srcLayout.layoutOf(aspect, layer, level),
-						finalLayout:   dstLayout.layoutOf(aspect, layer, level),
+						finalLayout:   ipDstLayout(dstLayout.layoutOf(aspect, layer, level), ipAttachmentLayout(aspect)),
 					},
 					inputFormat: newStateImgObj.Info().Fmt(),
+					logCtx:      logCtx.at(aspect, layer, level),
 				})
 			}
 		}
 	}
-	for _, renderJob := range renderJobs {
-		err := pi.p.rh.render(renderJob, renderTsk)
-		if err != nil {
-			log.E(pi.p.sb.ctx, "[Priming image: %v, aspect: %v, layer: %v, level: %v data by rendering] %v",
-				renderJob.renderTarget.image.VulkanHandle(),
-				renderJob.renderTarget.aspect,
-				renderJob.renderTarget.layer,
-				renderJob.renderTarget.level, err)
+	// The render jobs of images with many layers and levels are split across
+	// multiple scratch tasks, so the command buffer of each task is bounded.
+	batches := ipSplitRenderJobs(renderJobs, ipMaxRenderCommandsPerTask)
+	if len(batches) > 1 {
+		log.D(ctx, "%v render jobs are split into %v scratch tasks", len(renderJobs), len(batches))
+	}
+	for _, batch := range batches {
+		renderTsk := pi.p.sb.newScratchTaskOnQueue(pi.queue)
+		for _, renderJob := range batch {
+			err := pi.p.rh.render(renderJob, renderTsk)
+			if err != nil {
+				log.E(renderJob.logCtx.bind(pi.p.sb.ctx), "[Priming data by rendering] %v", err)
+			}
+		}
+		if err := renderTsk.commit(); err != nil {
+			return log.Errf(ctx, err, "[Committing scratch task for priming data by rendering]")
+		}
+	}
+	return nil
+}
+
+const (
+	// ipMaxRenderCommandsPerTask is the max estimated number of commands
+	// recorded in the command buffer of one scratch task when priming by
+	// rendering, see ipSplitRenderJobs.
+	ipMaxRenderCommandsPerTask = 2048
+	// ipRenderPassCommandCount is the max number of commands recorded to begin
+	// a render pass, draw and end it, see beginRenderPassAndDraw.
+	ipRenderPassCommandCount = 10
+)
+
+// ipRenderJobCommandCount returns the estimated number of commands recorded
+// for the given render job: the barriers before and after rendering, and the
+// render passes. The stencil aspect may be rendered one bit per pass with a
+// barrier and push constants each.
+func ipRenderJobCommandCount(job *ipRenderJob) int {
+	if job.renderTarget.aspect == VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT {
+		return 2 + 8*(2+ipRenderPassCommandCount)
+	}
+	return 2 + ipRenderPassCommandCount
+}
+
+// ipSplitRenderJobs splits the given render jobs, in order, into batches whose
+// estimated number of commands do not exceed the given max number of commands,
+// see ipRenderJobCommandCount. A job estimated to exceed the max number alone
+// is in a batch of its own.
+func ipSplitRenderJobs(jobs []*ipRenderJob, maxCommands int) [][]*ipRenderJob {
+	batches := [][]*ipRenderJob{}
+	batch := []*ipRenderJob{}
+	commands := 0
+	for _, job := range jobs {
+		count := ipRenderJobCommandCount(job)
+		if len(batch) > 0 && commands+count > maxCommands {
+			batches = append(batches, batch)
+			batch = []*ipRenderJob{}
+			commands = 0
 		}
+		batch = append(batch, job)
+		commands += count
 	}
-	if err := renderTsk.commit(); err != nil {
-		return log.Errf(pi.p.sb.ctx, err, "[Committing scratch task for priming image: %v data by rendering]", pi.img)
+	if len(batch) > 0 {
+		batches = append(batches, batch)
 	}
+	return batches
+}
+
+// ipPrimeableByLayoutTransition does not prime any data, but only transitions
+// the image to the destination layouts, leave the image content undefined.
+type ipPrimeableByLayoutTransition struct {
+	p       *imagePrimer
+	img     VkImage
+	aspects []VkImageAspectFlagBits
+	queue   VkQueue
+}
+
+func (pi *ipPrimeableByLayoutTransition) free() {}
+
+func (pi *ipPrimeableByLayoutTransition) primingQueue() VkQueue { return pi.queue }
+
+func (pi *ipPrimeableByLayoutTransition) prime(srcLayout, dstLayout ipLayoutInfo) error {
+	newStateImgObj := GetState(pi.p.sb.newState).Images().Get(pi.img)
+	if newStateImgObj.IsNil() {
+		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming by layout transition, image: %v]", pi.img)
+	}
+	transitionInfo := []imageSubRangeInfo{}
+	walkImageSubresourceRange(pi.p.sb, newStateImgObj, ipSubresourceRangeOfAspects(pi.p.sb, newStateImgObj, pi.aspects),
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			if dstLayout.layoutOf(aspect, layer, level) == VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED {
+				return
+			}
+			transitionInfo = append(transitionInfo, imageSubRangeInfo{
+				aspectMask:     ipImageAspectBarrierFlags(pi.p.sb, newStateImgObj, aspect),
+				baseMipLevel:   level,
+				levelCount:     1,
+				baseArrayLayer: layer,
+				layerCount:     1,
+				oldLayout:      srcLayout.layoutOf(aspect, layer, level),
+				newLayout:      dstLayout.layoutOf(aspect, layer, level),
+				oldQueue:       pi.queue,
+				newQueue:       pi.queue,
+			})
+		})
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, transitionInfo)
 	return nil
 }
 
+// aspectsOfRanges returns the aspects of the given image covered by the given
+// subresource ranges, in ascending order. For multi-planar images, this allows
+// only a subset of the planes to be primed. If no range is given, all the
+// aspects of the image are returned.
+func (p *imagePrimer) aspectsOfRanges(img ImageObjectʳ, rngs []VkImageSubresourceRange) []VkImageAspectFlagBits {
+	if len(rngs) == 0 {
+		return p.sb.imageAspectFlagBits(img, img.ImageAspect())
+	}
+	mask := VkImageAspectFlags(0)
+	for _, rng := range rngs {
+		mask |= rng.AspectMask()
+	}
+	aspects := p.sb.imageAspectFlagBits(img, mask)
+	sort.Slice(aspects, func(i, j int) bool { return aspects[i] < aspects[j] })
+	return aspects
+}
+
+// ipSubresourceRangeOfAspects returns a subresource range that covers all the
+// layers and levels of the given aspects of the given image.
+func ipSubresourceRangeOfAspects(sb *stateBuilder, img ImageObjectʳ, aspects []VkImageAspectFlagBits) VkImageSubresourceRange {
+	rng := sb.imageWholeSubresourceRange(img)
+	mask := VkImageAspectFlags(0)
+	for _, aspect := range aspects {
+		mask |= VkImageAspectFlags(aspect)
+	}
+	rng.SetAspectMask(mask)
+	return rng
+}
+
+// ipRenderAspectOrder returns the given aspects in the order they should be
+// primed by rendering: color aspects first, then depth, then stencil.
+func ipRenderAspectOrder(aspects []VkImageAspectFlagBits) []VkImageAspectFlagBits {
+	rank := func(aspect VkImageAspectFlagBits) int {
+		switch aspect {
+		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_DEPTH_BIT:
+			return 1
+		case VkImageAspectFlagBits_VK_IMAGE_ASPECT_STENCIL_BIT:
+			return 2
+		default:
+			return 0
+		}
+	}
+	ordered := make([]VkImageAspectFlagBits, len(aspects))
+	copy(ordered, aspects)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rank(ordered[i]) < rank(ordered[j])
+	})
+	return ordered
+}
+
 // ipPrimeableByImageStore contains the data for priming through
 // imageStore operations.
 type ipPrimeableByImageStore struct {
-	p             *imagePrimer
-	img           VkImage
-	queue         VkQueue
-	storeJobs     []ipImageStoreJob
-	freeCallbacks []func()
+	p       *imagePrimer
+	img     VkImage
+	aspects []VkImageAspectFlagBits
+	// boundSubresources are the subresources bound to memory, which are
+	// transitioned to GENERAL for the store jobs, see ipImageStoreTransition.
+	boundSubresources map[ipSubresource]bool
+	queue             VkQueue
+	storeJobs         []ipImageStoreJob
+	freeCallbacks     []func()
+}
+
+// ipImageStoreTransition returns the transition of the given subresource of
+// an image with the given bound subresources to GENERAL layout on the given
+// queue, for the store jobs. Returns false for the subresources not bound to
+// memory, e.g. of partially bound sparse images, which are never written, and
+// get no barrier at all.
+func ipImageStoreTransition(bound map[ipSubresource]bool, sr ipSubresource, queue VkQueue, srcLayout ipLayoutInfo) (imageSubRangeInfo, bool) {
+	if !bound[sr] {
+		return imageSubRangeInfo{}, false
+	}
+	return imageSubRangeInfo{
+		aspectMask:     VkImageAspectFlags(sr.aspect),
+		baseMipLevel:   sr.level,
+		levelCount:     1,
+		baseArrayLayer: sr.layer,
+		layerCount:     1,
+		oldLayout:      srcLayout.layoutOf(sr.aspect, sr.layer, sr.level),
+		newLayout:      VkImageLayout_VK_IMAGE_LAYOUT_GENERAL,
+		oldQueue:       queue,
+		newQueue:       queue,
+	}, true
 }
 
 func (pi *ipPrimeableByImageStore) free() {
@@ -177,49 +604,43 @@ func (pi *ipPrimeableByImageStore) free() {
 func (pi *ipPrimeableByImageStore) primingQueue() VkQueue { return pi.queue }
 
 func (pi *ipPrimeableByImageStore) prime(srcLayout, dstLayout ipLayoutInfo) error {
+	ctx := ipImageLogContext(pi.img, ipPrimingStrategyImageStore).bind(pi.p.sb.ctx)
 	oldStateImgObj := GetState(pi.p.sb.oldState).Images().Get(pi.img)
 	if oldStateImgObj.IsNil() {
-		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in old state"), "[Priming by buffer imageStore, img: %v]", pi.img)
+		return log.Errf(ctx, fmt.Errorf("Nil Image in old state"), "[Priming by buffer imageStore]")
 	}
 	newStateImgObj := GetState(pi.p.sb.newState).Images().Get(pi.img)
 	if newStateImgObj.IsNil() {
-		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming by buffer imageStore, img: %v]", pi.img)
+		return log.Errf(ctx, fmt.Errorf("Nil Image in new state"), "[Priming by buffer imageStore]")
 	}
-	whole := pi.p.sb.imageWholeSubresourceRange(newStateImgObj)
+	// Only the bound subresources are transitioned to GENERAL and back.
+	rng := ipSubresourceRangeOfAspects(pi.p.sb, newStateImgObj, pi.aspects)
 	transitionInfo := []imageSubRangeInfo{}
 	finalLayouts := []VkImageLayout{}
-	walkImageSubresourceRange(pi.p.sb, newStateImgObj, whole, func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
-		transitionInfo = append(transitionInfo, imageSubRangeInfo{
-			aspectMask:     VkImageAspectFlags(aspect),
-			baseMipLevel:   level,
-			levelCount:     1,
-			baseArrayLayer: layer,
-			layerCount:     1,
-			oldLayout:      srcLayout.layoutOf(aspect, layer, level),
-			newLayout:      VkImageLayout_VK_IMAGE_LAYOUT_GENERAL,
-			oldQueue:       pi.queue,
-			newQueue:       pi.queue,
-		})
-		finalLayouts = append(finalLayouts, dstLayout.layoutOf(aspect, layer, level))
+	walkImageSubresourceRange(pi.p.sb, newStateImgObj, rng, func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+		sr := ipSubresource{aspect: aspect, layer: layer, level: level}
+		if info, ok := ipImageStoreTransition(pi.boundSubresources, sr, pi.queue, srcLayout); ok {
+			transitionInfo = append(transitionInfo, info)
+			finalLayouts = append(finalLayouts, dstLayout.layoutOf(aspect, layer, level))
+		}
 	})
 	pi.p.sb.changeImageSubRangeLayoutAndOwnership(newStateImgObj.VulkanHandle(), transitionInfo)
 
 	for _, job := range pi.storeJobs {
 		err := pi.p.sh.store(job, pi.queue)
 		if err != nil {
-			aspect := VkImageAspectFlagBits(job.output.SubresourceRange().AspectMask())
-			layer := job.output.SubresourceRange().BaseArrayLayer()
-			level := job.output.SubresourceRange().BaseMipLevel()
-			log.E(pi.p.sb.ctx, "[Priming image: %v aspect: %v, layer: %v, level: %v, offset: %v, extent: %v data by imageStore] %v",
-				job.output.Image().VulkanHandle(), aspect, layer, level, job.offset, job.extent, err)
+			log.E(job.logCtx.bind(pi.p.sb.ctx), "[Priming data at offset: %v, extent: %v by imageStore] %v", job.offset, job.extent, err)
 		}
 	}
+	// Submit all the store jobs at once.
+	pi.p.sb.flushQueueFamilyScratchResources(pi.queue)
 
-	for i := range transitionInfo {
-		transitionInfo[i].oldLayout = VkImageLayout_VK_IMAGE_LAYOUT_GENERAL
-		transitionInfo[i].newLayout = finalLayouts[i]
+	storedInfo := append([]imageSubRangeInfo{}, transitionInfo...)
+	for i := range storedInfo {
+		storedInfo[i].oldLayout = VkImageLayout_VK_IMAGE_LAYOUT_GENERAL
+		storedInfo[i].newLayout = finalLayouts[i]
 	}
-	pi.p.sb.changeImageSubRangeLayoutAndOwnership(newStateImgObj.VulkanHandle(), transitionInfo)
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(newStateImgObj.VulkanHandle(), storedInfo)
 
 	return nil
 }
@@ -246,10 +667,47 @@ func (pi *ipPrimeableByPreinitialization) prime(srcLayout, dstLayout ipLayoutInf
 	if newStateImgObj.IsNil() {
 		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming by preinitialization, image: %v]", pi.img)
 	}
-	// TODO: Handle multi-planar images
-	newImgPlaneMemInfo, _ := subGetImagePlaneMemoryInfo(pi.p.sb.ctx, nil, api.CmdNoID, nil, pi.p.sb.newState, GetState(pi.p.sb.newState), 0, nil, nil, newStateImgObj, VkImageAspectFlagBits(0))
+	// Each plane of a disjoint multi-planar image is bound to its own memory,
+	// otherwise the whole image is bound to one memory.
+	planes := []VkImageAspectFlagBits{VkImageAspectFlagBits(0)}
+	if isDisjointImageInfo(oldStateImgObj.Info()) {
+		planes = pi.p.sb.imageAspectFlagBits(oldStateImgObj, oldStateImgObj.ImageAspect())
+	}
+	transitionInfo := []imageSubRangeInfo{}
+	for _, plane := range planes {
+		planeTransitionInfo, err := pi.primePlane(oldStateImgObj, newStateImgObj, plane, dstLayout)
+		if err != nil {
+			return log.Errf(pi.p.sb.ctx, err, "[Priming by preinitialization, image: %v, plane: %v]", pi.img, plane)
+		}
+		transitionInfo = append(transitionInfo, planeTransitionInfo...)
+	}
+
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, transitionInfo)
+
+	return nil
+}
+
+// primePlane maps the memory bound to the given plane of the image, fills the
+// data of the subresources in the plane and returns the layout transitions for
+// them. Plane 0 stands for the memory bound to the whole image for
+// non-disjoint images.
+func (pi *ipPrimeableByPreinitialization) primePlane(oldStateImgObj, newStateImgObj ImageObjectʳ, plane VkImageAspectFlagBits, dstLayout ipLayoutInfo) ([]imageSubRangeInfo, error) {
+	newImgPlaneMemInfo, _ := subGetImagePlaneMemoryInfo(pi.p.sb.ctx, nil, api.CmdNoID, nil, pi.p.sb.newState, GetState(pi.p.sb.newState), 0, nil, nil, newStateImgObj, plane)
+	oldImgPlaneMemInfo, _ := subGetImagePlaneMemoryInfo(pi.p.sb.ctx, nil, api.CmdNoID, nil, pi.p.sb.oldState, GetState(pi.p.sb.oldState), 0, nil, nil, oldStateImgObj, plane)
+	if oldImgPlaneMemInfo.IsNil() || newImgPlaneMemInfo.IsNil() || newImgPlaneMemInfo.BoundMemory().IsNil() {
+		return nil, fmt.Errorf("No bound memory")
+	}
 	newMem := newImgPlaneMemInfo.BoundMemory()
-	oldImgPlaneMemInfo, _ := subGetImagePlaneMemoryInfo(pi.p.sb.ctx, nil, api.CmdNoID, nil, pi.p.sb.oldState, GetState(pi.p.sb.oldState), 0, nil, nil, oldStateImgObj, VkImageAspectFlagBits(0))
+	// Mapping memory which is not host visible fails on the replay side, and
+	// leaves the unmap below unbalanced.
+	dev := pi.p.sb.s.Devices().Get(newMem.Device())
+	if dev.IsNil() {
+		return nil, fmt.Errorf("Nil Device: %v of memory: %v", newMem.Device(), newMem.VulkanHandle())
+	}
+	props := pi.p.sb.s.PhysicalDevices().Get(dev.PhysicalDevice()).MemoryProperties()
+	if !ipMemoryTypeHostVisible(props, newMem.MemoryTypeIndex()) {
+		return nil, fmt.Errorf("memory: %v of memory type: %v is not host visible, can not be mapped", newMem.VulkanHandle(), newMem.MemoryTypeIndex())
+	}
 	boundOffset := oldImgPlaneMemInfo.BoundMemoryOffset()
 	planeMemRequirements := oldImgPlaneMemInfo.MemoryRequirements()
 	boundSize := planeMemRequirements.Size()
@@ -272,6 +730,9 @@ func (pi *ipPrimeableByPreinitialization) prime(srcLayout, dstLayout ipLayoutInf
 	for _, rng := range pi.opaqueBoundRanges {
 		walkImageSubresourceRange(pi.p.sb, oldStateImgObj, rng,
 			func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+				if plane != VkImageAspectFlagBits(0) && aspect != plane {
+					return
+				}
 				origLevel := oldStateImgObj.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level)
 				origDataSlice := origLevel.Data()
 				linearLayout := origLevel.LinearLayout()
@@ -311,11 +772,159 @@ func (pi *ipPrimeableByPreinitialization) prime(srcLayout, dstLayout ipLayoutInf
 		newMem.VulkanHandle(),
 	))
 
-	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, transitionInfo)
+	return transitionInfo, nil
+}
+
+// ipMemoryTypeHostVisible returns true if the memory type of the given index
+// in the given memory properties is HOST_VISIBLE, so memory of the type can be
+// mapped.
+func ipMemoryTypeHostVisible(props VkPhysicalDeviceMemoryProperties, index uint32) bool {
+	if index >= props.MemoryTypeCount() {
+		return false
+	}
+	hostVisible := VkMemoryPropertyFlags(VkMemoryPropertyFlagBits_VK_MEMORY_PROPERTY_HOST_VISIBLE_BIT)
+	return props.MemoryTypes().Get(int(index)).PropertyFlags()&hostVisible != 0
+}
+
+// ipPrimeableByMipGeneration primes the base mip level of an image with the
+// wrapped primeable image data, then generates the other mip levels by
+// blitting each level from the previous one.
+type ipPrimeableByMipGeneration struct {
+	p      *imagePrimer
+	img    VkImage
+	base   primeableImageData
+	filter VkFilter
+}
+
+func (pi *ipPrimeableByMipGeneration) free() { pi.base.free() }
+
+func (pi *ipPrimeableByMipGeneration) primingQueue() VkQueue { return pi.base.primingQueue() }
+
+func (pi *ipPrimeableByMipGeneration) prime(srcLayout, dstLayout ipLayoutInfo) error {
+	newStateImgObj := GetState(pi.p.sb.newState).Images().Get(pi.img)
+	if newStateImgObj.IsNil() {
+		return log.Errf(pi.p.sb.ctx, fmt.Errorf("Nil Image in new state"), "[Priming by mip generation, image: %v]", pi.img)
+	}
+	// The base level priming transitions all the levels to TRANSFER_DST, then
+	// each level is transitioned to TRANSFER_SRC once it has been filled.
+	if err := pi.base.prime(srcLayout, useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL)); err != nil {
+		return log.Errf(pi.p.sb.ctx, err, "[Priming the base mip level of image: %v]", pi.img)
+	}
+	tsk := pi.p.sb.newScratchTaskOnQueue(pi.primingQueue())
+	tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
+		pi.recordMipGeneration(commandBuffer, newStateImgObj.Info())
+	})
+	if err := tsk.commit(); err != nil {
+		return log.Errf(pi.p.sb.ctx, err, "[Committing scratch task for generating mip levels of image: %v]", pi.img)
+	}
 
+	transitionInfo := []imageSubRangeInfo{}
+	aspect := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	walkImageSubresourceRange(pi.p.sb, newStateImgObj, ipSubresourceRangeOfAspects(pi.p.sb, newStateImgObj, []VkImageAspectFlagBits{aspect}),
+		func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
+			if dstLayout.layoutOf(aspect, layer, level) == VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED {
+				return
+			}
+			transitionInfo = append(transitionInfo, imageSubRangeInfo{
+				aspectMask:     VkImageAspectFlags(aspect),
+				baseMipLevel:   level,
+				levelCount:     1,
+				baseArrayLayer: layer,
+				layerCount:     1,
+				oldLayout:      VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL,
+				newLayout:      dstLayout.layoutOf(aspect, layer, level),
+				oldQueue:       pi.primingQueue(),
+				newQueue:       pi.primingQueue(),
+			})
+		})
+	pi.p.sb.changeImageSubRangeLayoutAndOwnership(pi.img, transitionInfo)
 	return nil
 }
 
+// recordMipGeneration records the commands to the given command buffer to
+// generate the mip levels of the image with the given info, once its base
+// level has been primed in TRANSFER_DST layout: each level is blitted from
+// the previous one, after the previous one is transitioned to TRANSFER_SRC.
+// All the levels are left in TRANSFER_SRC layout.
+func (pi *ipPrimeableByMipGeneration) recordMipGeneration(commandBuffer VkCommandBuffer, info ImageInfo) {
+	aspect := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	toTransferSrc := func(level uint32) VkImageMemoryBarrier {
+		return NewVkImageMemoryBarrier(pi.p.sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER, // sType
+			0, // pNext
+			VkAccessFlags(VkAccessFlagBits_VK_ACCESS_TRANSFER_WRITE_BIT), // srcAccessMask
+			VkAccessFlags(VkAccessFlagBits_VK_ACCESS_TRANSFER_READ_BIT),  // dstAccessMask
+			VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,           // oldLayout
+			VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL,           // newLayout
+			queueFamilyIgnore, // srcQueueFamilyIndex
+			queueFamilyIgnore, // dstQueueFamilyIndex
+			pi.img,            // image
+			NewVkImageSubresourceRange(pi.p.sb.ta,
+				VkImageAspectFlags(aspect), // aspectMask
+				level,                      // baseMipLevel
+				1,                          // levelCount
+				0,                          // baseArrayLayer
+				info.ArrayLayers(),         // layerCount
+			), // subresourceRange
+		)
+	}
+	pipelineBarrier := func(commandBuffer VkCommandBuffer, barrier VkImageMemoryBarrier) {
+		pi.p.sb.writeImageBarriers(commandBuffer,
+			VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_TRANSFER_BIT),
+			VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_TRANSFER_BIT),
+			[]VkImageMemoryBarrier{barrier})
+	}
+
+	for level := uint32(1); level < info.MipLevels(); level++ {
+		pipelineBarrier(commandBuffer, toTransferSrc(level-1))
+		blit := ipMipGenerationBlit(pi.p.sb, info, level)
+		pi.p.sb.write(pi.p.sb.cb.VkCmdBlitImage(
+			commandBuffer,
+			pi.img,
+			VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_SRC_OPTIMAL,
+			pi.img,
+			VkImageLayout_VK_IMAGE_LAYOUT_TRANSFER_DST_OPTIMAL,
+			1,
+			pi.p.sb.MustAllocReadData(blit).Ptr(),
+			pi.filter,
+		))
+	}
+	pipelineBarrier(commandBuffer, toTransferSrc(info.MipLevels()-1))
+}
+
+// ipMipGenerationBlit returns the blit region to generate the given mip level,
+// which must not be the base level, of all the array layers of the color
+// image with the given info from the previous level.
+func ipMipGenerationBlit(sb *stateBuilder, info ImageInfo, level uint32) VkImageBlit {
+	aspect := VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT
+	levelOffset := func(level uint32) VkOffset3D {
+		size := sb.levelSize(info.Extent(), info.Fmt(), level, aspect)
+		return NewVkOffset3D(sb.ta, int32(size.width), int32(size.height), int32(size.depth))
+	}
+	return NewVkImageBlit(sb.ta,
+		NewVkImageSubresourceLayers(sb.ta, // srcSubresource
+			VkImageAspectFlags(aspect), // aspectMask
+			level-1,                    // mipLevel
+			0,                          // baseArrayLayer
+			info.ArrayLayers(),         // layerCount
+		),
+		NewVkOffset3Dː2ᵃ(sb.ta, // srcOffsets
+			MakeVkOffset3D(sb.ta),
+			levelOffset(level-1),
+		),
+		NewVkImageSubresourceLayers(sb.ta, // dstSubresource
+			VkImageAspectFlags(aspect), // aspectMask
+			level,                      // mipLevel
+			0,                          // baseArrayLayer
+			info.ArrayLayers(),         // layerCount
+		),
+		NewVkOffset3Dː2ᵃ(sb.ta, // dstOffsets
+			MakeVkOffset3D(sb.ta),
+			levelOffset(level),
+		),
+	)
+}
+
 // newPrimeableImageData builds primeable image data for the given image with
 // the specific opaque memory bound subresource ranges. The built primeable
 // image data takes the data from the given image in the old state of the image
@@ -324,37 +933,251 @@ func (pi *ipPrimeableByPreinitialization) prime(srcLayout, dstLayout ipLayoutInf
 // true, the image data will be collected from the shadow memory of the old
 // state image object, which is on the host accessible space. If fromHostData is
 // false, the image data will be collected from the device memory.
+// The priming plan of the built primeable image data is recorded, and if a plan
+// is being replayed for the image, the plan is followed.
 func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkImageSubresourceRange, fromHostData bool) (primeableImageData, error) {
+	primeable, err := p.buildPrimeableImageData(img, opaqueBoundRanges, fromHostData)
+	if err != nil {
+		return nil, err
+	}
+	plan := p.planOf(img, primeable)
+	if replay, ok := p.replayPlans[img]; ok && !plan.sameStagingFormats(replay) {
+		log.W(p.sb.ctx, "Image: %v primed with staging formats: %v, instead of: %v in the replayed plan", img, plan.StagingFormats, replay.StagingFormats)
+	}
+	p.plans[img] = plan
+	log.D(p.sb.ctx, "Priming plan of image: %v: %v", img, plan)
+	if p.auditCoverage {
+		p.auditPrimingCoverage(img, opaqueBoundRanges, primeable)
+	}
+	return primeable, nil
+}
+
+// ipStagingUsage returns the minimal usage of the staging images of the given
+// priming strategy. The staging images are filled with buffer -> image copies,
+// then read as input attachments when priming by rendering, of the color,
+// depth and stencil aspects alike, or as storage images when priming by image
+// store. They are never sampled, so SAMPLED usage is not requested, and the
+// format and usage combination is less likely to be rejected. Returns 0 for
+// the strategies without staging images.
+func ipStagingUsage(strategy ipPrimingStrategy) VkImageUsageFlags {
+	transferDst := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
+	switch strategy {
+	case ipPrimingStrategyRendering:
+		return transferDst | VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_INPUT_ATTACHMENT_BIT)
+	case ipPrimingStrategyImageStore:
+		return transferDst | VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	}
+	return 0
+}
+
+// ipPrimingStrategyForUsage returns the strategy to prime the data of an image
+// with the given usage when no plan is replayed, or an empty strategy if the
+// usage allows none of them. Images only ever used as resolve attachments have
+// COLOR_ATTACHMENT usage but are often not TRANSFER_DST, they are primed by
+// rendering like any other single-sample color attachment, since the resolved
+// data is stored one texel per sample just as the rendered one.
+func ipPrimingStrategyForUsage(usage, layoutOnlyUsages VkImageUsageFlags) ipPrimingStrategy {
+	transDstBit := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
+	attBits := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT | VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT)
+	storageBit := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	isDepth := (usage & VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT)) != 0
+	switch {
+	case usage&layoutOnlyUsages != 0:
+		return ipPrimingStrategyLayoutTransition
+	case (usage&transDstBit) != 0 && !isDepth:
+		return ipPrimingStrategyBufferCopy
+	case (usage & attBits) != 0:
+		return ipPrimingStrategyRendering
+	case (usage & storageBit) != 0:
+		return ipPrimingStrategyImageStore
+	}
+	return ""
+}
+
+// ipDepthTransferSupported returns true if the depth aspect of an image with
+// the given usage, in a format with the given features, can be primed by
+// buffer -> image copies instead of rendering. This holds for the images with
+// both DEPTH_STENCIL_ATTACHMENT and TRANSFER_DST usage, whose format reports the
+// TRANSFER_DST feature, which is done by the devices with VK_KHR_maintenance1
+// or Vulkan 1.1. Such depth images in D16_UNORM, X8_D24_UNORM_PACK32,
+// D32_SFLOAT, or in any of the depth-stencil formats, gain the copy path.
+// Without VK_KHR_maintenance1, no transfer feature is reported, and whether the
+// format can be a copy destination is unknown, so the depth is rendered.
+func ipDepthTransferSupported(usage VkImageUsageFlags, features VkFormatFeatureFlags) bool {
+	depthUsage := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT |
+		VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
+	return usage&depthUsage == depthUsage &&
+		features&VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_TRANSFER_DST_BIT) != 0
+}
+
+// depthTransferSupported returns true if the depth aspect of the given image
+// with the given usage can be primed by buffer -> image copies on the device
+// of the image, see ipDepthTransferSupported.
+func (p *imagePrimer) depthTransferSupported(img ImageObjectʳ, usage VkImageUsageFlags) bool {
+	features, ok := p.formatFeatures(img)
+	return ok && ipDepthTransferSupported(usage, features)
+}
+
+// ipTransientAttachment returns true if an image with the given usage, bound to
+// memory with the given property flags, is a transient attachment, i.e. it has
+// TRANSIENT_ATTACHMENT usage or is bound to LAZILY_ALLOCATED memory. The
+// content of such images is not persistent, and the lazily allocated memory
+// may not be written by copies, so their data is not primed.
+func ipTransientAttachment(usage VkImageUsageFlags, memProps VkMemoryPropertyFlags) bool {
+	return usage&VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSIENT_ATTACHMENT_BIT) != 0 ||
+		memProps&VkMemoryPropertyFlags(VkMemoryPropertyFlagBits_VK_MEMORY_PROPERTY_LAZILY_ALLOCATED_BIT) != 0
+}
+
+// isTransientAttachment returns true if the given image in the old state is a
+// transient attachment, see ipTransientAttachment.
+func (p *imagePrimer) isTransientAttachment(img ImageObjectʳ) bool {
+	memProps := VkMemoryPropertyFlags(0)
+	memInfo, _ := subGetImagePlaneMemoryInfo(p.sb.ctx, nil, api.CmdNoID, nil, p.sb.oldState, GetState(p.sb.oldState), 0, nil, nil, img, VkImageAspectFlagBits(0))
+	if !memInfo.IsNil() && !memInfo.BoundMemory().IsNil() {
+		if flags, err := p.sb.s.getMemoryTypeFlags(memInfo.BoundMemory().Device(), memInfo.BoundMemory().MemoryTypeIndex()); err == nil {
+			memProps = flags
+		}
+	}
+	return ipTransientAttachment(img.Info().Usage(), memProps)
+}
+
+func (p *imagePrimer) buildPrimeableImageData(img VkImage, opaqueBoundRanges []VkImageSubresourceRange, fromHostData bool) (primeableImageData, error) {
 	nilQueueErr := fmt.Errorf("Nil Queue")
 	notImplErr := fmt.Errorf("Not Implemented")
 	queueNotExistInNewState := func(q VkQueue) error { return fmt.Errorf("Queue: %v does not exist in new state", q) }
 
 	oldStateImgObj := GetState(p.sb.oldState).Images().Get(img)
-	transDstBit := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT)
-	attBits := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_COLOR_ATTACHMENT_BIT | VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT)
-	storageBit := VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT)
+	if err := ipValidateImageInfo(oldStateImgObj.Info()); err != nil {
+		return nil, log.Errf(p.sb.ctx, err, "[Building primeable image data for image: %v]", img)
+	}
+	// The image may be recreated with extra usage to make it primeable, see
+	// primingUsage.
+	usage := oldStateImgObj.Info().Usage()
+	if newStateImgObj := GetState(p.sb.newState).Images().Get(img); !newStateImgObj.IsNil() {
+		usage = newStateImgObj.Info().Usage()
+	}
+	// Images created with EXTENDED_USAGE may have usages that are not valid for
+	// the views in their own format, which are created by the priming
+	// strategies, so such usages must not be used to pick the strategy.
+	if viewable := p.viewableUsage(oldStateImgObj, usage); viewable != usage {
+		log.W(p.sb.ctx, "Image: %v with extended usage: %v, only usage: %v is considered for priming", img, usage, viewable)
+		usage = viewable
+	}
+	usageStrategy := ipPrimingStrategyForUsage(usage, p.layoutOnlyUsages)
+	// Copying the depth data is much faster than rendering it, when the device
+	// supports copies to the depth aspect of the format.
+	if usageStrategy == ipPrimingStrategyRendering && p.depthTransferSupported(oldStateImgObj, usage) {
+		usageStrategy = ipPrimingStrategyBufferCopy
+	}
+	// Only the aspects (or planes) covered by the given ranges will be primed.
+	aspects := p.aspectsOfRanges(oldStateImgObj, opaqueBoundRanges)
+	// When replaying a plan, the strategy of the plan is picked regardless of
+	// the usage and the properties of the device. A forced strategy is picked
+	// the same way, instead of the one of the plan.
+	replay, replaying := p.replayPlans[img]
+	if forced, ok := p.forcedStrategies[img]; ok {
+		replay.Strategy, replaying = forced, true
+	}
+	pick := func(strategy ipPrimingStrategy, picked bool) bool {
+		if replaying {
+			return replay.Strategy == strategy
+		}
+		return picked
+	}
+	generateMipLevels := p.generateMipLevels
+	if replaying {
+		generateMipLevels = replay.GenerateMipLevels
+	}
+	skipped := p.skipped(img, oldStateImgObj.Info())
+	resumed := p.resumedImages[img]
+	transient := p.isTransientAttachment(oldStateImgObj)
+	// The memory of images with SPLIT_INSTANCE_BIND_REGIONS is bound per
+	// physical device of a device group, which is not tracked, so only the
+	// layouts of such images are restored.
+	splitInstance := oldStateImgObj.Info().Flags()&VkImageCreateFlags(VkImageCreateFlagBits_VK_IMAGE_CREATE_SPLIT_INSTANCE_BIND_REGIONS_BIT) != 0
+
+	if !skipped && !resumed && !splitInstance && !transient && generateMipLevels && fromHostData {
+		if baseRng, ok := p.mipGenerationRange(oldStateImgObj, usage, opaqueBoundRanges); ok {
+			primeable, err := p.newPrimeableImageDataByMipGeneration(oldStateImgObj, baseRng)
+			if err == nil {
+				return primeable, nil
+			}
+			log.W(p.sb.ctx, "[Generating mip levels for image: %v] %v, priming all the levels instead", img, err)
+		}
+	}
 
-	isDepth := (oldStateImgObj.Info().Usage() & VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_DEPTH_STENCIL_ATTACHMENT_BIT)) != 0
+	layoutTransitionQueue := func() (QueueObjectʳ, error) {
+		queue := p.queueForPriming(oldStateImgObj, ipPrimingStrategyLayoutTransition)
+		if queue.IsNil() {
+			return queue, log.Errf(p.sb.ctx, nilQueueErr, "[Building primeable image data that only restores layouts, image: %v]", img)
+		}
+		return queue, nil
+	}
+	// budgetExceeded returns the primeable image data that only restores the
+	// layouts, for the images whose staging images exceed the budget.
+	budgetExceeded := func() (primeableImageData, error) {
+		log.W(p.sb.ctx, "Image: %v needs more staging memory than the budget, data will not be primed, only layouts are restored", img)
+		queue, err := layoutTransitionQueue()
+		if err != nil {
+			return nil, err
+		}
+		return &ipPrimeableByLayoutTransition{p: p, img: img, aspects: aspects, queue: queue.VulkanHandle()}, nil
+	}
 
-	primeByCopy := (oldStateImgObj.Info().Usage()&transDstBit) != 0 && (!isDepth)
+	// The planes of multi-planar images are primed by copying their raw data,
+	// the staging images of the rendering and image store strategies can not
+	// hold the planes.
+	_, multiPlanar := ipMultiPlanarFormats[oldStateImgObj.Info().Fmt()]
+	unsupportedPlanes := multiPlanar && (usageStrategy == ipPrimingStrategyRendering || usageStrategy == ipPrimingStrategyImageStore)
+	if skipped || resumed || splitInstance || transient || pick(ipPrimingStrategyLayoutTransition, usageStrategy == ipPrimingStrategyLayoutTransition || unsupportedPlanes) {
+		queue, err := layoutTransitionQueue()
+		if err != nil {
+			return nil, err
+		}
+		if resumed {
+			log.I(p.sb.ctx, "Image: %v was primed before the checkpoint being resumed from, only layouts are restored", img)
+		} else if transient {
+			log.I(p.sb.ctx, "Image: %v is a transient attachment whose content is not persistent, only layouts are restored", img)
+		} else if splitInstance {
+			log.W(p.sb.ctx, "Image: %v is bound to split instance regions of a device group, data will not be primed, only layouts are restored", img)
+		} else if skipped {
+			log.I(p.sb.ctx, "Image: %v is skipped for priming, only layouts are restored", img)
+		} else if unsupportedPlanes {
+			log.W(p.sb.ctx, "Image: %v in multi-planar format: %v with usage: %v can only be primed by copies, data will not be primed, only layouts are restored", img, oldStateImgObj.Info().Fmt(), usage)
+		} else {
+			log.W(p.sb.ctx, "Image: %v with usage: %v, data will not be primed, only layouts are restored", img, usage)
+		}
+		return &ipPrimeableByLayoutTransition{p: p, img: img, aspects: aspects, queue: queue.VulkanHandle()}, nil
+	}
+
+	if p.dedupContent && fromHostData && (!replaying || replay.Strategy == ipPrimingStrategyImageCopy || replay.Strategy == ipPrimingStrategyImageBlit) {
+		if key, ok := p.contentKeyOf(oldStateImgObj, opaqueBoundRanges); ok {
+			if primeable, ok := p.newPrimeableImageDataByImageCopy(oldStateImgObj, key, aspects); ok {
+				return primeable, nil
+			}
+			p.recordContent(img, key)
+		}
+	}
+
+	primeByCopy := pick(ipPrimingStrategyBufferCopy, usageStrategy == ipPrimingStrategyBufferCopy)
 	if primeByCopy {
 		if fromHostData {
-			queue := getQueueForPriming(p.sb, oldStateImgObj,
-				VkQueueFlagBits_VK_QUEUE_TRANSFER_BIT|VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT|VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT)
+			queue := p.queueForPriming(oldStateImgObj, ipPrimingStrategyBufferCopy)
 			if queue.IsNil() {
 				return nil, log.Errf(p.sb.ctx, nilQueueErr, "[Building primeable image data that can be primed by buffer -> image copy, image: %v]", img)
 			}
 			job := newImagePrimerBufferImageCopyJob(oldStateImgObj)
-			for _, aspect := range p.sb.imageAspectFlagBits(oldStateImgObj, oldStateImgObj.ImageAspect()) {
-				job.addDst(p.sb.ctx, aspect, aspect, oldStateImgObj)
-			}
-			bcs := newImagePrimerBufferImageCopySession(p.sb, job)
-			for _, rng := range opaqueBoundRanges {
-				bcs.collectCopiesFromSubresourceRange(rng)
+			for _, aspect := range aspects {
+				if err := job.addDst(p.sb.ctx, aspect, aspect, oldStateImgObj); err != nil {
+					return nil, log.Errf(p.sb.ctx, err, "[Building primeable image data that can be primed by buffer -> image copy, image: %v]", img)
+				}
 			}
+			bcs := p.newBufferImageCopySession(job, ipPrimingStrategyBufferCopy)
+			bcs.collectCopiesFromSubresourceRanges(opaqueBoundRanges)
 			if isSparseResidency(oldStateImgObj) {
 				bcs.collectCopiesFromSparseImageBindings()
 			}
+			p.reportCopyErrors(img, bcs)
 			return &ipPrimeableByBufferCopy{p: p, copySession: bcs, queue: queue.VulkanHandle()}, nil
 
 		} else {
@@ -362,37 +1185,40 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 		}
 	}
 
-	primeByRendering := (!primeByCopy) && ((oldStateImgObj.Info().Usage() & attBits) != 0)
+	primeByRendering := pick(ipPrimingStrategyRendering, usageStrategy == ipPrimingStrategyRendering)
 	if primeByRendering {
 		if fromHostData {
-			queue := getQueueForPriming(p.sb, oldStateImgObj, VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT)
+			queue := p.queueForPriming(oldStateImgObj, ipPrimingStrategyRendering)
 			if queue.IsNil() {
 				return nil, log.Errf(p.sb.ctx, nilQueueErr, "[Building primeable image data that can be primed by rendering host data: %v]", img)
 			}
 			primeable := &ipPrimeableByRendering{p: p, img: img, stagingImages: map[VkImageAspectFlagBits][]ImageObjectʳ{}, queue: queue.VulkanHandle()}
 			copyJob := newImagePrimerBufferImageCopyJob(oldStateImgObj)
-			for _, aspect := range p.sb.imageAspectFlagBits(oldStateImgObj, oldStateImgObj.ImageAspect()) {
+			for _, aspect := range aspects {
 				stagingImgs, freeStagingImgs, err := p.create32BitUintColorStagingImagesForAspect(
-					oldStateImgObj, aspect, VkImageUsageFlags(
-						VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT|
-							VkImageUsageFlagBits_VK_IMAGE_USAGE_INPUT_ATTACHMENT_BIT|
-							VkImageUsageFlagBits_VK_IMAGE_USAGE_SAMPLED_BIT))
+					oldStateImgObj, aspect, ipStagingUsage(ipPrimingStrategyRendering))
 				if err != nil {
 					// Free allocated staging images in case of error
 					primeable.free()
+					if err == ipErrStagingBudgetExceeded {
+						return budgetExceeded()
+					}
 					return nil, log.Errf(p.sb.ctx, err, "[Creating staging images for priming image data by rendering host data, image: %v, aspect: %v]", img, aspect)
 				}
-				copyJob.addDst(p.sb.ctx, aspect, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT, stagingImgs...)
 				primeable.stagingImages[aspect] = stagingImgs
 				primeable.freeCallbacks = append(primeable.freeCallbacks, freeStagingImgs)
+				if err := copyJob.addDst(p.sb.ctx, aspect, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT, stagingImgs...); err != nil {
+					primeable.free()
+					return nil, log.Errf(p.sb.ctx, err, "[Building primeable image data that can be primed by rendering host data, image: %v, aspect: %v]", img, aspect)
+				}
 			}
-			bcs := newImagePrimerBufferImageCopySession(p.sb, copyJob)
-			for _, rng := range opaqueBoundRanges {
-				bcs.collectCopiesFromSubresourceRange(rng)
-			}
+			bcs := p.newBufferImageCopySession(copyJob, ipPrimingStrategyRendering)
+			bcs.collectCopiesFromSubresourceRanges(opaqueBoundRanges)
 			if isSparseResidency(oldStateImgObj) {
 				bcs.collectCopiesFromSparseImageBindings()
 			}
+			p.reportCopyErrors(img, bcs)
+			primeable.copySession = bcs
 			err := bcs.rolloutBufCopies(queue.VulkanHandle(), useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED), useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_SHADER_READ_ONLY_OPTIMAL))
 			if err != nil {
 				// Free allocated staging images in case of error.
@@ -406,38 +1232,29 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 		}
 	}
 
-	primeByImageStore := (!primeByCopy) && (!primeByRendering) && ((oldStateImgObj.Info().Usage() & storageBit) != 0)
+	primeByImageStore := pick(ipPrimingStrategyImageStore, usageStrategy == ipPrimingStrategyImageStore)
 	if primeByImageStore {
-		queue := getQueueForPriming(p.sb, oldStateImgObj, VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT)
+		queue := p.queueForPriming(oldStateImgObj, ipPrimingStrategyImageStore)
 		if queue.IsNil() {
 			return nil, log.Errf(p.sb.ctx, nilQueueErr, "[Building primeable image data that can be primed by host data imageStore operation, image: %v]", img)
 		}
 		if !GetState(p.sb.newState).Queues().Contains(queue.VulkanHandle()) {
 			return nil, log.Errf(p.sb.ctx, queueNotExistInNewState(queue.VulkanHandle()), "[Building primeable image data that can be primed by host data imageStore operation, image: %v]", img)
 		}
-		primeable := &ipPrimeableByImageStore{p: p, img: img, queue: queue.VulkanHandle()}
+		primeable := &ipPrimeableByImageStore{p: p, img: img, aspects: aspects, boundSubresources: p.boundSubresources(oldStateImgObj, opaqueBoundRanges), queue: queue.VulkanHandle()}
 
 		// helper types and functions about image view.
 		type imageViewInfo struct {
-			image  VkImage
+			image VkImage
+			// format is the format of the view, UNDEFINED for the format of
+			// the image.
+			format VkFormat
 			aspect VkImageAspectFlagBits
 			layer  uint32
 			level  uint32
 		}
 		createdImageViews := map[imageViewInfo]ImageViewObjectʳ{}
 
-		getViewType := func(imgType VkImageType) VkImageViewType {
-			switch imgType {
-			case VkImageType_VK_IMAGE_TYPE_1D:
-				return VkImageViewType_VK_IMAGE_VIEW_TYPE_1D
-			case VkImageType_VK_IMAGE_TYPE_2D:
-				return VkImageViewType_VK_IMAGE_VIEW_TYPE_2D
-			case VkImageType_VK_IMAGE_TYPE_3D:
-				return VkImageViewType_VK_IMAGE_VIEW_TYPE_3D
-			}
-			return VkImageViewType_VK_IMAGE_VIEW_TYPE_2D
-		}
-
 		getOrCreateImageView := func(info imageViewInfo) (ImageViewObjectʳ, error) {
 			if _, ok := createdImageViews[info]; ok {
 				return createdImageViews[info], nil
@@ -448,8 +1265,14 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 					fmt.Errorf("Nil Image Object"),
 					"[Creating image view with info: %v]", info)
 			}
-			view, freeView, err := p.createImageViewForImageSubresource(imgObj,
-				info.aspect, info.layer, info.level, getViewType(imgObj.Info().ImageType()))
+			// Both the input and output images are accessed as storage images.
+			format := info.format
+			if format == VkFormat_VK_FORMAT_UNDEFINED {
+				format = imgObj.Info().Fmt()
+			}
+			view, freeView, err := p.createImageViewForImageSubresource(imgObj, format,
+				info.aspect, info.layer, info.level, ipImageViewType(imgObj.Info().ImageType()),
+				VkImageUsageFlags(VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT))
 			if err != nil {
 				return ImageViewObjectʳ{}, log.Errf(p.sb.ctx, err,
 					"[Creating image view with info: %v]", info)
@@ -459,15 +1282,17 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 			return view, nil
 		}
 
-		addStoreJob := func(outputImage, inputImage VkImage, outputAspect, inputAspect VkImageAspectFlagBits,
+		addStoreJob := func(outputImage, inputImage VkImage, outputFormat VkFormat, outputAspect, inputAspect VkImageAspectFlagBits,
 			layer, level uint32, inputIndex int, offset VkOffset3D, extent VkExtent3D) error {
 			storeJob := ipImageStoreJob{
 				inputIndex: inputIndex,
 				offset:     offset,
 				extent:     extent,
+				logCtx:     ipImageLogContext(outputImage, ipPrimingStrategyImageStore).at(outputAspect, layer, level),
 			}
 			outputView, err := getOrCreateImageView(imageViewInfo{
 				image:  outputImage,
+				format: outputFormat,
 				aspect: outputAspect,
 				layer:  layer,
 				level:  level,
@@ -491,32 +1316,39 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 		}
 
 		if fromHostData {
-			// Build image store primeable from host data
+			// Build image store primeable from host data. Compressed images are
+			// stored to through their uncompressed block texel views, with the
+			// raw compressed blocks staged, otherwise the views are in the
+			// image's own format.
+			outputFormat, _ := p.blockTexelViewFormat(oldStateImgObj)
 			copyJob := newImagePrimerBufferImageCopyJob(oldStateImgObj)
-			aspects := map[VkImage]VkImageAspectFlagBits{}
-			for _, aspect := range p.sb.imageAspectFlagBits(oldStateImgObj, oldStateImgObj.ImageAspect()) {
+			stagingAspects := map[VkImage]VkImageAspectFlagBits{}
+			for _, aspect := range aspects {
 				stagingImgs, freeStagingImgs, err := p.create32BitUintColorStagingImagesForAspect(
-					oldStateImgObj, aspect, VkImageUsageFlags(
-						VkImageUsageFlagBits_VK_IMAGE_USAGE_TRANSFER_DST_BIT|
-							VkImageUsageFlagBits_VK_IMAGE_USAGE_STORAGE_BIT))
+					oldStateImgObj, aspect, ipStagingUsage(ipPrimingStrategyImageStore))
 				if err != nil {
 					// Free allocated staging images in case of error
 					primeable.free()
+					if err == ipErrStagingBudgetExceeded {
+						return budgetExceeded()
+					}
 					return nil, log.Errf(p.sb.ctx, err, "[Creating staging images for priming image data by imageStore operation from host data, image: %v, aspect: %v]", img, aspect)
 				}
-				copyJob.addDst(p.sb.ctx, aspect, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT, stagingImgs...)
 				primeable.freeCallbacks = append(primeable.freeCallbacks, freeStagingImgs)
+				if err := copyJob.addDst(p.sb.ctx, aspect, VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT, stagingImgs...); err != nil {
+					primeable.free()
+					return nil, log.Errf(p.sb.ctx, err, "[Building primeable image data that can be primed by imageStore operation from host data, image: %v, aspect: %v]", img, aspect)
+				}
 				for _, s := range stagingImgs {
-					aspects[s.VulkanHandle()] = aspect
+					stagingAspects[s.VulkanHandle()] = aspect
 				}
 			}
-			bcs := newImagePrimerBufferImageCopySession(p.sb, copyJob)
-			for _, rng := range opaqueBoundRanges {
-				bcs.collectCopiesFromSubresourceRange(rng)
-			}
+			bcs := p.newBufferImageCopySession(copyJob, ipPrimingStrategyImageStore)
+			bcs.collectCopiesFromSubresourceRanges(opaqueBoundRanges)
 			if isSparseResidency(oldStateImgObj) {
 				bcs.collectCopiesFromSparseImageBindings()
 			}
+			p.reportCopyErrors(img, bcs)
 			err := bcs.rolloutBufCopies(queue.VulkanHandle(),
 				useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED),
 				useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_GENERAL))
@@ -528,18 +1360,21 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 			}
 
 			for stagingImgObj, copies := range bcs.copies {
-				outputAspect := aspects[stagingImgObj.VulkanHandle()]
+				outputAspect := stagingAspects[stagingImgObj.VulkanHandle()]
 				for _, copy := range copies {
-					layer := copy.ImageSubresource().BaseArrayLayer()
 					level := copy.ImageSubresource().MipLevel()
-					err := addStoreJob(
-						img, stagingImgObj.VulkanHandle(), outputAspect,
-						VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
-						layer, level, bcs.indices[stagingImgObj],
-						copy.ImageOffset(), copy.ImageExtent())
-					if err != nil {
-						log.E(p.sb.ctx, "[Building image store jobs for building primeable image data (by image store): %v]", err)
-						continue
+					// A copy may cover several array layers, see appendCopy.
+					for i := uint32(0); i < copy.ImageSubresource().LayerCount(); i++ {
+						layer := copy.ImageSubresource().BaseArrayLayer() + i
+						err := addStoreJob(
+							img, stagingImgObj.VulkanHandle(), outputFormat, outputAspect,
+							VkImageAspectFlagBits_VK_IMAGE_ASPECT_COLOR_BIT,
+							layer, level, bcs.indices[stagingImgObj],
+							copy.ImageOffset(), copy.ImageExtent())
+						if err != nil {
+							log.E(p.sb.ctx, "[Building image store jobs for building primeable image data (by image store): %v]", err)
+							continue
+						}
 					}
 				}
 			}
@@ -556,7 +1391,7 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 				walkImageSubresourceRange(p.sb, oldStateImgObj, r,
 					func(aspect VkImageAspectFlagBits, layer, level uint32, levelSize byteSizeAndExtent) {
 						err := addStoreJob(
-							img, stagingImg.VulkanHandle(), aspect, aspect,
+							img, stagingImg.VulkanHandle(), VkFormat_VK_FORMAT_UNDEFINED, aspect, aspect,
 							layer, level, 0, MakeVkOffset3D(p.sb.ta),
 							NewVkExtent3D(p.sb.ta,
 								uint32(levelSize.width),
@@ -574,7 +1409,7 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 				walkSparseImageMemoryBindings(p.sb, oldStateImgObj,
 					func(aspect VkImageAspectFlagBits, layer, level uint32, blockData SparseBoundImageBlockInfoʳ) {
 						err := addStoreJob(
-							img, stagingImg.VulkanHandle(), aspect, aspect,
+							img, stagingImg.VulkanHandle(), VkFormat_VK_FORMAT_UNDEFINED, aspect, aspect,
 							layer, level, 0, blockData.Offset(), blockData.Extent(),
 						)
 						if err != nil {
@@ -620,6 +1455,7 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 					return nil, log.Errf(p.sb.ctx, err, "[Building imageStore primeable image data from device data, filling data to staging image: %v, from image: %v, aspect: %v, layer: %v, level: %v, offset: %v, extent: %v]", bjob.output.Image().VulkanHandle(), bjob.input.Image().VulkanHandle(), aspect, layer, level, bjob.offset, bjob.extent)
 				}
 			}
+			p.sb.flushQueueFamilyScratchResources(queue.VulkanHandle())
 
 			p.sb.changeImageSubRangeLayoutAndOwnership(img, imgPostLoadStoreTransitionInfo)
 
@@ -627,10 +1463,10 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 		}
 	}
 
-	primeByPreinitialization := (!primeByCopy) && (!primeByRendering) && (!primeByImageStore) && (oldStateImgObj.Info().Tiling() == VkImageTiling_VK_IMAGE_TILING_LINEAR) && (oldStateImgObj.Info().InitialLayout() == VkImageLayout_VK_IMAGE_LAYOUT_PREINITIALIZED)
+	primeByPreinitialization := pick(ipPrimingStrategyPreinitialization, (!primeByCopy) && (!primeByRendering) && (!primeByImageStore) && (oldStateImgObj.Info().Tiling() == VkImageTiling_VK_IMAGE_TILING_LINEAR) && (oldStateImgObj.Info().InitialLayout() == VkImageLayout_VK_IMAGE_LAYOUT_PREINITIALIZED))
 	if primeByPreinitialization {
 		if fromHostData {
-			queue := getQueueForPriming(p.sb, oldStateImgObj, VkQueueFlagBits_VK_QUEUE_TRANSFER_BIT|VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT|VkQueueFlagBits_VK_QUEUE_COMPUTE_BIT)
+			queue := p.queueForPriming(oldStateImgObj, ipPrimingStrategyPreinitialization)
 			if queue.IsNil() {
 				return nil, log.Errf(p.sb.ctx, nilQueueErr, "[Building primeable image data that can be primed by preinitialization with host data, image: %v]", img)
 			}
@@ -641,3 +1477,42 @@ func (p *imagePrimer) newPrimeableImageData(img VkImage, opaqueBoundRanges []VkI
 	}
 	return nil, log.Errf(p.sb.ctx, nil, "No way build primeable image data for image: %v", img)
 }
+
+// newPrimeableImageDataByMipGeneration builds primeable image data that primes
+// only the given base level range of the given image, and generates the other
+// mip levels with blits. Blits require a graphics queue, so an error is
+// returned if the base level is not going to be primed on one.
+func (p *imagePrimer) newPrimeableImageDataByMipGeneration(img ImageObjectʳ, baseRng VkImageSubresourceRange) (primeableImageData, error) {
+	base, err := p.newPrimeableImageData(img.VulkanHandle(), []VkImageSubresourceRange{baseRng}, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := base.(*ipPrimeableByBufferCopy); !ok {
+		base.free()
+		return nil, log.Errf(p.sb.ctx, nil, "base mip level cannot be primed by buffer -> image copy")
+	}
+	q := p.sb.s.Queues().Get(base.primingQueue())
+	familyProps := p.sb.s.PhysicalDevices().Get(p.sb.s.Devices().Get(q.Device()).PhysicalDevice()).QueueFamilyProperties().Get(q.Family())
+	if familyProps.QueueFlags()&VkQueueFlags(VkQueueFlagBits_VK_QUEUE_GRAPHICS_BIT) == 0 {
+		base.free()
+		return nil, log.Errf(p.sb.ctx, nil, "queue: %v for priming the base mip level does not support blits", q.VulkanHandle())
+	}
+	filter := VkFilter_VK_FILTER_NEAREST
+	if supported, _ := p.formatFeatures(img); supported&VkFormatFeatureFlags(VkFormatFeatureFlagBits_VK_FORMAT_FEATURE_SAMPLED_IMAGE_FILTER_LINEAR_BIT) != 0 {
+		filter = VkFilter_VK_FILTER_LINEAR
+	}
+	return &ipPrimeableByMipGeneration{p: p, img: img.VulkanHandle(), base: base, filter: filter}, nil
+}
+
+// reportCopyErrors logs each error of the subresources of the given image
+// which failed to produce buffer -> image copies in the given session, and
+// returns the number of such subresources. The copies of the other
+// subresources are still rolled out, so the image is partially primed, and
+// rolling out the copies returns an error which only has the first error.
+func (p *imagePrimer) reportCopyErrors(img VkImage, bcs *ipBufferImageCopySession) int {
+	errs := bcs.errors()
+	for _, err := range errs {
+		log.E(p.sb.ctx, "[Collecting buf->img copies for image: %v] %v", img, err)
+	}
+	return len(errs)
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/gapid/core/data/binary"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/api"
+	"github.com/google/gapid/gapis/api/transform"
+	"github.com/google/gapid/gapis/replay"
+	"github.com/google/gapid/gapis/replay/builder"
+	"github.com/google/gapid/gapis/replay/value"
+)
+
+// queryAllocationFailures is a command transform that reads back the results
+// of the vkAllocateMemory commands of the initial commands, i.e. the memory
+// allocations of the rebuilt state, the staging memory of the image primer
+// included, and reports the number of the ones which failed on the replay
+// device. The number is the feedback for the image primer of the subsequent
+// rebuilds, see ImagePrimerOptions.AllocationFailures.
+type queryAllocationFailures struct {
+	numInitialCmds int
+	mutex          sync.Mutex
+	allocations    int
+	failures       int
+	res            []replay.Result
+}
+
+func newQueryAllocationFailures(numInitialCmds int) *queryAllocationFailures {
+	return &queryAllocationFailures{numInitialCmds: numInitialCmds}
+}
+
+func (t *queryAllocationFailures) reportTo(r replay.Result) { t.res = append(t.res, r) }
+
+// record counts a memory allocation of the rebuilt state which returned the
+// given result on the replay device.
+func (t *queryAllocationFailures) record(result VkResult) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.allocations++
+	if result != VkResult_VK_SUCCESS {
+		t.failures++
+	}
+}
+
+func (t *queryAllocationFailures) Transform(ctx context.Context, id api.CmdID, cmd api.Cmd, out transform.Writer) {
+	alloc, ok := cmd.(*VkAllocateMemory)
+	if !ok || uint64(id) >= uint64(t.numInitialCmds) {
+		out.MutateAndWrite(ctx, id, cmd)
+		return
+	}
+	cb := CommandBuilder{Thread: cmd.Thread(), Arena: out.State().Arena}
+	out.MutateAndWrite(ctx, id, cb.Custom(func(ctx context.Context, s *api.GlobalState, b *builder.Builder) error {
+		if err := alloc.Mutate(ctx, id, s, b, nil); err != nil {
+			return err
+		}
+		// The result of vkAllocateMemory is on the top of the stack.
+		ptr := b.AllocateTemporaryMemory(4)
+		b.Store(ptr)
+		b.Post(ptr, 4, func(r binary.Reader, err error) {
+			if err != nil {
+				log.W(ctx, "[Reading back the result of vkAllocateMemory: %v] %v", id, err)
+				return
+			}
+			t.record(VkResult(r.Int32()))
+		})
+		return nil
+	}))
+}
+
+func (t *queryAllocationFailures) Flush(ctx context.Context, out transform.Writer) {
+	cb := CommandBuilder{Thread: 0, Arena: out.State().Arena}
+	out.MutateAndWrite(ctx, api.CmdNoID, cb.Custom(func(ctx context.Context, s *api.GlobalState, b *builder.Builder) error {
+		code := uint32(0xa110ca7e)
+		b.Push(value.U32(code))
+		b.Post(b.Buffer(1), 4, func(r binary.Reader, err error) {
+			for _, res := range t.res {
+				res.Do(func() (interface{}, error) {
+					if err != nil {
+						return nil, log.Err(ctx, err, "Flush did not get expected EOS code: '%v'")
+					}
+					if r.Uint32() != code {
+						return nil, log.Err(ctx, nil, "Flush did not get expected EOS code")
+					}
+					t.mutex.Lock()
+					defer t.mutex.Unlock()
+					if t.failures > 0 {
+						log.W(ctx, "%v of %v memory allocations of the rebuilt state failed at replay", t.failures, t.allocations)
+					}
+					return t.failures, nil
+				})
+			}
+		})
+		return nil
+	}))
+}
@@ -707,6 +707,35 @@ type timestampsConfig struct {
 type timestampsRequest struct {
 }
 
+type allocationFailuresConfig struct {
+}
+
+// allocationFailuresRequest requests the number of the memory allocations of
+// the rebuilt state which fail at replay, see queryAllocationFailures.
+type allocationFailuresRequest struct {
+}
+
+type primingStrategiesConfig struct {
+}
+
+// primingStrategiesRequest requests the priming strategies of an image to be
+// checked after a command, see readFramebuffer.PrimingStrategies.
+type primingStrategiesRequest struct {
+	after uint64
+	img   VkImage
+}
+
+type primedImageValidationConfig struct {
+}
+
+// primedImageValidationRequest requests the primed data of the images to be
+// validated with the given image primer options after a command, see
+// readFramebuffer.ValidatePrimedImages.
+type primedImageValidationRequest struct {
+	after uint64
+	opts  ImagePrimerOptions
+}
+
 func (a API) GetInitialPayload(ctx context.Context,
 	capture *path.Capture,
 	device *device.Instance,
@@ -758,6 +787,8 @@ func (a API) Replay(
 
 	var timestamps *queryTimestamps
 
+	var allocationFailures *queryAllocationFailures
+
 	earlyTerminator, err := NewVulkanTerminator(ctx, intent.Capture)
 	if err != nil {
 		return err
@@ -846,6 +877,43 @@ func (a API) Replay(
 			}
 			timestamps.reportTo(rr.Result)
 			optimize = false
+		case allocationFailuresRequest:
+			if allocationFailures == nil {
+				n, err := expandCommands(false)
+				if err != nil {
+					return err
+				}
+				// Only the initial commands are of interest, stop at the
+				// first command of the capture.
+				if err := earlyTerminator.Add(ctx, n, api.CmdID(n), api.SubCmdIdx{}); err != nil {
+					return err
+				}
+				allocationFailures = newQueryAllocationFailures(n)
+			}
+			allocationFailures.reportTo(rr.Result)
+			optimize = false
+		case primingStrategiesRequest:
+			extraCommands, err := expandCommands(false)
+			if err != nil {
+				return err
+			}
+			after := api.CmdID(req.after + uint64(extraCommands))
+			if err := earlyTerminator.Add(ctx, extraCommands, after, api.SubCmdIdx{}); err != nil {
+				return err
+			}
+			readFramebuffer.PrimingStrategies(after, req.img, rr.Result)
+			optimize = false
+		case primedImageValidationRequest:
+			extraCommands, err := expandCommands(false)
+			if err != nil {
+				return err
+			}
+			after := api.CmdID(req.after + uint64(extraCommands))
+			if err := earlyTerminator.Add(ctx, extraCommands, after, api.SubCmdIdx{}); err != nil {
+				return err
+			}
+			readFramebuffer.ValidatePrimedImages(after, req.opts, rr.Result)
+			optimize = false
 		case framebufferRequest:
 
 			cfg := cfg.(drawConfig)
@@ -929,6 +997,10 @@ func (a API) Replay(
 		transforms.Add(newDisplayToSurface())
 	}
 
+	if allocationFailures != nil {
+		transforms.Add(allocationFailures)
+	}
+
 	if issues != nil {
 		transforms.Add(issues) // Issue reporting required.
 	} else {
@@ -1077,3 +1149,74 @@ func (a API) QueryTimestamps(
 	}
 	return res.([]replay.Timestamp), nil
 }
+
+// QueryRebuildAllocationFailures replays the initial commands of the capture,
+// which rebuild its state, and returns the number of their memory allocations
+// which failed on the replay device. The number is meant to be given as the
+// AllocationFailures of the image primer options of the subsequent replays.
+func (a API) QueryRebuildAllocationFailures(
+	ctx context.Context,
+	intent replay.Intent,
+	mgr replay.Manager,
+	hints *service.UsageHints) (int, error) {
+
+	c, r := allocationFailuresConfig{}, allocationFailuresRequest{}
+	res, err := mgr.Replay(ctx, intent, c, r, a, hints)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := mgr.(replay.Exporter); ok {
+		return 0, nil
+	}
+	return res.(int), nil
+}
+
+// QueryPrimingStrategies primes the given image with each of the priming
+// strategies applicable to it after the given command, and returns the names
+// of the checked strategies, or an error if any of them primes data different
+// from the others or from the captured data.
+func (a API) QueryPrimingStrategies(
+	ctx context.Context,
+	intent replay.Intent,
+	mgr replay.Manager,
+	after uint64,
+	img VkImage,
+	hints *service.UsageHints) ([]string, error) {
+
+	c, r := primingStrategiesConfig{}, primingStrategiesRequest{after: after, img: img}
+	res, err := mgr.Replay(ctx, intent, c, r, a, hints)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := mgr.(replay.Exporter); ok {
+		return nil, nil
+	}
+	return res.([]string), nil
+}
+
+// QueryPrimedImageValidation primes the images of the ValidateImages of the
+// image primer options of the given context after the given command, and
+// compares their primed subresources with the reference images. Returns the
+// number of the validated subresources, or an error listing the pixels which
+// differ from the references by more than the tolerances.
+func (a API) QueryPrimedImageValidation(
+	ctx context.Context,
+	intent replay.Intent,
+	mgr replay.Manager,
+	after uint64,
+	hints *service.UsageHints) (int, error) {
+
+	opts := GetImagePrimerOptions(ctx)
+	if len(opts.ValidateImages) == 0 {
+		return 0, log.Errf(ctx, nil, "No primed image to validate in the image primer options")
+	}
+	c, r := primedImageValidationConfig{}, primedImageValidationRequest{after: after, opts: opts}
+	res, err := mgr.Replay(ctx, intent, c, r, a, hints)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := mgr.(replay.Exporter); ok {
+		return 0, nil
+	}
+	return res.(int), nil
+}
@@ -218,9 +218,9 @@ func getImageFormatFromVulkanFormat(vkfmt VkFormat) (*image.Format, error) {
 	case VkFormat_VK_FORMAT_A2R10G10B10_SNORM_PACK32:
 		return image.NewUncompressed("VK_FORMAT_A2R10G10B10_SNORM_PACK32", fmts.BGRA_S10S10S10S2_NORM), nil
 	case VkFormat_VK_FORMAT_A2R10G10B10_USCALED_PACK32:
-		return image.NewUncompressed("VK_FORMAT_A2R10G10B10_USCALED_PACK32", fmts.RGBA_U10U10U10U2), nil
+		return image.NewUncompressed("VK_FORMAT_A2R10G10B10_USCALED_PACK32", fmts.BGRA_U10U10U10U2), nil
 	case VkFormat_VK_FORMAT_A2R10G10B10_SSCALED_PACK32:
-		return image.NewUncompressed("VK_FORMAT_A2R10G10B10_SSCALED_PACK32", fmts.RGBA_S10S10S10S2), nil
+		return image.NewUncompressed("VK_FORMAT_A2R10G10B10_SSCALED_PACK32", fmts.BGRA_S10S10S10S2), nil
 	case VkFormat_VK_FORMAT_A2R10G10B10_UINT_PACK32:
 		return image.NewUncompressed("VK_FORMAT_A2R10G10B10_UINT_PACK32", fmts.BGRA_U10U10U10U2), nil
 	case VkFormat_VK_FORMAT_A2R10G10B10_SINT_PACK32:
@@ -386,59 +386,87 @@ func getImageFormatFromVulkanFormat(vkfmt VkFormat) (*image.Format, error) {
 	case VkFormat_VK_FORMAT_ASTC_4x4_UNORM_BLOCK:
 		return astc.NewRGBA_4x4("VK_FORMAT_ASTC_4x4_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_4x4_SRGB_BLOCK:
-		return astc.NewRGBA_4x4("VK_FORMAT_ASTC_4x4_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_4x4("VK_FORMAT_ASTC_4x4_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_4x4_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_4x4("VK_FORMAT_ASTC_4x4_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_5x4_UNORM_BLOCK:
 		return astc.NewRGBA_5x4("VK_FORMAT_ASTC_5x4_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_5x4_SRGB_BLOCK:
-		return astc.NewRGBA_5x4("VK_FORMAT_ASTC_5x4_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_5x4("VK_FORMAT_ASTC_5x4_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_5x4_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_5x4("VK_FORMAT_ASTC_5x4_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_5x5_UNORM_BLOCK:
 		return astc.NewRGBA_5x5("VK_FORMAT_ASTC_5x5_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_5x5_SRGB_BLOCK:
-		return astc.NewRGBA_5x5("VK_FORMAT_ASTC_5x5_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_5x5("VK_FORMAT_ASTC_5x5_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_5x5_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_5x5("VK_FORMAT_ASTC_5x5_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_6x5_UNORM_BLOCK:
 		return astc.NewRGBA_6x5("VK_FORMAT_ASTC_6x5_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_6x5_SRGB_BLOCK:
-		return astc.NewRGBA_6x5("VK_FORMAT_ASTC_6x5_UNORM_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_6x5("VK_FORMAT_ASTC_6x5_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_6x5_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_6x5("VK_FORMAT_ASTC_6x5_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_6x6_UNORM_BLOCK:
 		return astc.NewRGBA_6x6("VK_FORMAT_ASTC_6x6_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_6x6_SRGB_BLOCK:
-		return astc.NewRGBA_6x6("VK_FORMAT_ASTC_6x6_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_6x6("VK_FORMAT_ASTC_6x6_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_6x6_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_6x6("VK_FORMAT_ASTC_6x6_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_8x5_UNORM_BLOCK:
 		return astc.NewRGBA_8x5("VK_FORMAT_ASTC_8x5_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_8x5_SRGB_BLOCK:
-		return astc.NewRGBA_8x5("VK_FORMAT_ASTC_8x5_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_8x5("VK_FORMAT_ASTC_8x5_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_8x5_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_8x5("VK_FORMAT_ASTC_8x5_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_8x6_UNORM_BLOCK:
 		return astc.NewRGBA_8x6("VK_FORMAT_ASTC_8x6_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_8x6_SRGB_BLOCK:
-		return astc.NewRGBA_8x6("VK_FORMAT_ASTC_8x6_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_8x6("VK_FORMAT_ASTC_8x6_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_8x6_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_8x6("VK_FORMAT_ASTC_8x6_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_8x8_UNORM_BLOCK:
 		return astc.NewRGBA_8x8("VK_FORMAT_ASTC_8x8_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_8x8_SRGB_BLOCK:
-		return astc.NewRGBA_8x8("VK_FORMAT_ASTC_8x8_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_8x8("VK_FORMAT_ASTC_8x8_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_8x8_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_8x8("VK_FORMAT_ASTC_8x8_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x5_UNORM_BLOCK:
 		return astc.NewRGBA_10x5("VK_FORMAT_ASTC_10x5_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x5_SRGB_BLOCK:
-		return astc.NewRGBA_10x5("VK_FORMAT_ASTC_10x5_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_10x5("VK_FORMAT_ASTC_10x5_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_10x5_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_10x5("VK_FORMAT_ASTC_10x5_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x6_UNORM_BLOCK:
 		return astc.NewRGBA_10x6("VK_FORMAT_ASTC_10x6_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x6_SRGB_BLOCK:
-		return astc.NewRGBA_10x6("VK_FORMAT_ASTC_10x6_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_10x6("VK_FORMAT_ASTC_10x6_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_10x6_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_10x6("VK_FORMAT_ASTC_10x6_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x8_UNORM_BLOCK:
 		return astc.NewRGBA_10x8("VK_FORMAT_ASTC_10x8_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x8_SRGB_BLOCK:
-		return astc.NewRGBA_10x8("VK_FORMAT_ASTC_10x8_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_10x8("VK_FORMAT_ASTC_10x8_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_10x8_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_10x8("VK_FORMAT_ASTC_10x8_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x10_UNORM_BLOCK:
 		return astc.NewRGBA_10x10("VK_FORMAT_ASTC_10x10_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_10x10_SRGB_BLOCK:
-		return astc.NewRGBA_10x10("VK_FORMAT_ASTC_10x10_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_10x10("VK_FORMAT_ASTC_10x10_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_10x10_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_10x10("VK_FORMAT_ASTC_10x10_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_12x10_UNORM_BLOCK:
 		return astc.NewRGBA_12x10("VK_FORMAT_ASTC_12x10_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_12x10_SRGB_BLOCK:
-		return astc.NewRGBA_12x10("VK_FORMAT_ASTC_12x10_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_12x10("VK_FORMAT_ASTC_12x10_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_12x10_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_12x10("VK_FORMAT_ASTC_12x10_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_ASTC_12x12_UNORM_BLOCK:
 		return astc.NewRGBA_12x12("VK_FORMAT_ASTC_12x12_UNORM_BLOCK"), nil
 	case VkFormat_VK_FORMAT_ASTC_12x12_SRGB_BLOCK:
-		return astc.NewRGBA_12x12("VK_FORMAT_ASTC_12x12_SRGB_BLOCK"), nil
+		return astc.NewSRGB8_ALPHA8_12x12("VK_FORMAT_ASTC_12x12_SRGB_BLOCK"), nil
+	case VkFormat_VK_FORMAT_ASTC_12x12_SFLOAT_BLOCK_EXT:
+		return astc.NewRGBA_HDR_12x12("VK_FORMAT_ASTC_12x12_SFLOAT_BLOCK_EXT"), nil
 	case VkFormat_VK_FORMAT_D32_SFLOAT_S8_UINT:
 		return image.NewUncompressed("VK_FORMAT_D32_SFLOAT_S8_UINT", fmts.DS_F32U8), nil
 	case VkFormat_VK_FORMAT_D32_SFLOAT:
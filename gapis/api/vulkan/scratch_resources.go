@@ -22,6 +22,11 @@ import (
 
 const (
 	scratchBufferSize = uint64(64 * 1024 * 1024)
+	// maxPendingScratchTasks is the maximum number of committed but not yet
+	// executed scratch tasks of a queue family scratch resource. Once reached,
+	// the queue family scratch resource will be flushed, so the scratch
+	// resources held by the pending tasks can be reclaimed.
+	maxPendingScratchTasks = 256
 )
 
 // queueFamilyScratchResources holds the scratch resources for a queue family.
@@ -38,6 +43,17 @@ type queueFamilyScratchResources struct {
 	memorySize     uint64
 	allocated      uint64
 	postExecuted   map[VkQueue][]func()
+	pendingTasks   int
+	// timelineSignals are the timeline semaphore values to be signaled by
+	// the next submission of the command buffer of each queue, see
+	// scratchTask.signalTimelineSemaphore.
+	timelineSignals map[VkQueue][]scratchTimelineSignal
+}
+
+// scratchTimelineSignal is a value a timeline semaphore is signaled with.
+type scratchTimelineSignal struct {
+	semaphore VkSemaphore
+	value     uint64
 }
 
 // getQueueFamilyScratchResources returns the scratch resources for the family
@@ -51,15 +67,17 @@ func (sb *stateBuilder) getQueueFamilyScratchResources(queue VkQueue) *queueFami
 	}
 	if _, ok := sb.scratchResources[dev][family]; !ok {
 		sb.scratchResources[dev][family] = &queueFamilyScratchResources{
-			sb:             sb,
-			device:         dev,
-			queueFamily:    family,
-			commandPool:    VkCommandPool(0),
-			commandBuffers: map[VkQueue]VkCommandBuffer{},
-			memory:         VkDeviceMemory(0),
-			memorySize:     bufferAllocationSize(scratchBufferSize),
-			allocated:      uint64(0),
-			postExecuted:   map[VkQueue][]func(){},
+			sb:              sb,
+			device:          dev,
+			queueFamily:     family,
+			commandPool:     VkCommandPool(0),
+			commandBuffers:  map[VkQueue]VkCommandBuffer{},
+			memory:          VkDeviceMemory(0),
+			memorySize:      bufferAllocationSize(scratchBufferSize),
+			allocated:       uint64(0),
+			postExecuted:    map[VkQueue][]func(){},
+			pendingTasks:    0,
+			timelineSignals: map[VkQueue][]scratchTimelineSignal{},
 		}
 	}
 	return sb.scratchResources[dev][family]
@@ -292,20 +310,11 @@ func (qr *queueFamilyScratchResources) flush() {
 		sb.write(sb.cb.VkQueueSubmit(
 			q,
 			1,
-			sb.MustAllocReadData(NewVkSubmitInfo(sb.ta,
-				VkStructureType_VK_STRUCTURE_TYPE_SUBMIT_INFO, // sType
-				0, // pNext
-				0, // waitSemaphoreCount
-				0, // pWaitSemaphores
-				0, // pWaitDstStageMask
-				1, // commandBufferCount
-				NewVkCommandBufferᶜᵖ(sb.MustAllocReadData(cb).Ptr()), // pCommandBuffers
-				0, // signalSemaphoreCount
-				0, // pSignalSemaphores
-			)).Ptr(),
+			sb.MustAllocReadData(qr.submitInfo(q, cb)).Ptr(),
 			VkFence(0),
 			VkResult_VK_SUCCESS,
 		))
+		delete(qr.timelineSignals, q)
 	}
 	for q, cb := range qr.commandBuffers {
 		sb.write(sb.cb.VkQueueWaitIdle(q, VkResult_VK_SUCCESS))
@@ -315,6 +324,7 @@ func (qr *queueFamilyScratchResources) flush() {
 		))
 	}
 	qr.allocated = 0
+	qr.pendingTasks = 0
 	for q, fs := range qr.postExecuted {
 		for _, f := range fs {
 			f()
@@ -323,6 +333,51 @@ func (qr *queueFamilyScratchResources) flush() {
 	}
 }
 
+// submitInfo returns the info to submit the given command buffer of the given
+// queue, which signals the timeline semaphore values registered for the queue
+// with a VkTimelineSemaphoreSubmitInfoKHR.
+func (qr *queueFamilyScratchResources) submitInfo(queue VkQueue, cb VkCommandBuffer) VkSubmitInfo {
+	sb := qr.sb
+	signals := qr.timelineSignals[queue]
+	if len(signals) == 0 {
+		return NewVkSubmitInfo(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_SUBMIT_INFO, // sType
+			0, // pNext
+			0, // waitSemaphoreCount
+			0, // pWaitSemaphores
+			0, // pWaitDstStageMask
+			1, // commandBufferCount
+			NewVkCommandBufferᶜᵖ(sb.MustAllocReadData(cb).Ptr()), // pCommandBuffers
+			0, // signalSemaphoreCount
+			0, // pSignalSemaphores
+		)
+	}
+	semaphores := make([]VkSemaphore, len(signals))
+	values := make([]uint64, len(signals))
+	for i, s := range signals {
+		semaphores[i], values[i] = s.semaphore, s.value
+	}
+	timelineInfo := NewVkTimelineSemaphoreSubmitInfoKHR(sb.ta,
+		VkStructureType_VK_STRUCTURE_TYPE_TIMELINE_SEMAPHORE_SUBMIT_INFO_KHR, // sType
+		0,                   // pNext
+		0,                   // waitSemaphoreValueCount
+		0,                   // pWaitSemaphoreValues
+		uint32(len(values)), // signalSemaphoreValueCount
+		NewU64ᶜᵖ(sb.MustAllocReadData(values).Ptr()), // pSignalSemaphoreValues
+	)
+	return NewVkSubmitInfo(sb.ta,
+		VkStructureType_VK_STRUCTURE_TYPE_SUBMIT_INFO,       // sType
+		NewVoidᶜᵖ(sb.MustAllocReadData(timelineInfo).Ptr()), // pNext
+		0, // waitSemaphoreCount
+		0, // pWaitSemaphores
+		0, // pWaitDstStageMask
+		1, // commandBufferCount
+		NewVkCommandBufferᶜᵖ(sb.MustAllocReadData(cb).Ptr()),     // pCommandBuffers
+		uint32(len(semaphores)),                                  // signalSemaphoreCount
+		NewVkSemaphoreᶜᵖ(sb.MustAllocReadData(semaphores).Ptr()), // pSignalSemaphores
+	)
+}
+
 // free frees the command pool, command buffers and device memory of this
 // queue family scratch resource.
 func (qr *queueFamilyScratchResources) free() {
@@ -352,6 +407,7 @@ type scratchTask struct {
 	onCommit            []func()
 	cmdBufRecorded      []func(VkCommandBuffer)
 	defered             []func()
+	timelineSignals     []scratchTimelineSignal
 }
 
 type scratchBufferInfo struct {
@@ -379,18 +435,22 @@ func (sb *stateBuilder) newScratchTaskOnQueue(queue VkQueue) *scratchTask {
 // commit closes a scratchTask, tries to allocate memory for its buffers,
 // carries out the callbacks before the command buffer comamnds submission, add
 // the command buffer commands to the command, and pass the after-execution
-// callbacks to the after-execution callback queue.
+// callbacks to the after-execution callback queue. The queue family scratch
+// resource will be flushed if the task uses temporary device memory, or the
+// number of pending tasks reaches maxPendingScratchTasks, see taskCommitted.
+// It is also flushed if the task signals timeline semaphores, so the
+// semaphores are signaled once the commands of the task are executed.
 func (t *scratchTask) commit() error {
 	sb := t.sb
 	res := sb.getQueueFamilyScratchResources(t.queue)
-	if mem, isTemp := res.bindAndFillBuffers(t.totalAllocationSize, t.buffers); isTemp {
+	mem, isTemp := res.bindAndFillBuffers(t.totalAllocationSize, t.buffers)
+	if isTemp {
 		// The fixed size scratch buffer is not large enough for the allocation,
 		// temporary device memory is created for this task, need to free the
 		// memory after the task is done.
 		t.deferUntilExecuted(func() {
 			sb.write(sb.cb.VkFreeMemory(res.device, mem, memory.Nullptr))
 		})
-		defer res.flush()
 	}
 	for _, f := range t.onCommit {
 		f()
@@ -403,9 +463,25 @@ func (t *scratchTask) commit() error {
 	for i := len(t.defered) - 1; i >= 0; i-- {
 		res.postExecuted[t.queue] = append(res.postExecuted[t.queue], t.defered[i])
 	}
+	res.timelineSignals[t.queue] = append(res.timelineSignals[t.queue], t.timelineSignals...)
+	if res.taskCommitted(isTemp) || len(t.timelineSignals) > 0 {
+		res.flush()
+	}
 	return nil
 }
 
+// taskCommitted counts a task committed to this queue family scratch resource,
+// and returns true if the scratch resource should be flushed after it. Tasks
+// using temporary device memory are flushed right away, so the temporary
+// memory is freed before the next large task allocates its own. The other
+// tasks are flushed once the number of pending tasks, the temporary ones
+// included, reaches maxPendingScratchTasks, so their buffers and command
+// buffer space do not pile up.
+func (qr *queueFamilyScratchResources) taskCommitted(usingTempMem bool) bool {
+	qr.pendingTasks++
+	return usingTempMem || qr.pendingTasks >= maxPendingScratchTasks
+}
+
 // doOnCommitted register callbacks to be called when this scratchTask is
 // closed i.e. when onCommit() is called. Callbacks will be called in the order
 // in the argument list, and the calling order of doOnCommited.
@@ -432,6 +508,15 @@ func (t *scratchTask) deferUntilExecuted(f ...func()) *scratchTask {
 	return t
 }
 
+// signalTimelineSemaphore registers the given value to be signaled to the
+// given timeline semaphore when the command buffer commands of this
+// scratchTask are submitted, see queueFamilyScratchResources.submitInfo. The
+// value must be greater than the current value of the semaphore.
+func (t *scratchTask) signalTimelineSemaphore(semaphore VkSemaphore, value uint64) *scratchTask {
+	t.timelineSignals = append(t.timelineSignals, scratchTimelineSignal{semaphore: semaphore, value: value})
+	return t
+}
+
 // newBuffer creates a new VkBuffer with the given content and usage bits. The
 // content will NOT be filled to the buffer until this scratchTask is committed,
 // i.e. onCommit() being called. A VkBuffer will always be returned.
@@ -0,0 +1,43 @@
+// Copyright (C) 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vulkan
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestScratchTaskCommittedFlush(t *testing.T) {
+	ctx := log.Testing(t)
+	qr := &queueFamilyScratchResources{}
+	for i := 1; i < maxPendingScratchTasks; i++ {
+		if !assert.For(ctx, "flush after task %v", i).That(qr.taskCommitted(false)).Equals(false) {
+			return
+		}
+	}
+	assert.For(ctx, "flush at the threshold").That(qr.taskCommitted(false)).Equals(true)
+
+	// Temporary memory tasks are flushed right away, and count towards the
+	// threshold of the other tasks.
+	qr = &queueFamilyScratchResources{}
+	assert.For(ctx, "flush after temporary memory task").That(qr.taskCommitted(true)).Equals(true)
+	for i := 2; i < maxPendingScratchTasks; i++ {
+		qr.taskCommitted(false)
+	}
+	assert.For(ctx, "pending tasks").That(qr.pendingTasks).Equals(maxPendingScratchTasks - 1)
+	assert.For(ctx, "flush at the threshold with temporary memory task").That(qr.taskCommitted(false)).Equals(true)
+}
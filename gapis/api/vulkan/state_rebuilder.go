@@ -183,9 +183,17 @@ func (API) RebuildState(ctx context.Context, oldState *api.GlobalState) ([]api.C
 	{
 		imgPrimer := newImagePrimer(sb)
 		defer imgPrimer.free()
+		primerOpts := GetImagePrimerOptions(ctx)
+		if err := imgPrimer.applyOptions(ctx, primerOpts); err != nil {
+			log.E(ctx, "[Applying the image primer options] %v", err)
+		}
+		imgPrimer.warnAliasedImages()
 		for _, img := range s.Images().Keys() {
 			sb.createImage(s.Images().Get(img), imgPrimer)
 		}
+		imgPrimer.flushPrimingWorks()
+		imgPrimer.signalAllPrimed()
+		imgPrimer.logResults(ctx, primerOpts)
 	}
 
 	for _, smp := range s.Samplers().Keys() {
@@ -197,6 +205,11 @@ func (API) RebuildState(ctx context.Context, oldState *api.GlobalState) ([]api.C
 	}
 
 	for _, sem := range s.Semaphores().Keys() {
+		// The semaphore signaled by the image primer is created before the
+		// images are primed, see imagePrimer.signalPrimed.
+		if GetState(sb.newState).Semaphores().Contains(sem) {
+			continue
+		}
 		sb.createSemaphore(s.Semaphores().Get(sem))
 	}
 
@@ -696,6 +709,51 @@ func (sb *stateBuilder) createDevice(d DeviceObjectʳ) {
 			),
 		).Ptr())
 	}
+	if !d.SeparateDepthStencilLayoutsFeatures().IsNil() {
+		pNext = NewVoidᵖ(sb.MustAllocReadData(
+			NewVkPhysicalDeviceSeparateDepthStencilLayoutsFeaturesKHR(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_PHYSICAL_DEVICE_SEPARATE_DEPTH_STENCIL_LAYOUTS_FEATURES_KHR, // sType
+				pNext, // pNext
+				d.SeparateDepthStencilLayoutsFeatures().SeparateDepthStencilLayouts(), // separateDepthStencilLayouts
+			),
+		).Ptr())
+	}
+	if !d.ImagelessFramebufferFeatures().IsNil() {
+		pNext = NewVoidᵖ(sb.MustAllocReadData(
+			NewVkPhysicalDeviceImagelessFramebufferFeaturesKHR(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_PHYSICAL_DEVICE_IMAGELESS_FRAMEBUFFER_FEATURES_KHR, // sType
+				pNext, // pNext
+				d.ImagelessFramebufferFeatures().ImagelessFramebuffer(), // imagelessFramebuffer
+			),
+		).Ptr())
+	}
+	if !d.Synchronization2Features().IsNil() {
+		pNext = NewVoidᵖ(sb.MustAllocReadData(
+			NewVkPhysicalDeviceSynchronization2FeaturesKHR(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_PHYSICAL_DEVICE_SYNCHRONIZATION_2_FEATURES_KHR, // sType
+				pNext, // pNext
+				d.Synchronization2Features().Synchronization2(), // synchronization2
+			),
+		).Ptr())
+	}
+	if !d.ExtendedDynamicStateFeatures().IsNil() {
+		pNext = NewVoidᵖ(sb.MustAllocReadData(
+			NewVkPhysicalDeviceExtendedDynamicStateFeaturesEXT(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_PHYSICAL_DEVICE_EXTENDED_DYNAMIC_STATE_FEATURES_EXT, // sType
+				pNext, // pNext
+				d.ExtendedDynamicStateFeatures().ExtendedDynamicState(), // extendedDynamicState
+			),
+		).Ptr())
+	}
+	if !d.TimelineSemaphoreFeatures().IsNil() {
+		pNext = NewVoidᵖ(sb.MustAllocReadData(
+			NewVkPhysicalDeviceTimelineSemaphoreFeaturesKHR(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_PHYSICAL_DEVICE_TIMELINE_SEMAPHORE_FEATURES_KHR, // sType
+				pNext, // pNext
+				d.TimelineSemaphoreFeatures().TimelineSemaphore(), // timelineSemaphore
+			),
+		).Ptr())
+	}
 
 	sb.write(sb.cb.VkCreateDevice(
 		d.PhysicalDevice(),
@@ -785,18 +843,10 @@ func (sb *stateBuilder) changeImageSubRangeLayoutAndOwnership(image VkImage, sub
 	for oldQ, barriers := range releaseBarriers {
 		tsk := sb.newScratchTaskOnQueue(oldQ)
 		tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-			sb.write(sb.cb.VkCmdPipelineBarrier(
-				commandBuffer,
+			sb.writeImageBarriers(commandBuffer,
 				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
 				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-				VkDependencyFlags(0),
-				0,
-				memory.Nullptr,
-				0,
-				memory.Nullptr,
-				uint32(len(barriers)),
-				sb.MustAllocReadData(barriers).Ptr(),
-			))
+				barriers)
 		})
 		tsk.commit()
 		// Need to block the GPU execution to synchronize the queue family
@@ -807,23 +857,89 @@ func (sb *stateBuilder) changeImageSubRangeLayoutAndOwnership(image VkImage, sub
 	for newQ, barriers := range acquireBarriers {
 		tsk := sb.newScratchTaskOnQueue(newQ)
 		tsk.recordCmdBufCommand(func(commandBuffer VkCommandBuffer) {
-			sb.write(sb.cb.VkCmdPipelineBarrier(
-				commandBuffer,
+			sb.writeImageBarriers(commandBuffer,
 				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
 				VkPipelineStageFlags(VkPipelineStageFlagBits_VK_PIPELINE_STAGE_ALL_COMMANDS_BIT),
-				VkDependencyFlags(0),
-				0,
-				memory.Nullptr,
-				0,
-				memory.Nullptr,
-				uint32(len(barriers)),
-				sb.MustAllocReadData(barriers).Ptr(),
-			))
+				barriers)
 		})
 		tsk.commit()
 	}
 }
 
+// synchronization2 returns true if VK_KHR_synchronization2 is enabled on the
+// given device, along with its synchronization2 feature.
+func (sb *stateBuilder) synchronization2(dev VkDevice) bool {
+	devObj := GetState(sb.newState).Devices().Get(dev)
+	if devObj.IsNil() {
+		return false
+	}
+	features := devObj.Synchronization2Features()
+	if features.IsNil() || features.Synchronization2() == VkBool32(0) {
+		return false
+	}
+	for _, ext := range devObj.EnabledExtensions().All() {
+		if ext == "VK_KHR_synchronization2" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeImageBarriers writes a pipeline barrier with the given image memory
+// barriers to the given command buffer. vkCmdPipelineBarrier2KHR is used if
+// synchronization2 is enabled on the device of the command buffer, with the
+// stage masks given to every barrier, otherwise vkCmdPipelineBarrier is used.
+func (sb *stateBuilder) writeImageBarriers(commandBuffer VkCommandBuffer, srcStageMask, dstStageMask VkPipelineStageFlags, barriers []VkImageMemoryBarrier) {
+	cmdBuf := GetState(sb.newState).CommandBuffers().Get(commandBuffer)
+	if cmdBuf.IsNil() || !sb.synchronization2(cmdBuf.Device()) {
+		sb.write(sb.cb.VkCmdPipelineBarrier(
+			commandBuffer,
+			srcStageMask,
+			dstStageMask,
+			VkDependencyFlags(0),
+			0,
+			memory.Nullptr,
+			0,
+			memory.Nullptr,
+			uint32(len(barriers)),
+			sb.MustAllocReadData(barriers).Ptr(),
+		))
+		return
+	}
+	// The legacy stage and access flags have the same bits in the 64-bit flags.
+	barriers2 := []VkImageMemoryBarrier2KHR{}
+	for _, b := range barriers {
+		barriers2 = append(barriers2, NewVkImageMemoryBarrier2KHR(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_IMAGE_MEMORY_BARRIER_2_KHR, // sType
+			0,                                      // pNext
+			VkPipelineStageFlags2KHR(srcStageMask), // srcStageMask
+			VkAccessFlags2KHR(b.SrcAccessMask()),   // srcAccessMask
+			VkPipelineStageFlags2KHR(dstStageMask), // dstStageMask
+			VkAccessFlags2KHR(b.DstAccessMask()),   // dstAccessMask
+			b.OldLayout(),                          // oldLayout
+			b.NewLayout(),                          // newLayout
+			b.SrcQueueFamilyIndex(),                // srcQueueFamilyIndex
+			b.DstQueueFamilyIndex(),                // dstQueueFamilyIndex
+			b.Image(),                              // image
+			b.SubresourceRange(),                   // subresourceRange
+		))
+	}
+	sb.write(sb.cb.VkCmdPipelineBarrier2KHR(
+		commandBuffer,
+		sb.MustAllocReadData(NewVkDependencyInfoKHR(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_DEPENDENCY_INFO_KHR, // sType
+			0,                      // pNext
+			VkDependencyFlags(0),   // dependencyFlags
+			0,                      // memoryBarrierCount
+			0,                      // pMemoryBarriers
+			0,                      // bufferMemoryBarrierCount
+			0,                      // pBufferMemoryBarriers
+			uint32(len(barriers2)), // imageMemoryBarrierCount
+			NewVkImageMemoryBarrier2KHRᶜᵖ(sb.MustAllocReadData(barriers2).Ptr()), // pImageMemoryBarriers
+		)).Ptr(),
+	))
+}
+
 func (sb *stateBuilder) createSwapchain(swp SwapchainObjectʳ) {
 	extent := NewVkExtent2D(sb.ta,
 		swp.Info().Extent().Width(),
@@ -940,6 +1056,8 @@ func (sb *stateBuilder) createDeviceMemory(mem DeviceMemoryObjectʳ, allowDedica
 			),
 		).Ptr())
 	}
+	pNext = ipMemoryAllocateFlagsPNext(sb, mem, pNext)
+	pNext = ipExportMemoryAllocatePNext(sb, mem, pNext)
 
 	sb.write(sb.cb.VkAllocateMemory(
 		mem.Device(),
@@ -1361,6 +1479,9 @@ type byteSizeAndExtent struct {
 }
 
 func (sb *stateBuilder) levelSize(extent VkExtent3D, format VkFormat, mipLevel uint32, aspect VkImageAspectFlagBits) byteSizeAndExtent {
+	if planeSize, ok := ipPlaneLevelSize(extent, format, mipLevel, aspect); ok {
+		return planeSize
+	}
 	elementAndTexelBlockSize, _ :=
 		subGetElementAndTexelBlockSize(sb.ctx, nil, api.CmdNoID, nil, sb.oldState, nil, 0, nil, nil, format)
 	texelWidth := elementAndTexelBlockSize.TexelBlockSize().Width()
@@ -1509,9 +1630,30 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 	if img.IsSwapchainImage() {
 		return
 	}
+	// An image without any subresources can not be created, skip it rather
+	// than recording a vkCreateImage that fails on replay.
+	if err := ipValidateImageInfo(img.Info()); err != nil {
+		log.E(sb.ctx, "[Recreating image: %v]: %v", img.VulkanHandle(), err)
+		return
+	}
 
-	vkCreateImage(sb, img.Device(), img.Info(), img.VulkanHandle())
+	info := img.Info()
+	if usage := imgPrimer.primingUsage(img); usage != info.Usage() {
+		log.W(sb.ctx, "Image: %v with usage: %v is recreated with usage: %v to prime its data", img.VulkanHandle(), info.Usage(), usage)
+		info = info.Clone(sb.newState.Arena, api.CloneContext{})
+		info.SetUsage(usage)
+	}
 	planeMemInfo, _ := subGetImagePlaneMemoryInfo(sb.ctx, nil, api.CmdNoID, nil, sb.oldState, GetState(sb.oldState), 0, nil, nil, img, VkImageAspectFlagBits(0))
+	if !info.ExternalMemory().IsNil() {
+		var preserved bool
+		info, preserved = ipExternalMemoryImageInfo(sb.newState.Arena, info, planeMemInfo.BoundMemory())
+		if preserved {
+			log.I(sb.ctx, "Image: %v is recreated with external memory handle types: %v, its memory is recreated as exported", img.VulkanHandle(), info.ExternalMemory().HandleTypes())
+		} else {
+			log.W(sb.ctx, "Image: %v was created with external memory handle types: %v, but its memory can not be recreated as external, the image is recreated with normal memory", img.VulkanHandle(), img.Info().ExternalMemory().HandleTypes())
+		}
+	}
+	vkCreateImage(sb, img.Device(), info, img.VulkanHandle())
 	planeMemRequirements := planeMemInfo.MemoryRequirements()
 	vkGetImageMemoryRequirements(sb, img.Device(), img.VulkanHandle(), planeMemRequirements)
 
@@ -1577,34 +1719,21 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 
 		memories := make(map[VkDeviceMemory]bool)
 
-		nonSparseInfos := []VkSparseImageMemoryBind{}
-
-		for aspect, info := range img.SparseImageMemoryBindings().All() {
-			for layer, layerInfo := range info.Layers().All() {
-				for level, levelInfo := range layerInfo.Levels().All() {
-					for _, block := range levelInfo.Blocks().All() {
-						if !img.Info().DedicatedAllocationNV().IsNil() {
-							// If this was a dedicated allocation set it here
-							if _, ok := memories[block.Memory()]; !ok {
-								memories[block.Memory()] = true
-								sb.createDeviceMemory(sb.s.DeviceMemories().Get(block.Memory()), true)
-							}
-							nonSparseInfos = append(nonSparseInfos, NewVkSparseImageMemoryBind(sb.ta,
-								NewVkImageSubresource(sb.ta, // subresource
-									VkImageAspectFlags(aspect), // aspectMask
-									level,                      // mipLevel
-									layer,                      // arrayLayer
-								),
-								block.Offset(),       // offset
-								block.Extent(),       // extent
-								block.Memory(),       // memory
-								block.MemoryOffset(), // memoryOffset
-								block.Flags(),        // flags
-							))
-						}
-					}
+		if !img.Info().DedicatedAllocationNV().IsNil() {
+			// If this was a dedicated allocation set it here
+			walkSparseImageMemoryBindings(sb, img, func(aspect VkImageAspectFlagBits, layer, level uint32, block SparseBoundImageBlockInfoʳ) {
+				if _, ok := memories[block.Memory()]; !ok {
+					memories[block.Memory()] = true
+					sb.createDeviceMemory(sb.s.DeviceMemories().Get(block.Memory()), true)
 				}
-			}
+			})
+		}
+		// The residency blocks must be bound before their data can be primed.
+		imageBinds := ipSparseImageMemoryBinds(sb.ta, img)
+
+		imageBindCount := uint32(0)
+		if len(imageBinds) > 0 {
+			imageBindCount = 1
 		}
 
 		opaqueSparseBindings := make([]VkSparseMemoryBind, 0, img.OpaqueSparseMemoryBindings().Len())
@@ -1632,13 +1761,13 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 								sb.MustAllocReadData(opaqueSparseBindings).Ptr(),
 							),
 						)).Ptr()),
-					0, // imageBindCount
+					imageBindCount, // imageBindCount
 					NewVkSparseImageMemoryBindInfoᶜᵖ(sb.MustAllocReadData( // pImageBinds
 						NewVkSparseImageMemoryBindInfo(sb.ta,
-							img.VulkanHandle(),          // image
-							uint32(len(nonSparseInfos)), // bindCount
+							img.VulkanHandle(),      // image
+							uint32(len(imageBinds)), // bindCount
 							NewVkSparseImageMemoryBindᶜᵖ( // pBinds
-								sb.MustAllocReadData(nonSparseInfos).Ptr(),
+								sb.MustAllocReadData(imageBinds).Ptr(),
 							),
 						)).Ptr()),
 					0, // signalSemaphoreCount
@@ -1648,7 +1777,16 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 			VkResult_VK_SUCCESS,
 		))
 
+		if len(imageBinds) > 0 {
+			// The data of the residency blocks is primed on other queues, wait
+			// for the blocks to be bound.
+			sb.write(sb.cb.VkQueueWaitIdle(sparseQueue.VulkanHandle(), VkResult_VK_SUCCESS))
+		}
+
 		if sparseResidency {
+			for _, sr := range ipResidentSubresources(img) {
+				appendImageLevelToOpaqueRanges(sr.aspect, sr.layer, sr.level, byteSizeAndExtent{})
+			}
 			isMetadataBound := false
 			for _, req := range img.SparseMemoryRequirements().All() {
 				prop := req.FormatProperties()
@@ -1706,10 +1844,21 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 			return
 		}
 		walkImageSubresourceRange(sb, img, sb.imageWholeSubresourceRange(img), appendImageLevelToOpaqueRanges)
-		// TODO: Handle multi-planar images
-		planeMemInfo, _ := subGetImagePlaneMemoryInfo(sb.ctx, nil, api.CmdNoID, nil, sb.oldState, GetState(sb.oldState), 0, nil, nil, img, VkImageAspectFlagBits(0))
-		vkBindImageMemory(sb, img.Device(), img.VulkanHandle(),
-			planeMemInfo.BoundMemory().VulkanHandle(), planeMemInfo.BoundMemoryOffset())
+		if isDisjointImageInfo(img.Info()) {
+			// Disjoint multi-planar image, bind each bound plane separately.
+			for _, plane := range sb.imageAspectFlagBits(img, img.ImageAspect()) {
+				planeMemInfo := img.PlaneMemoryInfo().Get(plane)
+				if planeMemInfo.IsNil() || planeMemInfo.BoundMemory().IsNil() {
+					continue
+				}
+				vkBindImagePlaneMemory(sb, img.Device(), img.VulkanHandle(),
+					planeMemInfo.BoundMemory().VulkanHandle(), planeMemInfo.BoundMemoryOffset(), plane)
+			}
+		} else {
+			planeMemInfo, _ := subGetImagePlaneMemoryInfo(sb.ctx, nil, api.CmdNoID, nil, sb.oldState, GetState(sb.oldState), 0, nil, nil, img, VkImageAspectFlagBits(0))
+			vkBindImageMemory(sb, img.Device(), img.VulkanHandle(),
+				planeMemInfo.BoundMemory().VulkanHandle(), planeMemInfo.BoundMemoryOffset())
+		}
 	}
 	// opaqueRanges should contain all the bound image subresources by now.
 	if len(opaqueRanges) == 0 {
@@ -1740,7 +1889,7 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 					oldQueue = sparseQueue.VulkanHandle()
 				}
 				transitionInfo = append(transitionInfo, imageSubRangeInfo{
-					aspectMask:     ipImageBarrierAspectFlags(aspect, img.Info().Fmt()),
+					aspectMask:     ipImageAspectBarrierFlags(sb, img, aspect),
 					baseMipLevel:   level,
 					levelCount:     1,
 					baseArrayLayer: layer,
@@ -1756,7 +1905,7 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 						newQueueObj = img.LastBoundQueue()
 					}
 					ownerTransferInfo = append(ownerTransferInfo, imageSubRangeInfo{
-						aspectMask:     ipImageBarrierAspectFlags(aspect, img.Info().Fmt()),
+						aspectMask:     ipImageAspectBarrierFlags(sb, img, aspect),
 						baseMipLevel:   level,
 						levelCount:     1,
 						baseArrayLayer: layer,
@@ -1775,47 +1924,17 @@ func (sb *stateBuilder) createImage(img ImageObjectʳ, imgPrimer *imagePrimer) {
 	}
 	// We have to handle the above cases at some point.
 
-	primeable, err := imgPrimer.newPrimeableImageData(img.VulkanHandle(), opaqueRanges, true)
-	if err != nil {
-		log.E(sb.ctx, "Create primeable image data: %v", err)
+	opaqueRanges = imgPrimer.primeImageData(img, opaqueRanges)
+	if len(opaqueRanges) == 0 {
 		return
 	}
-	defer primeable.free()
-	err = primeable.prime(useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED), sameLayoutsOfImage(img))
+	primeable, err := imgPrimer.newPrimeableImageData(img.VulkanHandle(), opaqueRanges, true)
 	if err != nil {
-		log.E(sb.ctx, "Priming image data: %v", err)
+		log.E(sb.ctx, "Create primeable image data: %v", err)
 		return
 	}
-
-	queue := sb.s.Queues().Get(primeable.primingQueue())
-
-	if !queue.IsNil() {
-		// Image data priming is recorded successfully, check if we need to
-		// to transfer the queue family ownership
-		ownerTransferInfo := []imageSubRangeInfo{}
-		walkImageSubresourceRange(sb, img, sb.imageWholeSubresourceRange(img),
-			func(aspect VkImageAspectFlagBits, layer, level uint32, unused byteSizeAndExtent) {
-				// No need to handle for undefined layout
-				imgLevel := img.Aspects().Get(aspect).Layers().Get(layer).Levels().Get(level)
-				if imgLevel.Layout() == VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED || imgLevel.LastBoundQueue().IsNil() {
-					return
-				}
-				if queue.Family() != imgLevel.LastBoundQueue().Family() {
-					ownerTransferInfo = append(ownerTransferInfo, imageSubRangeInfo{
-						aspectMask:     VkImageAspectFlags(aspect),
-						baseMipLevel:   level,
-						levelCount:     1,
-						baseArrayLayer: layer,
-						layerCount:     1,
-						oldLayout:      imgLevel.Layout(),
-						newLayout:      imgLevel.Layout(),
-						oldQueue:       queue.VulkanHandle(),
-						newQueue:       imgLevel.LastBoundQueue().VulkanHandle(),
-					})
-				}
-			})
-		sb.changeImageSubRangeLayoutAndOwnership(img.VulkanHandle(), ownerTransferInfo)
-	}
+	imgPrimer.queuePriming(img, opaqueRanges, primeable,
+		useSpecifiedLayout(VkImageLayout_VK_IMAGE_LAYOUT_UNDEFINED), imgPrimer.dstLayoutsOf(img.VulkanHandle()))
 }
 
 func (sb *stateBuilder) createSampler(smp SamplerObjectʳ) {
@@ -1866,19 +1985,33 @@ func (sb *stateBuilder) createFence(fnc FenceObjectʳ) {
 }
 
 func (sb *stateBuilder) createSemaphore(sem SemaphoreObjectʳ) {
+	// The timeline semaphores are created with their last signaled values,
+	// they are not signaled by submits.
+	timeline := sem.Type() == VkSemaphoreTypeKHR_VK_SEMAPHORE_TYPE_TIMELINE_KHR
+	pNext := NewVoidᶜᵖ(memory.Nullptr)
+	if timeline {
+		pNext = NewVoidᶜᵖ(sb.MustAllocReadData(
+			NewVkSemaphoreTypeCreateInfoKHR(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_SEMAPHORE_TYPE_CREATE_INFO_KHR, // sType
+				0,           // pNext
+				sem.Type(),  // semaphoreType
+				sem.Value(), // initialValue
+			),
+		).Ptr())
+	}
 	sb.write(sb.cb.VkCreateSemaphore(
 		sem.Device(),
 		sb.MustAllocReadData(NewVkSemaphoreCreateInfo(sb.ta,
 			VkStructureType_VK_STRUCTURE_TYPE_SEMAPHORE_CREATE_INFO, // sType
-			0, // pNext
-			0, // flags
+			pNext, // pNext
+			0,     // flags
 		)).Ptr(),
 		memory.Nullptr,
 		sb.MustAllocWriteData(sem.VulkanHandle()).Ptr(),
 		VkResult_VK_SUCCESS,
 	))
 
-	if !sem.Signaled() {
+	if timeline || !sem.Signaled() {
 		return
 	}
 
@@ -2681,14 +2814,47 @@ func (sb *stateBuilder) createFramebuffer(fb FramebufferObjectʳ) {
 		imageViews = append(imageViews, fb.ImageAttachments().Get(v).VulkanHandle())
 	}
 
+	// Imageless framebuffers have the infos of their attachments instead of
+	// the image views.
+	pNext := NewVoidᶜᵖ(memory.Nullptr)
+	attachmentCount := uint32(len(imageViews))
+	if fb.Flags()&VkFramebufferCreateFlags(VkFramebufferCreateFlagBits_VK_FRAMEBUFFER_CREATE_IMAGELESS_BIT_KHR) != 0 {
+		attachmentInfos := []VkFramebufferAttachmentImageInfoKHR{}
+		for _, i := range fb.AttachmentImageInfos().Keys() {
+			info := fb.AttachmentImageInfos().Get(i)
+			viewFormats := []VkFormat{}
+			for _, j := range info.ViewFormats().Keys() {
+				viewFormats = append(viewFormats, info.ViewFormats().Get(j))
+			}
+			attachmentInfos = append(attachmentInfos, NewVkFramebufferAttachmentImageInfoKHR(sb.ta,
+				VkStructureType_VK_STRUCTURE_TYPE_FRAMEBUFFER_ATTACHMENT_IMAGE_INFO_KHR, // sType
+				0,                        // pNext
+				info.Flags(),             // flags
+				info.Usage(),             // usage
+				info.Width(),             // width
+				info.Height(),            // height
+				info.LayerCount(),        // layerCount
+				uint32(len(viewFormats)), // viewFormatCount
+				NewVkFormatᶜᵖ(sb.MustAllocReadData(viewFormats).Ptr()), // pViewFormats
+			))
+		}
+		pNext = NewVoidᶜᵖ(sb.MustAllocReadData(NewVkFramebufferAttachmentsCreateInfoKHR(sb.ta,
+			VkStructureType_VK_STRUCTURE_TYPE_FRAMEBUFFER_ATTACHMENTS_CREATE_INFO_KHR, // sType
+			0,                            // pNext
+			uint32(len(attachmentInfos)), // attachmentImageInfoCount
+			NewVkFramebufferAttachmentImageInfoKHRᶜᵖ(sb.MustAllocReadData(attachmentInfos).Ptr()), // pAttachmentImageInfos
+		)).Ptr())
+		attachmentCount = uint32(len(attachmentInfos))
+	}
+
 	sb.write(sb.cb.VkCreateFramebuffer(
 		fb.Device(),
 		sb.MustAllocReadData(NewVkFramebufferCreateInfo(sb.ta,
 			VkStructureType_VK_STRUCTURE_TYPE_FRAMEBUFFER_CREATE_INFO, // sType
-			0,                              // pNext
-			0,                              // flags
+			pNext,                          // pNext
+			fb.Flags(),                     // flags
 			fb.RenderPass().VulkanHandle(), // renderPass
-			uint32(len(imageViews)),        // attachmentCount
+			attachmentCount,                // attachmentCount
 			NewVkImageViewᶜᵖ(sb.MustAllocReadData(imageViews).Ptr()), // pAttachments
 			fb.Width(),  // width
 			fb.Height(), // height
@@ -455,3 +455,34 @@ void deleteCompileResult(glsl_compile_result_t* result) {
   }
   delete result;
 }
+
+spirv_validation_result_t* validateSpirv(uint32_t* spirv_binary,
+                                         size_t length) {
+  spirv_validation_result_t* result =
+      new spirv_validation_result_t{true, nullptr};
+
+  std::string err_msg;
+  spvtools::SpirvTools tools(SPV_ENV_VULKAN_1_0);
+  tools.SetMessageConsumer([&err_msg](spv_message_level_t, const char*,
+                                      const spv_position_t& position,
+                                      const char* message) {
+    err_msg += "word " + std::to_string(position.index) + ": " + message +
+               "\n";
+  });
+  if (!tools.Validate(spirv_binary, length)) {
+    result->ok = false;
+    if (err_msg.empty()) {
+      err_msg = "invalid SPIR-V";
+    }
+    result->message = new char[err_msg.length() + 1];
+    strcpy(result->message, err_msg.c_str());
+  }
+  return result;
+}
+
+void deleteValidationResult(spirv_validation_result_t* result) {
+  if (result) {
+    delete[] result->message;
+  }
+  delete result;
+}
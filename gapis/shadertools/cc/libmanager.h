@@ -96,6 +96,11 @@ typedef struct glsl_compile_result_t {
   spirv_binary_t binary;
 } glsl_compile_result_t;
 
+typedef struct spirv_validation_result_t {
+  bool ok;
+  char* message;
+} spirv_validation_result_t;
+
 code_with_debug_info_t* convertGlsl(const char*, size_t,
                                     const convert_options_t*);
 
@@ -115,6 +120,10 @@ glsl_compile_result_t* compileGlsl(const char* code, const compile_options_t*);
 
 void deleteCompileResult(glsl_compile_result_t*);
 
+spirv_validation_result_t* validateSpirv(uint32_t*, size_t);
+
+void deleteValidationResult(spirv_validation_result_t*);
+
 #ifdef __cplusplus
 }
 #endif
@@ -255,6 +255,25 @@ func AssembleSpirvText(chars string) []uint32 {
 	return words
 }
 
+// ValidateSpirvBinary validates the given SPIR-V binary words for Vulkan 1.0
+// by calling SPIRV-Tools. Returns an error with the validation messages if the
+// binary is invalid.
+func ValidateSpirvBinary(words []uint32) error {
+	if len(words) == 0 {
+		return fault.Const("Empty SPIR-V binary")
+	}
+	result := C.validateSpirv((*C.uint32_t)(&words[0]), C.size_t(len(words)))
+	defer C.deleteValidationResult(result)
+	if result.ok {
+		return nil
+	}
+	msg := []string{"Invalid SPIR-V binary."}
+	if m := C.GoString(result.message); len(m) > 0 {
+		msg = append(msg, m)
+	}
+	return fault.Const(strings.Join(msg, "\n"))
+}
+
 // OpcodeToString converts opcode number to human readable string.
 func OpcodeToString(opcode uint32) string {
 	return C.GoString(C.opcodeToString(C.uint32_t(opcode)))
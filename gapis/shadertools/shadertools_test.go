@@ -232,6 +232,27 @@ void main() {
 	}
 }
 
+func TestValidateSpirvBinary(t *testing.T) {
+	ctx := log.Testing(t)
+	code, err := shadertools.CompileGlsl(`#version 450
+layout(location=0) out vec4 color;
+void main() {
+	color = vec4(1.0);
+}`, shadertools.CompileOptions{
+		ShaderType: shadertools.TypeFragment,
+		ClientType: shadertools.Vulkan,
+	})
+	if !assert.For(ctx, "compile err").ThatError(err).Succeeded() {
+		return
+	}
+	assert.For(ctx, "valid code").ThatError(shadertools.ValidateSpirvBinary(code)).Succeeded()
+
+	// Drop the last instruction (OpFunctionEnd) to make the code invalid.
+	invalid := code[:len(code)-1]
+	assert.For(ctx, "invalid code").ThatError(shadertools.ValidateSpirvBinary(invalid)).Failed()
+	assert.For(ctx, "empty code").ThatError(shadertools.ValidateSpirvBinary([]uint32{})).Failed()
+}
+
 func TestParseDescriptorSets(t *testing.T) {
 	for _, test := range []struct {
 		desc       string